@@ -0,0 +1,303 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/utrack/go-simple-memdb/protocol"
+	"github.com/utrack/go-simple-memdb/storage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options configures the Client.
+type Options struct {
+	// PoolSize is the maximum number of open connections.
+	// Transactions hold their connections until finished.
+	// Defaults to 8.
+	PoolSize int
+	// DialTimeout bounds the connection's dialing.
+	// Defaults to 5 seconds.
+	DialTimeout time.Duration
+	// User and Password authenticate every connection
+	// if User is set.
+	User     string
+	Password string
+	// TLSConfig enables TLS if set.
+	TLSConfig *tls.Config
+}
+
+// Client talks to the server over a pool of connections.
+// It is safe for concurrent use.
+type Client struct {
+	pool *pool
+}
+
+// Dial connects to the server at addr with default options.
+func Dial(addr string) (*Client, error) {
+	return DialOptions(addr, Options{})
+}
+
+// DialOptions connects to the server at addr.
+func DialOptions(addr string, opts Options) (*Client, error) {
+	if opts.PoolSize < 1 {
+		opts.PoolSize = 8
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	if opts.User != "" {
+		if err := checkArgs(opts.User); err != nil {
+			return nil, err
+		}
+		if opts.Password == "" || strings.ContainsAny(opts.Password, "\r\n") {
+			return nil, ErrInvalidArgument.Here().Append("password")
+		}
+	}
+	ret := &Client{pool: newPool(addr, opts)}
+
+	// Check that the server is reachable
+	cn, _, err := ret.pool.get(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	ret.pool.put(cn)
+	return ret, nil
+}
+
+// Close closes client's connections.
+func (c *Client) Close() error {
+	return c.pool.close()
+}
+
+// Get returns the variable's value by its key.
+// storage.ErrNotFound is returned if the variable was not set,
+// protocol.ErrBinaryValue if the value has line breaks: GetBytes reads it.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	if err := checkArgs(key); err != nil {
+		return "", err
+	}
+	resp, err := c.do(ctx, "GET "+key, false)
+	if err != nil {
+		return "", err
+	}
+	return parseGet(resp)
+}
+
+// Set sets the variable's value by its key.
+func (c *Client) Set(ctx context.Context, key, value string) error {
+	if err := checkArgs(key); err != nil {
+		return err
+	}
+	if err := checkLastArg(value); err != nil {
+		return err
+	}
+	return c.doResult(ctx, "SET "+key+" "+value)
+}
+
+// GetBytes returns the variable's value by its key,
+// which may hold any bytes.
+// storage.ErrNotFound is returned if the variable was not set.
+func (c *Client) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	if err := checkArgs(key); err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, "GETB "+key, true)
+	if err != nil {
+		return nil, err
+	}
+	return parseGetPayload(resp)
+}
+
+// SetBytes sets the variable's value by its key to any bytes.
+func (c *Client) SetBytes(ctx context.Context, key string, value []byte) error {
+	if err := checkArgs(key); err != nil {
+		return err
+	}
+	return c.doResult(ctx, "SETB "+key+" "+payload(value))
+}
+
+// Unset removes the variable by its key.
+func (c *Client) Unset(ctx context.Context, key string) error {
+	if err := checkArgs(key); err != nil {
+		return err
+	}
+	return c.doResult(ctx, "UNSET "+key)
+}
+
+// NumEqualTo returns the number of variables set to the value.
+func (c *Client) NumEqualTo(ctx context.Context, value string) (uint64, error) {
+	if err := checkArgs(value); err != nil {
+		return 0, err
+	}
+	resp, err := c.do(ctx, "NUMEQUALTO "+value, false)
+	if err != nil {
+		return 0, err
+	}
+	return parseCount(resp)
+}
+
+// NumEqualToBytes returns the number of variables set to the value,
+// which may hold any bytes.
+func (c *Client) NumEqualToBytes(ctx context.Context, value []byte) (uint64, error) {
+	resp, err := c.do(ctx, "NUMEQUALTOB "+payload(value), false)
+	if err != nil {
+		return 0, err
+	}
+	return parseCount(resp)
+}
+
+// Begin starts a transaction over a dedicated connection.
+func (c *Client) Begin(ctx context.Context) (*Tx, error) {
+	return c.begin(ctx, "BEGIN")
+}
+
+// BeginReadOnly starts a read-only transaction over a dedicated connection.
+func (c *Client) BeginReadOnly(ctx context.Context) (*Tx, error) {
+	return c.begin(ctx, "BEGIN READONLY")
+}
+
+func (c *Client) begin(ctx context.Context, cmd string) (*Tx, error) {
+	cn, _, err := c.pool.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ret := &Tx{pool: c.pool, cn: cn}
+	if err = ret.doResult(ctx, cmd); err != nil {
+		ret.finish()
+		return nil, err
+	}
+	ret.depth = 1
+	return ret, nil
+}
+
+// do sends the command over a pooled connection.
+// The command is retried once over a new connection if the pooled
+// connection turned out to be broken, e.g. the server was restarted.
+func (c *Client) do(ctx context.Context, cmd string, withPayload bool) (string, error) {
+	for attempt := 0; ; attempt++ {
+		cn, reused, err := c.pool.get(ctx)
+		if err != nil {
+			return "", err
+		}
+		resp, err := cn.do(ctx, cmd, withPayload)
+		c.pool.put(cn)
+		if err != nil && reused && attempt == 0 && ctx.Err() == nil {
+			continue
+		}
+		return resp, err
+	}
+}
+
+// doResult sends the command that returns nothing on success.
+func (c *Client) doResult(ctx context.Context, cmd string) error {
+	resp, err := c.do(ctx, cmd, false)
+	if err != nil {
+		return err
+	}
+	return parseResult(resp)
+}
+
+// checkArgs returns ErrInvalidArgument if the args can't be sent
+// over the protocol.
+func checkArgs(args ...string) error {
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\r\n") {
+			return ErrInvalidArgument.Here().Appendf("%q", arg)
+		}
+	}
+	return nil
+}
+
+// checkLastArg returns ErrInvalidArgument if the command's last argument
+// can't be sent over the protocol. It may contain spaces, as the line
+// is split into up to the command's arguments, but not the line breaks;
+// trailing spaces would be trimmed with the line's ones.
+func checkLastArg(arg string) error {
+	if arg == "" || strings.ContainsAny(arg, "\r\n") || strings.HasSuffix(arg, " ") {
+		return ErrInvalidArgument.Here().Appendf("%q", arg)
+	}
+	return nil
+}
+
+// parseResult converts the response of a command that returns nothing
+// on success to the error.
+func parseResult(resp string) error {
+	if err := parseError(resp); err != nil {
+		return err
+	}
+	switch resp {
+	case "":
+		return nil
+	case "NO TRANSACTION":
+		return storage.ErrNoTransaction.Here()
+	case "NO SAVEPOINT":
+		return storage.ErrNoSavepoint.Here()
+	case "READONLY":
+		return storage.ErrReadOnly.Here()
+	case "OOM":
+		return storage.ErrOutOfMemory.Here()
+	case storage.ErrTxConflict.Error():
+		return storage.ErrTxConflict.Here()
+	}
+	return ErrServer.Here().Append(resp)
+}
+
+// parseError converts the response denying any command to the error,
+// or returns nil.
+func parseError(resp string) error {
+	switch resp {
+	case "NOAUTH":
+		return protocol.ErrNoAuth.Here()
+	case "NOPERM":
+		return protocol.ErrNoPerm.Here()
+	case "WRONGPASS":
+		return protocol.ErrWrongPass.Here()
+	}
+	return nil
+}
+
+// parseGet converts GET's response to the value.
+func parseGet(resp string) (string, error) {
+	if err := parseError(resp); err != nil {
+		return "", err
+	}
+	switch resp {
+	case "NULL":
+		return "", storage.ErrNotFound.Here()
+	case "BINARY VALUE":
+		return "", protocol.ErrBinaryValue.Here()
+	}
+	return resp, nil
+}
+
+// parseGetPayload converts GETB's response to the value.
+func parseGetPayload(resp string) ([]byte, error) {
+	_, value, ok := strings.Cut(resp, "\n")
+	if !ok {
+		_, err := parseGet(resp)
+		if err == nil {
+			err = ErrServer.Here().Append(resp)
+		}
+		return nil, err
+	}
+	return []byte(value), nil
+}
+
+// payload returns the length of the value followed by the value,
+// as the binary-safe commands take them.
+func payload(value []byte) string {
+	return strconv.Itoa(len(value)) + "\n" + string(value)
+}
+
+// parseCount converts NUMEQUALTO's response to the count.
+func parseCount(resp string) (uint64, error) {
+	if err := parseError(resp); err != nil {
+		return 0, err
+	}
+	ret, err := strconv.ParseUint(resp, 10, 64)
+	if err != nil {
+		return 0, ErrServer.Here().Append(resp)
+	}
+	return ret, nil
+}
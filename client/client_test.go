@@ -0,0 +1,358 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/ansel1/merry"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/utrack/go-simple-memdb/protocol"
+	"github.com/utrack/go-simple-memdb/storage"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// serve starts the in-process server on the address.
+func serve(addr string) (*protocol.Server, net.Listener) {
+	l, err := net.Listen("tcp", addr)
+	So(err, ShouldBeNil)
+	srv := protocol.NewServer(storage.New())
+	go func() { _ = srv.Serve(l) }()
+	return srv, l
+}
+
+func TestClient(t *testing.T) {
+	Convey("With server and client", t, func() {
+		srv, l := serve("127.0.0.1:0")
+		addr := l.Addr().String()
+		c, err := DialOptions(addr, Options{PoolSize: 2})
+		So(err, ShouldBeNil)
+		ctx := context.Background()
+
+		Reset(func() {
+			_ = c.Close()
+			_ = srv.Close()
+		})
+
+		Convey("Basic commands", func() {
+			_, err := c.Get(ctx, "a")
+			So(merry.Is(err, storage.ErrNotFound), ShouldBeTrue)
+
+			So(c.Set(ctx, "a", "10"), ShouldBeNil)
+			So(c.Set(ctx, "b", "10"), ShouldBeNil)
+			got, err := c.Get(ctx, "a")
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, "10")
+
+			cnt, err := c.NumEqualTo(ctx, "10")
+			So(err, ShouldBeNil)
+			So(cnt, ShouldEqual, uint64(2))
+
+			So(c.Unset(ctx, "a"), ShouldBeNil)
+			_, err = c.Get(ctx, "a")
+			So(merry.Is(err, storage.ErrNotFound), ShouldBeTrue)
+		})
+
+		Convey("Binary values", func() {
+			value := []byte("NULL\n\x00 \xff")
+			So(c.SetBytes(ctx, "a", value), ShouldBeNil)
+			So(c.SetBytes(ctx, "b", []byte{}), ShouldBeNil)
+			So(c.Set(ctx, "c", "NULL"), ShouldBeNil)
+
+			got, err := c.GetBytes(ctx, "a")
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, value)
+			got, err = c.GetBytes(ctx, "b")
+			So(err, ShouldBeNil)
+			So(got, ShouldBeEmpty)
+			got, err = c.GetBytes(ctx, "c")
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, []byte("NULL"))
+			_, err = c.GetBytes(ctx, "d")
+			So(merry.Is(err, storage.ErrNotFound), ShouldBeTrue)
+
+			for i := 0; i < 3; i++ {
+				_, err = c.Get(ctx, "a")
+				So(merry.Is(err, protocol.ErrBinaryValue), ShouldBeTrue)
+			}
+			So(c.Set(ctx, "e", "10"), ShouldBeNil)
+			str, err := c.Get(ctx, "e")
+			So(err, ShouldBeNil)
+			So(str, ShouldEqual, "10")
+
+			cnt, err := c.NumEqualToBytes(ctx, value)
+			So(err, ShouldBeNil)
+			So(cnt, ShouldEqual, uint64(1))
+
+			tx, err := c.Begin(ctx)
+			So(err, ShouldBeNil)
+			So(tx.SetBytes(ctx, "b", value), ShouldBeNil)
+			got, err = tx.GetBytes(ctx, "b")
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, value)
+			cnt, err = tx.NumEqualToBytes(ctx, value)
+			So(err, ShouldBeNil)
+			So(cnt, ShouldEqual, uint64(2))
+			So(tx.Commit(ctx), ShouldBeNil)
+		})
+
+		Convey("Values with spaces should be set", func() {
+			So(c.Set(ctx, "a", " hello\tworld  again"), ShouldBeNil)
+			got, err := c.Get(ctx, "a")
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, " hello\tworld  again")
+
+			tx, err := c.Begin(ctx)
+			So(err, ShouldBeNil)
+			So(tx.Set(ctx, "b", "x y"), ShouldBeNil)
+			got, err = tx.Get(ctx, "b")
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, "x y")
+			So(tx.Rollback(ctx), ShouldBeNil)
+		})
+
+		Convey("Invalid arguments should be rejected", func() {
+			So(merry.Is(c.Set(ctx, "a b", "10"), ErrInvalidArgument), ShouldBeTrue)
+			So(merry.Is(c.Set(ctx, "a", ""), ErrInvalidArgument), ShouldBeTrue)
+			So(merry.Is(c.Set(ctx, "a", "10 "), ErrInvalidArgument), ShouldBeTrue)
+			So(merry.Is(c.Set(ctx, "a", "10\nSET b 10"), ErrInvalidArgument), ShouldBeTrue)
+			_, err := c.NumEqualTo(ctx, "1 0")
+			So(merry.Is(err, ErrInvalidArgument), ShouldBeTrue)
+			_, err = c.Get(ctx, "a\nSET b 10")
+			So(merry.Is(err, ErrInvalidArgument), ShouldBeTrue)
+		})
+
+		Convey("Transactions", func() {
+			So(c.Set(ctx, "a", "10"), ShouldBeNil)
+			tx, err := c.Begin(ctx)
+			So(err, ShouldBeNil)
+			So(tx.Set(ctx, "a", "20"), ShouldBeNil)
+
+			got, err := tx.Get(ctx, "a")
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, "20")
+			got, err = c.Get(ctx, "a")
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, "10")
+
+			Convey("Commit should apply the changes", func() {
+				So(tx.Begin(ctx), ShouldBeNil)
+				So(tx.Set(ctx, "b", "30"), ShouldBeNil)
+				So(tx.Commit(ctx), ShouldBeNil)
+				got, err := c.Get(ctx, "b")
+				So(err, ShouldBeNil)
+				So(got, ShouldEqual, "30")
+
+				_, err = tx.Get(ctx, "a")
+				So(merry.Is(err, ErrClosed), ShouldBeTrue)
+			})
+
+			Convey("Rollback should forget the changes", func() {
+				So(tx.Savepoint(ctx, "sp"), ShouldBeNil)
+				So(tx.Set(ctx, "a", "40"), ShouldBeNil)
+				So(tx.RollbackTo(ctx, "sp"), ShouldBeNil)
+				So(merry.Is(tx.Release(ctx, "unknown"), storage.ErrNoSavepoint), ShouldBeTrue)
+				got, err := tx.Get(ctx, "a")
+				So(err, ShouldBeNil)
+				So(got, ShouldEqual, "20")
+
+				So(tx.Rollback(ctx), ShouldBeNil)
+				got, err = c.Get(ctx, "a")
+				So(err, ShouldBeNil)
+				So(got, ShouldEqual, "10")
+			})
+
+			Convey("Conflicting commit should fail", func() {
+				So(c.Set(ctx, "a", "50"), ShouldBeNil)
+				So(merry.Is(tx.Commit(ctx), storage.ErrTxConflict), ShouldBeTrue)
+			})
+
+			Convey("Read-only transaction should reject writes", func() {
+				rtx, err := c.BeginReadOnly(ctx)
+				So(err, ShouldBeNil)
+				So(merry.Is(rtx.Set(ctx, "a", "60"), storage.ErrReadOnly), ShouldBeTrue)
+				So(rtx.Rollback(ctx), ShouldBeNil)
+			})
+
+			Convey("Pool should wait for the free connection", func() {
+				tx2, err := c.Begin(ctx)
+				So(err, ShouldBeNil)
+
+				dlCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+				defer cancel()
+				_, err = c.Get(dlCtx, "a")
+				So(err == context.DeadlineExceeded, ShouldBeTrue)
+
+				So(tx2.Rollback(ctx), ShouldBeNil)
+				_, err = c.Get(ctx, "a")
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("Client should reconnect after server's restart", func() {
+			So(c.Set(ctx, "a", "10"), ShouldBeNil)
+			_ = srv.Close()
+			srv, _ = serve(addr)
+
+			So(c.Set(ctx, "a", "20"), ShouldBeNil)
+			got, err := c.Get(ctx, "a")
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, "20")
+		})
+
+		Convey("Closed client should fail", func() {
+			So(c.Close(), ShouldBeNil)
+			_, err := c.Get(ctx, "a")
+			So(merry.Is(err, ErrClosed), ShouldBeTrue)
+		})
+	})
+
+	Convey("With silent server", t, func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer l.Close()
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+
+		c, err := Dial(l.Addr().String())
+		So(err, ShouldBeNil)
+		defer c.Close()
+
+		Convey("Context's deadline should be honoured", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, err := c.Get(ctx, "a")
+			So(err == context.DeadlineExceeded, ShouldBeTrue)
+		})
+
+		Convey("Context's cancellation should be honoured", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+			_, err := c.Get(ctx, "a")
+			So(err == context.Canceled, ShouldBeTrue)
+		})
+	})
+}
+
+func TestClientAuth(t *testing.T) {
+	Convey("With server requiring authentication", t, func() {
+		hash, err := protocol.HashPassword("secret")
+		So(err, ShouldBeNil)
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		srv := protocol.NewServerConfig(storage.New(), protocol.Config{Users: []protocol.User{{
+			Name:         "reader",
+			PasswordHash: hash,
+			ACL:          protocol.ACL{Commands: []string{"@read"}, Keys: []string{"*"}},
+		}}})
+		go func() { _ = srv.Serve(l) }()
+		defer srv.Close()
+		addr := l.Addr().String()
+		ctx := context.Background()
+
+		Convey("Unauthenticated client should be denied", func() {
+			c, err := Dial(addr)
+			So(err, ShouldBeNil)
+			defer c.Close()
+			_, err = c.Get(ctx, "a")
+			So(merry.Is(err, protocol.ErrNoAuth), ShouldBeTrue)
+		})
+		Convey("Wrong password should be rejected", func() {
+			_, err := DialOptions(addr, Options{User: "reader", Password: "nope"})
+			So(merry.Is(err, protocol.ErrWrongPass), ShouldBeTrue)
+		})
+		Convey("Authenticated client should be restricted by ACL", func() {
+			c, err := DialOptions(addr, Options{User: "reader", Password: "secret"})
+			So(err, ShouldBeNil)
+			defer c.Close()
+			_, err = c.Get(ctx, "a")
+			So(merry.Is(err, storage.ErrNotFound), ShouldBeTrue)
+			So(merry.Is(c.Set(ctx, "a", "10"), protocol.ErrNoPerm), ShouldBeTrue)
+		})
+	})
+}
+
+// selfSigned returns the self-signed certificate for 127.0.0.1.
+func selfSigned() (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	So(err, ShouldBeNil)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "server"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	So(err, ShouldBeNil)
+	cert, err := x509.ParseCertificate(der)
+	So(err, ShouldBeNil)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, roots
+}
+
+func TestClientTLS(t *testing.T) {
+	Convey("With TLS server", t, func() {
+		cert, roots := selfSigned()
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		srv := protocol.NewServer(storage.New())
+		go func() { _ = srv.Serve(tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{cert}})) }()
+		defer srv.Close()
+		ctx := context.Background()
+
+		Convey("TLS client should be served", func() {
+			c, err := DialOptions(l.Addr().String(), Options{TLSConfig: &tls.Config{RootCAs: roots}})
+			So(err, ShouldBeNil)
+			defer c.Close()
+			So(c.Set(ctx, "a", "10"), ShouldBeNil)
+			got, err := c.Get(ctx, "a")
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, "10")
+		})
+		Convey("Untrusted server should be rejected", func() {
+			_, err := DialOptions(l.Addr().String(), Options{TLSConfig: &tls.Config{}})
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("With silent server", t, func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer l.Close()
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+
+		Convey("Handshake should honour the context's deadline without the dial timeout", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, err := dialConn(ctx, l.Addr().String(), 0, &tls.Config{})
+			So(err == context.DeadlineExceeded, ShouldBeTrue)
+		})
+	})
+}
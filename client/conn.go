@@ -0,0 +1,118 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// conn is a single connection to the server.
+type conn struct {
+	c net.Conn
+	r *bufio.Reader
+	// isBroken is true if the connection can't be reused.
+	isBroken bool
+}
+
+// dialConn connects to the server, over TLS if tlsConfig is set.
+func dialConn(ctx context.Context, addr string, timeout time.Duration, tlsConfig *tls.Config) (*conn, error) {
+	d := net.Dialer{Timeout: timeout}
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, contextErr(ctx, err)
+	}
+	if tlsConfig != nil {
+		if tlsConfig.ServerName == "" {
+			// Verify the dialed host, just like tls.Dial does
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tlsConn := tls.Client(c, tlsConfig)
+		if timeout > 0 {
+			_ = tlsConn.SetDeadline(time.Now().Add(timeout))
+		}
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			_ = c.Close()
+			return nil, contextErr(ctx, err)
+		}
+		c = tlsConn
+	}
+	return &conn{c: c, r: bufio.NewReader(c)}, nil
+}
+
+// do sends the command and returns server's response.
+// If withPayload is true, the response's length line is followed by
+// the payload, which is returned after the length line.
+// Connection is marked as broken on any IO error,
+// including context's cancellation.
+func (c *conn) do(ctx context.Context, cmd string, withPayload bool) (string, error) {
+	deadline, _ := ctx.Deadline()
+	if err := c.c.SetDeadline(deadline); err != nil {
+		c.isBroken = true
+		return "", err
+	}
+
+	// Unblock the IO when the context is cancelled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = c.c.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	ret, err := c.roundTrip(cmd, withPayload)
+	if err != nil {
+		c.isBroken = true
+		return "", contextErr(ctx, err)
+	}
+	return ret, nil
+}
+
+// roundTrip writes the command and reads the response line,
+// and the payload if withPayload is true and the line is its length.
+func (c *conn) roundTrip(cmd string, withPayload bool) (string, error) {
+	if _, err := c.c.Write([]byte(cmd + "\n")); err != nil {
+		return "", err
+	}
+	ret, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	ret = strings.TrimSuffix(ret, "\n")
+	n, err := strconv.Atoi(ret)
+	if !withPayload || err != nil || n < 0 {
+		// NULL or an error
+		return ret, nil
+	}
+	// Payload is terminated by the newline
+	payload := make([]byte, n+1)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return "", err
+	}
+	return ret + "\n" + string(payload[:n]), nil
+}
+
+func (c *conn) close() error {
+	return c.c.Close()
+}
+
+// contextErr returns the context's error in place of the IO error
+// if the context is done.
+func contextErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		// IO deadline fired before context's timer
+		return context.DeadlineExceeded
+	}
+	return err
+}
@@ -0,0 +1,41 @@
+/*
+Package client provides a client for the database's TCP protocol.
+
+Client keeps a pool of connections to the server; every request
+takes an idle connection from the pool (or dials a new one) and returns it back.
+Broken connections are dropped and redialed on demand.
+
+Server's responses are converted to the storage package's errors,
+so merry.Is(err, storage.ErrNotFound) works the same way
+for the client and embedded storage.
+
+Keys can't have spaces or newlines in them, values can't have newlines
+or trailing spaces; values passed to NumEqualTo can't have spaces either.
+GetBytes, SetBytes and NumEqualToBytes send the values of any bytes instead.
+
+Basic usage
+
+  c, err := client.Dial("127.0.0.1:4000")
+  if err != nil {
+  	return err
+  }
+  defer c.Close()
+
+  ctx := context.Background()
+  if err = c.Set(ctx, "key", "value"); err != nil {
+  	return err
+  }
+  value, err := c.Get(ctx, "key")
+
+Transactions
+
+Tx holds a single connection for its whole lifetime:
+
+  tx, err := c.Begin(ctx)
+  if err != nil {
+  	return err
+  }
+  _ = tx.Set(ctx, "key", "value2")
+  err = tx.Commit(ctx)
+*/
+package client
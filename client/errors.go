@@ -0,0 +1,15 @@
+package client
+
+import (
+	"github.com/ansel1/merry"
+)
+
+// ErrClosed is returned when using the closed client or finished transaction.
+var ErrClosed = merry.New("Client was closed.")
+
+// ErrInvalidArgument is returned when the key or value can't be sent
+// over the protocol, e.g. it is empty or has spaces in it.
+var ErrInvalidArgument = merry.New("Invalid key or value.")
+
+// ErrServer is returned for the unexpected server's response.
+var ErrServer = merry.New("Server error.")
@@ -0,0 +1,118 @@
+package client
+
+import (
+	"context"
+	"sync"
+)
+
+// pool keeps the connections to the server.
+type pool struct {
+	addr string
+	opts Options
+
+	// idle keeps the connections ready for use.
+	idle chan *conn
+	// slots limits the number of open connections.
+	slots chan struct{}
+
+	mu       sync.Mutex
+	isClosed bool
+}
+
+func newPool(addr string, opts Options) *pool {
+	return &pool{
+		addr:  addr,
+		opts:  opts,
+		idle:  make(chan *conn, opts.PoolSize),
+		slots: make(chan struct{}, opts.PoolSize),
+	}
+}
+
+// get returns an idle connection or dials a new one
+// if the pool is not full.
+// reused is true if the connection was taken from the idle ones.
+func (p *pool) get(ctx context.Context) (cn *conn, reused bool, err error) {
+	if p.closed() {
+		return nil, false, ErrClosed.Here()
+	}
+
+	select {
+	case cn = <-p.idle:
+		return cn, true, nil
+	default:
+	}
+
+	select {
+	case cn = <-p.idle:
+		return cn, true, nil
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+
+	cn, err = p.dial(ctx)
+	if err != nil {
+		<-p.slots
+		return nil, false, err
+	}
+	return cn, false, nil
+}
+
+// dial connects to the server and authenticates
+// if the user is set.
+func (p *pool) dial(ctx context.Context) (*conn, error) {
+	cn, err := dialConn(ctx, p.addr, p.opts.DialTimeout, p.opts.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	if p.opts.User == "" {
+		return cn, nil
+	}
+	resp, err := cn.do(ctx, "AUTH "+p.opts.User+" "+p.opts.Password, false)
+	if err == nil {
+		err = parseResult(resp)
+	}
+	if err != nil {
+		_ = cn.close()
+		return nil, err
+	}
+	return cn, nil
+}
+
+// put returns the connection to the pool.
+// Broken connections are closed.
+func (p *pool) put(cn *conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if cn.isBroken || p.isClosed {
+		_ = cn.close()
+		<-p.slots
+		return
+	}
+	p.idle <- cn
+}
+
+// close closes idle connections; connections in use are closed
+// when they're returned.
+func (p *pool) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.isClosed = true
+	for {
+		select {
+		case cn := <-p.idle:
+			_ = cn.close()
+			<-p.slots
+		default:
+			return nil
+		}
+	}
+}
+
+func (p *pool) closed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.isClosed
+}
@@ -0,0 +1,179 @@
+package client
+
+import (
+	"context"
+)
+
+// Tx is a transaction in progress.
+// It holds a single connection until it's committed or
+// rolled back completely.
+// Tx is not safe for concurrent use.
+type Tx struct {
+	pool *pool
+	cn   *conn
+	// depth is the number of open transaction blocks.
+	depth int
+}
+
+// Get returns the variable's value by its key.
+// storage.ErrNotFound is returned if the variable was not set,
+// protocol.ErrBinaryValue if the value has line breaks: GetBytes reads it.
+func (t *Tx) Get(ctx context.Context, key string) (string, error) {
+	if err := checkArgs(key); err != nil {
+		return "", err
+	}
+	resp, err := t.do(ctx, "GET "+key, false)
+	if err != nil {
+		return "", err
+	}
+	return parseGet(resp)
+}
+
+// Set sets the variable's value by its key.
+func (t *Tx) Set(ctx context.Context, key, value string) error {
+	if err := checkArgs(key); err != nil {
+		return err
+	}
+	if err := checkLastArg(value); err != nil {
+		return err
+	}
+	return t.doResult(ctx, "SET "+key+" "+value)
+}
+
+// GetBytes returns the variable's value by its key,
+// which may hold any bytes.
+// storage.ErrNotFound is returned if the variable was not set.
+func (t *Tx) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	if err := checkArgs(key); err != nil {
+		return nil, err
+	}
+	resp, err := t.do(ctx, "GETB "+key, true)
+	if err != nil {
+		return nil, err
+	}
+	return parseGetPayload(resp)
+}
+
+// SetBytes sets the variable's value by its key to any bytes.
+func (t *Tx) SetBytes(ctx context.Context, key string, value []byte) error {
+	if err := checkArgs(key); err != nil {
+		return err
+	}
+	return t.doResult(ctx, "SETB "+key+" "+payload(value))
+}
+
+// Unset removes the variable by its key.
+func (t *Tx) Unset(ctx context.Context, key string) error {
+	if err := checkArgs(key); err != nil {
+		return err
+	}
+	return t.doResult(ctx, "UNSET "+key)
+}
+
+// NumEqualTo returns the number of variables set to the value.
+func (t *Tx) NumEqualTo(ctx context.Context, value string) (uint64, error) {
+	if err := checkArgs(value); err != nil {
+		return 0, err
+	}
+	resp, err := t.do(ctx, "NUMEQUALTO "+value, false)
+	if err != nil {
+		return 0, err
+	}
+	return parseCount(resp)
+}
+
+// NumEqualToBytes returns the number of variables set to the value,
+// which may hold any bytes.
+func (t *Tx) NumEqualToBytes(ctx context.Context, value []byte) (uint64, error) {
+	resp, err := t.do(ctx, "NUMEQUALTOB "+payload(value), false)
+	if err != nil {
+		return 0, err
+	}
+	return parseCount(resp)
+}
+
+// Begin opens a nested transaction block.
+func (t *Tx) Begin(ctx context.Context) error {
+	if err := t.doResult(ctx, "BEGIN"); err != nil {
+		return err
+	}
+	t.depth++
+	return nil
+}
+
+// Savepoint creates a named savepoint.
+func (t *Tx) Savepoint(ctx context.Context, name string) error {
+	if err := checkArgs(name); err != nil {
+		return err
+	}
+	return t.doResult(ctx, "SAVEPOINT "+name)
+}
+
+// RollbackTo forgets the changes made since the savepoint.
+func (t *Tx) RollbackTo(ctx context.Context, name string) error {
+	if err := checkArgs(name); err != nil {
+		return err
+	}
+	return t.doResult(ctx, "ROLLBACK TO "+name)
+}
+
+// Release removes the savepoint, keeping the changes made since it.
+func (t *Tx) Release(ctx context.Context, name string) error {
+	if err := checkArgs(name); err != nil {
+		return err
+	}
+	return t.doResult(ctx, "RELEASE "+name)
+}
+
+// Commit commits all the transaction blocks and
+// releases the connection.
+func (t *Tx) Commit(ctx context.Context) error {
+	err := t.doResult(ctx, "COMMIT")
+	t.finish()
+	return err
+}
+
+// Rollback rolls back the most recent transaction block.
+// The connection is released when the last block is rolled back.
+func (t *Tx) Rollback(ctx context.Context) error {
+	err := t.doResult(ctx, "ROLLBACK")
+	if err == nil {
+		t.depth--
+	}
+	if t.depth <= 0 {
+		t.finish()
+	}
+	return err
+}
+
+// do sends the command over transaction's connection.
+// Transaction is finished if the connection is broken, since
+// the server rolls back the transactions of closed connections.
+func (t *Tx) do(ctx context.Context, cmd string, withPayload bool) (string, error) {
+	if t.cn == nil {
+		return "", ErrClosed.Here()
+	}
+	resp, err := t.cn.do(ctx, cmd, withPayload)
+	if err != nil {
+		t.finish()
+	}
+	return resp, err
+}
+
+func (t *Tx) doResult(ctx context.Context, cmd string) error {
+	resp, err := t.do(ctx, cmd, false)
+	if err != nil {
+		return err
+	}
+	return parseResult(resp)
+}
+
+// finish returns the connection to the pool.
+func (t *Tx) finish() {
+	if t.cn == nil {
+		return
+	}
+	t.pool.put(t.cn)
+	t.cn = nil
+	t.depth = 0
+}
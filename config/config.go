@@ -0,0 +1,536 @@
+/*
+Package config provides the database server's configuration,
+read from the command-line flags and optional TOML or YAML file.
+
+Flags override the file's values. See README.md for the file's format.
+*/
+package config
+
+import (
+	"flag"
+	"github.com/BurntSushi/toml"
+	"github.com/ansel1/merry"
+	"github.com/utrack/go-simple-memdb/logging"
+	"github.com/utrack/go-simple-memdb/persistence"
+	"github.com/utrack/go-simple-memdb/protocol"
+	"github.com/utrack/go-simple-memdb/storage"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalid is returned when the config can't be read or is invalid.
+var ErrInvalid = merry.New("Invalid config.")
+
+// Config is the database server's configuration.
+type Config struct {
+	Listen      Listen      `toml:"listen" yaml:"listen"`
+	Protocol    Protocol    `toml:"protocol" yaml:"protocol"`
+	Replication Replication `toml:"replication" yaml:"replication"`
+	Storage     Storage     `toml:"storage" yaml:"storage"`
+	Persistence Persistence `toml:"persistence" yaml:"persistence"`
+	History     History     `toml:"history" yaml:"history"`
+	SlowLog     SlowLog     `toml:"slowlog" yaml:"slowlog"`
+	TLS         TLS         `toml:"tls" yaml:"tls"`
+	Log         Log         `toml:"log" yaml:"log"`
+	Users       []User      `toml:"users" yaml:"users"`
+}
+
+// Listen configures where the commands are read from.
+type Listen struct {
+	// Stdio is true if the commands are read from stdin.
+	Stdio bool `toml:"stdio" yaml:"stdio"`
+	// TCP are the TCP addresses to listen at.
+	TCP []string `toml:"tcp" yaml:"tcp"`
+	// HTTP are the addresses to serve the commands POSTed over HTTP at.
+	HTTP []string `toml:"http" yaml:"http"`
+	// Unix are the unix socket paths to listen at.
+	Unix []string `toml:"unix" yaml:"unix"`
+	// UnixMode is the octal file mode of the unix sockets, e.g. "0660".
+	UnixMode string `toml:"unix_mode" yaml:"unix_mode"`
+	// UnixAllowUIDs and UnixAllowGIDs restrict the unix sockets' clients
+	// by their UID or GID. Clients are not restricted if both are empty.
+	UnixAllowUIDs []uint32 `toml:"unix_allow_uids" yaml:"unix_allow_uids"`
+	UnixAllowGIDs []uint32 `toml:"unix_allow_gids" yaml:"unix_allow_gids"`
+}
+
+// Protocol configures the protocol.
+type Protocol struct {
+	// Dialect is the network listeners' protocol dialect: "line" or "resp".
+	// Stdin is always processed in the line dialect.
+	Dialect string `toml:"dialect" yaml:"dialect"`
+	// ReadOnly is true if all the writes should be rejected.
+	ReadOnly bool `toml:"read_only" yaml:"read_only"`
+	// IdleTimeout closes the connections idle for that long, e.g. "5m";
+	// zero keeps them open.
+	IdleTimeout Duration `toml:"idle_timeout" yaml:"idle_timeout"`
+}
+
+// Replication configures the replication.
+type Replication struct {
+	// Listen is the address to stream the change sets to the followers at.
+	Listen string `toml:"listen" yaml:"listen"`
+	// Backlog is the number of recent change sets kept for the followers.
+	Backlog int `toml:"backlog" yaml:"backlog"`
+	// Follow is the leader's address to replicate from.
+	// Follower is always read-only.
+	Follow string `toml:"follow" yaml:"follow"`
+}
+
+// Storage configures the databases.
+type Storage struct {
+	// MaxMemory is the number of bytes the variables' keys and values
+	// of a database may take before the writes adding to them are rejected
+	// with OOM; zero doesn't limit them.
+	MaxMemory uint64 `toml:"max_memory" yaml:"max_memory"`
+	// SweepInterval is how often the expired variables are unset, e.g. "1s";
+	// zero doesn't unset them. Followers don't sweep, they replicate
+	// the leader's sweeps.
+	SweepInterval Duration `toml:"sweep_interval" yaml:"sweep_interval"`
+	// MaxDatabases is the number of the databases SELECT and SWAPDB create.
+	MaxDatabases int `toml:"max_databases" yaml:"max_databases"`
+}
+
+// Persistence configures where database "0" is kept on the disk,
+// see persistence.Options. It's not persisted if both paths are empty.
+type Persistence struct {
+	// SnapshotPath is the file of the snapshot written on shutdown.
+	SnapshotPath string `toml:"snapshot_path" yaml:"snapshot_path"`
+	// JournalPath is the file the changes committed after the snapshot are appended to.
+	JournalPath string `toml:"journal_path" yaml:"journal_path"`
+	// Fsync is the policy of flushing the journal: always, everysec or no.
+	Fsync string `toml:"fsync" yaml:"fsync"`
+}
+
+// History configures the variables' versions kept for HISTORY
+// and GET AT. History is not kept if both are zero.
+type History struct {
+	// Versions is the number of the last versions kept per variable.
+	Versions int `toml:"versions" yaml:"versions"`
+	// Age is how long the versions are kept after they were replaced, e.g. "1h".
+	Age Duration `toml:"age" yaml:"age"`
+}
+
+// SlowLog configures the log of the slow commands listed by SLOWLOG.
+type SlowLog struct {
+	// Threshold is the shortest duration of the commands logged, e.g. "10ms";
+	// zero logs every command.
+	Threshold Duration `toml:"threshold" yaml:"threshold"`
+	// MaxLen is the number of the latest slow commands kept;
+	// zero disables the slow log.
+	MaxLen int `toml:"max_len" yaml:"max_len"`
+}
+
+// TLS configures TLS of the TCP and HTTP listeners.
+// Files are reloaded on SIGHUP.
+type TLS struct {
+	// CertFile and KeyFile enable TLS if set.
+	CertFile string `toml:"cert_file" yaml:"cert_file"`
+	KeyFile  string `toml:"key_file" yaml:"key_file"`
+	// ClientCAFile requires the clients to present the certificates
+	// signed by its CAs. Certificate's common name authenticates
+	// the user of the same name.
+	ClientCAFile string `toml:"client_ca_file" yaml:"client_ca_file"`
+}
+
+// Log configures the logging.
+type Log struct {
+	// Level is the minimal level of the messages: debug, info, warn or error.
+	Level string `toml:"level" yaml:"level"`
+}
+
+// User is allowed to authenticate with AUTH.
+// If there are any users, clients should authenticate
+// and are restricted by their ACLs, see protocol.ACL.
+type User struct {
+	Name string `toml:"name" yaml:"name"`
+	// PasswordHash is the bcrypt hash of the password,
+	// e.g. printed by the hash-password command.
+	PasswordHash string `toml:"password_hash" yaml:"password_hash"`
+	// Commands are the allowed command names or categories: "@read", "@write", "@tx", "@all" etc.
+	Commands []string `toml:"commands" yaml:"commands"`
+	// DenyCommands are the commands denied even if allowed by Commands.
+	DenyCommands []string `toml:"deny_commands" yaml:"deny_commands"`
+	// Keys are the allowed key patterns, e.g. "app1:*"; "*" also allows
+	// the commands accessing all the keys, e.g. NUMEQUALTO.
+	Keys []string `toml:"keys" yaml:"keys"`
+}
+
+// Default returns the default config: commands are read from stdin only.
+func Default() Config {
+	return Config{
+		Listen:      Listen{Stdio: true, UnixMode: "0660"},
+		Protocol:    Protocol{Dialect: "line"},
+		Replication: Replication{Backlog: 1024},
+		Storage:     Storage{SweepInterval: Duration{time.Second}, MaxDatabases: storage.DefaultMaxDatabases},
+		Persistence: Persistence{Fsync: "everysec"},
+		SlowLog: SlowLog{
+			Threshold: Duration{protocol.DefaultSlowLog.Threshold},
+			MaxLen:    protocol.DefaultSlowLog.MaxLen,
+		},
+		Log: Log{Level: "info"},
+	}
+}
+
+// Load reads the config from the command-line arguments
+// and the config file given by the -config flag.
+// Usage and errors of flags are written to output.
+func Load(args []string, output io.Writer) (Config, error) {
+	fs := flag.NewFlagSet("go-simple-memdb", flag.ContinueOnError)
+	fs.SetOutput(output)
+
+	var cfgPath string
+	var tcp, httpAddrs, unix stringsFlag
+	fs.StringVar(&cfgPath, "config", "", "path to the TOML or YAML (.yaml, .yml) config file")
+	stdio := fs.Bool("stdio", true, "read the commands from stdin")
+	fs.Var(&tcp, "tcp", "TCP address to listen at (repeatable)")
+	fs.Var(&httpAddrs, "http", "address to serve the commands POSTed over HTTP at (repeatable)")
+	fs.Var(&unix, "unix", "unix socket path to listen at (repeatable)")
+	unixMode := fs.String("unix-mode", "0660", "octal file mode of the unix sockets")
+	var allowUIDs, allowGIDs uintsFlag
+	fs.Var(&allowUIDs, "unix-allow-uid", "UID allowed to connect to the unix sockets (repeatable)")
+	fs.Var(&allowGIDs, "unix-allow-gid", "GID allowed to connect to the unix sockets (repeatable)")
+	dialect := fs.String("dialect", "line", "protocol's dialect")
+	readOnly := fs.Bool("read-only", false, "reject all writes")
+	idleTimeout := fs.Duration("idle-timeout", 0, "close the connections idle for that long")
+	replListen := fs.String("replication-listen", "", "address to stream the changes to the followers at")
+	replBacklog := fs.Int("replication-backlog", 1024, "number of recent change sets kept for the followers")
+	tlsCert := fs.String("tls-cert", "", "TLS certificate file of the TCP listeners")
+	tlsKey := fs.String("tls-key", "", "TLS key file of the TCP listeners")
+	tlsClientCA := fs.String("tls-client-ca", "", "CA file to verify the client certificates with")
+	follow := fs.String("follow", "", "leader's replication address to follow")
+	maxMemory := fs.Uint64("max-memory", 0, "bytes the variables of a database may take, zero doesn't limit them")
+	maxDatabases := fs.Int("max-databases", storage.DefaultMaxDatabases, "number of the databases SELECT and SWAPDB create")
+	sweepInterval := fs.Duration("sweep-interval", time.Second, "how often the expired variables are unset, zero doesn't unset them")
+	snapshotPath := fs.String("snapshot-path", "", "file of the snapshot written on shutdown")
+	journalPath := fs.String("journal-path", "", "file the changes committed after the snapshot are appended to")
+	fsync := fs.String("fsync", "everysec", "policy of flushing the journal: always, everysec or no")
+	historyVersions := fs.Int("history-versions", 0, "number of the last versions kept per variable")
+	historyAge := fs.Duration("history-age", 0, "how long the replaced versions are kept")
+	slowLogThreshold := fs.Duration("slowlog-threshold", protocol.DefaultSlowLog.Threshold, "shortest duration of the commands logged as slow")
+	slowLogMaxLen := fs.Int("slowlog-max-len", protocol.DefaultSlowLog.MaxLen, "number of the latest slow commands kept")
+	logLevel := fs.String("log-level", "info", "log level: debug, info, warn or error")
+
+	if err := fs.Parse(args); err != nil {
+		return Config{}, ErrInvalid.Here().Append(err.Error())
+	}
+	if fs.NArg() > 0 {
+		return Config{}, ErrInvalid.Here().Appendf("unexpected arguments %v", fs.Args())
+	}
+
+	ret := Default()
+	if cfgPath != "" {
+		var err error
+		if ret, err = LoadFile(cfgPath); err != nil {
+			return Config{}, err
+		}
+	}
+
+	// Flags override the file
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "stdio":
+			ret.Listen.Stdio = *stdio
+		case "tcp":
+			ret.Listen.TCP = tcp
+		case "http":
+			ret.Listen.HTTP = httpAddrs
+		case "unix":
+			ret.Listen.Unix = unix
+		case "unix-mode":
+			ret.Listen.UnixMode = *unixMode
+		case "unix-allow-uid":
+			ret.Listen.UnixAllowUIDs = allowUIDs
+		case "unix-allow-gid":
+			ret.Listen.UnixAllowGIDs = allowGIDs
+		case "dialect":
+			ret.Protocol.Dialect = *dialect
+		case "read-only":
+			ret.Protocol.ReadOnly = *readOnly
+		case "idle-timeout":
+			ret.Protocol.IdleTimeout.Duration = *idleTimeout
+		case "replication-listen":
+			ret.Replication.Listen = *replListen
+		case "replication-backlog":
+			ret.Replication.Backlog = *replBacklog
+		case "follow":
+			ret.Replication.Follow = *follow
+		case "max-memory":
+			ret.Storage.MaxMemory = *maxMemory
+		case "max-databases":
+			ret.Storage.MaxDatabases = *maxDatabases
+		case "sweep-interval":
+			ret.Storage.SweepInterval.Duration = *sweepInterval
+		case "snapshot-path":
+			ret.Persistence.SnapshotPath = *snapshotPath
+		case "journal-path":
+			ret.Persistence.JournalPath = *journalPath
+		case "fsync":
+			ret.Persistence.Fsync = *fsync
+		case "history-versions":
+			ret.History.Versions = *historyVersions
+		case "history-age":
+			ret.History.Age.Duration = *historyAge
+		case "slowlog-threshold":
+			ret.SlowLog.Threshold.Duration = *slowLogThreshold
+		case "slowlog-max-len":
+			ret.SlowLog.MaxLen = *slowLogMaxLen
+		case "tls-cert":
+			ret.TLS.CertFile = *tlsCert
+		case "tls-key":
+			ret.TLS.KeyFile = *tlsKey
+		case "tls-client-ca":
+			ret.TLS.ClientCAFile = *tlsClientCA
+		case "log-level":
+			ret.Log.Level = *logLevel
+		}
+	})
+	return ret, ret.Validate()
+}
+
+// LoadFile reads the config from TOML file, or YAML one if its extension
+// is .yaml or .yml, over the default config.
+// Unknown keys are reported as errors.
+func LoadFile(path string) (Config, error) {
+	ret := Default()
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return Config{}, ErrInvalid.Here().Appendf("%v: %v", path, err)
+		}
+		if err = yaml.UnmarshalStrict(data, &ret); err != nil {
+			return Config{}, ErrInvalid.Here().Appendf("%v: %v", path, err)
+		}
+	default:
+		md, err := toml.DecodeFile(path, &ret)
+		if err != nil {
+			return Config{}, ErrInvalid.Here().Appendf("%v: %v", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, 0, len(undecoded))
+			for _, key := range undecoded {
+				keys = append(keys, key.String())
+			}
+			sort.Strings(keys)
+			return Config{}, ErrInvalid.Here().Appendf("%v: unknown keys %v", path, strings.Join(keys, ", "))
+		}
+	}
+	return ret, ret.Validate()
+}
+
+// Validate returns ErrInvalid describing the first problem found.
+func (c Config) Validate() error {
+	if !c.Listen.Stdio && len(c.Listen.TCP) == 0 && len(c.Listen.HTTP) == 0 && len(c.Listen.Unix) == 0 {
+		return ErrInvalid.Here().Append("listen: no listeners configured")
+	}
+	if _, err := strconv.ParseUint(c.Listen.UnixMode, 8, 32); err != nil {
+		return ErrInvalid.Here().Appendf("listen.unix_mode: should be octal file mode, got %q", c.Listen.UnixMode)
+	}
+	if _, err := protocol.ParseDialect(c.Protocol.Dialect); err != nil {
+		return ErrInvalid.Here().Appendf("protocol.dialect: should be \"line\" or \"resp\", got %q", c.Protocol.Dialect)
+	}
+	if c.Protocol.IdleTimeout.Duration < 0 {
+		return ErrInvalid.Here().Appendf("protocol.idle_timeout: should not be negative, got %v", c.Protocol.IdleTimeout)
+	}
+	if c.Replication.Backlog < 1 {
+		return ErrInvalid.Here().Appendf("replication.backlog: should be positive, got %v", c.Replication.Backlog)
+	}
+	if c.Replication.Listen != "" && c.Replication.Follow != "" {
+		return ErrInvalid.Here().Append("replication: can't both listen and follow")
+	}
+	if c.Storage.MaxDatabases < 1 {
+		return ErrInvalid.Here().Appendf("storage.max_databases: should be positive, got %v", c.Storage.MaxDatabases)
+	}
+	if c.Storage.SweepInterval.Duration < 0 {
+		return ErrInvalid.Here().Appendf("storage.sweep_interval: should not be negative, got %v", c.Storage.SweepInterval)
+	}
+	if _, err := persistence.ParseFsync(c.Persistence.Fsync); err != nil {
+		return ErrInvalid.Here().Appendf("persistence.fsync: %v", err)
+	}
+	if c.IsPersistent() && c.Replication.Follow != "" {
+		return ErrInvalid.Here().Append("persistence: followers are restored from the leader, not from the disk")
+	}
+	if c.History.Versions < 0 {
+		return ErrInvalid.Here().Appendf("history.versions: should not be negative, got %v", c.History.Versions)
+	}
+	if c.History.Age.Duration < 0 {
+		return ErrInvalid.Here().Appendf("history.age: should not be negative, got %v", c.History.Age)
+	}
+	if c.SlowLog.Threshold.Duration < 0 {
+		return ErrInvalid.Here().Appendf("slowlog.threshold: should not be negative, got %v", c.SlowLog.Threshold)
+	}
+	if c.SlowLog.MaxLen < 0 {
+		return ErrInvalid.Here().Appendf("slowlog.max_len: should not be negative, got %v", c.SlowLog.MaxLen)
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return ErrInvalid.Here().Append("tls: both cert_file and key_file should be set")
+	}
+	if c.TLS.ClientCAFile != "" && c.TLS.CertFile == "" {
+		return ErrInvalid.Here().Append("tls: client_ca_file requires cert_file and key_file")
+	}
+	if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+		return ErrInvalid.Here().Appendf("log.level: %v", err)
+	}
+	names := map[string]bool{}
+	for _, u := range c.protocolUsers() {
+		if err := u.Validate(); err != nil {
+			return ErrInvalid.Here().Appendf("users: %v", err)
+		}
+		if names[u.Name] {
+			return ErrInvalid.Here().Appendf("users: duplicate user %v", u.Name)
+		}
+		names[u.Name] = true
+	}
+	return nil
+}
+
+// TLSFiles returns the TLS files for the protocol package,
+// or nil if TLS is disabled.
+func (c Config) TLSFiles() *protocol.TLSFiles {
+	if c.TLS.CertFile == "" {
+		return nil
+	}
+	return &protocol.TLSFiles{
+		CertFile:     c.TLS.CertFile,
+		KeyFile:      c.TLS.KeyFile,
+		ClientCAFile: c.TLS.ClientCAFile,
+	}
+}
+
+// StorageConfig returns the config for the storage package.
+func (c Config) StorageConfig() storage.Config {
+	return storage.Config{
+		Retention:    storage.Retention{Versions: c.History.Versions, Age: c.History.Age.Duration},
+		MaxMemory:    c.Storage.MaxMemory,
+		MaxDatabases: c.Storage.MaxDatabases,
+	}
+}
+
+// IsPersistent returns true if database "0" should be kept on the disk.
+func (c Config) IsPersistent() bool {
+	return c.Persistence.SnapshotPath != "" || c.Persistence.JournalPath != ""
+}
+
+// PersistenceOptions returns the options for the persistence package.
+func (c Config) PersistenceOptions() persistence.Options {
+	fsync, _ := persistence.ParseFsync(c.Persistence.Fsync)
+	return persistence.Options{
+		SnapshotPath: c.Persistence.SnapshotPath,
+		JournalPath:  c.Persistence.JournalPath,
+		Fsync:        fsync,
+	}
+}
+
+// SweepInterval returns how often the expired variables should be unset,
+// or zero if they shouldn't. Followers never sweep.
+func (c Config) SweepInterval() time.Duration {
+	if c.Replication.Follow != "" {
+		return 0
+	}
+	return c.Storage.SweepInterval.Duration
+}
+
+// LogLevel returns the parsed log level.
+func (c Config) LogLevel() logging.Level {
+	ret, _ := logging.ParseLevel(c.Log.Level)
+	return ret
+}
+
+// UnixFileMode returns the parsed file mode of the unix sockets.
+func (c Config) UnixFileMode() os.FileMode {
+	ret, _ := strconv.ParseUint(c.Listen.UnixMode, 8, 32)
+	return os.FileMode(ret)
+}
+
+// ProtocolConfig returns the config for the protocol package.
+// Followers are always read-only.
+// Every config has its own Metrics, so the sessions sharing them
+// should share the config.
+func (c Config) ProtocolConfig(logger *logging.Logger) protocol.Config {
+	dialect, _ := protocol.ParseDialect(c.Protocol.Dialect)
+	return protocol.Config{
+		Dialect:     dialect,
+		ReadOnly:    c.Protocol.ReadOnly || c.Replication.Follow != "",
+		Logger:      logger,
+		AllowUIDs:   c.Listen.UnixAllowUIDs,
+		AllowGIDs:   c.Listen.UnixAllowGIDs,
+		Users:       c.protocolUsers(),
+		IdleTimeout: c.Protocol.IdleTimeout.Duration,
+		Metrics: protocol.NewMetrics(protocol.SlowLogConfig{
+			Threshold: c.SlowLog.Threshold.Duration,
+			MaxLen:    c.SlowLog.MaxLen,
+		}),
+	}
+}
+
+// protocolUsers returns the users for the protocol package.
+func (c Config) protocolUsers() []protocol.User {
+	var ret []protocol.User
+	for _, u := range c.Users {
+		ret = append(ret, protocol.User{
+			Name:         u.Name,
+			PasswordHash: u.PasswordHash,
+			ACL: protocol.ACL{
+				Commands:     u.Commands,
+				DenyCommands: u.DenyCommands,
+				Keys:         u.Keys,
+			},
+		})
+	}
+	return ret
+}
+
+// stringsFlag is a repeatable string flag.
+type stringsFlag []string
+
+// String implements flag.Value.
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+// Set implements flag.Value.
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// uintsFlag is a repeatable uint32 flag.
+type uintsFlag []uint32
+
+// String implements flag.Value.
+func (u *uintsFlag) String() string {
+	ret := make([]string, 0, len(*u))
+	for _, v := range *u {
+		ret = append(ret, strconv.FormatUint(uint64(v), 10))
+	}
+	return strings.Join(ret, ",")
+}
+
+// Set implements flag.Value.
+func (u *uintsFlag) Set(value string) error {
+	v, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return err
+	}
+	*u = append(*u, uint32(v))
+	return nil
+}
+
+// Duration is the duration read from the string like "1h30m".
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
@@ -0,0 +1,304 @@
+package config
+
+import (
+	"github.com/ansel1/merry"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/utrack/go-simple-memdb/persistence"
+	"github.com/utrack/go-simple-memdb/protocol"
+	"github.com/utrack/go-simple-memdb/storage"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeFile(dir, contents string) string {
+	return writeNamedFile(dir, "memdb.toml", contents)
+}
+
+func writeNamedFile(dir, name, contents string) string {
+	path := filepath.Join(dir, name)
+	So(ioutil.WriteFile(path, []byte(contents), 0600), ShouldBeNil)
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	Convey("With temp dir", t, func() {
+		dir, err := ioutil.TempDir("", "memdb-config")
+		So(err, ShouldBeNil)
+		Reset(func() { os.RemoveAll(dir) })
+
+		Convey("No args should return the defaults", func() {
+			cfg, err := Load(nil, ioutil.Discard)
+			So(err, ShouldBeNil)
+			So(cfg, ShouldResemble, Default())
+			So(cfg.Listen.Stdio, ShouldBeTrue)
+		})
+		Convey("Flags should be parsed", func() {
+			cfg, err := Load([]string{"-stdio=false", "-tcp", ":1", "-tcp", ":2", "-unix", "/tmp/sock",
+				"-http", ":3", "-read-only", "-log-level", "debug"}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			So(cfg.Listen, ShouldResemble, Listen{TCP: []string{":1", ":2"}, HTTP: []string{":3"}, Unix: []string{"/tmp/sock"}, UnixMode: "0660"})
+			So(cfg.Protocol.ReadOnly, ShouldBeTrue)
+			So(cfg.Log.Level, ShouldEqual, "debug")
+		})
+		Convey("File should be read", func() {
+			path := writeFile(dir, `
+[listen]
+stdio = false
+tcp = [":6380"]
+
+[protocol]
+read_only = true
+
+[replication]
+follow = "leader:7000"
+backlog = 10
+
+[log]
+level = "warn"
+`)
+			cfg, err := Load([]string{"-config", path}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			So(cfg.Listen, ShouldResemble, Listen{TCP: []string{":6380"}, UnixMode: "0660"})
+			So(cfg.Replication, ShouldResemble, Replication{Follow: "leader:7000", Backlog: 10})
+			So(cfg.Log.Level, ShouldEqual, "warn")
+
+			Convey("Flags should override it", func() {
+				cfg, err := Load([]string{"-config", path, "-tcp", ":1", "-log-level", "error"}, ioutil.Discard)
+				So(err, ShouldBeNil)
+				So(cfg.Listen.TCP, ShouldResemble, []string{":1"})
+				So(cfg.Log.Level, ShouldEqual, "error")
+				So(cfg.Replication.Backlog, ShouldEqual, 10)
+			})
+		})
+		Convey("YAML file should be read", func() {
+			hash, err := protocol.HashPassword("secret")
+			So(err, ShouldBeNil)
+			path := writeNamedFile(dir, "memdb.yaml", `
+listen:
+  stdio: false
+  tcp: [":6380"]
+  unix_allow_uids: [1000]
+protocol:
+  idle_timeout: 5m
+replication:
+  follow: leader:7000
+  backlog: 10
+storage:
+  max_memory: 1024
+  sweep_interval: 2s
+users:
+  - name: app1
+    password_hash: "`+hash+`"
+    keys: ["app1:*"]
+`)
+			cfg, err := LoadFile(path)
+			So(err, ShouldBeNil)
+			So(cfg.Listen, ShouldResemble, Listen{TCP: []string{":6380"}, UnixMode: "0660", UnixAllowUIDs: []uint32{1000}})
+			So(cfg.Protocol.IdleTimeout.Duration, ShouldEqual, 5*time.Minute)
+			So(cfg.Replication, ShouldResemble, Replication{Follow: "leader:7000", Backlog: 10})
+			So(cfg.Storage, ShouldResemble, Storage{MaxMemory: 1024, SweepInterval: Duration{2 * time.Second}, MaxDatabases: storage.DefaultMaxDatabases})
+			So(cfg.Users[0].Keys, ShouldResemble, []string{"app1:*"})
+
+			Convey("Unknown keys should be rejected", func() {
+				path := writeNamedFile(dir, "memdb.yml", "listen:\n  tpc: [\":1\"]\n")
+				_, err := Load([]string{"-config", path}, ioutil.Discard)
+				So(merry.Is(err, ErrInvalid), ShouldBeTrue)
+				So(err.Error(), ShouldContainSubstring, "tpc")
+			})
+			Convey("Malformed file should be rejected", func() {
+				path := writeNamedFile(dir, "memdb.yml", "listen: [\n")
+				_, err := Load([]string{"-config", path}, ioutil.Discard)
+				So(merry.Is(err, ErrInvalid), ShouldBeTrue)
+			})
+		})
+		Convey("Unix socket options should be parsed", func() {
+			path := writeFile(dir, "[listen]\nunix = [\"/tmp/sock\"]\nunix_mode = \"0600\"\nunix_allow_gids = [100]\n")
+			cfg, err := Load([]string{"-config", path, "-unix-allow-uid", "1000", "-unix-allow-uid", "1001"}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			So(cfg.UnixFileMode(), ShouldEqual, os.FileMode(0600))
+			pcfg := cfg.ProtocolConfig(nil)
+			So(pcfg.AllowUIDs, ShouldResemble, []uint32{1000, 1001})
+			So(pcfg.AllowGIDs, ShouldResemble, []uint32{100})
+		})
+		Convey("Users should be read", func() {
+			hash, err := protocol.HashPassword("secret")
+			So(err, ShouldBeNil)
+			path := writeFile(dir, `
+[[users]]
+name = "app1"
+password_hash = "`+hash+`"
+commands = ["@read", "@tx"]
+deny_commands = ["NUMEQUALTO"]
+keys = ["app1:*"]
+`)
+			cfg, err := Load([]string{"-config", path}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			So(cfg.ProtocolConfig(nil).Users, ShouldResemble, []protocol.User{{
+				Name:         "app1",
+				PasswordHash: hash,
+				ACL: protocol.ACL{
+					Commands:     []string{"@read", "@tx"},
+					DenyCommands: []string{"NUMEQUALTO"},
+					Keys:         []string{"app1:*"},
+				},
+			}})
+
+			Convey("Duplicate users should be rejected", func() {
+				path := writeFile(dir, "[[users]]\nname = \"a\"\npassword_hash = \""+hash+"\"\n"+
+					"[[users]]\nname = \"a\"\npassword_hash = \""+hash+"\"\n")
+				_, err := Load([]string{"-config", path}, ioutil.Discard)
+				So(merry.Is(err, ErrInvalid), ShouldBeTrue)
+			})
+			Convey("Plain passwords should be rejected", func() {
+				path := writeFile(dir, "[[users]]\nname = \"a\"\npassword_hash = \"secret\"\n")
+				_, err := Load([]string{"-config", path}, ioutil.Discard)
+				So(merry.Is(err, ErrInvalid), ShouldBeTrue)
+			})
+		})
+		Convey("TLS should be configured", func() {
+			cfg, err := Load(nil, ioutil.Discard)
+			So(err, ShouldBeNil)
+			So(cfg.TLSFiles(), ShouldBeNil)
+
+			path := writeFile(dir, "[tls]\ncert_file = \"a.crt\"\nkey_file = \"a.key\"\n")
+			cfg, err = Load([]string{"-config", path, "-tls-client-ca", "ca.crt"}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			So(cfg.TLSFiles(), ShouldResemble, &protocol.TLSFiles{CertFile: "a.crt", KeyFile: "a.key", ClientCAFile: "ca.crt"})
+		})
+		Convey("History should be configured", func() {
+			cfg, err := Load(nil, ioutil.Discard)
+			So(err, ShouldBeNil)
+			So(cfg.StorageConfig().Retention.IsEnabled(), ShouldBeFalse)
+
+			path := writeFile(dir, "[history]\nversions = 10\nage = \"1h30m\"\n")
+			cfg, err = Load([]string{"-config", path, "-history-versions", "5"}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			So(cfg.StorageConfig(), ShouldResemble, storage.Config{
+				Retention:    storage.Retention{Versions: 5, Age: 90 * time.Minute},
+				MaxDatabases: storage.DefaultMaxDatabases,
+			})
+
+			path = writeFile(dir, "[storage]\nmax_memory = 1024\n")
+			cfg, err = Load([]string{"-config", path}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			So(cfg.StorageConfig().MaxMemory, ShouldEqual, uint64(1024))
+			cfg, err = Load([]string{"-config", path, "-max-memory", "0"}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			So(cfg.StorageConfig().MaxMemory, ShouldEqual, uint64(0))
+			So(cfg.SweepInterval(), ShouldEqual, time.Second)
+
+			path = writeFile(dir, "[storage]\nsweep_interval = \"100ms\"\n")
+			cfg, err = Load([]string{"-config", path}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			So(cfg.SweepInterval(), ShouldEqual, 100*time.Millisecond)
+			cfg, err = Load([]string{"-config", path, "-follow", ":1"}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			So(cfg.SweepInterval(), ShouldEqual, time.Duration(0))
+
+			path = writeFile(dir, "[history]\nage = \"long\"\n")
+			_, err = Load([]string{"-config", path}, ioutil.Discard)
+			So(merry.Is(err, ErrInvalid), ShouldBeTrue)
+		})
+		Convey("Persistence should be configured", func() {
+			cfg, err := Load(nil, ioutil.Discard)
+			So(err, ShouldBeNil)
+			So(cfg.IsPersistent(), ShouldBeFalse)
+
+			path := writeFile(dir, "[persistence]\nsnapshot_path = \"memdb.snapshot\"\nfsync = \"always\"\n")
+			cfg, err = Load([]string{"-config", path, "-journal-path", "memdb.journal"}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			So(cfg.IsPersistent(), ShouldBeTrue)
+			So(cfg.PersistenceOptions(), ShouldResemble, persistence.Options{
+				SnapshotPath: "memdb.snapshot",
+				JournalPath:  "memdb.journal",
+				Fsync:        persistence.FsyncAlways,
+			})
+		})
+		Convey("Slow log should be configured", func() {
+			cfg, err := Load(nil, ioutil.Discard)
+			So(err, ShouldBeNil)
+			So(cfg.SlowLog, ShouldResemble, SlowLog{Threshold: Duration{10 * time.Millisecond}, MaxLen: 128})
+
+			path := writeFile(dir, "[slowlog]\nthreshold = \"1s\"\nmax_len = 10\n")
+			cfg, err = Load([]string{"-config", path, "-slowlog-max-len", "0"}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			So(cfg.SlowLog, ShouldResemble, SlowLog{Threshold: Duration{time.Second}, MaxLen: 0})
+			So(cfg.ProtocolConfig(nil).Metrics, ShouldNotBeNil)
+
+			_, err = Load([]string{"-slowlog-threshold", "-1s"}, ioutil.Discard)
+			So(merry.Is(err, ErrInvalid), ShouldBeTrue)
+		})
+		Convey("Dialect should be configured", func() {
+			cfg, err := Load(nil, ioutil.Discard)
+			So(err, ShouldBeNil)
+			So(cfg.ProtocolConfig(nil).Dialect, ShouldEqual, protocol.DialectLine)
+
+			path := writeFile(dir, "[protocol]\ndialect = \"resp\"\n")
+			cfg, err = Load([]string{"-config", path}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			So(cfg.ProtocolConfig(nil).Dialect, ShouldEqual, protocol.DialectRESP)
+		})
+		Convey("Idle timeout should be configured", func() {
+			path := writeFile(dir, "[protocol]\nidle_timeout = \"5m\"\n")
+			cfg, err := Load([]string{"-config", path}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			So(cfg.ProtocolConfig(nil).IdleTimeout, ShouldEqual, 5*time.Minute)
+
+			cfg, err = Load([]string{"-config", path, "-idle-timeout", "0"}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			So(cfg.Protocol.IdleTimeout.Duration, ShouldEqual, 0)
+
+			_, err = Load([]string{"-idle-timeout", "-1s"}, ioutil.Discard)
+			So(merry.Is(err, ErrInvalid), ShouldBeTrue)
+		})
+		Convey("Follower should be read-only", func() {
+			cfg, err := Load([]string{"-follow", "leader:7000"}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			So(cfg.ProtocolConfig(nil).ReadOnly, ShouldBeTrue)
+		})
+		Convey("Unknown keys should be rejected", func() {
+			path := writeFile(dir, "[listen]\ntpc = [\":1\"]\n[foo]\nbar = 1\n")
+			_, err := Load([]string{"-config", path}, ioutil.Discard)
+			So(merry.Is(err, ErrInvalid), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, "foo.bar, listen.tpc")
+		})
+		Convey("Malformed file should be rejected", func() {
+			path := writeFile(dir, "[listen\n")
+			_, err := Load([]string{"-config", path}, ioutil.Discard)
+			So(merry.Is(err, ErrInvalid), ShouldBeTrue)
+		})
+		Convey("Missing file should be rejected", func() {
+			_, err := Load([]string{"-config", filepath.Join(dir, "nope.toml")}, ioutil.Discard)
+			So(merry.Is(err, ErrInvalid), ShouldBeTrue)
+		})
+		Convey("Unknown flags should be rejected", func() {
+			_, err := Load([]string{"-nope"}, ioutil.Discard)
+			So(merry.Is(err, ErrInvalid), ShouldBeTrue)
+		})
+		Convey("Invalid values should be rejected", func() {
+			for _, args := range [][]string{
+				{"-stdio=false"},
+				{"-dialect", "xml"},
+				{"-unix-mode", "rw"},
+				{"-tls-cert", "a.crt"},
+				{"-tls-client-ca", "ca.crt"},
+				{"-unix-allow-uid", "-1"},
+				{"-log-level", "loud"},
+				{"-replication-backlog", "0"},
+				{"-replication-listen", ":1", "-follow", ":2"},
+				{"-history-versions", "-1"},
+				{"-history-age", "-1s"},
+				{"-sweep-interval", "-1s"},
+				{"-max-databases", "0"},
+				{"-fsync", "sometimes"},
+				{"-journal-path", "memdb.journal", "-follow", ":2"},
+			} {
+				_, err := Load(args, ioutil.Discard)
+				So(merry.Is(err, ErrInvalid), ShouldBeTrue)
+			}
+		})
+	})
+}
@@ -2,17 +2,51 @@
 
 The commands are red from stdin and written to stdout.
 
+Flags and an optional TOML or YAML config file (-config path) can add TCP, HTTP and unix socket listeners,
+disable stdin (-stdio=false), serve RESP on the listeners (-dialect resp), make the database read-only, set up the replication,
+persistence, memory limit, expiration sweeps and the log level; flags override the file. Run with -help to list the flags.
+TCP listeners serve TLS if the certificate is configured; it is reloaded on SIGHUP.
+
+Script files can be executed and verified against the expected output:
+
+  go-simple-memdb run [-load init.txt] script.txt
+  go-simple-memdb verify [-load init.txt] script.txt expected.txt
+
+Users' password hashes are printed by the hash-password command reading the password from stdin.
+
+If stdin is a terminal, the interactive console is started: its prompt shows the number of
+transaction blocks in progress, command names and known keys are completed on Tab, and
+the history is kept in ~/.memdb_history.
+
 Protocol specification
 
   SET name value – Set the variable name to the value value. Neither variable names nor values will contain spaces.
-  GET name – Print out the value of the variable name, or NULL if that variable is not set.
+  GET name – Print out the value of the variable name, or NULL if that variable is not set. Print BINARY VALUE if the value has line breaks; GETB prints it.
   UNSET name – Unset the variable name, making it just like that variable was never set.
   NUMEQUALTO value – Print out the number of variables that are currently set to value. If no variables equal that value, print 0.
 
   BEGIN – Open a new transaction block. Transaction blocks can be nested; a BEGIN can be issued inside of an existing block.
-  ROLLBACK – Undo all of the commands issued in the most recent transaction block, and close the block. Print nothing if successful, or print NO TRANSACTION if no transaction is in progress.
+  BEGIN READONLY – Open a new read-only transaction block. Writes inside of it print READONLY; nested blocks are read-only too. Other options print SYNTAX ERROR.
+  ROLLBACK – Undo all of the commands issued in the most recent transaction block (including its savepoints), and close the block. Print nothing if successful, or print NO TRANSACTION if no transaction is in progress.
+  SAVEPOINT name – Create a named savepoint in the current transaction block. Print NO TRANSACTION if no transaction is in progress.
+  ROLLBACK TO name – Undo the commands issued since the savepoint, keeping it and the transaction open. Print NO SAVEPOINT if there's no such savepoint.
+  RELEASE name – Remove the savepoint, keeping the changes made since it. Print NO SAVEPOINT if there's no such savepoint.
   COMMIT – Close all open transaction blocks, permanently applying the changes made in them. Print nothing if successful, or print NO TRANSACTION if no transaction is in progress.
 
+  SELECT db – Switch to the database (numbered or named); connections start in database 0. Print TOO MANY DATABASES if there are max_databases of them already.
+  SWAPDB db1 db2 – Swap the variables of the databases.
+  FLUSHDB – Unset all the variables of the current database.
+  FLUSHALL – Unset all the variables of every database.
+  EXPIRE name seconds – Set the variable to expire; expired variables are unset by the next sweep.
+  TTL name – Print out the seconds left until the variable expires, -1 if it doesn't expire, or NULL if it's not set.
+  PERSIST name – Remove the variable's expiration.
+  Database commands print NOT ALLOWED IN TRANSACTION inside of transaction blocks.
+
+  COMMAND [name] – Print out the number of commands, then a line per command: its name, minimal number of arguments and flags.
+  HELP [name] – Describe the commands' syntax.
+  AUTH user password – Authenticate as the user configured in the config file, print WRONGPASS on failure.
+  If there are any users, other commands print NOAUTH until authenticated and NOPERM if the user's ACL denies them.
+
   END – Exit the program.
 
 */
@@ -0,0 +1,87 @@
+/*
+Package logging provides a minimal leveled logger.
+
+Nil *Logger is valid and discards everything, so the packages
+can log unconditionally.
+*/
+package logging
+
+import (
+	"fmt"
+	"github.com/ansel1/merry"
+	"io"
+	"log"
+	"strings"
+)
+
+// Level is the logging level.
+type Level int
+
+// Logging levels, from the most verbose one.
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// String implements fmt.Stringer.
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ErrUnknownLevel is returned when parsing unknown level's name.
+var ErrUnknownLevel = merry.New("Unknown log level.")
+
+// ParseLevel returns the level by its name.
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return Level(i), nil
+		}
+	}
+	return Debug, ErrUnknownLevel.Here().Appendf("%q, should be one of %v", name, strings.Join(levelNames, ", "))
+}
+
+// Logger writes the messages of its level and above.
+type Logger struct {
+	l     *log.Logger
+	level Level
+}
+
+// New creates new Logger writing to w.
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{l: log.New(w, "", log.LstdFlags), level: level}
+}
+
+// Debugf logs the message with Debug level.
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(Debug, format, args...)
+}
+
+// Infof logs the message with Info level.
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(Info, format, args...)
+}
+
+// Warnf logs the message with Warn level.
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(Warn, format, args...)
+}
+
+// Errorf logs the message with Error level.
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(Error, format, args...)
+}
+
+func (l *Logger) logf(level Level, format string, args ...interface{}) {
+	if l == nil || level < l.level {
+		return
+	}
+	_ = l.l.Output(3, strings.ToUpper(level.String())+" "+fmt.Sprintf(format, args...))
+}
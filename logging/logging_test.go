@@ -0,0 +1,40 @@
+package logging
+
+import (
+	"bytes"
+	"github.com/ansel1/merry"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	Convey("With logger", t, func() {
+		buf := &bytes.Buffer{}
+		l := New(buf, Warn)
+
+		Convey("Should skip lower levels", func() {
+			l.Debugf("debug")
+			l.Infof("info")
+			So(buf.String(), ShouldEqual, "")
+		})
+		Convey("Should write its level and above", func() {
+			l.Warnf("warn %v", 1)
+			l.Errorf("error %v", 2)
+			So(buf.String(), ShouldContainSubstring, "WARN warn 1\n")
+			So(buf.String(), ShouldContainSubstring, "ERROR error 2\n")
+		})
+		Convey("Nil logger should discard", func() {
+			var l *Logger
+			l.Errorf("error")
+		})
+	})
+
+	Convey("ParseLevel", t, func() {
+		got, err := ParseLevel("INFO")
+		So(err, ShouldBeNil)
+		So(got, ShouldEqual, Info)
+
+		_, err = ParseLevel("verbose")
+		So(merry.Is(err, ErrUnknownLevel), ShouldBeTrue)
+	})
+}
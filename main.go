@@ -1,14 +1,188 @@
 package main
 
 import (
+	"bufio"
+	"fmt"
+	"github.com/utrack/go-simple-memdb/config"
+	"github.com/utrack/go-simple-memdb/logging"
+	"github.com/utrack/go-simple-memdb/persistence"
 	"github.com/utrack/go-simple-memdb/protocol"
+	"github.com/utrack/go-simple-memdb/repl"
+	"github.com/utrack/go-simple-memdb/replication"
 	"github.com/utrack/go-simple-memdb/storage"
+	"net"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
-	db := storage.New()
-	// Create a protocol socket and link it to stdin/stdout
-	sock := protocol.NewSocket(db)
+	if len(os.Args) > 1 && (os.Args[1] == "run" || os.Args[1] == "verify") {
+		os.Exit(runScript(os.Args[1], os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		os.Exit(hashPassword())
+	}
+
+	cfg, err := config.Load(os.Args[1:], os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logger := logging.New(os.Stderr, cfg.LogLevel())
+
+	reg := storage.NewRegistryConfig(cfg.StorageConfig())
+	if err = run(reg, cfg, logger); err != nil {
+		logger.Errorf("%v", err)
+		os.Exit(1)
+	}
+}
+
+// run serves the databases as configured until stdin is closed
+// or, if stdin isn't used, until the process is signalled.
+// Database "0" is persisted and replicated.
+func run(reg *storage.Registry, cfg config.Config, logger *logging.Logger) error {
+	db := reg.Get("0")
+	if cfg.IsPersistent() {
+		store, err := persistence.Open(db, cfg.PersistenceOptions())
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := store.Close(); err != nil {
+				logger.Errorf("Saving the database failed: %v", err)
+			}
+		}()
+		logger.Infof("Restored the database to version %v", db.Seq())
+	}
+	var replicationInfo []protocol.ReplicationInfo
+	if cfg.Replication.Follow != "" {
+		follower := replication.NewFollower(db)
+		defer follower.Close()
+		go func() { _ = follower.Follow(cfg.Replication.Follow) }()
+		logger.Infof("Following %v", cfg.Replication.Follow)
+		replicationInfo = append(replicationInfo, follower)
+	}
+	if cfg.Replication.Listen != "" {
+		l, err := net.Listen("tcp", cfg.Replication.Listen)
+		if err != nil {
+			return err
+		}
+		leader := replication.NewLeader(db, cfg.Replication.Backlog)
+		defer leader.Close()
+		go func() { _ = leader.Serve(l) }()
+		logger.Infof("Streaming changes on %v", l.Addr())
+		replicationInfo = append(replicationInfo, leader)
+	}
+
+	if interval := cfg.SweepInterval(); interval > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go sweepExpired(reg, interval, stop)
+	}
+
+	var tlsReloader *protocol.TLSReloader
+	if files := cfg.TLSFiles(); files != nil {
+		var err error
+		if tlsReloader, err = protocol.NewTLSReloader(*files); err != nil {
+			return err
+		}
+		go reloadTLS(tlsReloader, logger)
+	}
+
+	protocolCfg := cfg.ProtocolConfig(logger)
+	protocolCfg.Replication = replicationInfo
+	srv := protocol.NewRegistryServer(reg, protocolCfg)
+	defer srv.Close()
+	for _, addr := range cfg.Listen.TCP {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		if tlsReloader != nil {
+			l = tlsReloader.Listener(l)
+		}
+		go func() { _ = srv.Serve(l) }()
+	}
+	for _, addr := range cfg.Listen.HTTP {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		if tlsReloader != nil {
+			l = tlsReloader.Listener(l)
+		}
+		go func() { _ = srv.ServeHTTPListener(l) }()
+	}
+	for _, path := range cfg.Listen.Unix {
+		l, err := protocol.ListenUnix(path, cfg.UnixFileMode())
+		if err != nil {
+			return err
+		}
+		go func() { _ = srv.Serve(l) }()
+	}
+
+	if !cfg.Listen.Stdio {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		logger.Infof("Stopping on %v", <-sig)
+		return nil
+	}
+
+	// Link a protocol socket to stdin/stdout
+	stdioCfg := protocolCfg
+	stdioCfg.Dialect = protocol.DialectLine
+	sock := protocol.NewRegistrySocket(reg, stdioCfg)
+	if repl.IsTerminal(os.Stdin) {
+		return repl.New(sock, repl.DefaultHistoryPath()).Run(os.Stdin, os.Stdout)
+	}
 	sock.Process(os.Stdin, os.Stdout)
+	return nil
+}
+
+// reloadTLS reloads the TLS files on SIGHUP.
+func reloadTLS(r *protocol.TLSReloader, logger *logging.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := r.Reload(); err != nil {
+			logger.Errorf("TLS reload failed, keeping the old certificate: %v", err)
+			continue
+		}
+		logger.Infof("TLS certificate reloaded")
+	}
+}
+
+// sweepExpired unsets the databases' expired variables every interval
+// until stopped.
+func sweepExpired(reg *storage.Registry, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			reg.SweepExpired()
+		}
+	}
+}
+
+// hashPassword prints the hash of the password read from stdin
+// for the users' config and returns the exit code.
+func hashPassword() int {
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		fmt.Fprintln(os.Stderr, "hash-password: password expected on stdin")
+		return 2
+	}
+	hash, err := protocol.HashPassword(strings.TrimRight(password, "\r\n"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(hash)
+	return 0
 }
@@ -0,0 +1,27 @@
+/*
+Package persistence keeps the root storage on the disk.
+
+Store writes the root's snapshot by Save and Close, and appends every
+change set committed after it to the journal, flushing the journal
+by the Fsync policy. Open restores the root from the snapshot, then
+applies the journal's change sets following it. Save compacts the journal,
+dropping the change sets included in the new snapshot.
+
+Variables' expiration times are written by the snapshots only:
+EXPIRE and PERSIST are not change sets, the sweeps that unset the expired
+variables are.
+
+Basic usage
+
+  root := storage.New()
+  store, err := persistence.Open(root, persistence.Options{
+      SnapshotPath: "memdb.snapshot",
+      JournalPath:  "memdb.journal",
+      Fsync:        persistence.FsyncEverySec,
+  })
+  if err != nil {
+      return err
+  }
+  defer store.Close()
+*/
+package persistence
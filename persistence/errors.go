@@ -0,0 +1,15 @@
+package persistence
+
+import (
+	"github.com/ansel1/merry"
+)
+
+// ErrCorrupt is returned when the snapshot or the journal can't be read,
+// or the journal's change sets don't follow the snapshot.
+var ErrCorrupt = merry.New("Persisted data is corrupt.")
+
+// ErrUnknownFsync is returned when parsing unknown fsync policy's name.
+var ErrUnknownFsync = merry.New("Unknown fsync policy.")
+
+// ErrClosed is returned when the store was closed.
+var ErrClosed = merry.New("Store was closed.")
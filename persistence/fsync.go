@@ -0,0 +1,40 @@
+package persistence
+
+import (
+	"fmt"
+)
+
+// Fsync is the policy of flushing the journal to the disk.
+type Fsync int
+
+// Fsync policies, from the most durable one.
+const (
+	// FsyncAlways flushes every change set before it's committed.
+	FsyncAlways Fsync = iota
+	// FsyncEverySec flushes the journal every second, so a crash
+	// loses up to a second of change sets.
+	FsyncEverySec
+	// FsyncNo leaves flushing to the OS.
+	FsyncNo
+)
+
+var fsyncNames = []string{"always", "everysec", "no"}
+
+// String implements fmt.Stringer.
+func (f Fsync) String() string {
+	if f < FsyncAlways || f > FsyncNo {
+		return fmt.Sprintf("fsync(%d)", int(f))
+	}
+	return fsyncNames[f]
+}
+
+// ParseFsync returns the fsync policy by its name:
+// always, everysec or no.
+func ParseFsync(name string) (Fsync, error) {
+	for i, n := range fsyncNames {
+		if n == name {
+			return Fsync(i), nil
+		}
+	}
+	return 0, ErrUnknownFsync.Here().Append(name)
+}
@@ -0,0 +1,399 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"github.com/ansel1/merry"
+	"github.com/utrack/go-simple-memdb/storage"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// syncInterval is the interval between the journal's flushes
+// with FsyncEverySec.
+const syncInterval = time.Second
+
+// Options configure where and how the root is persisted.
+type Options struct {
+	// SnapshotPath is the file of the root's snapshot written by Save.
+	// Snapshot is not written if it's empty.
+	SnapshotPath string
+	// JournalPath is the file the change sets committed after
+	// the snapshot are appended to. Change sets are not written if it's empty.
+	JournalPath string
+	// Fsync is the policy of flushing the journal.
+	Fsync Fsync
+}
+
+// Store persists the root storage's snapshot and journal.
+type Store struct {
+	root storage.Root
+	opts Options
+
+	// saveMu serializes the saves.
+	saveMu sync.Mutex
+
+	mu      sync.Mutex
+	journal *os.File
+	// isDirty is true if the journal was written since it was flushed.
+	isDirty bool
+	// err is the first error writing the journal;
+	// change sets are not written after it.
+	err error
+	// dropped is the sequence number of the last change set
+	// not written because of the err.
+	dropped  uint64
+	isClosed bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Open restores the root from the snapshot and the journal, if they exist,
+// then appends every change set committed to the root to the journal.
+// ErrCorrupt is returned if they can't be read. Incomplete change set
+// at the end of the journal, e.g. written during a crash, is dropped.
+// Open should be called before the root is written to.
+func Open(root storage.Root, opts Options) (*Store, error) {
+	ret := &Store{root: root, opts: opts, done: make(chan struct{})}
+	if err := ret.restore(); err != nil {
+		return nil, err
+	}
+	if opts.JournalPath != "" {
+		journal, err := ret.replay()
+		if err != nil {
+			return nil, err
+		}
+		ret.journal = journal
+	}
+	root.OnCommit(ret.onCommit)
+	if ret.journal != nil && opts.Fsync == FsyncEverySec {
+		ret.wg.Add(1)
+		go ret.syncEverySec()
+	}
+	return ret, nil
+}
+
+// restore restores the root from the snapshot, if it exists.
+func (s *Store) restore() error {
+	if s.opts.SnapshotPath == "" {
+		return nil
+	}
+	f, err := os.Open(s.opts.SnapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	defer f.Close()
+
+	var snap storage.Snapshot
+	if err = gob.NewDecoder(bufio.NewReader(f)).Decode(&snap); err != nil {
+		return ErrCorrupt.Here().Appendf("%v: %v", s.opts.SnapshotPath, err)
+	}
+	s.root.Restore(snap)
+	return nil
+}
+
+// replay applies the journal's change sets that follow the root's ones
+// and returns the journal opened for appending.
+func (s *Store) replay() (*os.File, error) {
+	f, err := os.OpenFile(s.opts.JournalPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, merry.Wrap(err)
+	}
+	offset, err := readJournal(f, func(cs storage.ChangeSet) error {
+		if cs.Seq <= s.root.Seq() {
+			// Included in the snapshot
+			return nil
+		}
+		if err := s.root.Apply(cs); err != nil {
+			return ErrCorrupt.Here().Appendf("%v: %v", s.opts.JournalPath, err)
+		}
+		return nil
+	})
+	if err == nil {
+		// Drop the incomplete change set
+		err = f.Truncate(offset)
+	}
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, merry.Wrap(err)
+	}
+	return f, nil
+}
+
+// onCommit appends the root's change set to the journal.
+// It is called with root locked, so it mustn't call the root.
+func (s *Store) onCommit(cs storage.ChangeSet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.journal == nil || s.isClosed {
+		return
+	}
+	if s.err != nil {
+		s.dropped = cs.Seq
+		return
+	}
+	if s.err = writeRecord(s.journal, cs); s.err != nil {
+		s.dropped = cs.Seq
+		return
+	}
+	if s.opts.Fsync == FsyncAlways {
+		s.err = merry.Wrap(s.journal.Sync())
+		return
+	}
+	s.isDirty = true
+}
+
+// syncEverySec flushes the journal every syncInterval until the store is closed.
+func (s *Store) syncEverySec() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			if s.isDirty && s.err == nil {
+				s.err = merry.Wrap(s.journal.Sync())
+				s.isDirty = false
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Err returns the first error writing the journal.
+// Change sets committed after it are not written to the journal
+// until Save writes the snapshot including them.
+func (s *Store) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Save writes the root's snapshot, replacing the previous one atomically,
+// and drops the change sets included in it from the journal.
+// Journal is just flushed if there's no SnapshotPath.
+func (s *Store) Save() error {
+	s.mu.Lock()
+	isClosed := s.isClosed
+	s.mu.Unlock()
+	if isClosed {
+		return ErrClosed.Here()
+	}
+	return s.save()
+}
+
+func (s *Store) save() error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	if s.opts.SnapshotPath == "" {
+		return s.sync()
+	}
+	snap := s.root.Snapshot()
+	err := writeFile(s.opts.SnapshotPath, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(snap)
+	})
+	if err != nil {
+		return err
+	}
+	return s.compact(snap.Seq)
+}
+
+// sync flushes the journal.
+func (s *Store) sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.journal == nil {
+		return nil
+	}
+	s.isDirty = false
+	return merry.Wrap(s.journal.Sync())
+}
+
+// compact rewrites the journal, keeping the change sets after the sequence number.
+// Change sets committed meanwhile wait for it.
+func (s *Store) compact(seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.journal == nil {
+		return nil
+	}
+
+	if _, err := s.journal.Seek(0, io.SeekStart); err != nil {
+		return merry.Wrap(err)
+	}
+	var kept []storage.ChangeSet
+	_, err := readJournal(s.journal, func(cs storage.ChangeSet) error {
+		if cs.Seq > seq {
+			kept = append(kept, cs)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = writeFile(s.opts.JournalPath, func(w io.Writer) error {
+		for _, cs := range kept {
+			if err := writeRecord(w, cs); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	journal, err := os.OpenFile(s.opts.JournalPath, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		// The change sets can't be persisted anymore
+		s.err = merry.Wrap(err)
+		return s.err
+	}
+	_ = s.journal.Close()
+	s.journal = journal
+	s.isDirty = false
+	if s.dropped <= seq {
+		// The snapshot includes the change sets not written
+		s.err = nil
+	}
+	return nil
+}
+
+// Close stops writing the journal and saves the root.
+// Change sets committed after it are not persisted.
+// The first error writing the journal is returned, if any.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	if s.isClosed {
+		s.mu.Unlock()
+		return ErrClosed.Here()
+	}
+	s.isClosed = true
+	s.mu.Unlock()
+
+	close(s.done)
+	s.wg.Wait()
+
+	err := s.save()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		err = s.err
+	}
+	if s.journal != nil {
+		if closeErr := s.journal.Close(); err == nil {
+			err = merry.Wrap(closeErr)
+		}
+	}
+	return err
+}
+
+// writeFile replaces the file atomically with the contents written by the func,
+// flushing them to the disk first.
+func writeFile(path string, write func(io.Writer) error) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return merry.Wrap(err)
+	}
+	w := bufio.NewWriter(f)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return merry.Wrap(err)
+	}
+	// Persist the rename
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
+	}
+	return nil
+}
+
+// Journal's records are the gob-encoded change sets, each one preceded
+// by its length and CRC-32 checksum, so the incomplete records
+// can be told from the corrupt ones.
+
+// recordHeader is the length of the record's length and checksum.
+const recordHeader = 8
+
+// writeRecord writes the change set's record with a single write.
+func writeRecord(w io.Writer, cs storage.ChangeSet) error {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, recordHeader))
+	if err := gob.NewEncoder(&buf).Encode(cs); err != nil {
+		return merry.Wrap(err)
+	}
+	ret := buf.Bytes()
+	payload := ret[recordHeader:]
+	binary.BigEndian.PutUint32(ret, uint32(len(payload)))
+	binary.BigEndian.PutUint32(ret[4:], crc32.ChecksumIEEE(payload))
+	_, err := w.Write(ret)
+	return merry.Wrap(err)
+}
+
+// readJournal passes the journal's change sets to the func and returns
+// the offset after the last complete record. ErrCorrupt is returned
+// if the record is malformed.
+func readJournal(r io.Reader, f func(storage.ChangeSet) error) (int64, error) {
+	br := bufio.NewReader(r)
+	var offset int64
+	header := make([]byte, recordHeader)
+	for {
+		if _, err := io.ReadFull(br, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return offset, nil
+		} else if err != nil {
+			return offset, merry.Wrap(err)
+		}
+		// Corrupt length shouldn't allocate more than the journal's size
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, br, int64(binary.BigEndian.Uint32(header))); err == io.EOF {
+			return offset, nil
+		} else if err != nil {
+			return offset, merry.Wrap(err)
+		}
+		payload := buf.Bytes()
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			return offset, ErrCorrupt.Here().Appendf("checksum mismatch at offset %v", offset)
+		}
+
+		var cs storage.ChangeSet
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&cs); err != nil {
+			return offset, ErrCorrupt.Here().Appendf("offset %v: %v", offset, err)
+		}
+		if err := f(cs); err != nil {
+			return offset, err
+		}
+		offset += int64(recordHeader + len(payload))
+	}
+}
@@ -0,0 +1,176 @@
+package persistence
+
+import (
+	"github.com/ansel1/merry"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/utrack/go-simple-memdb/storage"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	Convey("With temp dir", t, func() {
+		dir, err := ioutil.TempDir("", "memdb-persistence")
+		So(err, ShouldBeNil)
+		Reset(func() { os.RemoveAll(dir) })
+		opts := Options{
+			SnapshotPath: filepath.Join(dir, "snapshot"),
+			JournalPath:  filepath.Join(dir, "journal"),
+		}
+
+		open := func(opts Options) (storage.Root, *Store) {
+			root := storage.New()
+			store, err := Open(root, opts)
+			So(err, ShouldBeNil)
+			return root, store
+		}
+		get := func(root storage.Root, key string) string {
+			ret, err := root.Get(key)
+			if merry.Is(err, storage.ErrNotFound) {
+				return "NULL"
+			}
+			So(err, ShouldBeNil)
+			return ret
+		}
+
+		Convey("Missing files should open empty root", func() {
+			root, store := open(opts)
+			So(root.Seq(), ShouldEqual, uint64(0))
+			So(store.Close(), ShouldBeNil)
+			So(merry.Is(store.Close(), ErrClosed), ShouldBeTrue)
+			So(merry.Is(store.Save(), ErrClosed), ShouldBeTrue)
+		})
+
+		Convey("With committed changes", func() {
+			root, store := open(opts)
+			root.Set("a", "10")
+			root.Set("b", "20")
+			tx := root.Tx()
+			tx.Set("c", "30")
+			tx.Unset("a")
+			_, err := tx.Commit()
+			So(err, ShouldBeNil)
+			So(root.Expire("b", time.Hour), ShouldBeTrue)
+
+			Convey("Journal should restore them after crash", func() {
+				// No Close, the snapshot is not written
+				So(store.Err(), ShouldBeNil)
+				other, otherStore := open(opts)
+				defer otherStore.Close()
+				So(other.Seq(), ShouldEqual, uint64(3))
+				So([]string{get(other, "a"), get(other, "b"), get(other, "c")}, ShouldResemble, []string{"NULL", "20", "30"})
+			})
+
+			Convey("Close should save the snapshot and compact the journal", func() {
+				So(store.Close(), ShouldBeNil)
+				info, err := os.Stat(opts.JournalPath)
+				So(err, ShouldBeNil)
+				So(info.Size(), ShouldEqual, 0)
+
+				other, otherStore := open(opts)
+				So(other.Seq(), ShouldEqual, uint64(3))
+				So(get(other, "b"), ShouldEqual, "20")
+				_, ok, _ := other.TTL("b")
+				So(ok, ShouldBeTrue)
+
+				Convey("Journal should keep the changes after the snapshot", func() {
+					other.Set("d", "40")
+					other.Unset("c")
+					So(otherStore.Err(), ShouldBeNil)
+
+					last, lastStore := open(opts)
+					defer lastStore.Close()
+					So(last.Seq(), ShouldEqual, uint64(5))
+					So([]string{get(last, "c"), get(last, "d")}, ShouldResemble, []string{"NULL", "40"})
+				})
+			})
+
+			Convey("Save should drop the saved change sets from the journal", func() {
+				So(store.Save(), ShouldBeNil)
+				root.Set("d", "40")
+				var seqs []uint64
+				f, err := os.Open(opts.JournalPath)
+				So(err, ShouldBeNil)
+				defer f.Close()
+				_, err = readJournal(f, func(cs storage.ChangeSet) error {
+					seqs = append(seqs, cs.Seq)
+					return nil
+				})
+				So(err, ShouldBeNil)
+				So(seqs, ShouldResemble, []uint64{4})
+			})
+
+			Convey("Incomplete change set should be dropped", func() {
+				info, err := os.Stat(opts.JournalPath)
+				So(err, ShouldBeNil)
+				So(os.Truncate(opts.JournalPath, info.Size()-3), ShouldBeNil)
+
+				other, otherStore := open(opts)
+				So(other.Seq(), ShouldEqual, uint64(2))
+				So(get(other, "a"), ShouldEqual, "10")
+
+				// Next change sets follow the complete ones
+				other.Set("e", "50")
+				So(otherStore.Err(), ShouldBeNil)
+				last, lastStore := open(opts)
+				defer lastStore.Close()
+				So(last.Seq(), ShouldEqual, uint64(3))
+				So(get(last, "e"), ShouldEqual, "50")
+			})
+
+			Convey("Corrupt journal should be rejected", func() {
+				data, err := ioutil.ReadFile(opts.JournalPath)
+				So(err, ShouldBeNil)
+				data[recordHeader] ^= 0xff
+				So(ioutil.WriteFile(opts.JournalPath, data, 0600), ShouldBeNil)
+
+				_, err = Open(storage.New(), opts)
+				So(merry.Is(err, ErrCorrupt), ShouldBeTrue)
+			})
+
+			Convey("Corrupt snapshot should be rejected", func() {
+				So(ioutil.WriteFile(opts.SnapshotPath, []byte("nope"), 0600), ShouldBeNil)
+				_, err = Open(storage.New(), opts)
+				So(merry.Is(err, ErrCorrupt), ShouldBeTrue)
+			})
+		})
+
+		Convey("Journal should be enough to restore the root", func() {
+			opts.SnapshotPath = ""
+			opts.Fsync = FsyncAlways
+			root, store := open(opts)
+			root.Set("a", "10")
+			So(store.Close(), ShouldBeNil)
+
+			other, otherStore := open(opts)
+			defer otherStore.Close()
+			So(get(other, "a"), ShouldEqual, "10")
+		})
+
+		Convey("Snapshot should be enough to restore the root", func() {
+			opts.JournalPath = ""
+			root, store := open(opts)
+			root.Set("a", "10")
+			So(store.Close(), ShouldBeNil)
+
+			other, otherStore := open(opts)
+			defer otherStore.Close()
+			So(get(other, "a"), ShouldEqual, "10")
+		})
+	})
+}
+
+func TestParseFsync(t *testing.T) {
+	Convey("Fsync policies should be parsed by their names", t, func() {
+		for _, f := range []Fsync{FsyncAlways, FsyncEverySec, FsyncNo} {
+			got, err := ParseFsync(f.String())
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, f)
+		}
+		_, err := ParseFsync("sometimes")
+		So(merry.Is(err, ErrUnknownFsync), ShouldBeTrue)
+	})
+}
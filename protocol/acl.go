@@ -0,0 +1,204 @@
+package protocol
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+// User is allowed to run the commands permitted by its ACL
+// after authenticating with AUTH.
+type User struct {
+	Name string
+	// PasswordHash is the bcrypt hash of the password, see HashPassword.
+	PasswordHash string
+	ACL          ACL
+}
+
+// ACL limits the commands and keys available to the user.
+// Commands flagged with FlagNoAuth are always allowed.
+type ACL struct {
+	// Commands are the allowed commands: their names (e.g. "GET"),
+	// categories named after the commands' flags (e.g. "@read", "@tx")
+	// or "@all".
+	Commands []string
+	// DenyCommands are the commands denied even if allowed by Commands,
+	// in the same format.
+	DenyCommands []string
+	// Keys are the patterns of the keys allowed for the commands flagged
+	// with FlagKey, e.g. "app1:*". '*' matches any sequence of characters
+	// and '?' matches a single character.
+	// Commands flagged with FlagKeyspace are denied
+	// unless a pattern allows all the keys, e.g. "*".
+	Keys []string
+}
+
+// dummyHash is compared to the password of unknown users,
+// so they take as long as the known ones to be rejected.
+const dummyHash = "$2a$10$3Y5nRdSItTm1vDFgpcv0GOkEI6sQJsLXisj7lA1Tt8BTZPVBARQdm"
+
+// HashPassword returns the password's bcrypt hash for User's PasswordHash.
+func HashPassword(password string) (string, error) {
+	ret, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(ret), err
+}
+
+// Validate returns ErrInvalidUser if the user's password hash
+// or ACL is malformed.
+func (u User) Validate() error {
+	if u.Name == "" {
+		return ErrInvalidUser.Here().Append("empty name")
+	}
+	if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+		return ErrInvalidUser.Here().Appendf("%v: password hash: %v", u.Name, err)
+	}
+	for _, rules := range [][]string{u.ACL.Commands, u.ACL.DenyCommands} {
+		for _, rule := range rules {
+			if strings.HasPrefix(rule, "@") && rule != "@all" && categoryFlag(rule) == 0 {
+				return ErrInvalidUser.Here().Appendf("%v: unknown command category %v", u.Name, rule)
+			}
+		}
+	}
+	return nil
+}
+
+// allowsCommand returns true if the ACL allows the command.
+func (a ACL) allowsCommand(c Command) bool {
+	if c.Flags&FlagNoAuth != 0 {
+		return true
+	}
+	return matchCommand(a.Commands, c) && !matchCommand(a.DenyCommands, c)
+}
+
+// allowsKey returns true if the key matches any of the ACL's patterns.
+func (a ACL) allowsKey(key string) bool {
+	for _, pattern := range a.Keys {
+		if matchPattern(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsAllKeys returns true if any of the ACL's patterns matches
+// every key, so the commands flagged with FlagKeyspace are allowed.
+func (a ACL) allowsAllKeys() bool {
+	for _, pattern := range a.Keys {
+		if pattern != "" && strings.Trim(pattern, "*") == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// matchCommand returns true if the command matches any of the rules.
+func matchCommand(rules []string, c Command) bool {
+	for _, rule := range rules {
+		switch {
+		case rule == "@all" || rule == c.Name:
+			return true
+		case strings.HasPrefix(rule, "@") && c.Flags&categoryFlag(rule) != 0:
+			return true
+		}
+	}
+	return false
+}
+
+// categoryFlag returns the flag of the category, e.g. FlagRead for "@read",
+// or 0 if there's no such category.
+func categoryFlag(category string) CommandFlags {
+	for i, name := range flagNames {
+		if "@"+name == category {
+			return 1 << uint(i)
+		}
+	}
+	return 0
+}
+
+// matchPattern returns true if the string matches the pattern
+// having '*' and '?' wildcards.
+func matchPattern(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchPattern(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return len(s) == 0
+}
+
+// Auth authenticates the session as the user.
+// Returns nothing on success or WRONGPASS if there's no such user
+// or the password is wrong; the session keeps its previous user then.
+func (i *StorageSession) Auth(name, password string) string {
+	hash := dummyHash
+	var user *User
+	for n := range i.cfg.Users {
+		if i.cfg.Users[n].Name == name {
+			user = &i.cfg.Users[n]
+			hash = user.PasswordHash
+		}
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if user == nil || err != nil {
+		i.cfg.Logger.Warnf("Authentication of user %q failed", name)
+		return errOutput(ErrWrongPass.Here())
+	}
+	i.user = user
+	i.cfg.Logger.Debugf("User %v authenticated", name)
+	return ""
+}
+
+// authenticateAs authenticates the session as the user
+// identified by other means, e.g. by the client certificate.
+// Session stays unauthenticated if there's no such user.
+func (i *StorageSession) authenticateAs(name string) {
+	for n := range i.cfg.Users {
+		if i.cfg.Users[n].Name == name {
+			i.user = &i.cfg.Users[n]
+			i.cfg.Logger.Debugf("User %v authenticated by certificate", name)
+			return
+		}
+	}
+	i.cfg.Logger.Debugf("Certificate subject %q is not a user", name)
+}
+
+// authorize returns ErrNoAuth if the session should be authenticated
+// to run the command, or ErrNoPerm if the user's ACL denies it.
+// Sessions are not restricted if there are no users configured.
+func (i *StorageSession) authorize(c Command, args []string) error {
+	if len(i.cfg.Users) == 0 || c.Flags&FlagNoAuth != 0 {
+		return nil
+	}
+	if i.user == nil {
+		i.cfg.Logger.Warnf("%v denied: not authenticated", c.Name)
+		return ErrNoAuth.Here()
+	}
+	if !i.user.ACL.allowsCommand(c) {
+		i.cfg.Logger.Warnf("%v denied for user %v: command is not allowed", c.Name, i.user.Name)
+		return ErrNoPerm.Here().Append(c.Name)
+	}
+	if c.Flags&FlagKeyspace != 0 && !i.user.ACL.allowsAllKeys() {
+		i.cfg.Logger.Warnf("%v denied for user %v: not all the keys are allowed", c.Name, i.user.Name)
+		return ErrNoPerm.Here().Append(c.Name)
+	}
+	if c.Flags&FlagKey != 0 && len(args) > 0 && !i.user.ACL.allowsKey(args[0]) {
+		i.cfg.Logger.Warnf("%v denied for user %v: key %q is not allowed", c.Name, i.user.Name, args[0])
+		return ErrNoPerm.Here().Append(c.Name)
+	}
+	return nil
+}
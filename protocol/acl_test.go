@@ -0,0 +1,137 @@
+package protocol
+
+import (
+	"bytes"
+	"github.com/ansel1/merry"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/utrack/go-simple-memdb/logging"
+	"github.com/utrack/go-simple-memdb/storage"
+	"golang.org/x/crypto/bcrypt"
+	"testing"
+)
+
+func testUser(name, password string, acl ACL) User {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	So(err, ShouldBeNil)
+	return User{Name: name, PasswordHash: string(hash), ACL: acl}
+}
+
+func TestACL(t *testing.T) {
+	Convey("With users", t, func() {
+		stor := storage.New()
+		stor.Set("app1:a", "10")
+		stor.Set("app2:a", "20")
+		logs := &bytes.Buffer{}
+		cfg := Config{
+			Logger: logging.New(logs, logging.Debug),
+			Users: []User{
+				testUser("admin", "secret", ACL{Commands: []string{"@all"}, Keys: []string{"*"}}),
+				testUser("reader", "pass word", ACL{Commands: []string{"@read", "@tx"}, Keys: []string{"*"}}),
+				testUser("app1", "app1pass", ACL{Commands: []string{"@all"}, DenyCommands: []string{"NUMEQUALTO"}, Keys: []string{"app1:*"}}),
+			},
+		}
+		sock := NewSocketConfig(stor, cfg)
+
+		Convey("Commands should require authentication", func() {
+			So(exec(sock, "GET app1:a", "SET a 1", "BEGIN"), ShouldResemble, []string{"NOAUTH", "NOAUTH", "NOAUTH"})
+			So(logs.String(), ShouldContainSubstring, "GET denied: not authenticated")
+
+			out, ok := sock.Exec("HELP GET")
+			So(ok, ShouldBeTrue)
+			So(out, ShouldStartWith, "GET name")
+		})
+		Convey("Wrong password should be rejected", func() {
+			So(exec(sock, "AUTH admin nope", "AUTH nobody secret", "AUTH admin", "GET app1:a"), ShouldResemble,
+				[]string{"WRONGPASS", "WRONGPASS", "WRONG NUMBER OF ARGUMENTS", "NOAUTH"})
+			So(logs.String(), ShouldContainSubstring, `Authentication of user "nobody" failed`)
+			So(logs.String(), ShouldNotContainSubstring, "nope")
+		})
+		Convey("Admin should run everything", func() {
+			So(exec(sock, "AUTH admin secret", "SET a 1", "GET app2:a", "NUMEQUALTO 10"), ShouldResemble,
+				[]string{"", "", "20", "1"})
+
+			Convey("Failed AUTH should keep the user", func() {
+				So(exec(sock, "AUTH reader nope", "SET a 2"), ShouldResemble, []string{"WRONGPASS", ""})
+			})
+		})
+		Convey("Read-only user should not write", func() {
+			So(exec(sock, "AUTH reader pass word", "GET app1:a", "BEGIN", "SET a 1", "UNSET app1:a", "ROLLBACK"), ShouldResemble,
+				[]string{"", "10", "", "NOPERM", "NOPERM", ""})
+			So(logs.String(), ShouldContainSubstring, "SET denied for user reader: command is not allowed")
+		})
+		Convey("User should be restricted by key patterns", func() {
+			So(exec(sock, "AUTH app1 app1pass", "GET app1:a", "SET app1:b 1", "GET app2:a", "SET app2:a 1", "NUMEQUALTO 10"), ShouldResemble,
+				[]string{"", "10", "", "NOPERM", "NOPERM", "NOPERM"})
+			So(logs.String(), ShouldContainSubstring, `GET denied for user app1: key "app2:a" is not allowed`)
+
+			Convey("Commands accessing all the keys should be denied", func() {
+				So(exec(sock, "NUMEQUALTOB 2\n10", "SUM", "AVG", "COUNTRANGE 0 100", "TOPVALUES 1", "DISTINCTVALUES",
+					"SWAPDB 0 1", "FLUSHDB", "FLUSHALL", "SLOWLOG GET"), ShouldResemble,
+					[]string{"NOPERM", "NOPERM", "NOPERM", "NOPERM", "NOPERM", "NOPERM", "NOPERM", "NOPERM", "NOPERM", "NOPERM"})
+				So(exec(sock, "CREATEINDEX byName name", "DROPINDEX byName", "CLIENT KILL 1", "CLIENT LIST"), ShouldResemble,
+					[]string{"NOPERM", "NOPERM", "NOPERM", "NOPERM"})
+				So(logs.String(), ShouldContainSubstring, "FLUSHDB denied for user app1: not all the keys are allowed")
+				So(exec(sock, "AUTH admin secret", "GET app2:a"), ShouldResemble, []string{"", "20"})
+			})
+			Convey("Denied keys should not be found", func() {
+				stor.Set("app2:b", "10")
+				So(exec(sock, "FIND 10"), ShouldResemble, []string{"1\napp1:a"})
+			})
+		})
+	})
+}
+
+func TestUserValidate(t *testing.T) {
+	Convey("Valid user should pass", t, func() {
+		hash, err := HashPassword("secret")
+		So(err, ShouldBeNil)
+		So(bcrypt.CompareHashAndPassword([]byte(hash), []byte("secret")), ShouldBeNil)
+
+		u := User{Name: "u", PasswordHash: hash, ACL: ACL{Commands: []string{"@read", "GET"}, DenyCommands: []string{"@write"}}}
+		So(u.Validate(), ShouldBeNil)
+
+		Convey("Malformed user should be rejected", func() {
+			for _, bad := range []User{
+				{PasswordHash: hash},
+				{Name: "u", PasswordHash: "secret"},
+				{Name: "u", PasswordHash: hash, ACL: ACL{Commands: []string{"@reads"}}},
+				{Name: "u", PasswordHash: hash, ACL: ACL{DenyCommands: []string{"@nope"}}},
+			} {
+				So(merry.Is(bad.Validate(), ErrInvalidUser), ShouldBeTrue)
+			}
+		})
+	})
+}
+
+func TestAllowsAllKeys(t *testing.T) {
+	Convey("Only the patterns matching every key should allow all the keys", t, func() {
+		So(ACL{Keys: []string{"app1:*", "*"}}.allowsAllKeys(), ShouldBeTrue)
+		So(ACL{Keys: []string{"**"}}.allowsAllKeys(), ShouldBeTrue)
+		So(ACL{Keys: []string{"app1:*", "?*"}}.allowsAllKeys(), ShouldBeFalse)
+		So(ACL{Keys: []string{""}}.allowsAllKeys(), ShouldBeFalse)
+		So(ACL{}.allowsAllKeys(), ShouldBeFalse)
+	})
+}
+
+func TestMatchPattern(t *testing.T) {
+	Convey("Patterns should match", t, func() {
+		for _, c := range []struct {
+			pattern, s string
+			match      bool
+		}{
+			{"*", "", true},
+			{"*", "anything", true},
+			{"app1:*", "app1:a", true},
+			{"app1:*", "app1:", true},
+			{"app1:*", "app2:a", false},
+			{"app?:a", "app1:a", true},
+			{"app?:a", "app:a", false},
+			{"*:a:*", "x:a:y", true},
+			{"*:a:*", "x:b:y", false},
+			{"key", "key", true},
+			{"key", "key2", false},
+		} {
+			So(matchPattern(c.pattern, c.s), ShouldEqual, c.match)
+		}
+	})
+}
@@ -0,0 +1,200 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clients keep the sessions processing the pipes, see CLIENT.
+// Sessions sharing the Config share its Clients.
+// They are safe for concurrent use.
+type Clients struct {
+	mu      sync.Mutex
+	nextID  uint64
+	entries map[uint64]*clientEntry
+}
+
+// ClientInfo describes the client's session.
+type ClientInfo struct {
+	// ID is unique within the Clients.
+	ID uint64
+	// Addr is the address of the client, "-" if it's unknown.
+	Addr string
+	// Name is set by CLIENT SETNAME.
+	Name       string
+	Created    time.Time
+	LastActive time.Time
+	// DB is the name of the selected database, empty if the session
+	// has no registry.
+	DB      string
+	TxDepth int
+	// User is the name of the authenticated user, if any.
+	User string
+	// LastCommand is the name of the last command executed.
+	LastCommand string
+}
+
+// clientEntry is the registered session. Its info is updated
+// by the session after every command.
+type clientEntry struct {
+	mu   sync.Mutex
+	info ClientInfo
+
+	// killed is set by Kill; closer closes the session's pipe, if it can,
+	// or deadliner interrupts the pipe's read, if it can.
+	killed    int32
+	closer    io.Closer
+	deadliner readDeadliner
+}
+
+// NewClients creates the Clients without sessions.
+func NewClients() *Clients {
+	return &Clients{entries: map[uint64]*clientEntry{}}
+}
+
+// register adds the session reading the pipe to the Clients.
+func (c *Clients) register(sess *StorageSession, pipe io.Reader) *clientEntry {
+	now := time.Now()
+	ret := &clientEntry{info: ClientInfo{Addr: sess.client, Created: now, LastActive: now}}
+	ret.closer, _ = pipe.(io.Closer)
+	ret.deadliner, _ = pipe.(readDeadliner)
+	ret.update(sess, "")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	ret.info.ID = c.nextID
+	c.entries[ret.info.ID] = ret
+	return ret
+}
+
+// unregister removes the session from the Clients.
+func (c *Clients) unregister(entry *clientEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, entry.info.ID)
+}
+
+// List returns the clients sorted by their IDs.
+func (c *Clients) List() []ClientInfo {
+	c.mu.Lock()
+	entries := make([]*clientEntry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		entries = append(entries, entry)
+	}
+	c.mu.Unlock()
+
+	ret := make([]ClientInfo, len(entries))
+	for i, entry := range entries {
+		entry.mu.Lock()
+		ret[i] = entry.info
+		entry.mu.Unlock()
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret
+}
+
+// Kill ends the client's session: its pipe is closed, or its read times out
+// if the pipe can't be closed, so the session stops processing the commands
+// and rolls back its transactions. Sessions reading the other pipes
+// (e.g. bytes.Buffer) stop once their pending read returns, without
+// executing the command read.
+// ErrNoClient is returned if there's no such client.
+func (c *Clients) Kill(id uint64) error {
+	c.mu.Lock()
+	entry, ok := c.entries[id]
+	c.mu.Unlock()
+	if !ok {
+		return ErrNoClient.Here().Append(strconv.FormatUint(id, 10))
+	}
+	atomic.StoreInt32(&entry.killed, 1)
+	switch {
+	case entry.closer != nil:
+		_ = entry.closer.Close()
+	case entry.deadliner != nil:
+		// The session checks killed after setting its deadlines,
+		// so this one is not overridden unnoticed
+		_ = entry.deadliner.SetReadDeadline(time.Unix(1, 0))
+	}
+	return nil
+}
+
+// update updates the session's info after the command.
+func (e *clientEntry) update(sess *StorageSession, command string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.info.DB = sess.DBName()
+	e.info.TxDepth = sess.TxDepth()
+	e.info.User = ""
+	if sess.user != nil {
+		e.info.User = sess.user.Name
+	}
+	if command != "" {
+		e.info.LastCommand = command
+		e.info.LastActive = time.Now()
+	}
+}
+
+// setName sets the client's name.
+func (e *clientEntry) setName(name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.info.Name = name
+}
+
+// isKilled returns true if the session was killed.
+func (e *clientEntry) isKilled() bool {
+	return atomic.LoadInt32(&e.killed) != 0
+}
+
+// clientCommand executes CLIENT's subcommands.
+func clientCommand(sess *StorageSession, args []string) string {
+	sub, rest, _ := strings.Cut(strings.Join(args, " "), " ")
+	switch strings.ToUpper(sub) {
+	case "LIST":
+		clients := sess.cfg.Clients.List()
+		lines := []string{strconv.Itoa(len(clients))}
+		now := time.Now()
+		for _, c := range clients {
+			lines = append(lines, fmt.Sprintf("%v %v %v %v %v %v %v %v %v", c.ID, c.Addr, orDash(c.Name),
+				int64(now.Sub(c.Created).Seconds()), int64(now.Sub(c.LastActive).Seconds()),
+				orDash(c.DB), c.TxDepth, orDash(c.User), orDash(c.LastCommand)))
+		}
+		return strings.Join(lines, "\n")
+	case "KILL":
+		id, err := strconv.ParseUint(rest, 10, 64)
+		if err != nil {
+			return errOutput(ErrInvalidNumber.Here().Append(rest))
+		}
+		return errOutput(sess.cfg.Clients.Kill(id))
+	case "SETNAME":
+		if rest == "" || strings.Contains(rest, " ") {
+			return "WRONG NUMBER OF ARGUMENTS"
+		}
+		if sess.entry == nil {
+			return errOutput(ErrNoClient.Here())
+		}
+		sess.entry.setName(rest)
+		return ""
+	case "ID":
+		if sess.entry == nil {
+			return errOutput(ErrNoClient.Here())
+		}
+		return strconv.FormatUint(sess.entry.info.ID, 10)
+	}
+	return "UNKNOWN COMMAND"
+}
+
+// orDash returns the string, or "-" if it's empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,184 @@
+package protocol
+
+import (
+	"bufio"
+	"github.com/ansel1/merry"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/utrack/go-simple-memdb/storage"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClients(t *testing.T) {
+	Convey("With registry server", t, func() {
+		cfg := Config{Clients: NewClients()}
+		srv := NewRegistryServer(storage.NewRegistry(), cfg)
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		go func() { _ = srv.Serve(l) }()
+		Reset(func() { _ = srv.Close() })
+
+		dial := func() (net.Conn, *bufio.Reader) {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			So(err, ShouldBeNil)
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			return conn, bufio.NewReader(conn)
+		}
+		// run writes the commands and reads their single-line outputs
+		run := func(conn net.Conn, r *bufio.Reader, cmds ...string) []string {
+			_, err := conn.Write([]byte(strings.Join(cmds, "\n") + "\n"))
+			So(err, ShouldBeNil)
+			ret := make([]string, len(cmds))
+			for i := range cmds {
+				line, err := r.ReadString('\n')
+				So(err, ShouldBeNil)
+				ret[i] = strings.TrimSuffix(line, "\n")
+			}
+			return ret
+		}
+
+		c1, r1 := dial()
+		c2, r2 := dial()
+		id1 := run(c1, r1, "CLIENT ID")[0]
+		id2 := run(c2, r2, "CLIENT SETNAME worker", "SELECT 1", "BEGIN", "SET a 10", "CLIENT ID")[4]
+
+		Convey("CLIENT LIST should list the sessions", func() {
+			out := run(c1, r1, "CLIENT LIST")
+			So(out[0], ShouldEqual, "2")
+			lines := []string{readLine(r1), readLine(r1)}
+			So(strings.Fields(lines[0]), ShouldHaveLength, 9)
+			fields := strings.Fields(lines[0])
+			So(fields[0], ShouldEqual, id1)
+			So(fields[1], ShouldEqual, c1.LocalAddr().String())
+			So(append(fields[2:3], fields[5:]...), ShouldResemble, []string{"-", "0", "0", "-", "CLIENT"})
+			fields = strings.Fields(lines[1])
+			So(fields[0], ShouldEqual, id2)
+			So(append(fields[2:3], fields[5:]...), ShouldResemble, []string{"worker", "1", "1", "-", "CLIENT"})
+			So(cfg.Clients.List()[1].LastCommand, ShouldEqual, "CLIENT")
+		})
+		Convey("Killed session should be closed and rolled back", func() {
+			So(run(c1, r1, "CLIENT KILL "+id2), ShouldResemble, []string{""})
+			_, err := r2.ReadString('\n')
+			So(err, ShouldNotBeNil)
+			So(waitClients(cfg.Clients, 1), ShouldBeTrue)
+			So(run(c1, r1, "SELECT 1", "GET a"), ShouldResemble, []string{"", "NULL"})
+		})
+		Convey("Malformed or unknown IDs should be rejected", func() {
+			So(run(c1, r1, "CLIENT KILL x", "CLIENT KILL 1000", "CLIENT SETNAME a b", "CLIENT FOO"), ShouldResemble,
+				[]string{"INVALID NUMBER", "NO SUCH CLIENT", "WRONG NUMBER OF ARGUMENTS", "UNKNOWN COMMAND"})
+		})
+		Convey("Closed sessions should be removed", func() {
+			_ = c2.Close()
+			So(waitClients(cfg.Clients, 1), ShouldBeTrue)
+		})
+	})
+
+	Convey("Idle connections should be closed and rolled back", t, func() {
+		cfg := Config{Clients: NewClients(), IdleTimeout: 100 * time.Millisecond}
+		stor := storage.New()
+		srv := NewServerConfig(stor, cfg)
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		go func() { _ = srv.Serve(l) }()
+		defer srv.Close()
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		So(err, ShouldBeNil)
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		_, err = conn.Write([]byte("BEGIN\nSET a 10\n"))
+		So(err, ShouldBeNil)
+		So(readLine(r), ShouldBeEmpty)
+		So(readLine(r), ShouldBeEmpty)
+
+		_, err = r.ReadString('\n')
+		So(err, ShouldNotBeNil)
+		So(waitClients(cfg.Clients, 0), ShouldBeTrue)
+		_, err = stor.Get("a")
+		So(merry.Is(err, storage.ErrNotFound), ShouldBeTrue)
+	})
+
+	Convey("With session reading the pipe", t, func() {
+		clients := NewClients()
+		stor := storage.New()
+		sock := NewSocketConfig(stor, Config{Clients: clients, IdleTimeout: time.Minute})
+		client, server := net.Pipe()
+		defer client.Close()
+		_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(client)
+		done := make(chan struct{})
+		// process starts the session reading the pipe and opens its transaction
+		process := func(pipe io.Reader) uint64 {
+			go func() {
+				sock.Process(pipe, server)
+				close(done)
+			}()
+			_, err := client.Write([]byte("BEGIN\nSET a 10\n"))
+			So(err, ShouldBeNil)
+			So(readLine(r), ShouldBeEmpty)
+			So(readLine(r), ShouldBeEmpty)
+			return clients.List()[0].ID
+		}
+		waitDone := func() bool {
+			select {
+			case <-done:
+				return true
+			case <-time.After(5 * time.Second):
+				return false
+			}
+		}
+
+		Convey("Kill should interrupt the read of the pipe that can't be closed", func() {
+			So(clients.Kill(process(deadlinePipe{server})), ShouldBeNil)
+			So(waitDone(), ShouldBeTrue)
+			_, err := stor.Get("a")
+			So(merry.Is(err, storage.ErrNotFound), ShouldBeTrue)
+		})
+		Convey("Killed session should stop once its pending read returns", func() {
+			So(clients.Kill(process(struct{ io.Reader }{server})), ShouldBeNil)
+			_, err := client.Write([]byte("COMMIT\n"))
+			So(err, ShouldBeNil)
+			So(waitDone(), ShouldBeTrue)
+			_, err = stor.Get("a")
+			So(merry.Is(err, storage.ErrNotFound), ShouldBeTrue)
+		})
+	})
+
+	Convey("Sessions without pipes should not be registered", t, func() {
+		sock := NewSocket(storage.New())
+		So(exec(sock, "CLIENT ID", "CLIENT LIST"), ShouldResemble, []string{"NO SUCH CLIENT", "0"})
+	})
+}
+
+// deadlinePipe is the pipe whose reads time out, but which can't be closed.
+type deadlinePipe struct {
+	conn net.Conn
+}
+
+func (p deadlinePipe) Read(b []byte) (int, error) {
+	return p.conn.Read(b)
+}
+
+func (p deadlinePipe) SetReadDeadline(t time.Time) error {
+	return p.conn.SetReadDeadline(t)
+}
+
+// readLine reads the output's line.
+func readLine(r *bufio.Reader) string {
+	ret, err := r.ReadString('\n')
+	So(err, ShouldBeNil)
+	return strings.TrimSuffix(ret, "\n")
+}
+
+// waitClients waits until there are n clients.
+func waitClients(c *Clients, n int) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if len(c.List()) == n {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,331 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CommandFlags describe the command's behaviour.
+type CommandFlags uint
+
+const (
+	// FlagRead marks the commands that read the data.
+	FlagRead CommandFlags = 1 << iota
+	// FlagWrite marks the commands that modify the data.
+	// They're rejected with READONLY by read-only sessions and transactions.
+	FlagWrite
+	// FlagTx marks the commands that control the transactions.
+	FlagTx
+	// FlagNoTx marks the commands that are not allowed
+	// within the transaction blocks.
+	FlagNoTx
+	// FlagKey marks the commands that take the key as the first argument.
+	FlagKey
+	// FlagQuit marks the commands that end the session.
+	FlagQuit
+	// FlagNoAuth marks the commands allowed without authentication
+	// and regardless of the ACLs.
+	FlagNoAuth
+	// FlagPayload marks the binary-safe commands: their last argument
+	// is the length of the payload following the command's line.
+	FlagPayload
+	// FlagSecret marks the commands whose arguments are not logged,
+	// e.g. passwords.
+	FlagSecret
+	// FlagDenyOOM marks the commands that may add to the memory taken
+	// by the variables, rejected while the database is out of memory.
+	FlagDenyOOM
+	// FlagKeyspace marks the commands accessing the variables regardless
+	// of their keys, e.g. NUMEQUALTO or FLUSHDB, revealing the keys
+	// of the other sessions' commands, or managing the indexes and sessions
+	// shared by all the users; they're denied to the users whose ACL
+	// doesn't allow all the keys.
+	FlagKeyspace
+)
+
+// flagNames are the names of the flags listed by COMMAND.
+var flagNames = []string{"read", "write", "tx", "notx", "key", "quit", "noauth", "payload", "secret", "denyoom", "keyspace"}
+
+// String returns comma-separated flag names, or "-" if there are none.
+func (f CommandFlags) String() string {
+	var names []string
+	for i, name := range flagNames {
+		if f&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "-"
+	}
+	return strings.Join(names, ",")
+}
+
+// CommandFunc executes the command within the session and returns its output.
+// args holds at least command's arity arguments; the last one holds
+// the rest of the line, since there are at most two of them.
+// Commands flagged with FlagPayload get the payload in place of its length.
+type CommandFunc func(sess *StorageSession, args []string) string
+
+// Command describes the protocol's command.
+type Command struct {
+	Name string
+	// Arity is the minimal number of the arguments.
+	Arity int
+	Flags CommandFlags
+	// Usage is the command's syntax, e.g. "GET name".
+	Usage string
+	// Summary is a short description of the command.
+	Summary string
+
+	handler CommandFunc
+}
+
+// Describe sets the command's usage and summary listed by HELP.
+// It should be called during the registration.
+func (c *Command) Describe(usage, summary string) *Command {
+	c.Usage = usage
+	c.Summary = summary
+	return c
+}
+
+var (
+	commandsMu sync.RWMutex
+	commands   = map[string]*Command{}
+)
+
+// RegisterCommand adds the command to the protocol for all the sockets.
+// Its arity is the minimal number of the arguments.
+// Commands are usually registered at init and
+// RegisterCommand panics if the name is already taken.
+func RegisterCommand(name string, arity int, flags CommandFlags, handler CommandFunc) *Command {
+	commandsMu.Lock()
+	defer commandsMu.Unlock()
+	if _, ok := commands[name]; ok {
+		panic(fmt.Sprintf("protocol: command %v is registered twice", name))
+	}
+	ret := &Command{
+		Name:    name,
+		Arity:   arity,
+		Flags:   flags,
+		Usage:   name,
+		handler: handler,
+	}
+	commands[name] = ret
+	return ret
+}
+
+// Commands returns the registered commands sorted by their names.
+func Commands() []Command {
+	commandsMu.RLock()
+	defer commandsMu.RUnlock()
+	ret := make([]Command, 0, len(commands))
+	for _, c := range commands {
+		ret = append(ret, *c)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// lookupCommand returns the registered command by its name.
+func lookupCommand(name string) (Command, bool) {
+	commandsMu.RLock()
+	defer commandsMu.RUnlock()
+	c, ok := commands[name]
+	if !ok {
+		return Command{}, false
+	}
+	return *c, true
+}
+
+func init() {
+	RegisterCommand("GET", 1, FlagRead|FlagKey, func(sess *StorageSession, args []string) string {
+		if len(args) > 1 && strings.HasPrefix(args[1], "AT ") {
+			return sess.GetAt(args[0], strings.TrimPrefix(args[1], "AT "))
+		}
+		return sess.Get(args[0])
+	}).Describe("GET name [AT version|time]", "Print out the value of the variable (as of the version or RFC 3339 time), or NULL if it's not set. Print BINARY VALUE if it has line breaks; GETB prints it.")
+	RegisterCommand("SET", 2, FlagWrite|FlagKey|FlagDenyOOM, func(sess *StorageSession, args []string) string {
+		return sess.Set(args[0], args[1])
+	}).Describe("SET name value", "Set the variable to the value.")
+	RegisterCommand("UNSET", 1, FlagWrite|FlagKey, func(sess *StorageSession, args []string) string {
+		return sess.Unset(args[0])
+	}).Describe("UNSET name", "Unset the variable.")
+	RegisterCommand("NUMEQUALTO", 1, FlagRead|FlagKeyspace, func(sess *StorageSession, args []string) string {
+		return strconv.FormatUint(sess.NumEqualsTo(args[0]), 10)
+	}).Describe("NUMEQUALTO value", "Print out the number of variables set to the value.")
+	RegisterCommand("FIND", 1, FlagRead, func(sess *StorageSession, args []string) string {
+		return sess.Find("", args[0])
+	}).Describe("FIND value", "List the variables set to the value: the count, then a line per name.")
+	RegisterCommand("FINDBY", 2, FlagRead, func(sess *StorageSession, args []string) string {
+		return sess.Find(args[0], args[1])
+	}).Describe("FINDBY index value", "List the variables indexed as the value by the index: the count, then a line per name.")
+	RegisterCommand("CREATEINDEX", 2, FlagWrite|FlagNoTx|FlagKeyspace, func(sess *StorageSession, args []string) string {
+		return sess.CreateIndex(args[0], args[1])
+	}).Describe("CREATEINDEX index path", "Index the JSON values by the field at the dot-separated path, e.g. user.name.")
+	RegisterCommand("DROPINDEX", 1, FlagWrite|FlagNoTx|FlagKeyspace, func(sess *StorageSession, args []string) string {
+		return sess.DropIndex(args[0])
+	}).Describe("DROPINDEX index", "Remove the index.")
+	RegisterCommand("COUNTRANGE", 2, FlagRead|FlagKeyspace, func(sess *StorageSession, args []string) string {
+		if args[0] != "NUMERIC" {
+			return sess.CountRange(args[0], args[1], false)
+		}
+		bounds := strings.Fields(args[1])
+		if len(bounds) != 2 {
+			return "WRONG NUMBER OF ARGUMENTS"
+		}
+		return sess.CountRange(bounds[0], bounds[1], true)
+	}).Describe("COUNTRANGE [NUMERIC] min max", "Print out the number of variables set to the values between min and max inclusive, compared as strings or numbers.")
+	RegisterCommand("DISTINCTVALUES", 0, FlagRead|FlagKeyspace, func(sess *StorageSession, args []string) string {
+		return sess.DistinctValues()
+	}).Describe("DISTINCTVALUES", "Print out the number of distinct values.")
+	RegisterCommand("TOPVALUES", 1, FlagRead|FlagKeyspace, func(sess *StorageSession, args []string) string {
+		return sess.TopValues(args[0])
+	}).Describe("TOPVALUES n", "List the n most common values: the count, then a line of the number of variables and the value per value.")
+	RegisterCommand("SUM", 0, FlagRead|FlagKeyspace, func(sess *StorageSession, args []string) string {
+		return sess.Sum(strings.Join(args, " "))
+	}).Describe("SUM [prefix]", "Print out the sum of the numeric values of the variables whose names start with the prefix.")
+	RegisterCommand("AVG", 0, FlagRead|FlagKeyspace, func(sess *StorageSession, args []string) string {
+		return sess.Avg(strings.Join(args, " "))
+	}).Describe("AVG [prefix]", "Print out the average of the numeric values of the variables whose names start with the prefix, or NULL if there are none.")
+	RegisterCommand("HISTORY", 1, FlagRead|FlagKey, func(sess *StorageSession, args []string) string {
+		return sess.History(args[0])
+	}).Describe("HISTORY name", "List the versions of the variable kept: the count, then a line of version, time and value per version.")
+	RegisterCommand("EXPIRE", 2, FlagWrite|FlagKey|FlagNoTx, func(sess *StorageSession, args []string) string {
+		return sess.Expire(args[0], args[1])
+	}).Describe("EXPIRE name seconds", "Set the variable to expire after the seconds; it's unset by the next sweep. Prints NULL if it's not set.")
+	RegisterCommand("TTL", 1, FlagRead|FlagKey, func(sess *StorageSession, args []string) string {
+		return sess.TTL(args[0])
+	}).Describe("TTL name", "Print out the seconds left until the variable expires, -1 if it doesn't expire, or NULL if it's not set.")
+	RegisterCommand("PERSIST", 1, FlagWrite|FlagKey|FlagNoTx, func(sess *StorageSession, args []string) string {
+		return sess.Persist(args[0])
+	}).Describe("PERSIST name", "Remove the variable's expiration. Prints NULL if it didn't expire.")
+	RegisterCommand("GETB", 1, FlagRead|FlagKey, func(sess *StorageSession, args []string) string {
+		return sess.GetPayload(args[0])
+	}).Describe("GETB name", "Print out the length of the value, then the value's bytes on the next line, or NULL if it's not set.")
+	RegisterCommand("SETB", 2, FlagWrite|FlagKey|FlagPayload|FlagDenyOOM, func(sess *StorageSession, args []string) string {
+		return sess.Set(args[0], args[1])
+	}).Describe("SETB name length", "Set the variable to the length bytes following the line.")
+	RegisterCommand("NUMEQUALTOB", 1, FlagRead|FlagPayload|FlagKeyspace, func(sess *StorageSession, args []string) string {
+		return strconv.FormatUint(sess.NumEqualsTo(args[0]), 10)
+	}).Describe("NUMEQUALTOB length", "Print out the number of variables set to the length bytes following the line.")
+
+	RegisterCommand("BEGIN", 0, FlagTx, func(sess *StorageSession, args []string) string {
+		switch {
+		case len(args) == 0:
+			return sess.Tx()
+		case args[0] == "READONLY" && len(args) == 1:
+			return sess.ReadTx()
+		}
+		return errOutput(ErrSyntax.Here().Append(strings.Join(args, " ")))
+	}).Describe("BEGIN [READONLY]", "Open a new (read-only) transaction block.")
+	RegisterCommand("COMMIT", 0, FlagTx, func(sess *StorageSession, args []string) string {
+		return sess.Commit()
+	}).Describe("COMMIT", "Close all open transaction blocks, applying their changes.")
+	RegisterCommand("ROLLBACK", 0, FlagTx, func(sess *StorageSession, args []string) string {
+		switch {
+		case len(args) == 0:
+			return sess.Rollback()
+		case args[0] != "TO":
+			return errOutput(ErrSyntax.Here().Append(strings.Join(args, " ")))
+		case len(args) == 1:
+			// Rolling back the whole block instead would lose the changes
+			return "WRONG NUMBER OF ARGUMENTS"
+		}
+		return sess.RollbackTo(args[1])
+	}).Describe("ROLLBACK [TO name]", "Undo the most recent transaction block, or the changes since the savepoint.")
+	RegisterCommand("SAVEPOINT", 1, FlagTx, func(sess *StorageSession, args []string) string {
+		return sess.Savepoint(args[0])
+	}).Describe("SAVEPOINT name", "Create a named savepoint in the current transaction block.")
+	RegisterCommand("RELEASE", 1, FlagTx, func(sess *StorageSession, args []string) string {
+		return sess.Release(args[0])
+	}).Describe("RELEASE name", "Remove the savepoint, keeping the changes made since it.")
+
+	RegisterCommand("SELECT", 1, FlagNoTx, func(sess *StorageSession, args []string) string {
+		return sess.Select(args[0])
+	}).Describe("SELECT db", "Switch to the database, creating it if needed, up to the configured number of databases.")
+	RegisterCommand("SWAPDB", 2, FlagWrite|FlagNoTx|FlagKeyspace, func(sess *StorageSession, args []string) string {
+		return sess.SwapDB(args[0], args[1])
+	}).Describe("SWAPDB db1 db2", "Swap the variables of the databases.")
+	RegisterCommand("FLUSHDB", 0, FlagWrite|FlagNoTx|FlagKeyspace, func(sess *StorageSession, args []string) string {
+		return sess.FlushDB()
+	}).Describe("FLUSHDB", "Unset all the variables of the current database.")
+	RegisterCommand("FLUSHALL", 0, FlagWrite|FlagNoTx|FlagKeyspace, func(sess *StorageSession, args []string) string {
+		return sess.FlushAll()
+	}).Describe("FLUSHALL", "Unset all the variables of every database.")
+
+	RegisterCommand("AUTH", 2, FlagNoAuth|FlagSecret, func(sess *StorageSession, args []string) string {
+		return sess.Auth(args[0], args[1])
+	}).Describe("AUTH user password", "Authenticate as the user.")
+	RegisterCommand("END", 0, FlagQuit|FlagNoAuth, nil).
+		Describe("END", "Exit the session.")
+	RegisterCommand("COMMAND", 0, FlagNoAuth, commandInfo).
+		Describe("COMMAND [name]", "List the commands: the count, then a line of name, arity and flags per command.")
+	RegisterCommand("HELP", 0, FlagNoAuth, help).
+		Describe("HELP [name]", "Describe the commands.")
+	RegisterCommand("SLOWLOG", 1, FlagKeyspace, slowLogCommand).
+		Describe("SLOWLOG GET [n]|LEN|RESET", "List the n (10 by default) latest slow commands: the count, then a line of id, time, duration in microseconds, client, transaction depth, command and arguments per command; print out their number; or forget them.")
+	RegisterCommand("CLIENT", 1, FlagKeyspace, clientCommand).
+		Describe("CLIENT LIST|KILL id|SETNAME name|ID", "List the clients: the count, then a line of id, address, name, age and idle time in seconds, database, transaction depth, user and last command per client; close the client's connection, rolling back its transactions; name the connection; or print out its id.")
+	RegisterCommand("MONITOR", 0, FlagNoTx, func(sess *StorageSession, args []string) string {
+		return sess.Monitor()
+	}).Describe("MONITOR", "Stream the commands executed by the other sessions, a line of time, database, client, transaction depth, command and arguments per command, until END.")
+	RegisterCommand("LATENCY", 0, 0, latencyCommand).
+		Describe("LATENCY [name|RESET]", "List the commands' latencies: the count, then a line of name, calls, median, 99th percentile and maximum in microseconds per command; or forget them.")
+	RegisterCommand("REPLICATION", 0, 0, replicationCommand).
+		Describe("REPLICATION", "Describe the replication: the count, then a line of name and value per field, such as role, offset, lag and the followers.")
+}
+
+// replicationCommand describes the replication for REPLICATION.
+func replicationCommand(sess *StorageSession, args []string) string {
+	var lines []string
+	for _, r := range sess.cfg.Replication {
+		lines = append(lines, r.Info()...)
+	}
+	return strings.Join(append([]string{strconv.Itoa(len(lines))}, lines...), "\n")
+}
+
+// commandInfo lists the registered commands for COMMAND.
+func commandInfo(sess *StorageSession, args []string) string {
+	cmds, ok := commandsFor(args)
+	if !ok {
+		return "UNKNOWN COMMAND"
+	}
+	lines := []string{strconv.Itoa(len(cmds))}
+	for _, c := range cmds {
+		lines = append(lines, fmt.Sprintf("%v %v %v", c.Name, c.Arity, c.Flags))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// help describes the registered commands for HELP.
+func help(sess *StorageSession, args []string) string {
+	cmds, ok := commandsFor(args)
+	if !ok {
+		return "UNKNOWN COMMAND"
+	}
+	lines := make([]string, 0, len(cmds))
+	for _, c := range cmds {
+		line := c.Usage
+		if c.Summary != "" {
+			line += " – " + c.Summary
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// commandsFor returns the command named by the first argument,
+// or all the commands if there are no arguments.
+func commandsFor(args []string) ([]Command, bool) {
+	if len(args) == 0 {
+		return Commands(), true
+	}
+	c, ok := lookupCommand(args[0])
+	if !ok {
+		return nil, false
+	}
+	return []Command{c}, true
+}
@@ -0,0 +1,108 @@
+package protocol
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/utrack/go-simple-memdb/storage"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func init() {
+	RegisterCommand("TESTAPPEND", 2, FlagWrite|FlagKey, func(sess *StorageSession, args []string) string {
+		w, err := sess.Writer()
+		if err != nil {
+			return errOutput(err)
+		}
+		val, _ := w.Get(args[0])
+		w.Set(args[0], val+args[1])
+		return ""
+	}).Describe("TESTAPPEND name value", "Append the value to the variable.")
+	RegisterCommand("TESTNOTX", 0, FlagNoTx, func(sess *StorageSession, args []string) string {
+		return "OK"
+	})
+}
+
+// testReplication reports its lines as the replication's state.
+type testReplication []string
+
+func (r testReplication) Info() []string {
+	return r
+}
+
+func TestCommands(t *testing.T) {
+	Convey("With storage and socket", t, func() {
+		stor := storage.New()
+		sock := NewSocket(stor)
+
+		Convey("Custom command should be executed", func() {
+			So(exec(sock, "SET a x", "TESTAPPEND a y", "GET a", "TESTAPPEND a"), ShouldResemble,
+				[]string{"", "", "xy", "WRONG NUMBER OF ARGUMENTS"})
+		})
+		Convey("Write command should be rejected by read-only socket", func() {
+			ro := NewReadOnlySocket(stor)
+			So(exec(ro, "TESTAPPEND a y", "BEGIN", "TESTAPPEND a y"), ShouldResemble,
+				[]string{"READONLY", "", "READONLY"})
+		})
+		Convey("Commands flagged with FlagDenyOOM should be rejected over maxmemory", func() {
+			sock := NewSocket(storage.NewConfig(storage.Config{MaxMemory: 4}))
+			So(exec(sock, "SET a 10", "SET b 20", "SET c 30", "TESTAPPEND a y", "UNSET a", "SET c 30"), ShouldResemble,
+				[]string{"", "", "OOM", "", "", ""})
+		})
+		Convey("Command should be rejected within transaction if flagged", func() {
+			So(exec(sock, "TESTNOTX", "BEGIN", "TESTNOTX", "ROLLBACK", "TESTNOTX"), ShouldResemble,
+				[]string{"OK", "", "NOT ALLOWED IN TRANSACTION", "", "OK"})
+		})
+		Convey("Registering the command twice should panic", func() {
+			So(func() { RegisterCommand("GET", 1, FlagRead, nil) }, ShouldPanic)
+		})
+		Convey("COMMAND should list the commands", func() {
+			out, _ := sock.Exec("COMMAND")
+			lines := strings.Split(out, "\n")
+			So(lines[0], ShouldEqual, strconv.Itoa(len(Commands())))
+			So(lines, ShouldHaveLength, len(Commands())+1)
+			So(lines[1:], ShouldContain, "GET 1 read,key")
+			So(lines[1:], ShouldContain, "END 0 quit,noauth")
+			So(lines[1:], ShouldContain, "TESTNOTX 0 notx")
+			So(lines[1:], ShouldContain, "SETB 2 write,key,payload,denyoom")
+
+			So(exec(sock, "COMMAND SET", "COMMAND FOO"), ShouldResemble,
+				[]string{"1\nSET 2 write,key,denyoom", "UNKNOWN COMMAND"})
+		})
+		Convey("REPLICATION should describe the replication", func() {
+			So(exec(sock, "REPLICATION"), ShouldResemble, []string{"0"})
+			sock := NewSocketConfig(stor, Config{Replication: []ReplicationInfo{
+				testReplication{"role follower", "lag 2"},
+				testReplication{"role leader"},
+			}})
+			So(exec(sock, "REPLICATION"), ShouldResemble, []string{"3\nrole follower\nlag 2\nrole leader"})
+		})
+		Convey("HELP should describe the commands", func() {
+			out, _ := sock.Exec("HELP")
+			So(out, ShouldContainSubstring, "ROLLBACK [TO name] – Undo")
+			So(out, ShouldContainSubstring, "\nTESTNOTX\n")
+
+			So(exec(sock, "HELP TESTAPPEND"), ShouldResemble,
+				[]string{"TESTAPPEND name value – Append the value to the variable."})
+		})
+	})
+}
+
+// exec executes the commands and returns their outputs.
+func exec(sock *DBSocket, cmds ...string) []string {
+	var ret []string
+	for _, cmd := range cmds {
+		out, _ := sock.Exec(cmd)
+		ret = append(ret, out)
+	}
+	return ret
+}
+
+func TestCommandFlags(t *testing.T) {
+	Convey("Flags should be named", t, func() {
+		So(CommandFlags(0).String(), ShouldEqual, "-")
+		So((FlagRead | FlagKey).String(), ShouldEqual, "read,key")
+		So((FlagTx | FlagNoTx | FlagQuit | FlagNoAuth).String(), ShouldEqual, "tx,notx,quit,noauth")
+		So((FlagPayload | FlagSecret).String(), ShouldEqual, "payload,secret")
+	})
+}
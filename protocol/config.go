@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"github.com/utrack/go-simple-memdb/logging"
+	"time"
+)
+
+// Config configures the sessions, sockets and servers.
+type Config struct {
+	// ReadOnly is true if all the writes should be rejected, e.g. for replicas.
+	ReadOnly bool
+	// Logger logs the events; nil Logger discards them.
+	Logger *logging.Logger
+
+	// AllowUIDs and AllowGIDs restrict the unix socket clients by their
+	// peer credentials: client is accepted if its UID or GID is listed.
+	// Clients are not restricted if both are empty; TCP clients never are.
+	AllowUIDs []uint32
+	AllowGIDs []uint32
+
+	// Users are allowed to authenticate with AUTH.
+	// If there are any, sessions should be authenticated to run
+	// the commands and are restricted by the users' ACLs.
+	Users []User
+
+	// Dialect is the dialect the pipes are processed in;
+	// DialectLine is the default.
+	Dialect Dialect
+
+	// IdleTimeout closes the network connections that sent no commands
+	// for that long, rolling back their transactions; zero disables it.
+	IdleTimeout time.Duration
+
+	// Metrics record the commands' latencies and the slow log.
+	// Servers and sessions created without ones get their own,
+	// with the DefaultSlowLog.
+	Metrics *Metrics
+	// Monitors stream the commands to the sessions in MONITOR mode.
+	// Servers and sessions created without ones get their own.
+	Monitors *Monitors
+	// Clients keep the sessions processing the pipes.
+	// Servers and sessions created without ones get their own.
+	Clients *Clients
+	// Replication reports the replication's state for REPLICATION,
+	// e.g. the replication's Leader and Follower.
+	Replication []ReplicationInfo
+}
+
+// ReplicationInfo reports the replication's state.
+type ReplicationInfo interface {
+	// Info returns the lines of the state's field names and values.
+	Info() []string
+}
+
+// withDefaults returns the config with the Metrics, Monitors
+// and Clients, creating them if needed.
+func (c Config) withDefaults() Config {
+	if c.Metrics == nil {
+		c.Metrics = NewMetrics(DefaultSlowLog)
+	}
+	if c.Monitors == nil {
+		c.Monitors = NewMonitors()
+	}
+	if c.Clients == nil {
+		c.Clients = NewClients()
+	}
+	return c
+}
@@ -1,3 +1,29 @@
 /* Package protocol provides database's socket IO primitives.
+
+Use NewSocket to process a single IO pipe (e.g. stdin/stdout),
+or Server to serve network connections, each one with its own session.
+Server is the http.Handler too: every POST request's body is processed
+by its own session, see ServeHTTPListener.
+ListenUnix creates unix socket listeners; their clients can be restricted
+by peer credentials with Config's AllowUIDs and AllowGIDs.
+TLSReloader serves TLS, optionally verifying the client certificates
+whose common names authenticate the users of the same names.
+
+Commands are dispatched through the registry; RegisterCommand adds
+custom commands, and COMMAND and HELP list the registered ones.
+Commands flagged with FlagPayload are binary-safe: the length of their
+last argument is sent in its place, followed by the argument's bytes.
+
+Config's Dialect selects the line protocol or RESP, the Redis serialization
+protocol: its arrays of bulk strings are executed by ExecArgs, and the outputs
+are written as its replies.
+
+Config's Metrics record every command's latency and log the slow ones,
+see SLOWLOG and LATENCY; its Monitors stream the commands to the sessions
+in MONITOR mode; its Clients keep the sessions processing the pipes,
+see CLIENT. Sessions sharing the Config share all of them.
+Connections idle for Config's IdleTimeout are closed, rolling back
+their transactions.
+REPLICATION describes the replication by Config's Replication.
 */
 package protocol
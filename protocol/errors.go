@@ -0,0 +1,76 @@
+package protocol
+
+import (
+	"github.com/ansel1/merry"
+)
+
+// ErrServerClosed is returned by the Server's Serve
+// after the server was closed.
+var ErrServerClosed = merry.New("Server was closed.")
+
+// ErrAddrInUse is returned when the unix socket is served already.
+var ErrAddrInUse = merry.New("Address is in use.")
+
+// ErrPeerCredUnsupported is returned when peer credentials
+// can't be read on this platform.
+var ErrPeerCredUnsupported = merry.New("Peer credentials are not supported on this platform.")
+
+// ErrNoAuth is returned when the session should be authenticated
+// to run the command.
+var ErrNoAuth = merry.New("Authentication required.")
+
+// ErrNoPerm is returned when the user's ACL denies the command.
+var ErrNoPerm = merry.New("Permission denied.")
+
+// ErrWrongPass is returned when there's no such user or the password is wrong.
+var ErrWrongPass = merry.New("Wrong user or password.")
+
+// ErrInvalidUser is returned when the user's config is malformed.
+var ErrInvalidUser = merry.New("Invalid user.")
+
+// ErrInvalidTLS is returned when the TLS files can't be loaded.
+var ErrInvalidTLS = merry.New("Invalid TLS certificate or key.")
+
+// ErrInTransaction is returned when the command is not allowed
+// within the transaction blocks.
+var ErrInTransaction = merry.New("Command is not allowed in transaction.")
+
+// ErrNoDatabases is returned when the session can't switch
+// the databases, having no registry.
+var ErrNoDatabases = merry.New("There are no databases to select.")
+
+// ErrInvalidVersion is returned when the version to read
+// is neither a number nor RFC 3339 time.
+var ErrInvalidVersion = merry.New("Version should be a number or RFC 3339 time.")
+
+// ErrInvalidNumber is returned when the command's argument
+// should be a number.
+var ErrInvalidNumber = merry.New("Argument should be a number.")
+
+// ErrNoAggregates is returned when the session's DB
+// doesn't aggregate the values.
+var ErrNoAggregates = merry.New("Values are not aggregated.")
+
+// ErrInvalidRequest is returned when the request in the RESP dialect
+// is malformed.
+var ErrInvalidRequest = merry.New("Invalid RESP request.")
+
+// ErrNoExpiration is returned when the session's DB
+// doesn't expire the variables.
+var ErrNoExpiration = merry.New("Variables don't expire.")
+
+// ErrNoClient is returned when there's no such client,
+// or the session is not a registered client.
+var ErrNoClient = merry.New("No such client.")
+
+// ErrInvalidPayload is returned when the binary payload's length
+// is malformed or doesn't match the payload.
+var ErrInvalidPayload = merry.New("Invalid payload.")
+
+// ErrSyntax is returned when the command's arguments are not
+// the ones it accepts, e.g. BEGIN's option is misspelled.
+var ErrSyntax = merry.New("Syntax error.")
+
+// ErrBinaryValue is returned when GET's value has line breaks,
+// so it can't be printed in the line dialect; GETB should be used instead.
+var ErrBinaryValue = merry.New("Value has line breaks, use GETB.")
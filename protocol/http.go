@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"net"
+	"net/http"
+)
+
+// ServeHTTP implements http.Handler: the POST request's body is processed
+// as the commands of a new session, and their output is the response's body.
+// Requests authenticate as the users by HTTP basic authentication
+// or by the client certificate, if any.
+// Transactions left in progress are rolled back when the body ends.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Commands should be POSTed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sock := s.newSocket()
+	sock.sess.client = r.RemoteAddr
+	if name, password, ok := r.BasicAuth(); ok {
+		if out := sock.sess.Auth(name, password); out != "" {
+			http.Error(w, out, http.StatusUnauthorized)
+			return
+		}
+	} else if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		sock.sess.authenticateAs(r.TLS.PeerCertificates[0].Subject.CommonName)
+	}
+
+	s.cfg.Logger.Debugf("Client %v requested %v", r.RemoteAddr, r.URL.Path)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	sock.Process(r.Body, w)
+}
+
+// ServeHTTPListener accepts HTTP connections on the listener and serves
+// their requests by ServeHTTP until the listener or the server is closed.
+func (s *Server) ServeHTTPListener(l net.Listener) error {
+	hs := &http.Server{Handler: s}
+	if !s.track(hs) {
+		_ = l.Close()
+		return ErrServerClosed.Here()
+	}
+	defer s.untrack(hs)
+	s.cfg.Logger.Infof("Serving HTTP on %v %v", l.Addr().Network(), l.Addr())
+
+	err := hs.Serve(l)
+	if s.closed() {
+		return ErrServerClosed.Here()
+	}
+	s.cfg.Logger.Errorf("HTTP on %v failed: %v", l.Addr(), err)
+	return err
+}
@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/utrack/go-simple-memdb/storage"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServerHTTP(t *testing.T) {
+	Convey("With registry server over HTTP", t, func() {
+		hash, err := HashPassword("secret")
+		So(err, ShouldBeNil)
+		reg := storage.NewRegistry()
+		srv := NewRegistryServer(reg, Config{Users: []User{
+			{Name: "app", PasswordHash: hash, ACL: ACL{Commands: []string{"@all"}, Keys: []string{"*"}}},
+		}})
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		served := make(chan error, 1)
+		go func() { served <- srv.ServeHTTPListener(l) }()
+		Reset(func() { _ = srv.Close() })
+		url := "http://" + l.Addr().String() + "/"
+
+		post := func(user, password, body string) (int, string) {
+			req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+			So(err, ShouldBeNil)
+			if user != "" {
+				req.SetBasicAuth(user, password)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+			out, err := ioutil.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			return resp.StatusCode, string(out)
+		}
+
+		Convey("Request's commands should be processed by a session", func() {
+			code, out := post("app", "secret", "SET a 10\nSETB b 3\nx y\nGET a\nGETB b\nBEGIN\nSET a 20\n")
+			So(code, ShouldEqual, http.StatusOK)
+			So(out, ShouldEqual, "\n\n10\n3\nx y\n\n\n")
+
+			Convey("Transactions left in progress should be rolled back", func() {
+				_, out := post("app", "secret", "GET a\n")
+				So(out, ShouldEqual, "10\n")
+			})
+		})
+		Convey("Requests should be authenticated", func() {
+			code, out := post("", "", "GET a\nAUTH app secret\nGET a\n")
+			So(code, ShouldEqual, http.StatusOK)
+			So(out, ShouldEqual, "NOAUTH\n\nNULL\n")
+
+			code, out = post("app", "wrong", "GET a\n")
+			So(code, ShouldEqual, http.StatusUnauthorized)
+			So(out, ShouldEqual, "WRONGPASS\n")
+		})
+		Convey("Only POST should be allowed", func() {
+			resp, err := http.Get(url)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusMethodNotAllowed)
+		})
+		Convey("Close should stop serving", func() {
+			So(srv.Close(), ShouldBeNil)
+			So(<-served, ShouldNotBeNil)
+			_, err := http.Post(url, "text/plain", strings.NewReader("GET a\n"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,317 @@
+package protocol
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Metrics record the commands' latencies and log the slow ones.
+// Sessions sharing the Config share its Metrics.
+// They are safe for concurrent use.
+type Metrics struct {
+	slowLog SlowLogConfig
+
+	latenciesMu sync.RWMutex
+	latencies   map[string]*histogram
+
+	// entries are the slow log's ring buffer, next is the ID
+	// of the next entry, which goes to entries[next%len].
+	entriesMu sync.Mutex
+	entries   []SlowLogEntry
+	next      uint64
+	// first is the ID of the oldest entry kept since the reset.
+	first uint64
+}
+
+// SlowLogConfig configures the slow log.
+type SlowLogConfig struct {
+	// Threshold is the shortest duration of the commands logged;
+	// zero logs every command.
+	Threshold time.Duration
+	// MaxLen is the number of the latest entries kept;
+	// zero disables the slow log.
+	MaxLen int
+}
+
+// DefaultSlowLog is the slow log's config of the Metrics created
+// for the Config without ones.
+var DefaultSlowLog = SlowLogConfig{Threshold: 10 * time.Millisecond, MaxLen: 128}
+
+// SlowLogEntry is the command logged as slow.
+type SlowLogEntry struct {
+	// ID grows with every entry logged.
+	ID       uint64
+	Time     time.Time
+	Duration time.Duration
+	Command  string
+	// Args are truncated to maxLoggedArg bytes each;
+	// they're omitted for the commands flagged with FlagSecret.
+	Args []string
+	// Client is the address of the client, "-" if it's unknown.
+	Client string
+	// TxDepth is the number of transaction blocks the command was run in.
+	TxDepth int
+}
+
+// maxLoggedArg is the longest argument kept by the slow log.
+const maxLoggedArg = 128
+
+// NewMetrics creates the Metrics with the slow log configured by cfg.
+func NewMetrics(cfg SlowLogConfig) *Metrics {
+	ret := &Metrics{slowLog: cfg, latencies: map[string]*histogram{}}
+	if cfg.MaxLen > 0 {
+		ret.entries = make([]SlowLogEntry, cfg.MaxLen)
+	}
+	return ret
+}
+
+// record records the command's latency and logs it if it's slow.
+func (m *Metrics) record(c Command, args []string, start time.Time, d time.Duration, client string, txDepth int) {
+	m.histogram(c.Name).add(d)
+	if len(m.entries) == 0 || d < m.slowLog.Threshold {
+		return
+	}
+	entry := SlowLogEntry{Time: start, Duration: d, Command: c.Name, Client: client, TxDepth: txDepth}
+	if c.Flags&FlagSecret == 0 {
+		entry.Args = make([]string, len(args))
+		for i, arg := range args {
+			entry.Args[i] = truncateArg(arg)
+		}
+	}
+
+	m.entriesMu.Lock()
+	defer m.entriesMu.Unlock()
+	entry.ID = m.next
+	m.entries[m.next%uint64(len(m.entries))] = entry
+	m.next++
+}
+
+// histogram returns the command's histogram, creating it if needed.
+func (m *Metrics) histogram(name string) *histogram {
+	m.latenciesMu.RLock()
+	ret, ok := m.latencies[name]
+	m.latenciesMu.RUnlock()
+	if ok {
+		return ret
+	}
+
+	m.latenciesMu.Lock()
+	defer m.latenciesMu.Unlock()
+	if ret, ok = m.latencies[name]; !ok {
+		ret = &histogram{}
+		m.latencies[name] = ret
+	}
+	return ret
+}
+
+// Latencies returns the latency histograms of the commands run,
+// by the commands' names.
+func (m *Metrics) Latencies() map[string]Histogram {
+	m.latenciesMu.RLock()
+	defer m.latenciesMu.RUnlock()
+	ret := make(map[string]Histogram, len(m.latencies))
+	for name, h := range m.latencies {
+		ret[name] = h.snapshot()
+	}
+	return ret
+}
+
+// ResetLatencies forgets the latencies recorded.
+func (m *Metrics) ResetLatencies() {
+	m.latenciesMu.Lock()
+	defer m.latenciesMu.Unlock()
+	m.latencies = map[string]*histogram{}
+}
+
+// SlowLog returns up to n latest slow log's entries, newest first.
+func (m *Metrics) SlowLog(n int) []SlowLogEntry {
+	m.entriesMu.Lock()
+	defer m.entriesMu.Unlock()
+	if l := m.slowLogLen(); n > l {
+		n = l
+	}
+	ret := make([]SlowLogEntry, 0, n)
+	for id := m.next; len(ret) < n; id-- {
+		ret = append(ret, m.entries[(id-1)%uint64(len(m.entries))])
+	}
+	return ret
+}
+
+// SlowLogLen returns the number of the slow log's entries.
+func (m *Metrics) SlowLogLen() int {
+	m.entriesMu.Lock()
+	defer m.entriesMu.Unlock()
+	return m.slowLogLen()
+}
+
+func (m *Metrics) slowLogLen() int {
+	ret := m.next - m.first
+	if ret > uint64(len(m.entries)) {
+		return len(m.entries)
+	}
+	return int(ret)
+}
+
+// ResetSlowLog removes the slow log's entries.
+// Entries' IDs keep growing.
+func (m *Metrics) ResetSlowLog() {
+	m.entriesMu.Lock()
+	defer m.entriesMu.Unlock()
+	m.first = m.next
+}
+
+// latencyBuckets is the number of the histograms' buckets: bucket i counts
+// the latencies shorter than 2^i microseconds, the last one counts the rest.
+const latencyBuckets = 24
+
+// Histogram is the distribution of the command's latencies.
+type Histogram struct {
+	Count uint64
+	Total time.Duration
+	Max   time.Duration
+	// Buckets count the latencies shorter than 2^i microseconds,
+	// but not shorter than the previous bucket's ones.
+	// The last bucket counts all the longer latencies.
+	Buckets [latencyBuckets]uint64
+}
+
+// Quantile returns the upper bound of the latencies of the q's quantile,
+// e.g. 0.99, limited by the longest latency.
+func (h Histogram) Quantile(q float64) time.Duration {
+	// rank is the index of the latency in order
+	rank := uint64(math.Ceil(q*float64(h.Count))) - 1
+	if rank >= h.Count {
+		rank = 0
+	}
+	var seen uint64
+	for i, n := range h.Buckets[:latencyBuckets-1] {
+		if seen += n; seen > rank {
+			if bound := time.Duration(1<<uint(i)) * time.Microsecond; bound < h.Max {
+				return bound
+			}
+			break
+		}
+	}
+	return h.Max
+}
+
+// histogram records the latencies atomically.
+type histogram struct {
+	count, total, max uint64
+	buckets           [latencyBuckets]uint64
+}
+
+func (h *histogram) add(d time.Duration) {
+	i := bits.Len64(uint64(d.Microseconds()))
+	if i >= latencyBuckets {
+		i = latencyBuckets - 1
+	}
+	atomic.AddUint64(&h.buckets[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.total, uint64(d))
+	for {
+		prev := atomic.LoadUint64(&h.max)
+		if uint64(d) <= prev || atomic.CompareAndSwapUint64(&h.max, prev, uint64(d)) {
+			break
+		}
+	}
+}
+
+func (h *histogram) snapshot() Histogram {
+	ret := Histogram{
+		Count: atomic.LoadUint64(&h.count),
+		Total: time.Duration(atomic.LoadUint64(&h.total)),
+		Max:   time.Duration(atomic.LoadUint64(&h.max)),
+	}
+	for i := range h.buckets {
+		ret.Buckets[i] = atomic.LoadUint64(&h.buckets[i])
+	}
+	return ret
+}
+
+// truncateArg truncates the argument to maxLoggedArg bytes.
+func truncateArg(arg string) string {
+	if len(arg) <= maxLoggedArg {
+		return arg
+	}
+	return fmt.Sprintf("%v... (%v more bytes)", arg[:maxLoggedArg], len(arg)-maxLoggedArg)
+}
+
+// formatArgs joins the arguments for the output, quoting the ones
+// that are empty or contain spaces, newlines or non-printable characters.
+func formatArgs(args []string) string {
+	ret := make([]string, len(args))
+	for i, arg := range args {
+		ret[i] = arg
+		if arg == "" || !utf8.ValidString(arg) || strings.IndexFunc(arg, func(r rune) bool { return !unicode.IsGraphic(r) || r == ' ' || r == '"' }) >= 0 {
+			ret[i] = strconv.Quote(arg)
+		}
+	}
+	return strings.Join(ret, " ")
+}
+
+// slowLogCommand executes SLOWLOG's subcommands.
+func slowLogCommand(sess *StorageSession, args []string) string {
+	m := sess.cfg.Metrics
+	sub, rest, _ := strings.Cut(strings.Join(args, " "), " ")
+	switch strings.ToUpper(sub) {
+	case "GET":
+		n := 10
+		if rest != "" {
+			var err error
+			if n, err = strconv.Atoi(rest); err != nil || n < 0 {
+				return errOutput(ErrInvalidNumber.Here().Append(rest))
+			}
+		}
+		entries := m.SlowLog(n)
+		lines := []string{strconv.Itoa(len(entries))}
+		for _, e := range entries {
+			line := fmt.Sprintf("%v %v %v %v %v %v", e.ID, e.Time.Format(time.RFC3339Nano), e.Duration.Microseconds(),
+				e.Client, e.TxDepth, e.Command)
+			if len(e.Args) > 0 {
+				line += " " + formatArgs(e.Args)
+			}
+			lines = append(lines, line)
+		}
+		return strings.Join(lines, "\n")
+	case "LEN":
+		return strconv.Itoa(m.SlowLogLen())
+	case "RESET":
+		m.ResetSlowLog()
+		return ""
+	}
+	return "UNKNOWN COMMAND"
+}
+
+// latencyCommand lists the commands' latencies for LATENCY.
+func latencyCommand(sess *StorageSession, args []string) string {
+	m := sess.cfg.Metrics
+	if len(args) > 0 && strings.ToUpper(args[0]) == "RESET" {
+		m.ResetLatencies()
+		return ""
+	}
+	latencies := m.Latencies()
+	names := make([]string, 0, len(latencies))
+	for name := range latencies {
+		if len(args) == 0 || name == args[0] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	lines := []string{strconv.Itoa(len(names))}
+	for _, name := range names {
+		h := latencies[name]
+		lines = append(lines, fmt.Sprintf("%v %v %v %v %v", name, h.Count,
+			h.Quantile(0.5).Microseconds(), h.Quantile(0.99).Microseconds(), h.Max.Microseconds()))
+	}
+	return strings.Join(lines, "\n")
+}
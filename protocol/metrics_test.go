@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"bufio"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/utrack/go-simple-memdb/storage"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowLog(t *testing.T) {
+	Convey("With socket logging every command", t, func() {
+		m := NewMetrics(SlowLogConfig{MaxLen: 3})
+		sock := NewSocketConfig(storage.New(), Config{Metrics: m})
+
+		Convey("Latest entries should be kept, newest first", func() {
+			exec(sock, "SET a 10", "BEGIN", "SET b 20", "GET a", "NUMEQUALTO 10")
+			So(m.SlowLogLen(), ShouldEqual, 3)
+			entries := m.SlowLog(10)
+			So(entries, ShouldHaveLength, 3)
+			So(entries[0].ID, ShouldEqual, uint64(4))
+			So(entries[0].Command, ShouldEqual, "NUMEQUALTO")
+			So(entries[0].Args, ShouldResemble, []string{"10"})
+			So(entries[0].TxDepth, ShouldEqual, 1)
+			So(entries[0].Client, ShouldEqual, "-")
+			So(entries[2].Command, ShouldEqual, "SET")
+			So(entries[2].Args, ShouldResemble, []string{"b", "20"})
+			So(m.SlowLog(1), ShouldResemble, entries[:1])
+
+			out := exec(sock, "SLOWLOG GET 2", "SLOWLOG LEN", "SLOWLOG RESET", "SLOWLOG LEN", "SLOWLOG GET")
+			lines := strings.Split(out[0], "\n")
+			So(lines, ShouldHaveLength, 3)
+			So(lines[0], ShouldEqual, "2")
+			fields := strings.Fields(lines[1])
+			So(fields[0], ShouldEqual, "4")
+			So(fields[3:], ShouldResemble, []string{"-", "1", "NUMEQUALTO", "10"})
+			_, err := time.Parse(time.RFC3339Nano, fields[1])
+			So(err, ShouldBeNil)
+			// SLOWLOG's commands are logged too
+			So(out[1:4], ShouldResemble, []string{"3", "", "1"})
+			lines = strings.Split(out[4], "\n")
+			So(lines, ShouldHaveLength, 3)
+			So(lines[1], ShouldEndWith, " SLOWLOG LEN")
+			So(lines[2], ShouldEndWith, " SLOWLOG RESET")
+		})
+		Convey("Arguments should be truncated and quoted", func() {
+			exec(sock, "SET a "+strings.Repeat("x", 200), "SETB b 3\nx\ny", "AUTH user password")
+			entries := m.SlowLog(3)
+			So(entries[0].Command, ShouldEqual, "AUTH")
+			So(entries[0].Args, ShouldBeNil)
+			So(entries[1].Args, ShouldResemble, []string{"b", "x\ny"})
+			So(entries[2].Args[1], ShouldEqual, strings.Repeat("x", 128)+"... (72 more bytes)")
+
+			lines := strings.Split(exec(sock, "SLOWLOG GET 2")[0], "\n")
+			So(lines[1], ShouldEndWith, " AUTH")
+			So(lines[2], ShouldEndWith, ` SETB b "x\ny"`)
+		})
+		Convey("Malformed subcommands should be rejected", func() {
+			So(exec(sock, "SLOWLOG GET x", "SLOWLOG FOO", "SLOWLOG"), ShouldResemble,
+				[]string{"INVALID NUMBER", "UNKNOWN COMMAND", "WRONG NUMBER OF ARGUMENTS"})
+		})
+	})
+
+	Convey("Commands faster than the threshold should not be logged", t, func() {
+		m := NewMetrics(SlowLogConfig{Threshold: time.Hour, MaxLen: 3})
+		sock := NewSocketConfig(storage.New(), Config{Metrics: m})
+		exec(sock, "SET a 10", "GET a")
+		So(m.SlowLogLen(), ShouldEqual, 0)
+		So(m.Latencies()["GET"].Count, ShouldEqual, uint64(1))
+	})
+
+	Convey("Server's sessions should share the slow log, naming the clients", t, func() {
+		m := NewMetrics(SlowLogConfig{MaxLen: 10})
+		srv := NewServerConfig(storage.New(), Config{Metrics: m})
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		go func() { _ = srv.Serve(l) }()
+		defer srv.Close()
+
+		for i := 0; i < 2; i++ {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			So(err, ShouldBeNil)
+			_, err = conn.Write([]byte("SET a 10\n"))
+			So(err, ShouldBeNil)
+			_, err = bufio.NewReader(conn).ReadString('\n')
+			So(err, ShouldBeNil)
+			So(m.SlowLog(1)[0].Client, ShouldEqual, conn.LocalAddr().String())
+			_ = conn.Close()
+		}
+		So(m.SlowLogLen(), ShouldEqual, 2)
+	})
+}
+
+func TestLatencies(t *testing.T) {
+	Convey("Latencies should be counted by their buckets", t, func() {
+		h := &histogram{}
+		for _, d := range []time.Duration{0, 500 * time.Nanosecond, 3 * time.Microsecond, 3 * time.Microsecond, time.Hour} {
+			h.add(d)
+		}
+		got := h.snapshot()
+		So(got.Count, ShouldEqual, uint64(5))
+		So(got.Max, ShouldEqual, time.Hour)
+		So(got.Buckets[0], ShouldEqual, uint64(2))
+		So(got.Buckets[2], ShouldEqual, uint64(2))
+		So(got.Buckets[latencyBuckets-1], ShouldEqual, uint64(1))
+
+		So(got.Quantile(0.4), ShouldEqual, time.Microsecond)
+		So(got.Quantile(0.5), ShouldEqual, 4*time.Microsecond)
+		So(got.Quantile(0.8), ShouldEqual, 4*time.Microsecond)
+		So(got.Quantile(0.99), ShouldEqual, time.Hour)
+		So(Histogram{}.Quantile(0.5), ShouldEqual, 0)
+	})
+
+	Convey("LATENCY should list the commands run", t, func() {
+		sock := NewSocket(storage.New())
+		exec(sock, "SET a 10", "GET a", "GET b")
+		lines := strings.Split(exec(sock, "LATENCY")[0], "\n")
+		So(lines[0], ShouldEqual, "2")
+		So(strings.Fields(lines[1])[:2], ShouldResemble, []string{"GET", "2"})
+		So(strings.Fields(lines[2])[:2], ShouldResemble, []string{"SET", "1"})
+		So(strings.Split(exec(sock, "LATENCY SET")[0], "\n"), ShouldHaveLength, 2)
+		out := exec(sock, "LATENCY RESET", "LATENCY")
+		So(out[0], ShouldBeEmpty)
+		So(out[1], ShouldStartWith, "1\nLATENCY 1 ")
+	})
+}
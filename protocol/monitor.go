@@ -0,0 +1,229 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// monitorBuffer is the number of the events buffered for a monitor;
+// events are dropped while its buffer is full.
+const monitorBuffer = 1024
+
+// Monitors stream the commands executed by the sessions
+// to the sessions in MONITOR mode.
+// Sessions sharing the Config share its Monitors.
+// They are safe for concurrent use.
+type Monitors struct {
+	// n is the number of monitors, so the commands
+	// are not published if there are none.
+	n int32
+
+	mu       sync.RWMutex
+	monitors map[*monitor]struct{}
+}
+
+// MonitorEvent is the command executed by the session.
+type MonitorEvent struct {
+	Time time.Time
+	// Client is the address of the client, "-" if it's unknown.
+	Client string
+	// DB is the name of the selected database, "-" if the session
+	// has no registry.
+	DB string
+	// TxDepth is the number of transaction blocks the command was run in.
+	TxDepth int
+	Command Command
+	// Args are the command's arguments, truncated as in the slow log.
+	Args []string
+	// key is the command's key, not truncated, for the monitors' ACLs.
+	key string
+}
+
+// monitor is the session in MONITOR mode.
+type monitor struct {
+	sess   *StorageSession
+	events chan MonitorEvent
+	// dropped is the number of the events dropped since the last one sent.
+	dropped uint64
+}
+
+// NewMonitors creates the Monitors without monitors.
+func NewMonitors() *Monitors {
+	return &Monitors{monitors: map[*monitor]struct{}{}}
+}
+
+// publish sends the session's command to the monitors but the session's own.
+// Monitors which can't keep up miss the events, so the commands
+// are never blocked. Arguments are truncated before the events are buffered,
+// so the buffers don't keep the payloads.
+func (m *Monitors) publish(sess *StorageSession, c Command, args []string) {
+	if atomic.LoadInt32(&m.n) == 0 {
+		return
+	}
+	e := MonitorEvent{
+		Time:    time.Now(),
+		Client:  sess.client,
+		DB:      sess.DBName(),
+		TxDepth: sess.TxDepth(),
+		Command: c,
+		Args:    make([]string, len(args)),
+	}
+	// Arguments are cloned, so they don't keep the command's line either
+	for i, arg := range args {
+		e.Args[i] = strings.Clone(truncateArg(arg))
+	}
+	if c.Flags&FlagKey != 0 && len(args) > 0 {
+		e.key = strings.Clone(args[0])
+	}
+	if e.DB == "" {
+		e.DB = "-"
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for mon := range m.monitors {
+		if mon.sess == sess {
+			continue
+		}
+		select {
+		case mon.events <- e:
+		default:
+			atomic.AddUint64(&mon.dropped, 1)
+		}
+	}
+}
+
+// subscribe starts sending the events to the session.
+func (m *Monitors) subscribe(sess *StorageSession) *monitor {
+	ret := &monitor{sess: sess, events: make(chan MonitorEvent, monitorBuffer)}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.monitors[ret] = struct{}{}
+	atomic.AddInt32(&m.n, 1)
+	return ret
+}
+
+// unsubscribe stops sending the events to the monitor.
+func (m *Monitors) unsubscribe(mon *monitor) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.monitors[mon]; ok {
+		delete(m.monitors, mon)
+		atomic.AddInt32(&m.n, -1)
+	}
+}
+
+// Monitor switches the session to MONITOR mode: the commands executed
+// by the other sessions are streamed to it by the socket's Process.
+func (i *StorageSession) Monitor() string {
+	if i.monitor == nil {
+		i.monitor = i.cfg.Monitors.subscribe(i)
+	}
+	return ""
+}
+
+// format formats the event for the monitor. Arguments are redacted
+// if the monitor's user is not allowed to see them.
+func (mon *monitor) format(e MonitorEvent) string {
+	ret := fmt.Sprintf("%v [%v %v %v] %v", e.Time.Format(time.RFC3339Nano), e.DB, e.Client, e.TxDepth, e.Command.Name)
+	if len(e.Args) == 0 {
+		return ret
+	}
+	if mon.redacts(e) {
+		return ret + " (redacted)"
+	}
+	return ret + " " + formatArgs(e.Args)
+}
+
+// redacts returns true if the event's arguments should be hidden
+// from the monitor: they're secret, or the monitor's user
+// is not allowed to run the command or to access its keys.
+func (mon *monitor) redacts(e MonitorEvent) bool {
+	if e.Command.Flags&FlagSecret != 0 {
+		return true
+	}
+	if len(mon.sess.cfg.Users) == 0 {
+		return false
+	}
+	user := mon.sess.user
+	if user == nil || !user.ACL.allowsCommand(e.Command) {
+		return true
+	}
+	if e.Command.Flags&FlagKeyspace != 0 && !user.ACL.allowsAllKeys() {
+		return true
+	}
+	return e.Command.Flags&FlagKey != 0 && !user.ACL.allowsKey(e.key)
+}
+
+// stream writes the monitor's events until END is read or the pipe is closed.
+// Other commands are ignored.
+func (mon *monitor) stream(r *bufio.Reader, w *bufio.Writer) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if mon.sess.cfg.Dialect == DialectRESP {
+				args, err := readRESP(r)
+				if err != nil {
+					return
+				}
+				if len(args) == 0 {
+					continue
+				}
+				if c, found := lookupCommand(strings.ToUpper(args[0])); found && c.Flags&FlagQuit != 0 {
+					return
+				}
+				continue
+			}
+			cmdRaw, err := readCommand(r)
+			if err != nil {
+				return
+			}
+			if c, _, found := parseCommand(cmdRaw); found && c.Flags&FlagQuit != 0 {
+				return
+			}
+		}
+	}()
+
+	for {
+		if w.Flush() != nil {
+			return
+		}
+		select {
+		case e := <-mon.events:
+			if !mon.write(w, e) {
+				return
+			}
+			// Write the events buffered in a batch
+			for n := len(mon.events); n > 0; n-- {
+				if !mon.write(w, <-mon.events) {
+					return
+				}
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// write writes the event, preceded by the number of the events
+// dropped since the last one written, if there are any.
+// Events are the lines, or the simple strings in the RESP dialect.
+func (mon *monitor) write(w io.StringWriter, e MonitorEvent) bool {
+	prefix, suffix := "", "\n"
+	if mon.sess.cfg.Dialect == DialectRESP {
+		prefix, suffix = "+", "\r\n"
+	}
+	if dropped := atomic.SwapUint64(&mon.dropped, 0); dropped > 0 {
+		if _, err := w.WriteString(fmt.Sprintf("%vDROPPED %v%v", prefix, dropped, suffix)); err != nil {
+			return false
+		}
+	}
+	_, err := w.WriteString(prefix + mon.format(e) + suffix)
+	return err == nil
+}
@@ -0,0 +1,162 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/utrack/go-simple-memdb/storage"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMonitor(t *testing.T) {
+	Convey("With registry server", t, func() {
+		srv := NewRegistryServer(storage.NewRegistry(), Config{})
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		go func() { _ = srv.Serve(l) }()
+		Reset(func() { _ = srv.Close() })
+
+		dial := func() (net.Conn, *bufio.Reader) {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			So(err, ShouldBeNil)
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			return conn, bufio.NewReader(conn)
+		}
+		readLine := func(r *bufio.Reader) string {
+			ret, err := r.ReadString('\n')
+			So(err, ShouldBeNil)
+			return strings.TrimSuffix(ret, "\n")
+		}
+
+		mon, monR := dial()
+		_, err = mon.Write([]byte("MONITOR\n"))
+		So(err, ShouldBeNil)
+		So(readLine(monR), ShouldBeEmpty)
+
+		Convey("Other sessions' commands should be streamed", func() {
+			c, r := dial()
+			_, err := c.Write([]byte("SET a 10\nSELECT 1\nBEGIN\nSETB b 3\nx y\nGET a\n"))
+			So(err, ShouldBeNil)
+			for i := 0; i < 5; i++ {
+				readLine(r)
+			}
+
+			client := c.LocalAddr().String()
+			var got []string
+			for i := 0; i < 5; i++ {
+				line := readLine(monR)
+				fields := strings.SplitN(line, " ", 2)
+				_, err := time.Parse(time.RFC3339Nano, fields[0])
+				So(err, ShouldBeNil)
+				got = append(got, fields[1])
+			}
+			So(got, ShouldResemble, []string{
+				"[0 " + client + " 0] SET a 10",
+				"[0 " + client + " 0] SELECT 1",
+				"[1 " + client + " 0] BEGIN",
+				"[1 " + client + " 1] SETB b \"x y\"",
+				"[1 " + client + " 1] GET a",
+			})
+
+			Convey("END should stop the stream", func() {
+				_, err := mon.Write([]byte("GET a\nEND\n"))
+				So(err, ShouldBeNil)
+				_, err = monR.ReadString('\n')
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+
+	Convey("With users", t, func() {
+		cfg := Config{
+			Users: []User{
+				testUser("admin", "secret", ACL{Commands: []string{"@all"}, Keys: []string{"*"}}),
+				testUser("app1", "app1pass", ACL{Commands: []string{"@read", "MONITOR"}, Keys: []string{"app1:*"}}),
+			},
+			Monitors: NewMonitors(),
+		}
+		sock := NewSocketConfig(storage.New(), cfg)
+		So(exec(sock, "AUTH admin secret"), ShouldResemble, []string{""})
+
+		Convey("Values denied by the monitor's ACL should be redacted", func() {
+			monSock := NewSocketConfig(storage.New(), cfg)
+			So(exec(monSock, "AUTH app1 app1pass", "MONITOR"), ShouldResemble, []string{"", ""})
+			exec(sock, "SET app1:a 10", "GET app1:a", "GET app2:a", "NUMEQUALTO 10", "AUTH admin secret", "COMMIT")
+			So(exec(monSock, "GET app1:a"), ShouldResemble, []string{"NULL"})
+
+			var got []string
+			for n := len(monSock.sess.monitor.events); n > 0; n-- {
+				line := monSock.sess.monitor.format(<-monSock.sess.monitor.events)
+				got = append(got, line[strings.Index(line, "] ")+2:])
+			}
+			So(got, ShouldResemble, []string{
+				"SET (redacted)",
+				"GET app1:a",
+				"GET (redacted)",
+				"NUMEQUALTO (redacted)",
+				"AUTH (redacted)",
+				"COMMIT",
+			})
+		})
+		Convey("MONITOR should be allowed to the permitted users outside of transactions", func() {
+			So(exec(sock, "BEGIN", "MONITOR", "ROLLBACK"), ShouldResemble, []string{"", "NOT ALLOWED IN TRANSACTION", ""})
+			reader := NewSocketConfig(storage.New(), cfg)
+			cfg.Users[1].ACL.Commands = []string{"@read"}
+			So(exec(reader, "AUTH app1 app1pass", "MONITOR"), ShouldResemble, []string{"", "NOPERM"})
+		})
+	})
+
+	Convey("Slow monitor should not block the commands", t, func() {
+		cfg := Config{Monitors: NewMonitors()}
+		monSock := NewSocketConfig(storage.New(), cfg)
+		sock := NewSocketConfig(storage.New(), cfg)
+		So(exec(monSock, "MONITOR"), ShouldResemble, []string{""})
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < monitorBuffer+10; i++ {
+				sock.Exec("SET a 10")
+			}
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			So("commands blocked", ShouldBeEmpty)
+		}
+
+		mon := monSock.sess.monitor
+		So(len(mon.events), ShouldEqual, monitorBuffer)
+		buf := &bytes.Buffer{}
+		So(mon.write(buf, <-mon.events), ShouldBeTrue)
+		So(buf.String(), ShouldStartWith, "DROPPED 10\n")
+		So(buf.String(), ShouldEndWith, " SET a 10\n")
+
+		Convey("Closed monitor should stop receiving", func() {
+			monSock.Close()
+			So(cfg.Monitors.n, ShouldEqual, 0)
+			sock.Exec("SET a 10")
+			So(len(mon.events), ShouldEqual, monitorBuffer-1)
+		})
+	})
+}
+
+func TestMonitorsPublish(t *testing.T) {
+	Convey("Published arguments should be truncated before buffering", t, func() {
+		m := NewMonitors()
+		mon := m.subscribe(NewSession(storage.New()))
+		c, _ := lookupCommand("SETB")
+		key, value := strings.Repeat("k", 200), strings.Repeat("x", 1<<20)
+		m.publish(NewSession(storage.New()), c, []string{key, value})
+
+		e := <-mon.events
+		So(e.Args, ShouldResemble, []string{truncateArg(key), truncateArg(value)})
+		So(len(e.Args[1]), ShouldBeLessThan, 200)
+		So(e.key, ShouldEqual, key)
+		So(mon.format(e), ShouldEndWith, " SETB "+strconv.Quote(truncateArg(key))+" "+strconv.Quote(truncateArg(value)))
+	})
+}
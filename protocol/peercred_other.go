@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package protocol
+
+import (
+	"net"
+)
+
+// peerCred returns ErrPeerCredUnsupported:
+// SO_PEERCRED is supported on Linux only.
+func peerCred(conn *net.UnixConn) (PeerCred, error) {
+	return PeerCred{}, ErrPeerCredUnsupported.Here()
+}
@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/ansel1/merry"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Dialect is the protocol's dialect the pipes are processed in.
+type Dialect int
+
+// Dialects of the protocol.
+const (
+	// DialectLine reads a command per line and writes
+	// an output per command, terminated by a newline.
+	DialectLine Dialect = iota
+	// DialectRESP reads the commands as the arrays of bulk strings
+	// or inline commands of the Redis serialization protocol and writes
+	// their output as its replies, see writeRESP.
+	DialectRESP
+)
+
+var dialectNames = []string{"line", "resp"}
+
+// ErrUnknownDialect is returned when parsing unknown dialect's name.
+var ErrUnknownDialect = merry.New("Unknown dialect.")
+
+// String implements fmt.Stringer.
+func (d Dialect) String() string {
+	if d < DialectLine || d > DialectRESP {
+		return fmt.Sprintf("dialect(%d)", int(d))
+	}
+	return dialectNames[d]
+}
+
+// ParseDialect returns the dialect by its name: line or resp.
+func ParseDialect(name string) (Dialect, error) {
+	for i, n := range dialectNames {
+		if n == name {
+			return Dialect(i), nil
+		}
+	}
+	return 0, ErrUnknownDialect.Here().Append(name)
+}
+
+// maxRESPArgs is the largest number of the RESP command's arguments.
+const maxRESPArgs = 1024
+
+// readRESP reads the RESP array of bulk strings, or the inline command's
+// line split by spaces. ErrInvalidRequest is returned if it's malformed.
+func readRESP(r *bufio.Reader) ([]string, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > maxRESPArgs {
+		return nil, ErrInvalidRequest.Here().Append(line)
+	}
+	ret := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		if line, err = readRESPLine(r); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimPrefix(line, "$"))
+		if !strings.HasPrefix(line, "$") || err != nil || size < 0 || size > maxPayload {
+			return nil, ErrInvalidRequest.Here().Append(line)
+		}
+		// Bulk string is terminated by CRLF
+		arg := make([]byte, size+2)
+		if _, err = io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, ErrInvalidRequest.Here().Append("bulk string is not terminated")
+		}
+		ret = append(ret, string(arg[:size]))
+	}
+	return ret, nil
+}
+
+// readRESPLine reads the line without its CRLF or LF terminator.
+func readRESPLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// respOutput drops the length line of GETB's output:
+// the RESP bulk strings carry their length themselves.
+func respOutput(args []string, output string) string {
+	if len(args) == 0 || !strings.EqualFold(args[0], "GETB") || output == "NULL" || isErrOutput(output) {
+		return output
+	}
+	if i := strings.IndexByte(output, '\n'); i >= 0 {
+		return output[i+1:]
+	}
+	return output
+}
+
+// writeRESP writes the command's output as the RESP reply:
+// empty output is +OK, NULL is the null bulk string, error outputs
+// are the errors and the other outputs are the bulk strings.
+func writeRESP(w *bufio.Writer, output string) {
+	switch {
+	case output == "":
+		_, _ = w.WriteString("+OK\r\n")
+	case output == "NULL":
+		_, _ = w.WriteString("$-1\r\n")
+	case isErrOutput(output):
+		_, _ = w.WriteString("-" + output + "\r\n")
+	default:
+		_, _ = w.WriteString("$" + strconv.Itoa(len(output)) + "\r\n" + output + "\r\n")
+	}
+}
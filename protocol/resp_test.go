@@ -0,0 +1,135 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/ansel1/merry"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/utrack/go-simple-memdb/storage"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRESP(t *testing.T) {
+	Convey("With RESP socket", t, func() {
+		sock := NewSocketConfig(storage.New(), Config{Dialect: DialectRESP})
+		process := func(in string) string {
+			out := bytes.NewBuffer(nil)
+			sock.Process(strings.NewReader(in), out)
+			return out.String()
+		}
+
+		Convey("Arrays of bulk strings should be executed", func() {
+			So(process("*3\r\n$3\r\nset\r\n$1\r\na\r\n$2\r\n10\r\n"+
+				"*2\r\n$3\r\nGET\r\n$1\r\na\r\n"+
+				"*2\r\n$3\r\nGET\r\n$1\r\nb\r\n"+
+				"*2\r\n$10\r\nNUMEQUALTO\r\n$2\r\n10\r\n"),
+				ShouldEqual, "+OK\r\n$2\r\n10\r\n$-1\r\n$1\r\n1\r\n")
+		})
+
+		Convey("Inline commands should be executed", func() {
+			So(process("SET a 10\r\nGET a\nNOPE\r\nGET\r\n\r\nCOMMIT\r\n"), ShouldEqual,
+				"+OK\r\n$2\r\n10\r\n-UNKNOWN COMMAND\r\n-WRONG NUMBER OF ARGUMENTS\r\n-UNKNOWN COMMAND\r\n-NO TRANSACTION\r\n")
+		})
+
+		Convey("Bulk strings should be binary-safe", func() {
+			So(process("*3\r\n$4\r\nSETB\r\n$1\r\na\r\n$6\r\nx y\r\n\x00\r\n"+
+				"*2\r\n$4\r\nGETB\r\n$1\r\na\r\n"), ShouldEqual, "+OK\r\n$6\r\nx y\r\n\x00\r\n")
+		})
+
+		Convey("GET should print the values with line breaks", func() {
+			So(process("*3\r\n$4\r\nSETB\r\n$1\r\na\r\n$3\r\nx\ny\r\n*2\r\n$3\r\nGET\r\n$1\r\na\r\n"),
+				ShouldEqual, "+OK\r\n$3\r\nx\ny\r\n")
+		})
+
+		Convey("Values past the second argument should be joined", func() {
+			So(process("*4\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\nx\r\n$1\r\ny\r\n*2\r\n$4\r\nGETB\r\n$1\r\na\r\n"),
+				ShouldEqual, "+OK\r\n$3\r\nx y\r\n")
+		})
+
+		Convey("Malformed requests should close the pipe", func() {
+			for _, in := range []string{
+				"*x\r\n",
+				"*-2\r\n",
+				"*1\r\n:1\r\n",
+				"*1\r\n$3\r\nGETX\r\n",
+				"*1\r\n$-1\r\n",
+			} {
+				So(process(in+"GET a\r\n"), ShouldEqual, "-INVALID REQUEST\r\n")
+			}
+			_, err := readRESP(bufio.NewReader(strings.NewReader("*1\r\n$4\r\nGET\r\n")))
+			So(err, ShouldNotBeNil)
+			_, err = readRESP(bufio.NewReader(strings.NewReader("*2\r\n")))
+			So(merry.Is(err, ErrInvalidRequest), ShouldBeFalse)
+		})
+
+		Convey("END should close the pipe", func() {
+			So(process("*1\r\n$3\r\nend\r\nGET a\r\n"), ShouldBeEmpty)
+		})
+	})
+
+	Convey("With RESP server", t, func() {
+		srv := NewRegistryServer(storage.NewRegistry(), Config{
+			Dialect: DialectRESP,
+			Users:   []User{testUser("alice", "secret", ACL{Commands: []string{"@all"}, Keys: []string{"*"}})},
+		})
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		go func() { _ = srv.Serve(l) }()
+		Reset(func() { _ = srv.Close() })
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		readLine := func() string {
+			ret, err := readRESPLine(r)
+			So(err, ShouldBeNil)
+			return ret
+		}
+
+		Convey("AUTH should authenticate the session", func() {
+			_, err := conn.Write([]byte("GET a\r\n*3\r\n$4\r\nAUTH\r\n$5\r\nalice\r\n$4\r\nnope\r\nAUTH alice secret\r\nGET a\r\n"))
+			So(err, ShouldBeNil)
+			So([]string{readLine(), readLine(), readLine(), readLine()}, ShouldResemble,
+				[]string{"-NOAUTH", "-WRONGPASS", "+OK", "$-1"})
+		})
+
+		Convey("MONITOR should stream simple strings", func() {
+			_, err := conn.Write([]byte("AUTH alice secret\r\nMONITOR\r\n"))
+			So(err, ShouldBeNil)
+			So([]string{readLine(), readLine()}, ShouldResemble, []string{"+OK", "+OK"})
+
+			other, err := net.Dial("tcp", l.Addr().String())
+			So(err, ShouldBeNil)
+			defer other.Close()
+			_, err = other.Write([]byte("AUTH alice secret\r\n*3\r\n$3\r\nSET\r\n$1\r\na\r\n$2\r\n10\r\n"))
+			So(err, ShouldBeNil)
+
+			So(readLine(), ShouldEndWith, "] AUTH (redacted)")
+			line := readLine()
+			So(line, ShouldStartWith, "+")
+			So(line, ShouldEndWith, "] SET a 10")
+
+			_, err = conn.Write([]byte("*1\r\n$3\r\nEND\r\n"))
+			So(err, ShouldBeNil)
+			_, err = r.ReadString('\n')
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestParseDialect(t *testing.T) {
+	Convey("Dialects should be parsed by their names", t, func() {
+		for _, d := range []Dialect{DialectLine, DialectRESP} {
+			got, err := ParseDialect(d.String())
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, d)
+		}
+		_, err := ParseDialect("xml")
+		So(merry.Is(err, ErrUnknownDialect), ShouldBeTrue)
+	})
+}
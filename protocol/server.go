@@ -0,0 +1,184 @@
+package protocol
+
+import (
+	"github.com/utrack/go-simple-memdb/storage"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Server serves the protocol over network connections.
+// Every connection gets its own StorageSession.
+type Server struct {
+	db  storage.DB
+	reg *storage.Registry
+	cfg Config
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	https     map[*http.Server]struct{}
+	isClosed  bool
+}
+
+// NewServer creates and returns new Server over the database.
+func NewServer(db storage.DB) *Server {
+	return NewServerConfig(db, Config{})
+}
+
+// NewReadOnlyServer creates and returns new Server
+// that rejects all writes, e.g. for replicas.
+func NewReadOnlyServer(db storage.DB) *Server {
+	return NewServerConfig(db, Config{ReadOnly: true})
+}
+
+// NewServerConfig creates and returns new Server
+// configured by cfg.
+func NewServerConfig(db storage.DB, cfg Config) *Server {
+	return &Server{
+		db:        db,
+		cfg:       cfg.withDefaults(),
+		listeners: map[net.Listener]struct{}{},
+		conns:     map[net.Conn]struct{}{},
+		https:     map[*http.Server]struct{}{},
+	}
+}
+
+// NewRegistryServer creates and returns new Server
+// over the registry's databases configured by cfg.
+// Connections start in database "0".
+func NewRegistryServer(reg *storage.Registry, cfg Config) *Server {
+	ret := NewServerConfig(reg.Get("0"), cfg)
+	ret.reg = reg
+	return ret
+}
+
+// Serve accepts connections on the listener and serves them
+// until the listener or the server is closed.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.track(l) {
+		_ = l.Close()
+		return ErrServerClosed.Here()
+	}
+	defer s.untrack(l)
+	s.cfg.Logger.Infof("Serving on %v %v", l.Addr().Network(), l.Addr())
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.closed() {
+				return ErrServerClosed.Here()
+			}
+			s.cfg.Logger.Errorf("Accept on %v failed: %v", l.Addr(), err)
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close closes server's listeners, connections and HTTP servers.
+// Transactions in progress are rolled back.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.isClosed = true
+	for l := range s.listeners {
+		_ = l.Close()
+	}
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	for hs := range s.https {
+		_ = hs.Close()
+	}
+	return nil
+}
+
+// serveConn processes connection's requests until it's closed.
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	if !s.track(conn) {
+		return
+	}
+	defer s.untrack(conn)
+	if !s.allowPeer(conn) {
+		return
+	}
+
+	commonName, err := handshake(conn)
+	if err != nil {
+		s.cfg.Logger.Warnf("TLS handshake with %v failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	s.cfg.Logger.Debugf("Client %v connected", conn.RemoteAddr())
+	defer s.cfg.Logger.Debugf("Client %v disconnected", conn.RemoteAddr())
+	sock := s.newSocket()
+	if commonName != "" {
+		sock.sess.authenticateAs(commonName)
+	}
+	sock.sess.client = clientAddr(conn)
+	sock.Process(conn, conn)
+}
+
+// newSocket returns the socket of a new session over the server's databases.
+func (s *Server) newSocket() *DBSocket {
+	if s.reg != nil {
+		return NewRegistrySocket(s.reg, s.cfg)
+	}
+	return NewSocketConfig(s.db, s.cfg)
+}
+
+// track remembers the listener, connection or HTTP server
+// to close them on Close().
+// Returns false if the server is closed already.
+func (s *Server) track(c interface{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isClosed {
+		return false
+	}
+	switch c := c.(type) {
+	case net.Listener:
+		s.listeners[c] = struct{}{}
+	case net.Conn:
+		s.conns[c] = struct{}{}
+	case *http.Server:
+		s.https[c] = struct{}{}
+	}
+	return true
+}
+
+// untrack forgets the listener, connection or HTTP server.
+func (s *Server) untrack(c interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch c := c.(type) {
+	case net.Listener:
+		delete(s.listeners, c)
+	case net.Conn:
+		delete(s.conns, c)
+	case *http.Server:
+		delete(s.https, c)
+	}
+}
+
+// closed returns true if the server was closed.
+func (s *Server) closed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.isClosed
+}
+
+// clientAddr returns the connection's remote address,
+// or the local one prefixed with "unix:" for the unnamed unix socket clients.
+func clientAddr(conn net.Conn) string {
+	if addr := conn.RemoteAddr(); addr != nil && addr.String() != "" {
+		return addr.String()
+	}
+	if addr := conn.LocalAddr(); addr != nil && addr.String() != "" {
+		return "unix:" + addr.String()
+	}
+	return "-"
+}
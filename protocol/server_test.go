@@ -0,0 +1,80 @@
+package protocol
+
+import (
+	"bufio"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/utrack/go-simple-memdb/storage"
+	"net"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	Convey("With storage and server over loopback", t, func() {
+		stor := storage.New()
+		srv := NewServer(stor)
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		served := make(chan error, 1)
+		go func() { served <- srv.Serve(l) }()
+
+		dial := func() (net.Conn, *bufio.Reader) {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			So(err, ShouldBeNil)
+			return conn, bufio.NewReader(conn)
+		}
+		cmd := func(conn net.Conn, r *bufio.Reader, line string) string {
+			_, err := conn.Write([]byte(line + "\n"))
+			So(err, ShouldBeNil)
+			ret, err := r.ReadString('\n')
+			So(err, ShouldBeNil)
+			return ret
+		}
+
+		Convey("Connections should share the storage", func() {
+			c1, r1 := dial()
+			c2, r2 := dial()
+			So(cmd(c1, r1, "SET a 10"), ShouldEqual, "\n")
+			So(cmd(c2, r2, "GET a"), ShouldEqual, "10\n")
+
+			Convey("Transactions should be per connection", func() {
+				So(cmd(c1, r1, "BEGIN"), ShouldEqual, "\n")
+				So(cmd(c1, r1, "SET a 20"), ShouldEqual, "\n")
+				So(cmd(c2, r2, "GET a"), ShouldEqual, "10\n")
+				So(cmd(c2, r2, "COMMIT"), ShouldEqual, "NO TRANSACTION\n")
+			})
+		})
+
+		Convey("Registry server should share the databases", func() {
+			reg := storage.NewRegistry()
+			regSrv := NewRegistryServer(reg, Config{})
+			regL, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			go func() { _ = regSrv.Serve(regL) }()
+			defer regSrv.Close()
+
+			c1, err := net.Dial("tcp", regL.Addr().String())
+			So(err, ShouldBeNil)
+			c2, err := net.Dial("tcp", regL.Addr().String())
+			So(err, ShouldBeNil)
+			r1, r2 := bufio.NewReader(c1), bufio.NewReader(c2)
+			So(cmd(c1, r1, "SELECT 1"), ShouldEqual, "\n")
+			So(cmd(c1, r1, "SET a 10"), ShouldEqual, "\n")
+			So(cmd(c2, r2, "GET a"), ShouldEqual, "NULL\n")
+			So(cmd(c2, r2, "SELECT 1"), ShouldEqual, "\n")
+			So(cmd(c2, r2, "GET a"), ShouldEqual, "10\n")
+		})
+
+		Convey("Close should stop serving", func() {
+			c, r := dial()
+			So(cmd(c, r, "SET a 10"), ShouldEqual, "\n")
+			So(srv.Close(), ShouldBeNil)
+			So(<-served, ShouldNotBeNil)
+			_, err := r.ReadString('\n')
+			So(err, ShouldNotBeNil)
+		})
+
+		Reset(func() {
+			_ = srv.Close()
+		})
+	})
+}
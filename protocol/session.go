@@ -1,53 +1,439 @@
 package protocol
 
 import (
+	"fmt"
 	"github.com/ansel1/merry"
 	"github.com/utrack/go-simple-memdb/storage"
+	"math"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // StorageSession handles requests for a connection
 // and returns output strings.
 type StorageSession struct {
 	stor storage.DB
+	// root reads the database's history,
+	// or is nil if the session's DB doesn't keep it.
+	root storage.Root
+
+	// reg keeps the databases to SELECT from, if any.
+	reg *storage.Registry
+	// dbName is the name of the selected database.
+	dbName string
+
+	// readTx is the read-only transaction in progress, if any.
+	readTx storage.ReadOnlyTx
+	// readTxDepth is the number of transaction blocks
+	// opened within the read-only transaction.
+	readTxDepth int
+	// blocks mirrors the storage's stack of transaction blocks
+	// and savepoints in progress (not counting read-only ones).
+	blocks []block
+
+	// user is the authenticated user, if any.
+	user *User
+	// client is the client's address, "-" if it's unknown.
+	client string
+	// monitor receives the other sessions' commands in MONITOR mode.
+	monitor *monitor
+	// entry is the session's entry in the Clients,
+	// if the session processes the pipe.
+	entry *clientEntry
+
+	cfg Config
+}
+
+// block is a transaction block or savepoint in progress.
+type block struct {
+	isSavepoint bool
+	name        string
 }
 
 // NewSession creates and returns new StorageSession.
 func NewSession(stor storage.DB) *StorageSession {
-	return &StorageSession{stor: stor}
+	return NewSessionConfig(stor, Config{})
+}
+
+// NewReadOnlySession creates and returns new StorageSession
+// that rejects all writes, e.g. for replicas.
+func NewReadOnlySession(stor storage.DB) *StorageSession {
+	return NewSessionConfig(stor, Config{ReadOnly: true})
+}
+
+// NewSessionConfig creates and returns new StorageSession
+// configured by cfg.
+func NewSessionConfig(stor storage.DB, cfg Config) *StorageSession {
+	root, _ := stor.(storage.Root)
+	return &StorageSession{stor: stor, root: root, client: "-", cfg: cfg.withDefaults()}
+}
+
+// NewRegistrySession creates and returns new StorageSession
+// over the registry's databases, starting in database "0".
+func NewRegistrySession(reg *storage.Registry, cfg Config) *StorageSession {
+	root := reg.Get("0")
+	return &StorageSession{stor: root, root: root, reg: reg, dbName: "0", client: "-", cfg: cfg.withDefaults()}
+}
+
+// reader returns the storage to read from.
+func (i *StorageSession) reader() storage.Reader {
+	if i.readTx != nil {
+		return i.readTx
+	}
+	return i.stor
+}
+
+// checkWritable returns ErrReadOnly if writes are forbidden
+// for the session or current transaction.
+func (i *StorageSession) checkWritable() error {
+	if i.cfg.ReadOnly || i.readTx != nil {
+		return storage.ErrReadOnly.Here()
+	}
+	return nil
+}
+
+// checkMemory returns storage.ErrOutOfMemory if the session's database
+// takes more memory than allowed.
+func (i *StorageSession) checkMemory() error {
+	if i.root == nil {
+		return nil
+	}
+	return i.root.CheckMemory()
+}
+
+// Reader returns the storage to read from within
+// the current transaction, for the custom commands.
+func (i *StorageSession) Reader() storage.Reader {
+	return i.reader()
+}
+
+// Writer returns the storage to write to within
+// the current transaction, for the custom commands.
+// ErrReadOnly is returned if writes are forbidden.
+func (i *StorageSession) Writer() (storage.ReadWriter, error) {
+	if err := i.checkWritable(); err != nil {
+		return nil, err
+	}
+	return i.stor, nil
 }
 
 // Get returns the variable's value by its key.
 // Returns NULL if not found or error's text
 // on unexpected error.
 func (i *StorageSession) Get(key string) string {
-	ret, err := i.stor.Get(key)
+	ret, err := i.reader().Get(key)
 	if merry.Is(err, storage.ErrNotFound) {
 		return "NULL"
 	}
 	if err != nil {
 		return err.Error()
 	}
-	return ret
+	return i.valueOutput(ret)
+}
+
+// GetPayload returns the value's length and the value on the next line,
+// so it is binary-safe.
+// Returns NULL if not found or error's text
+// on unexpected error.
+func (i *StorageSession) GetPayload(key string) string {
+	ret, err := i.reader().Get(key)
+	if merry.Is(err, storage.ErrNotFound) {
+		return "NULL"
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return strconv.Itoa(len(ret)) + "\n" + ret
+}
+
+// GetAt returns the variable's committed value as of the version
+// (change set's sequence number) or RFC 3339 time.
+// Returns NULL if it was not set at that moment, NO HISTORY if
+// that moment is out of the history kept, or error's text
+// on unexpected error.
+func (i *StorageSession) GetAt(key, at string) string {
+	if i.root == nil {
+		return errOutput(storage.ErrNoHistory.Here())
+	}
+	var ret string
+	var err error
+	if seq, parseErr := strconv.ParseUint(at, 10, 64); parseErr == nil {
+		ret, err = i.root.GetAt(key, seq)
+	} else if t, parseErr := time.Parse(time.RFC3339Nano, at); parseErr == nil {
+		ret, err = i.root.GetAtTime(key, t)
+	} else {
+		err = ErrInvalidVersion.Here().Append(at)
+	}
+	if merry.Is(err, storage.ErrNotFound) {
+		return "NULL"
+	}
+	if err != nil {
+		return errOutput(err)
+	}
+	return i.valueOutput(ret)
+}
+
+// valueOutput returns the value printed by GET, or BINARY VALUE
+// if it has line breaks and the session is in the line dialect:
+// the following lines would be read as the next commands' outputs.
+func (i *StorageSession) valueOutput(value string) string {
+	if i.cfg.Dialect != DialectRESP && strings.ContainsRune(value, '\n') {
+		return errOutput(ErrBinaryValue.Here())
+	}
+	return value
+}
+
+// Expire sets the committed variable to expire after the number of seconds.
+// Returns nothing on success or NULL if the variable is not set.
+func (i *StorageSession) Expire(key, seconds string) string {
+	if i.root == nil {
+		return errOutput(ErrNoExpiration.Here())
+	}
+	n, err := strconv.ParseUint(seconds, 10, 32)
+	if err != nil {
+		return errOutput(ErrInvalidNumber.Here().Append(seconds))
+	}
+	if !i.root.Expire(key, time.Duration(n)*time.Second) {
+		return "NULL"
+	}
+	return ""
+}
+
+// TTL prints the seconds left until the committed variable expires,
+// rounded up, -1 if it doesn't expire or NULL if it's not set.
+func (i *StorageSession) TTL(key string) string {
+	if i.root == nil {
+		return errOutput(ErrNoExpiration.Here())
+	}
+	ttl, ok, err := i.root.TTL(key)
+	switch {
+	case merry.Is(err, storage.ErrNotFound):
+		return "NULL"
+	case err != nil:
+		return errOutput(err)
+	case !ok:
+		return "-1"
+	}
+	return strconv.FormatInt(int64((ttl+time.Second-1)/time.Second), 10)
+}
+
+// Persist removes the variable's expiration.
+// Returns nothing on success or NULL if the variable didn't expire.
+func (i *StorageSession) Persist(key string) string {
+	if i.root == nil {
+		return errOutput(ErrNoExpiration.Here())
+	}
+	if !i.root.Persist(key) {
+		return "NULL"
+	}
+	return ""
+}
+
+// History lists the variable's committed versions kept: their count,
+// then a line of the version's number, time and value (or NULL if it
+// was unset) per version, oldest first.
+func (i *StorageSession) History(key string) string {
+	var versions []storage.Version
+	if i.root != nil {
+		versions = i.root.History(key)
+	}
+	lines := []string{strconv.Itoa(len(versions))}
+	for _, v := range versions {
+		value := v.Value
+		if v.Deleted {
+			value = "NULL"
+		}
+		lines = append(lines, fmt.Sprintf("%v %v %v", v.Seq, v.Time.Format(time.RFC3339Nano), value))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Find lists the keys of the variables set to the value, or indexed
+// as the value by the index if it's set: their count, then a line per key.
+// Keys denied by the user's ACL are skipped.
+// Returns NO INDEX if there's no such index.
+func (i *StorageSession) Find(index, value string) string {
+	finder, ok := i.reader().(storage.Finder)
+	if !ok {
+		return errOutput(storage.ErrNoIndex.Here())
+	}
+	keys := finder.KeysWithValue(value)
+	if index != "" {
+		var err error
+		if keys, err = finder.Find(index, value); err != nil {
+			return errOutput(err)
+		}
+	}
+	lines := []string{""}
+	keys(func(key string) bool {
+		if i.user == nil || i.user.ACL.allowsKey(key) {
+			lines = append(lines, key)
+		}
+		return true
+	})
+	lines[0] = strconv.Itoa(len(lines) - 1)
+	return strings.Join(lines, "\n")
+}
+
+// CreateIndex creates the index of the database's variables
+// by their JSON field at the dot-separated path.
+// Returns nothing on success or INDEX EXISTS if the name is taken.
+func (i *StorageSession) CreateIndex(name, path string) string {
+	if i.root == nil {
+		return errOutput(storage.ErrNoIndex.Here())
+	}
+	return errOutput(i.root.CreateIndex(name, storage.JSONField(path)))
+}
+
+// DropIndex removes the database's index.
+// Returns nothing on success or NO INDEX if there's no such index.
+func (i *StorageSession) DropIndex(name string) string {
+	if i.root == nil {
+		return errOutput(storage.ErrNoIndex.Here())
+	}
+	return errOutput(i.root.DropIndex(name))
+}
+
+// CountRange prints the number of variables whose values are between
+// min and max inclusive, compared as strings or as numbers if numeric is set.
+// Returns INVALID NUMBER if numeric bounds are not numbers.
+func (i *StorageSession) CountRange(min, max string, numeric bool) string {
+	agg, err := i.aggregator()
+	if err != nil {
+		return errOutput(err)
+	}
+	if !numeric {
+		return strconv.FormatUint(agg.CountRange(min, max), 10)
+	}
+	minNumber, err := parseNumber(min)
+	if err != nil {
+		return errOutput(err)
+	}
+	maxNumber, err := parseNumber(max)
+	if err != nil {
+		return errOutput(err)
+	}
+	return strconv.FormatUint(agg.CountNumericRange(minNumber, maxNumber), 10)
+}
+
+// DistinctValues prints the number of distinct values.
+func (i *StorageSession) DistinctValues() string {
+	agg, err := i.aggregator()
+	if err != nil {
+		return errOutput(err)
+	}
+	return strconv.FormatUint(agg.DistinctValues(), 10)
+}
+
+// TopValues lists up to n most common values: their count,
+// then a line of the number of variables and the value per value.
+// Returns INVALID NUMBER if n is not a non-negative integer.
+func (i *StorageSession) TopValues(n string) string {
+	agg, err := i.aggregator()
+	if err != nil {
+		return errOutput(err)
+	}
+	count, err := strconv.Atoi(n)
+	if err != nil || count < 0 {
+		return errOutput(ErrInvalidNumber.Here().Append(n))
+	}
+	values := agg.TopValues(count)
+	lines := []string{strconv.Itoa(len(values))}
+	for _, v := range values {
+		lines = append(lines, fmt.Sprintf("%v %v", v.Count, v.Value))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Sum prints the sum of the numeric values of the variables
+// whose keys start with the prefix.
+func (i *StorageSession) Sum(prefix string) string {
+	agg, err := i.aggregator()
+	if err != nil {
+		return errOutput(err)
+	}
+	sum, _ := agg.SumPrefix(prefix)
+	return strconv.FormatFloat(sum, 'g', -1, 64)
+}
+
+// Avg prints the average of the numeric values of the variables
+// whose keys start with the prefix, or NULL if there are none.
+func (i *StorageSession) Avg(prefix string) string {
+	agg, err := i.aggregator()
+	if err != nil {
+		return errOutput(err)
+	}
+	sum, count := agg.SumPrefix(prefix)
+	if count == 0 {
+		return "NULL"
+	}
+	return strconv.FormatFloat(sum/float64(count), 'g', -1, 64)
+}
+
+// aggregator returns the session's aggregator.
+func (i *StorageSession) aggregator() (storage.Aggregator, error) {
+	agg, ok := i.reader().(storage.Aggregator)
+	if !ok {
+		return nil, ErrNoAggregates.Here()
+	}
+	return agg, nil
+}
+
+// parseNumber parses the finite number.
+func parseNumber(s string) (float64, error) {
+	ret, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(ret) {
+		return 0, ErrInvalidNumber.Here().Append(s)
+	}
+	return ret, nil
 }
 
 // Set sets the variable's value by its key.
-func (i *StorageSession) Set(key, value string) {
+// Returns nothing on success or READONLY if writes
+// are forbidden.
+func (i *StorageSession) Set(key, value string) string {
+	if err := i.checkWritable(); err != nil {
+		return errOutput(err)
+	}
 	i.stor.Set(key, value)
+	return ""
 }
 
 // Unset deletes the variable by its key.
-func (i *StorageSession) Unset(key string) {
+// Returns nothing on success or READONLY if writes
+// are forbidden.
+func (i *StorageSession) Unset(key string) string {
+	if err := i.checkWritable(); err != nil {
+		return errOutput(err)
+	}
 	i.stor.Unset(key)
+	return ""
 }
 
 // NumEqualsTo returns variables' count by their value.
 func (i *StorageSession) NumEqualsTo(val string) uint64 {
-	return i.stor.NumEqualTo(val)
+	return i.reader().NumEqualTo(val)
 }
 
 // Tx creates and enters new transaction.
+// Transactions are read-only within the read-only transaction
+// or session.
 func (i *StorageSession) Tx() string {
+	if i.cfg.ReadOnly || i.readTx != nil {
+		return i.ReadTx()
+	}
 	i.stor = i.stor.Tx()
+	i.blocks = append(i.blocks, block{})
+	return ""
+}
+
+// ReadTx creates and enters new read-only transaction.
+func (i *StorageSession) ReadTx() string {
+	if i.readTx == nil {
+		i.readTx = i.stor.ReadTx()
+	}
+	i.readTxDepth++
 	return ""
 }
 
@@ -55,28 +441,275 @@ func (i *StorageSession) Tx() string {
 // Returns nothing on success, error on unexpected error,
 // or NO TRANSACTION if not in transaction.
 func (i *StorageSession) Commit() string {
+	inReadTx := i.readTx != nil
+	i.closeReadTx()
+
 	var err error
 	i.stor, err = i.stor.Commit()
-	if merry.Is(err, storage.ErrNoTransaction) {
-		return "NO TRANSACTION"
+	if !merry.Is(err, storage.ErrNoTransaction) {
+		// Committed or aborted by conflict
+		i.blocks = nil
 	}
-	if err != nil {
-		return err.Error()
+	if inReadTx && merry.Is(err, storage.ErrNoTransaction) {
+		// Read-only tx was the only one in progress
+		return ""
 	}
-	return ""
+	return errOutput(err)
 }
 
 // Rollback rolls back current transaction in progress (if exists).
 // Returns nothing on success, error on unexpected error,
 // or NO TRANSACTION if not in transaction.
 func (i *StorageSession) Rollback() string {
+	if i.readTx != nil {
+		i.readTxDepth--
+		if i.readTxDepth == 0 {
+			i.closeReadTx()
+		}
+		return ""
+	}
 	var err error
 	i.stor, err = i.stor.Rollback()
-	if merry.Is(err, storage.ErrNoTransaction) {
-		return "NO TRANSACTION"
+	if err == nil {
+		i.popBlocks(func(b block) bool { return !b.isSavepoint }, true)
+	}
+	return errOutput(err)
+}
+
+// Savepoint creates a named savepoint in current transaction.
+// Returns nothing on success, error on unexpected error,
+// or NO TRANSACTION if not in transaction.
+func (i *StorageSession) Savepoint(name string) string {
+	if err := i.checkWritable(); err != nil {
+		return errOutput(err)
+	}
+	var err error
+	i.stor, err = i.stor.Savepoint(name)
+	if err == nil {
+		i.blocks = append(i.blocks, block{isSavepoint: true, name: name})
+	}
+	return errOutput(err)
+}
+
+// RollbackTo rolls back the changes made since the savepoint.
+// Returns nothing on success, error on unexpected error,
+// NO TRANSACTION if not in transaction or NO SAVEPOINT
+// if there's no such savepoint.
+func (i *StorageSession) RollbackTo(name string) string {
+	if err := i.checkWritable(); err != nil {
+		return errOutput(err)
+	}
+	var err error
+	i.stor, err = i.stor.RollbackTo(name)
+	if err == nil {
+		i.popBlocks(isSavepoint(name), false)
+	}
+	return errOutput(err)
+}
+
+// Release removes the savepoint, keeping the changes made since it.
+// Returns nothing on success, error on unexpected error,
+// NO TRANSACTION if not in transaction or NO SAVEPOINT
+// if there's no such savepoint.
+func (i *StorageSession) Release(name string) string {
+	if err := i.checkWritable(); err != nil {
+		return errOutput(err)
+	}
+	var err error
+	i.stor, err = i.stor.Release(name)
+	if err == nil {
+		i.popBlocks(isSavepoint(name), true)
+	}
+	return errOutput(err)
+}
+
+// Select switches the session to the registry's database.
+// Returns nothing on success, NOT ALLOWED IN TRANSACTION if any
+// transaction is in progress or NO DATABASES if the session has no registry.
+func (i *StorageSession) Select(name string) string {
+	if err := i.checkRegistry(); err != nil {
+		return errOutput(err)
 	}
+	root, err := i.reg.Open(name)
 	if err != nil {
-		return err.Error()
+		return errOutput(err)
+	}
+	i.root = root
+	i.stor = i.root
+	i.dbName = name
+	return ""
+}
+
+// SwapDB swaps the variables of the registry's databases.
+func (i *StorageSession) SwapDB(a, b string) string {
+	if err := i.checkRegistry(); err != nil {
+		return errOutput(err)
+	}
+	if err := i.checkWritable(); err != nil {
+		return errOutput(err)
+	}
+	for _, name := range []string{a, b} {
+		if _, err := i.reg.Open(name); err != nil {
+			return errOutput(err)
+		}
+	}
+	i.reg.Swap(a, b)
+	return ""
+}
+
+// FlushDB unsets all the variables of the selected database.
+func (i *StorageSession) FlushDB() string {
+	if err := i.checkRegistry(); err != nil {
+		return errOutput(err)
+	}
+	if err := i.checkWritable(); err != nil {
+		return errOutput(err)
 	}
+	i.reg.Get(i.dbName).Flush()
 	return ""
 }
+
+// FlushAll unsets all the variables of every registry's database.
+func (i *StorageSession) FlushAll() string {
+	if err := i.checkRegistry(); err != nil {
+		return errOutput(err)
+	}
+	if err := i.checkWritable(); err != nil {
+		return errOutput(err)
+	}
+	i.reg.FlushAll()
+	return ""
+}
+
+// DBName returns the name of the selected database,
+// or an empty string if the session has no registry.
+func (i *StorageSession) DBName() string {
+	return i.dbName
+}
+
+// checkRegistry returns ErrNoDatabases if the session has no registry,
+// or ErrInTransaction if any transaction is in progress.
+func (i *StorageSession) checkRegistry() error {
+	if i.reg == nil {
+		return ErrNoDatabases.Here()
+	}
+	if i.TxDepth() > 0 {
+		return ErrInTransaction.Here()
+	}
+	return nil
+}
+
+// TxDepth returns the number of transaction blocks in progress.
+func (i *StorageSession) TxDepth() int {
+	ret := i.readTxDepth
+	for _, b := range i.blocks {
+		if !b.isSavepoint {
+			ret++
+		}
+	}
+	return ret
+}
+
+// popBlocks pops the blocks until the one matching the func.
+// Matching block is popped too if inclusive is true.
+func (i *StorageSession) popBlocks(match func(block) bool, inclusive bool) {
+	for n := len(i.blocks) - 1; n >= 0; n-- {
+		if match(i.blocks[n]) {
+			if inclusive {
+				n--
+			}
+			i.blocks = i.blocks[:n+1]
+			return
+		}
+	}
+	i.blocks = nil
+}
+
+// isSavepoint returns the func that matches the savepoint by its name.
+func isSavepoint(name string) func(block) bool {
+	return func(b block) bool {
+		return b.isSavepoint && b.name == name
+	}
+}
+
+// Close rolls back all the transactions in progress.
+func (i *StorageSession) Close() {
+	if i.monitor != nil {
+		i.cfg.Monitors.unsubscribe(i.monitor)
+		i.monitor = nil
+	}
+	i.closeReadTx()
+	for {
+		stor, err := i.stor.Rollback()
+		if err != nil {
+			break
+		}
+		i.stor = stor
+	}
+	i.blocks = nil
+}
+
+// closeReadTx closes the read-only transaction.
+func (i *StorageSession) closeReadTx() {
+	if i.readTx != nil {
+		i.readTx.Close()
+	}
+	i.readTx = nil
+	i.readTxDepth = 0
+}
+
+// errTokens are the outputs for the errors, in the order they're matched.
+var errTokens = []struct {
+	err   merry.Error
+	token string
+}{
+	{storage.ErrNoTransaction, "NO TRANSACTION"},
+	{storage.ErrReadOnly, "READONLY"},
+	{storage.ErrOutOfMemory, "OOM"},
+	{storage.ErrNoSavepoint, "NO SAVEPOINT"},
+	{ErrInTransaction, "NOT ALLOWED IN TRANSACTION"},
+	{ErrNoDatabases, "NO DATABASES"},
+	{ErrNoAuth, "NOAUTH"},
+	{ErrNoPerm, "NOPERM"},
+	{ErrWrongPass, "WRONGPASS"},
+	{ErrInvalidPayload, "INVALID PAYLOAD"},
+	{ErrInvalidRequest, "INVALID REQUEST"},
+	{storage.ErrNoHistory, "NO HISTORY"},
+	{storage.ErrNoIndex, "NO INDEX"},
+	{storage.ErrIndexExists, "INDEX EXISTS"},
+	{ErrInvalidVersion, "INVALID VERSION"},
+	{ErrInvalidNumber, "INVALID NUMBER"},
+	{ErrNoAggregates, "NOT SUPPORTED"},
+	{ErrNoExpiration, "NOT SUPPORTED"},
+	{ErrNoClient, "NO SUCH CLIENT"},
+	{ErrSyntax, "SYNTAX ERROR"},
+	{storage.ErrTooManyDatabases, "TOO MANY DATABASES"},
+	{ErrBinaryValue, "BINARY VALUE"},
+}
+
+// errOutput returns the output for storage's error.
+func errOutput(err error) string {
+	if err == nil {
+		return ""
+	}
+	for _, t := range errTokens {
+		if merry.Is(err, t.err) {
+			return t.token
+		}
+	}
+	return err.Error()
+}
+
+// isErrOutput returns true if the command's output reports an error.
+func isErrOutput(output string) bool {
+	switch output {
+	case "UNKNOWN COMMAND", "WRONG NUMBER OF ARGUMENTS", storage.ErrTxConflict.Error():
+		return true
+	}
+	for _, t := range errTokens {
+		if output == t.token {
+			return true
+		}
+	}
+	return false
+}
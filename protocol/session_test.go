@@ -3,6 +3,7 @@ package protocol
 import (
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/utrack/go-simple-memdb/storage"
+	"strings"
 	"testing"
 )
 
@@ -16,8 +17,16 @@ type testStorage struct {
 	fNumEqualTo func(string) uint64
 
 	fTx       func() storage.DB
+	fReadTx   func() storage.ReadOnlyTx
 	fCommit   func() (storage.DB, error)
 	fRollback func() (storage.DB, error)
+
+	fSavepoint  func(string) (storage.DB, error)
+	fRollbackTo func(string) (storage.DB, error)
+	fRelease    func(string) (storage.DB, error)
+
+	// isClosed is true once the read-only tx is closed.
+	isClosed bool
 }
 
 func (t *testStorage) Get(key string) (string, error) {
@@ -40,6 +49,14 @@ func (t *testStorage) Tx() storage.DB {
 	return t.fTx()
 }
 
+func (t *testStorage) ReadTx() storage.ReadOnlyTx {
+	return t.fReadTx()
+}
+
+func (t *testStorage) Close() {
+	t.isClosed = true
+}
+
 func (t *testStorage) Commit() (storage.DB, error) {
 	return t.fCommit()
 }
@@ -48,6 +65,18 @@ func (t *testStorage) Rollback() (storage.DB, error) {
 	return t.fRollback()
 }
 
+func (t *testStorage) Savepoint(name string) (storage.DB, error) {
+	return t.fSavepoint(name)
+}
+
+func (t *testStorage) RollbackTo(name string) (storage.DB, error) {
+	return t.fRollbackTo(name)
+}
+
+func (t *testStorage) Release(name string) (storage.DB, error) {
+	return t.fRelease(name)
+}
+
 // We set one function at a time and test StorageSession
 // by calling respective functions.
 // If something unexpected was called - tests should fail
@@ -92,7 +121,8 @@ func TestStorageSession(t *testing.T) {
 			sentKey := "someKey"
 			sentVal := "someVal"
 
-			sessHandler.Set(sentKey, sentVal)
+			got := sessHandler.Set(sentKey, sentVal)
+			So(got, ShouldEqual, "")
 			So(gotKey, ShouldEqual, sentKey)
 			So(gotVal, ShouldEqual, sentVal)
 
@@ -104,7 +134,8 @@ func TestStorageSession(t *testing.T) {
 				gotKey = k
 			}
 			sentKey := "some-key-sent"
-			sessHandler.Unset(sentKey)
+			got := sessHandler.Unset(sentKey)
+			So(got, ShouldEqual, "")
 			So(gotKey, ShouldEqual, sentKey)
 		})
 
@@ -131,6 +162,50 @@ func TestStorageSession(t *testing.T) {
 			So(sessHandler.stor, ShouldResemble, sentStor)
 		})
 
+		Convey("ReadTx", func() {
+			readStor := &testStorage{}
+			s.fReadTx = func() storage.ReadOnlyTx {
+				return readStor
+			}
+			got := sessHandler.ReadTx()
+			So(got, ShouldEqual, "")
+			So(sessHandler.readTx, ShouldEqual, readStor)
+
+			Convey("Reads should go to read-only tx", func() {
+				readStor.fGet = func(_ string) (string, error) {
+					return "readVal", nil
+				}
+				So(sessHandler.Get("k"), ShouldEqual, "readVal")
+			})
+			Convey("Writes should be rejected", func() {
+				So(sessHandler.Set("k", "v"), ShouldEqual, "READONLY")
+				So(sessHandler.Unset("k"), ShouldEqual, "READONLY")
+			})
+			Convey("Nested Tx should be read-only", func() {
+				So(sessHandler.Tx(), ShouldEqual, "")
+				So(sessHandler.Rollback(), ShouldEqual, "")
+				So(sessHandler.readTx, ShouldEqual, readStor)
+				So(readStor.isClosed, ShouldBeFalse)
+				So(sessHandler.Rollback(), ShouldEqual, "")
+				So(sessHandler.readTx, ShouldBeNil)
+				So(readStor.isClosed, ShouldBeTrue)
+			})
+			Convey("Commit should close it", func() {
+				s.fCommit = func() (storage.DB, error) {
+					return s, storage.ErrNoTransaction.Here()
+				}
+				So(sessHandler.Commit(), ShouldEqual, "")
+				So(sessHandler.readTx, ShouldBeNil)
+				So(readStor.isClosed, ShouldBeTrue)
+			})
+		})
+
+		Convey("Read-only session should reject writes", func() {
+			sessHandler := NewReadOnlySession(s)
+			So(sessHandler.Set("k", "v"), ShouldEqual, "READONLY")
+			So(sessHandler.Unset("k"), ShouldEqual, "READONLY")
+		})
+
 		Convey("Commit", func() {
 			sentStor := &testStorage{}
 			s.fCommit = func() (storage.DB, error) {
@@ -167,6 +242,224 @@ func TestStorageSession(t *testing.T) {
 				So(sessHandler.stor, ShouldEqual, sentStor)
 			})
 		})
+		Convey("Savepoint", func() {
+			sentStor := &testStorage{}
+			var gotName string
+			s.fSavepoint = func(name string) (storage.DB, error) {
+				gotName = name
+				return sentStor, nil
+			}
+			got := sessHandler.Savepoint("sp")
+			So(got, ShouldEqual, "")
+			So(gotName, ShouldEqual, "sp")
+			So(sessHandler.stor, ShouldEqual, sentStor)
+		})
+		Convey("RollbackTo", func() {
+			sentStor := &testStorage{}
+			var gotName string
+			s.fRollbackTo = func(name string) (storage.DB, error) {
+				gotName = name
+				return sentStor, nil
+			}
+			got := sessHandler.RollbackTo("sp")
+			So(got, ShouldEqual, "")
+			So(gotName, ShouldEqual, "sp")
+			So(sessHandler.stor, ShouldEqual, sentStor)
+			Convey("Proper NO SAVEPOINT", func() {
+				sessHandler.stor = s
+				s.fRollbackTo = func(_ string) (storage.DB, error) {
+					return s, storage.ErrNoSavepoint.Here()
+				}
+				So(sessHandler.RollbackTo("sp"), ShouldEqual, "NO SAVEPOINT")
+				So(sessHandler.stor, ShouldEqual, s)
+			})
+		})
+		Convey("Release", func() {
+			sentStor := &testStorage{}
+			var gotName string
+			s.fRelease = func(name string) (storage.DB, error) {
+				gotName = name
+				return sentStor, nil
+			}
+			got := sessHandler.Release("sp")
+			So(got, ShouldEqual, "")
+			So(gotName, ShouldEqual, "sp")
+			So(sessHandler.stor, ShouldEqual, sentStor)
+		})
 	})
 
 }
+
+func TestRegistrySession(t *testing.T) {
+	Convey("With registry and sessions", t, func() {
+		reg := storage.NewRegistry()
+		s1 := NewRegistrySocket(reg, Config{})
+		s2 := NewRegistrySocket(reg, Config{})
+
+		Convey("Databases should be isolated", func() {
+			So(s1.DBName(), ShouldEqual, "0")
+			So(exec(s1, "SET a 10", "SELECT tenant1", "GET a", "SET a 20"), ShouldResemble, []string{"", "", "NULL", ""})
+			So(s1.DBName(), ShouldEqual, "tenant1")
+			So(exec(s2, "GET a", "SELECT tenant1", "GET a"), ShouldResemble, []string{"10", "", "20"})
+		})
+		Convey("New databases should be limited", func() {
+			limited := storage.NewRegistryConfig(storage.Config{MaxDatabases: 2})
+			s := NewRegistrySocket(limited, Config{})
+			So(exec(s, "SELECT 1", "SELECT 2", "SWAPDB 0 3", "SELECT 0", "GET a"), ShouldResemble,
+				[]string{"", "TOO MANY DATABASES", "TOO MANY DATABASES", "", "NULL"})
+			So(s.DBName(), ShouldEqual, "0")
+			So(limited.Names(), ShouldResemble, []string{"0", "1"})
+		})
+		Convey("Switching databases should be rejected in transaction", func() {
+			So(exec(s1, "BEGIN", "SET a 10", "SELECT 1", "SWAPDB 0 1", "FLUSHDB", "FLUSHALL", "COMMIT", "GET a"), ShouldResemble,
+				[]string{"", "", "NOT ALLOWED IN TRANSACTION", "NOT ALLOWED IN TRANSACTION", "NOT ALLOWED IN TRANSACTION",
+					"NOT ALLOWED IN TRANSACTION", "", "10"})
+			So(s1.DBName(), ShouldEqual, "0")
+		})
+		Convey("SWAPDB should swap the databases for every session", func() {
+			So(exec(s1, "SET a 10", "SELECT 1", "SET a 20", "SWAPDB 0 1", "GET a"), ShouldResemble, []string{"", "", "", "", "10"})
+			So(exec(s2, "GET a"), ShouldResemble, []string{"20"})
+
+			Convey("Transaction should commit to the database it started in", func() {
+				So(exec(s2, "BEGIN", "SET b 30"), ShouldResemble, []string{"", ""})
+				So(exec(s1, "SWAPDB 0 1"), ShouldResemble, []string{""})
+				So(exec(s2, "COMMIT", "GET b", "SELECT 1", "GET b"), ShouldResemble, []string{"", "30", "", "NULL"})
+			})
+		})
+		Convey("FLUSHDB and FLUSHALL should unset the variables", func() {
+			So(exec(s1, "SET a 10", "SELECT 1", "SET a 20", "SET b 20", "FLUSHDB", "GET b", "SELECT 0", "GET a"), ShouldResemble,
+				[]string{"", "", "", "", "", "NULL", "", "10"})
+			So(exec(s2, "FLUSHALL", "GET a"), ShouldResemble, []string{"", "NULL"})
+		})
+		Convey("Read-only session should not modify the databases", func() {
+			ro := NewRegistrySocket(reg, Config{ReadOnly: true})
+			So(exec(ro, "SELECT 1", "SWAPDB 0 1", "FLUSHDB", "FLUSHALL"), ShouldResemble, []string{"", "READONLY", "READONLY", "READONLY"})
+		})
+		Convey("Session without registry should not select", func() {
+			sock := NewSocket(storage.New())
+			So(exec(sock, "SELECT 1", "FLUSHDB"), ShouldResemble, []string{"NO DATABASES", "NO DATABASES"})
+			So(sock.DBName(), ShouldEqual, "")
+		})
+	})
+}
+
+func TestSessionHistory(t *testing.T) {
+	Convey("With registry keeping the history", t, func() {
+		reg := storage.NewRegistry()
+		reg.SetRetention(storage.Retention{Versions: 10})
+		sock := NewRegistrySocket(reg, Config{})
+		So(exec(sock, "SET a 10", "BEGIN", "SET a 20 30", "COMMIT", "UNSET a"), ShouldResemble, []string{"", "", "", "", ""})
+
+		Convey("HISTORY should list the versions", func() {
+			out, _ := sock.Exec("HISTORY a")
+			lines := strings.Split(out, "\n")
+			So(lines, ShouldHaveLength, 4)
+			So(lines[0], ShouldEqual, "3")
+			So(lines[1], ShouldStartWith, "1 ")
+			So(lines[1], ShouldEndWith, " 10")
+			So(lines[2], ShouldEndWith, " 20 30")
+			So(lines[3], ShouldEndWith, " NULL")
+			So(exec(sock, "HISTORY b"), ShouldResemble, []string{"0"})
+
+			at := strings.SplitN(lines[2], " ", 3)[1]
+			So(exec(sock, "GET a AT "+at), ShouldResemble, []string{"20 30"})
+		})
+		Convey("GET AT should read the version", func() {
+			So(exec(sock, "GET a AT 1", "GET a AT 2", "GET a AT 3", "GET a AT 0", "GET a AT yesterday", "GET a"), ShouldResemble,
+				[]string{"10", "20 30", "NULL", "NO HISTORY", "INVALID VERSION", "NULL"})
+			So(exec(sock, "SETB a 3\nx\ny", "GET a AT 4"), ShouldResemble, []string{"", "BINARY VALUE"})
+		})
+		Convey("Versions should be read from the selected database", func() {
+			So(exec(sock, "SELECT 1", "SET a 40", "GET a AT 1", "HISTORY b"), ShouldResemble,
+				[]string{"", "", "40", "0"})
+		})
+		Convey("Sessions over transactions should read the committed versions", func() {
+			tx := NewSocket(reg.Get("0").Tx())
+			So(exec(tx, "SET a 50", "GET a AT 1", "GET a AT 4", "HISTORY b"), ShouldResemble, []string{"", "10", "NULL", "0"})
+		})
+	})
+}
+
+func TestSessionExpiration(t *testing.T) {
+	Convey("With registry session", t, func() {
+		reg := storage.NewRegistry()
+		sock := NewRegistrySocket(reg, Config{})
+		So(exec(sock, "SET a 10", "SET b 20"), ShouldResemble, []string{"", ""})
+
+		Convey("EXPIRE should set the expiration", func() {
+			So(exec(sock, "EXPIRE a 100", "TTL a", "TTL b", "EXPIRE c 100", "TTL c", "EXPIRE a soon"), ShouldResemble,
+				[]string{"", "100", "-1", "NULL", "NULL", "INVALID NUMBER"})
+			So(exec(sock, "PERSIST a", "TTL a", "PERSIST a"), ShouldResemble, []string{"", "-1", "NULL"})
+		})
+		Convey("Expired variables should be unset by the sweep", func() {
+			So(exec(sock, "EXPIRE a 0", "GET a"), ShouldResemble, []string{"", "10"})
+			So(reg.SweepExpired(), ShouldEqual, 1)
+			So(exec(sock, "GET a", "GET b"), ShouldResemble, []string{"NULL", "20"})
+		})
+		Convey("SET should remove the expiration", func() {
+			So(exec(sock, "EXPIRE a 100", "SET a 11", "TTL a"), ShouldResemble, []string{"", "", "-1"})
+		})
+		Convey("EXPIRE should not be allowed in transactions", func() {
+			So(exec(sock, "BEGIN", "EXPIRE a 100", "PERSIST a", "TTL a"), ShouldResemble,
+				[]string{"", "NOT ALLOWED IN TRANSACTION", "NOT ALLOWED IN TRANSACTION", "-1"})
+		})
+		Convey("Read-only session should not expire the variables", func() {
+			ro := NewRegistrySocket(reg, Config{ReadOnly: true})
+			So(exec(ro, "EXPIRE a 100", "TTL a"), ShouldResemble, []string{"READONLY", "-1"})
+		})
+		Convey("Sessions over transactions should expire the committed variables", func() {
+			tx := NewSocket(reg.Get("0").Tx())
+			So(exec(tx, "SET c 30", "EXPIRE c 100", "EXPIRE a 100", "TTL a"), ShouldResemble, []string{"", "NULL", "", "100"})
+		})
+	})
+}
+
+func TestSessionFind(t *testing.T) {
+	Convey("With session", t, func() {
+		sock := NewSocket(storage.New())
+		So(exec(sock, "SET a 10", "SET b 10", "SET u1 {\"age\": 30, \"name\": \"alice\"}", "SET u2 {\"age\": 31}"), ShouldResemble,
+			[]string{"", "", "", ""})
+
+		Convey("FIND should list the variables set to the value", func() {
+			So(exec(sock, "FIND 10", "FIND 20"), ShouldResemble, []string{"2\na\nb", "0"})
+			So(exec(sock, "BEGIN", "SET c 10", "UNSET a", "FIND 10", "ROLLBACK", "FIND 10"), ShouldResemble,
+				[]string{"", "", "", "2\nb\nc", "", "2\na\nb"})
+			So(exec(sock, "BEGIN READONLY", "FIND 10"), ShouldResemble, []string{"", "2\na\nb"})
+		})
+		Convey("FINDBY should use the index", func() {
+			So(exec(sock, "CREATEINDEX age age", "FINDBY age 30", "CREATEINDEX age name", "FINDBY name alice"), ShouldResemble,
+				[]string{"", "1\nu1", "INDEX EXISTS", "NO INDEX"})
+			So(exec(sock, "BEGIN", "SET u3 {\"age\": 30}", "FINDBY age 30", "DROPINDEX age", "COMMIT", "FINDBY age 30"), ShouldResemble,
+				[]string{"", "", "2\nu1\nu3", "NOT ALLOWED IN TRANSACTION", "", "2\nu1\nu3"})
+			So(exec(sock, "DROPINDEX age", "FINDBY age 30", "DROPINDEX age"), ShouldResemble,
+				[]string{"", "NO INDEX", "NO INDEX"})
+		})
+	})
+}
+
+func TestSessionAggregates(t *testing.T) {
+	Convey("With session", t, func() {
+		sock := NewSocket(storage.New())
+		So(exec(sock, "SET n:a 10", "SET n:b 2.5", "SET n:c 10", "SET s:a apple", "SET s:b banana"), ShouldResemble,
+			[]string{"", "", "", "", ""})
+
+		Convey("COUNTRANGE should count the values by range", func() {
+			So(exec(sock, "COUNTRANGE a b", "COUNTRANGE 1 2.5", "COUNTRANGE NUMERIC 2 9", "COUNTRANGE NUMERIC -inf 10"), ShouldResemble,
+				[]string{"1", "3", "1", "3"})
+			So(exec(sock, "COUNTRANGE NUMERIC 1 x", "COUNTRANGE NUMERIC 1", "COUNTRANGE a"), ShouldResemble,
+				[]string{"INVALID NUMBER", "WRONG NUMBER OF ARGUMENTS", "WRONG NUMBER OF ARGUMENTS"})
+		})
+		Convey("DISTINCTVALUES and TOPVALUES should count the values", func() {
+			So(exec(sock, "DISTINCTVALUES", "TOPVALUES 2", "TOPVALUES 0", "TOPVALUES -1"), ShouldResemble,
+				[]string{"4", "2\n2 10\n1 2.5", "0", "INVALID NUMBER"})
+			So(exec(sock, "BEGIN", "SET s:a 2.5", "BEGIN", "SET s:b 2.5", "TOPVALUES 1", "DISTINCTVALUES", "ROLLBACK", "TOPVALUES 1"), ShouldResemble,
+				[]string{"", "", "", "", "1\n3 2.5", "2", "", "1\n2 10"})
+		})
+		Convey("SUM and AVG should aggregate the numbers by the names' prefix", func() {
+			So(exec(sock, "SUM", "SUM n:", "AVG n:", "SUM s:", "AVG s:"), ShouldResemble,
+				[]string{"22.5", "22.5", "7.5", "0", "NULL"})
+			So(exec(sock, "BEGIN READONLY", "AVG n:", "ROLLBACK", "BEGIN", "UNSET n:b", "AVG n:"), ShouldResemble,
+				[]string{"", "7.5", "", "", "", "10"})
+		})
+	})
+}
@@ -2,10 +2,13 @@ package protocol
 
 import (
 	"bufio"
+	"errors"
+	"github.com/ansel1/merry"
 	"github.com/utrack/go-simple-memdb/storage"
 	"io"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // DBSocket is a sock scanner that reads commands and returns their output.
@@ -17,48 +20,286 @@ type DBSocket struct {
 // according to protocol specs, relays
 // them to the Database via StorageSession and returns the output.
 func NewSocket(db storage.DB) *DBSocket {
-	return &DBSocket{sess: NewSession(db)}
+	return NewSocketConfig(db, Config{})
 }
 
+// NewReadOnlySocket returns new DBSocket that rejects
+// all writes to the Database.
+func NewReadOnlySocket(db storage.DB) *DBSocket {
+	return NewSocketConfig(db, Config{ReadOnly: true})
+}
+
+// NewRegistrySocket returns new DBSocket over the registry's
+// databases, starting in database "0".
+func NewRegistrySocket(reg *storage.Registry, cfg Config) *DBSocket {
+	return &DBSocket{sess: NewRegistrySession(reg, cfg)}
+}
+
+// NewSocketConfig returns new DBSocket configured by cfg.
+func NewSocketConfig(db storage.DB, cfg Config) *DBSocket {
+	return &DBSocket{sess: NewSessionConfig(db, cfg)}
+}
+
+// flushLatency is the longest time the output is kept buffered
+// while the pipelined commands are processed.
+const flushLatency = 5 * time.Millisecond
+
+// maxPayload is the longest payload accepted by the commands
+// flagged with FlagPayload.
+const maxPayload = 64 << 20
+
 // Process starts the IO pipe.
+// Output of pipelined commands is batched: it's flushed when there are
+// no more commands buffered, when the write buffer is full or every
+// flushLatency.
+// After MONITOR, the other sessions' commands are streamed
+// to the pipe until END is read.
+// Transactions left in progress are rolled back
+// when the pipe is closed.
 func (s *DBSocket) Process(rPipe io.Reader, wPipe io.Writer) {
+	s.process(rPipe, wPipe, false)
+}
+
+// process starts the IO pipe, flushing the output
+// after every command if flushEach is true.
+func (s *DBSocket) process(rPipe io.Reader, wPipe io.Writer, flushEach bool) {
+	defer s.Close()
+	s.sess.entry = s.sess.cfg.Clients.register(s.sess, rPipe)
+	defer s.sess.cfg.Clients.unregister(s.sess.entry)
 	r := bufio.NewReader(rPipe)
 	w := bufio.NewWriter(wPipe)
+	defer func() { _ = w.Flush() }()
 
-	var cmdRaw string
-	var cmd []string
-	var err error
+	deadliner, _ := rPipe.(readDeadliner)
+	if s.sess.cfg.IdleTimeout <= 0 {
+		deadliner = nil
+	}
+
+	lastFlush := time.Now()
 	for {
-		cmdRaw, err = r.ReadString('\n')
-		cmdRaw = strings.Trim(cmdRaw, "\n ")
-		if err != nil {
+		if deadliner != nil && r.Buffered() == 0 {
+			_ = deadliner.SetReadDeadline(time.Now().Add(s.sess.cfg.IdleTimeout))
+			if s.sess.entry.isKilled() {
+				return
+			}
+		}
+		exec, err := s.read(r)
+		if merry.Is(err, ErrInvalidPayload) || merry.Is(err, ErrInvalidRequest) {
+			// Payload's or request's bytes can't be told from the next commands
+			s.write(w, errOutput(err))
+			return
+		}
+		if isTimeout(err) {
+			s.sess.cfg.Logger.Debugf("Client %v was idle for %v, closing", s.sess.client, s.sess.cfg.IdleTimeout)
+		}
+		if err != nil || s.sess.entry.isKilled() {
 			return
 		}
 
-		cmd = strings.SplitN(cmdRaw, " ", 3)
-		output := ""
-		switch cmd[0] {
-		case "END":
+		output, ok := exec()
+		if !ok {
+			return
+		}
+		s.write(w, output)
+		if s.sess.monitor != nil {
+			// Monitors are never idle
+			if deadliner != nil {
+				_ = deadliner.SetReadDeadline(time.Time{})
+				if s.sess.entry.isKilled() {
+					return
+				}
+			}
+			s.sess.monitor.stream(r, w)
 			return
-		case "GET":
-			output = s.sess.Get(cmd[1])
-		case "SET":
-			s.sess.Set(cmd[1], cmd[2])
-		case "UNSET":
-			s.sess.Unset(cmd[1])
-		case "NUMEQUALTO":
-			output = strconv.FormatUint(s.sess.NumEqualsTo(cmd[1]), 10)
-		case "BEGIN":
-			output = s.sess.Tx()
-		case "COMMIT":
-			output = s.sess.Commit()
-		case "ROLLBACK":
-			output = s.sess.Rollback()
-		default:
-			output = "UNKNOWN COMMAND"
 		}
-		_, _ = w.WriteString(output)
-		_ = w.WriteByte('\n')
-		_ = w.Flush()
+
+		if flushEach || r.Buffered() == 0 || time.Since(lastFlush) >= flushLatency {
+			if w.Flush() != nil {
+				return
+			}
+			lastFlush = time.Now()
+		}
+	}
+}
+
+// read reads the next command in the session's dialect
+// and returns the func executing it.
+func (s *DBSocket) read(r *bufio.Reader) (func() (string, bool), error) {
+	if s.sess.cfg.Dialect == DialectRESP {
+		args, err := readRESP(r)
+		return func() (string, bool) {
+			output, ok := s.ExecArgs(args)
+			return respOutput(args, output), ok
+		}, err
+	}
+	cmdRaw, err := readCommand(r)
+	return func() (string, bool) { return s.Exec(cmdRaw) }, err
+}
+
+// write writes the command's output in the session's dialect.
+func (s *DBSocket) write(w *bufio.Writer, output string) {
+	if s.sess.cfg.Dialect == DialectRESP {
+		writeRESP(w, output)
+		return
+	}
+	_, _ = w.WriteString(output)
+	_ = w.WriteByte('\n')
+}
+
+// readDeadliner is the pipe whose reads time out, e.g. net.Conn.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// isTimeout returns true if the error is the pipe's timeout.
+func isTimeout(err error) bool {
+	var timeout interface{ Timeout() bool }
+	return errors.As(err, &timeout) && timeout.Timeout()
+}
+
+// ReadCommand reads the command's line, followed by its payload
+// if the command is flagged with FlagPayload, as Exec expects them.
+// ErrInvalidPayload is returned if the payload's length is malformed.
+func ReadCommand(r *bufio.Reader) (string, error) {
+	return readCommand(r)
+}
+
+// readCommand reads the command's line, followed by its payload
+// if the command is flagged with FlagPayload.
+func readCommand(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	c, args, found := parseCommand(line)
+	if !found || c.Flags&FlagPayload == 0 || len(args) < c.Arity {
+		return line, nil
 	}
+	n, err := payloadLen(args)
+	if err != nil {
+		return "", err
+	}
+	// Payload is terminated by the newline
+	payload := make([]byte, n+1)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return "", err
+	}
+	return line + string(payload), nil
+}
+
+// Exec executes a single command and returns its output.
+// Commands flagged with FlagPayload expect the payload after
+// the command's line: "SETB name 5\nvalue".
+// ok is false if the command ends the session.
+func (s *DBSocket) Exec(cmdRaw string) (output string, ok bool) {
+	line, payload, hasPayload := strings.Cut(strings.TrimLeft(cmdRaw, "\n "), "\n")
+	c, args, found := parseCommand(line)
+	if !found {
+		return "UNKNOWN COMMAND", true
+	}
+	if len(args) < c.Arity {
+		return "WRONG NUMBER OF ARGUMENTS", true
+	}
+	if c.Flags&FlagPayload != 0 {
+		n, err := payloadLen(args)
+		if len(payload) == n+1 && payload[n] == '\n' {
+			payload = payload[:n]
+		}
+		if err != nil || !hasPayload || len(payload) != n {
+			return errOutput(ErrInvalidPayload.Here()), true
+		}
+		args[len(args)-1] = payload
+	}
+	return s.exec(c, args)
+}
+
+// ExecArgs executes a single command given by its name and arguments,
+// e.g. read in the RESP dialect, and returns its output.
+// Command's name is case-insensitive; its arguments past the second one
+// are joined by spaces, just like the rest of the command's line is.
+// Commands flagged with FlagPayload get the payload as their last argument.
+// ok is false if the command ends the session.
+func (s *DBSocket) ExecArgs(args []string) (output string, ok bool) {
+	if len(args) == 0 {
+		return "UNKNOWN COMMAND", true
+	}
+	c, found := lookupCommand(strings.ToUpper(args[0]))
+	if !found {
+		return "UNKNOWN COMMAND", true
+	}
+	args = args[1:]
+	if len(args) > 2 {
+		args = []string{args[0], strings.Join(args[1:], " ")}
+	}
+	if len(args) < c.Arity {
+		return "WRONG NUMBER OF ARGUMENTS", true
+	}
+	return s.exec(c, args)
+}
+
+// exec authorizes and executes the parsed command.
+func (s *DBSocket) exec(c Command, args []string) (output string, ok bool) {
+	start := time.Now()
+	txDepth := s.sess.TxDepth()
+	defer func() {
+		s.sess.cfg.Metrics.record(c, args, start, time.Since(start), s.sess.client, txDepth)
+		if s.sess.entry != nil {
+			s.sess.entry.update(s.sess, c.Name)
+		}
+	}()
+
+	if err := s.sess.authorize(c, args); err != nil {
+		return errOutput(err), true
+	}
+	s.sess.cfg.Monitors.publish(s.sess, c, args)
+
+	switch {
+	case c.Flags&FlagQuit != 0:
+		return "", false
+	case c.Flags&FlagNoTx != 0 && s.sess.TxDepth() > 0:
+		return errOutput(ErrInTransaction.Here()), true
+	case c.Flags&FlagWrite != 0:
+		err := s.sess.checkWritable()
+		if err == nil && c.Flags&FlagDenyOOM != 0 {
+			err = s.sess.checkMemory()
+		}
+		if err != nil {
+			return errOutput(err), true
+		}
+	}
+	return c.handler(s.sess, args), true
+}
+
+// parseCommand splits the command's line into the registered command
+// and its arguments.
+func parseCommand(line string) (Command, []string, bool) {
+	cmd := strings.SplitN(strings.Trim(line, "\n "), " ", 3)
+	c, found := lookupCommand(cmd[0])
+	return c, cmd[1:], found
+}
+
+// payloadLen returns the length of the payload passed
+// as the last argument.
+func payloadLen(args []string) (int, error) {
+	ret, err := strconv.Atoi(args[len(args)-1])
+	if err != nil || ret < 0 || ret > maxPayload {
+		return 0, ErrInvalidPayload.Here().Append(args[len(args)-1])
+	}
+	return ret, nil
+}
+
+// TxDepth returns the number of transaction blocks in progress.
+func (s *DBSocket) TxDepth() int {
+	return s.sess.TxDepth()
+}
+
+// DBName returns the name of the selected database,
+// or an empty string if the socket has no registry.
+func (s *DBSocket) DBName() string {
+	return s.sess.DBName()
+}
+
+// Close rolls back the transactions in progress.
+func (s *DBSocket) Close() {
+	s.sess.Close()
 }
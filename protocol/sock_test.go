@@ -1,10 +1,14 @@
 package protocol
 
 import (
+	"bufio"
 	"bytes"
+	"fmt"
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/utrack/go-simple-memdb/storage"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestSocket(t *testing.T) {
@@ -152,5 +156,238 @@ END`)
 
 `)
 		})
+		Convey("ROLLBACK TO should require the known savepoint", func() {
+			So(exec(sock, "BEGIN", "SET a 1", "SAVEPOINT s", "SET a 2", "ROLLBACK TO", "GET a", "ROLLBACK TO nope", "GET a", "ROLLBACK s", "GET a"), ShouldResemble,
+				[]string{"", "", "", "", "WRONG NUMBER OF ARGUMENTS", "2", "NO SAVEPOINT", "2", "SYNTAX ERROR", "2"})
+			So(exec(sock, "ROLLBACK TO s", "GET a", "COMMIT", "GET a"), ShouldResemble, []string{"", "1", "", "1"})
+		})
+		Convey("Unknown BEGIN options should be rejected", func() {
+			So(exec(sock, "BEGIN bogus", "BEGIN readonly", "BEGIN READONLY now", "SET a 10", "ROLLBACK", "GET a"), ShouldResemble,
+				[]string{"SYNTAX ERROR", "SYNTAX ERROR", "SYNTAX ERROR", "", "NO TRANSACTION", "10"})
+		})
+		Convey("Read-only tx test", func() {
+			_, _ = bufIn.WriteString(`SET a 10
+BEGIN
+SET a 20
+BEGIN READONLY
+GET a
+SET a 30
+UNSET a
+NUMEQUALTO 20
+COMMIT
+GET a
+ROLLBACK
+END`)
+			sock.Process(bufIn, bufOut)
+			ret := bufOut.String()
+			So(ret, ShouldEqual, `
+
+
+
+20
+READONLY
+READONLY
+1
+
+20
+NO TRANSACTION
+`)
+		})
+		Convey("Read-only socket test", func() {
+			stor.Set("a", "10")
+			sock := NewReadOnlySocket(stor)
+			_, _ = bufIn.WriteString(`GET a
+SET a 20
+BEGIN
+UNSET a
+ROLLBACK
+GET a
+END`)
+			sock.Process(bufIn, bufOut)
+			ret := bufOut.String()
+			So(ret, ShouldEqual, `10
+READONLY
+
+READONLY
+
+10
+`)
+		})
+		Convey("Savepoints test", func() {
+			_, _ = bufIn.WriteString(`SAVEPOINT a
+BEGIN
+SET a 10
+SAVEPOINT one
+SET a 20
+BEGIN
+SET a 30
+SAVEPOINT two
+SET a 40
+ROLLBACK TO one
+ROLLBACK TO two
+GET a
+ROLLBACK
+GET a
+ROLLBACK TO one
+GET a
+SET a 50
+RELEASE one
+GET a
+ROLLBACK TO one
+ROLLBACK
+GET a
+END`)
+			sock.Process(bufIn, bufOut)
+			ret := bufOut.String()
+			So(ret, ShouldEqual, `NO TRANSACTION
+
+
+
+
+
+
+
+
+NO SAVEPOINT
+
+30
+
+20
+
+10
+
+
+50
+NO SAVEPOINT
+
+NULL
+`)
+		})
+		Convey("Missing arguments should be reported", func() {
+			_, _ = bufIn.WriteString(`GET
+SET a
+END`)
+			sock.Process(bufIn, bufOut)
+			So(bufOut.String(), ShouldEqual, `WRONG NUMBER OF ARGUMENTS
+WRONG NUMBER OF ARGUMENTS
+`)
+		})
+		Convey("Binary values should be passed with their length", func() {
+			_, _ = bufIn.WriteString("SETB a 4\n\x00\nb \n" +
+				"SETB b 0\n\n" +
+				"GETB a\n" +
+				"GET a\n" +
+				"NUMEQUALTOB 4\n\x00\nb \n" +
+				"NUMEQUALTOB 1\n\x00\n" +
+				"GETB b\n" +
+				"GETB c\n" +
+				"SETB c -1\n" +
+				"SET c 10\n")
+			sock.Process(bufIn, bufOut)
+			So(bufOut.String(), ShouldEqual, "\n\n4\n\x00\nb \nBINARY VALUE\n1\n0\n0\n\nNULL\nINVALID PAYLOAD\n")
+			_, err := stor.Get("c")
+			So(err, ShouldNotBeNil)
+		})
+		Convey("GET should keep the pipe in sync on the values with line breaks", func() {
+			So(exec(sock, "SETB a 3\nx\ny", "GET a", "SET b 1", "GET b"), ShouldResemble,
+				[]string{"", "BINARY VALUE", "", "1"})
+		})
+		Convey("Exec should take the payload after the line", func() {
+			So(exec(sock, "SETB a 2\n\x00\x01", "SETB b 2\n\x00\x01\n", "NUMEQUALTOB 2\n\x00\x01", "GETB a"), ShouldResemble,
+				[]string{"", "", "2", "2\n\x00\x01"})
+			So(exec(sock, "SETB a 3\n\x00\x01", "SETB a 2", "SETB a x\n\x00", "SETB a"), ShouldResemble,
+				[]string{"INVALID PAYLOAD", "INVALID PAYLOAD", "INVALID PAYLOAD", "WRONG NUMBER OF ARGUMENTS"})
+		})
+		Convey("TxDepth should count transaction blocks", func() {
+			for _, cmd := range []string{"BEGIN", "SAVEPOINT a", "BEGIN", "BEGIN READONLY"} {
+				sock.Exec(cmd)
+			}
+			So(sock.TxDepth(), ShouldEqual, 3)
+			sock.Exec("ROLLBACK")
+			So(sock.TxDepth(), ShouldEqual, 2)
+			So(exec(sock, "ROLLBACK TO a"), ShouldResemble, []string{"NO SAVEPOINT"})
+			So(sock.TxDepth(), ShouldEqual, 2)
+			sock.Exec("ROLLBACK")
+			sock.Exec("ROLLBACK TO a")
+			So(sock.TxDepth(), ShouldEqual, 1)
+			sock.Exec("BEGIN")
+			So(exec(sock, "RELEASE a"), ShouldResemble, []string{"NO SAVEPOINT"})
+			So(sock.TxDepth(), ShouldEqual, 2)
+			sock.Exec("ROLLBACK")
+			sock.Exec("RELEASE a")
+			So(sock.TxDepth(), ShouldEqual, 1)
+			sock.Exec("COMMIT")
+			So(sock.TxDepth(), ShouldEqual, 0)
+		})
 	})
 }
+
+func TestSocketPipelining(t *testing.T) {
+	Convey("With socket over pipe", t, func() {
+		client, server := net.Pipe()
+		go NewSocket(storage.New()).Process(server, server)
+		r := bufio.NewReader(client)
+		Reset(func() { _ = client.Close() })
+
+		Convey("Single command should be answered without waiting for more", func() {
+			_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+			_, err := client.Write([]byte("SET a 10\nGET a\n"))
+			So(err, ShouldBeNil)
+			for _, want := range []string{"\n", "10\n"} {
+				got, err := r.ReadString('\n')
+				So(err, ShouldBeNil)
+				So(got, ShouldEqual, want)
+			}
+		})
+		Convey("Pipelined responses should stay ordered", func() {
+			const n = 10000
+			go func() {
+				w := bufio.NewWriter(client)
+				for i := 0; i < n; i++ {
+					fmt.Fprintf(w, "SET k%v %v\nGET k%v\n", i, i, i)
+				}
+				_ = w.Flush()
+			}()
+			for i := 0; i < n; i++ {
+				got, err := r.ReadString('\n')
+				So(err, ShouldBeNil)
+				So(got, ShouldEqual, "\n")
+				got, err = r.ReadString('\n')
+				So(err, ShouldBeNil)
+				if got != fmt.Sprintf("%v\n", i) {
+					So(got, ShouldEqual, fmt.Sprintf("%v\n", i))
+				}
+			}
+		})
+	})
+}
+
+// benchmarkProcess pipelines b.N commands over net.Pipe.
+func benchmarkProcess(b *testing.B, flushEach bool) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go NewSocket(storage.New()).process(server, server, flushEach)
+	go func() {
+		w := bufio.NewWriter(client)
+		for i := 0; i < b.N; i++ {
+			_, _ = w.WriteString("GET a\n")
+		}
+		_ = w.Flush()
+	}()
+
+	r := bufio.NewReader(client)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := r.ReadString('\n'); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProcessFlushEach(b *testing.B) {
+	benchmarkProcess(b, true)
+}
+
+func BenchmarkProcessBatched(b *testing.B) {
+	benchmarkProcess(b, false)
+}
@@ -0,0 +1,107 @@
+package protocol
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// handshakeTimeout bounds the TLS handshake of the clients.
+const handshakeTimeout = 10 * time.Second
+
+// TLSFiles are the PEM files the TLS config is loaded from.
+type TLSFiles struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is the CA bundle the client certificates are verified with.
+	// Client certificates are required if it's set.
+	ClientCAFile string
+}
+
+// TLSReloader keeps the TLS config loaded from the files
+// and reloads it on demand, e.g. on SIGHUP.
+// Reloaded config applies to the new connections.
+type TLSReloader struct {
+	files TLSFiles
+
+	mu  sync.RWMutex
+	cfg *tls.Config
+}
+
+// NewTLSReloader loads the TLS config from the files.
+func NewTLSReloader(files TLSFiles) (*TLSReloader, error) {
+	ret := &TLSReloader{files: files}
+	if err := ret.Reload(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Reload reloads the files. Current config is kept on error.
+func (r *TLSReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.files.CertFile, r.files.KeyFile)
+	if err != nil {
+		return ErrInvalidTLS.Here().Append(err.Error())
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if r.files.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.files.ClientCAFile)
+		if err != nil {
+			return ErrInvalidTLS.Here().Append(err.Error())
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return ErrInvalidTLS.Here().Appendf("no certificates in %v", r.files.ClientCAFile)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cfg = cfg
+	return nil
+}
+
+// Config returns the TLS config for the listeners
+// that always uses the last loaded files.
+func (r *TLSReloader) Config() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.cfg, nil
+		},
+	}
+}
+
+// Listener wraps the listener to serve TLS.
+func (r *TLSReloader) Listener(l net.Listener) net.Listener {
+	return tls.NewListener(l, r.Config())
+}
+
+// handshake completes the TLS handshake of the connection
+// and returns the verified client certificate's common name, if any.
+// Plain connections are left as is.
+func handshake(conn net.Conn) (commonName string, err error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	_ = tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err = tlsConn.Handshake(); err != nil {
+		return "", err
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return "", nil
+	}
+	return state.PeerCertificates[0].Subject.CommonName, nil
+}
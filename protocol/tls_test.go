@@ -0,0 +1,211 @@
+package protocol
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/ansel1/merry"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/utrack/go-simple-memdb/storage"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues the certificates for the tests.
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	pem    []byte
+	serial int64
+}
+
+func newTestCA() *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	So(err, ShouldBeNil)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	So(err, ShouldBeNil)
+	cert, err := x509.ParseCertificate(der)
+	So(err, ShouldBeNil)
+	return &testCA{
+		cert:   cert,
+		key:    key,
+		pem:    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		serial: 1,
+	}
+}
+
+// issue returns PEM-encoded certificate and key for the common name.
+func (ca *testCA) issue(commonName string) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	So(err, ShouldBeNil)
+	ca.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	So(err, ShouldBeNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	So(err, ShouldBeNil)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// clientConfig returns the client's TLS config trusting the CA
+// with the certificate for the common name, if any.
+func (ca *testCA) clientConfig(commonName string) *tls.Config {
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	ret := &tls.Config{RootCAs: roots}
+	if commonName != "" {
+		certPEM, keyPEM := ca.issue(commonName)
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		So(err, ShouldBeNil)
+		ret.Certificates = []tls.Certificate{cert}
+	}
+	return ret
+}
+
+func TestTLSServer(t *testing.T) {
+	Convey("With CA and server's certificate files", t, func() {
+		dir, err := ioutil.TempDir("", "memdb-tls")
+		So(err, ShouldBeNil)
+		ca := newTestCA()
+		files := TLSFiles{
+			CertFile: filepath.Join(dir, "server.crt"),
+			KeyFile:  filepath.Join(dir, "server.key"),
+		}
+		writeCert := func() {
+			certPEM, keyPEM := ca.issue("server")
+			So(ioutil.WriteFile(files.CertFile, certPEM, 0600), ShouldBeNil)
+			So(ioutil.WriteFile(files.KeyFile, keyPEM, 0600), ShouldBeNil)
+		}
+		writeCert()
+		So(ioutil.WriteFile(filepath.Join(dir, "ca.crt"), ca.pem, 0600), ShouldBeNil)
+
+		stor := storage.New()
+		stor.Set("a", "10")
+		serve := func(files TLSFiles, cfg Config) (*TLSReloader, string) {
+			reloader, err := NewTLSReloader(files)
+			So(err, ShouldBeNil)
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			srv := NewServerConfig(stor, cfg)
+			go func() { _ = srv.Serve(reloader.Listener(l)) }()
+			Reset(func() { _ = srv.Close() })
+			return reloader, l.Addr().String()
+		}
+		cmd := func(conn net.Conn, line string) (string, error) {
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Write([]byte(line + "\n")); err != nil {
+				return "", err
+			}
+			return bufio.NewReader(conn).ReadString('\n')
+		}
+
+		Convey("TLS clients should be served", func() {
+			reloader, addr := serve(files, Config{})
+			conn, err := tls.Dial("tcp", addr, ca.clientConfig(""))
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			got, err := cmd(conn, "GET a")
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, "10\n")
+
+			Convey("Plain clients should be rejected", func() {
+				conn, err := net.Dial("tcp", addr)
+				So(err, ShouldBeNil)
+				defer conn.Close()
+				_, err = cmd(conn, "GET a")
+				So(err, ShouldNotBeNil)
+			})
+			Convey("Certificate should be reloaded", func() {
+				serial := conn.ConnectionState().PeerCertificates[0].SerialNumber
+				writeCert()
+				So(reloader.Reload(), ShouldBeNil)
+
+				conn, err := tls.Dial("tcp", addr, ca.clientConfig(""))
+				So(err, ShouldBeNil)
+				defer conn.Close()
+				So(conn.ConnectionState().PeerCertificates[0].SerialNumber.Cmp(serial), ShouldNotEqual, 0)
+
+				Convey("Broken files should keep the certificate", func() {
+					So(ioutil.WriteFile(files.KeyFile, []byte("nope"), 0600), ShouldBeNil)
+					So(merry.Is(reloader.Reload(), ErrInvalidTLS), ShouldBeTrue)
+					conn, err := tls.Dial("tcp", addr, ca.clientConfig(""))
+					So(err, ShouldBeNil)
+					_ = conn.Close()
+				})
+			})
+		})
+		Convey("Client certificates should be verified", func() {
+			files.ClientCAFile = filepath.Join(dir, "ca.crt")
+			hash, err := HashPassword("secret")
+			So(err, ShouldBeNil)
+			_, addr := serve(files, Config{Users: []User{
+				{Name: "app1", PasswordHash: hash, ACL: ACL{Commands: []string{"@all"}, Keys: []string{"*"}}},
+			}})
+
+			Convey("Certificate's subject should authenticate the user", func() {
+				conn, err := tls.Dial("tcp", addr, ca.clientConfig("app1"))
+				So(err, ShouldBeNil)
+				defer conn.Close()
+				got, err := cmd(conn, "GET a")
+				So(err, ShouldBeNil)
+				So(got, ShouldEqual, "10\n")
+			})
+			Convey("Unknown subject should stay unauthenticated", func() {
+				conn, err := tls.Dial("tcp", addr, ca.clientConfig("stranger"))
+				So(err, ShouldBeNil)
+				defer conn.Close()
+				got, err := cmd(conn, "GET a")
+				So(err, ShouldBeNil)
+				So(got, ShouldEqual, "NOAUTH\n")
+			})
+			Convey("Clients without certificates should be rejected", func() {
+				conn, err := tls.Dial("tcp", addr, ca.clientConfig(""))
+				if err == nil {
+					defer conn.Close()
+					_, err = cmd(conn, "GET a")
+				}
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("Missing files should be rejected", func() {
+			_, err := NewTLSReloader(TLSFiles{CertFile: files.CertFile, KeyFile: filepath.Join(dir, "nope")})
+			So(merry.Is(err, ErrInvalidTLS), ShouldBeTrue)
+			files.ClientCAFile = files.KeyFile
+			_, err = NewTLSReloader(files)
+			So(merry.Is(err, ErrInvalidTLS), ShouldBeTrue)
+		})
+
+		Reset(func() {
+			_ = os.RemoveAll(dir)
+		})
+	})
+}
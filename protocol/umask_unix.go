@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package protocol
+
+import (
+	"syscall"
+)
+
+// umask sets the process' file mode creation mask and returns the old one.
+func umask(mask int) int {
+	return syscall.Umask(mask)
+}
@@ -0,0 +1,6 @@
+package protocol
+
+// umask does nothing and returns 0: there's no umask on Windows.
+func umask(mask int) int {
+	return 0
+}
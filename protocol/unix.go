@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"net"
+	"os"
+	"sync"
+)
+
+// PeerCred are the credentials of the unix socket's peer process.
+type PeerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// umaskMu serializes the umask changes of ListenUnix.
+var umaskMu sync.Mutex
+
+// ListenUnix listens on the unix socket at path, setting its file mode.
+// The socket is created with the mode already, by the umask set around
+// its creation, so it's never accessible by the others meanwhile.
+// Stale socket file left by the crashed server is removed;
+// ErrAddrInUse is returned if the socket is served already.
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			_ = conn.Close()
+			return nil, ErrAddrInUse.Here().Append(path)
+		}
+		_ = os.Remove(path)
+	}
+
+	umaskMu.Lock()
+	old := umask(int(^mode & os.ModePerm))
+	l, err := net.Listen("unix", path)
+	umask(old)
+	umaskMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, mode); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// allowPeer returns true if the client is allowed to connect
+// by the config's AllowUIDs and AllowGIDs.
+// Only unix socket clients are restricted.
+func (s *Server) allowPeer(conn net.Conn) bool {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok || (len(s.cfg.AllowUIDs) == 0 && len(s.cfg.AllowGIDs) == 0) {
+		return true
+	}
+	cred, err := peerCred(unixConn)
+	if err != nil {
+		s.cfg.Logger.Warnf("Client rejected: can't read its credentials: %v", err)
+		return false
+	}
+	for _, uid := range s.cfg.AllowUIDs {
+		if cred.UID == uid {
+			return true
+		}
+	}
+	for _, gid := range s.cfg.AllowGIDs {
+		if cred.GID == gid {
+			return true
+		}
+	}
+	s.cfg.Logger.Warnf("Client rejected: pid %v uid %v gid %v is not allowed", cred.PID, cred.UID, cred.GID)
+	return false
+}
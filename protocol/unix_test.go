@@ -0,0 +1,125 @@
+package protocol
+
+import (
+	"bufio"
+	"github.com/ansel1/merry"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/utrack/go-simple-memdb/storage"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestUnixServer(t *testing.T) {
+	Convey("With storage and temp dir", t, func() {
+		stor := storage.New()
+		dir, err := ioutil.TempDir("", "memdb-unix")
+		So(err, ShouldBeNil)
+		path := filepath.Join(dir, "memdb.sock")
+
+		serve := func(cfg Config) *Server {
+			l, err := ListenUnix(path, 0660)
+			So(err, ShouldBeNil)
+			srv := NewServerConfig(stor, cfg)
+			go func() { _ = srv.Serve(l) }()
+			return srv
+		}
+		cmd := func(conn net.Conn, r *bufio.Reader, line string) (string, error) {
+			_, _ = conn.Write([]byte(line + "\n"))
+			return r.ReadString('\n')
+		}
+		dial := func() (net.Conn, *bufio.Reader) {
+			conn, err := net.Dial("unix", path)
+			So(err, ShouldBeNil)
+			return conn, bufio.NewReader(conn)
+		}
+
+		Convey("Socket should be served with the file mode", func() {
+			srv := serve(Config{})
+			defer srv.Close()
+
+			fi, err := os.Stat(path)
+			So(err, ShouldBeNil)
+			So(fi.Mode()&os.ModePerm, ShouldEqual, os.FileMode(0660))
+
+			c1, r1 := dial()
+			c2, r2 := dial()
+			_, err = cmd(c1, r1, "BEGIN")
+			So(err, ShouldBeNil)
+			_, err = cmd(c1, r1, "SET a 10")
+			So(err, ShouldBeNil)
+			got, err := cmd(c2, r2, "GET a")
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, "NULL\n")
+
+			Convey("Served socket should not be taken over", func() {
+				_, err := ListenUnix(path, 0660)
+				So(merry.Is(err, ErrAddrInUse), ShouldBeTrue)
+			})
+		})
+		Convey("Umask should be restored after creating the socket", func() {
+			if runtime.GOOS == "windows" {
+				return
+			}
+			old := umask(022)
+			l, err := ListenUnix(path, 0600)
+			So(umask(old), ShouldEqual, 022)
+			So(err, ShouldBeNil)
+			defer l.Close()
+
+			fi, err := os.Stat(path)
+			So(err, ShouldBeNil)
+			So(fi.Mode()&os.ModePerm, ShouldEqual, os.FileMode(0600))
+		})
+		Convey("Stale socket should be replaced", func() {
+			l, err := net.Listen("unix", path)
+			So(err, ShouldBeNil)
+			l.(*net.UnixListener).SetUnlinkOnClose(false)
+			So(l.Close(), ShouldBeNil)
+
+			srv := serve(Config{})
+			defer srv.Close()
+			c, r := dial()
+			got, err := cmd(c, r, "GET a")
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, "NULL\n")
+		})
+		Convey("Clients should be restricted by credentials", func() {
+			Convey("Listed UID should be accepted", func() {
+				if runtime.GOOS != "linux" {
+					return
+				}
+				srv := serve(Config{AllowUIDs: []uint32{uint32(os.Getuid())}})
+				defer srv.Close()
+				c, r := dial()
+				got, err := cmd(c, r, "GET a")
+				So(err, ShouldBeNil)
+				So(got, ShouldEqual, "NULL\n")
+			})
+			Convey("Listed GID should be accepted", func() {
+				if runtime.GOOS != "linux" {
+					return
+				}
+				srv := serve(Config{AllowUIDs: []uint32{uint32(os.Getuid()) + 1}, AllowGIDs: []uint32{uint32(os.Getgid())}})
+				defer srv.Close()
+				c, r := dial()
+				_, err := cmd(c, r, "GET a")
+				So(err, ShouldBeNil)
+			})
+			Convey("Others should be rejected", func() {
+				srv := serve(Config{AllowUIDs: []uint32{uint32(os.Getuid()) + 1}})
+				defer srv.Close()
+				c, r := dial()
+				_, err := cmd(c, r, "GET a")
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Reset(func() {
+			_ = os.RemoveAll(dir)
+		})
+	})
+}
@@ -0,0 +1,9 @@
+/*
+Package repl provides an interactive console for the database.
+
+The console is used when stdin is a terminal. It shows the selected
+database and the number of transaction blocks in progress in its prompt,
+supports basic line editing (arrows, Home/End, Ctrl-A/E/U/K/W), keeps
+persistent history (Up/Down) and completes command names and known keys on Tab.
+*/
+package repl
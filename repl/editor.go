@@ -0,0 +1,278 @@
+package repl
+
+import (
+	"bufio"
+	"github.com/ansel1/merry"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// errInterrupted is returned when the line was cancelled with Ctrl-C.
+var errInterrupted = merry.New("Interrupted.")
+
+// Control keys.
+const (
+	keyCtrlA     = 1
+	keyCtrlB     = 2
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyCtrlE     = 5
+	keyCtrlF     = 6
+	keyCtrlH     = 8
+	keyTab       = 9
+	keyLF        = 10
+	keyCtrlK     = 11
+	keyCtrlL     = 12
+	keyCR        = 13
+	keyCtrlN     = 14
+	keyCtrlP     = 16
+	keyCtrlU     = 21
+	keyCtrlW     = 23
+	keyEsc       = 27
+	keyBackspace = 127
+)
+
+// editor reads the lines from the terminal in raw mode,
+// echoing and editing them.
+type editor struct {
+	r       *bufio.Reader
+	w       io.Writer
+	history *history
+	// complete returns the candidates for the word
+	// being typed at the end of the line.
+	complete func(line string) []string
+
+	prompt string
+	buf    []rune
+	pos    int
+	// histPos is the position in the history; len(history) is the new line.
+	histPos int
+	// draft keeps the new line while browsing the history.
+	draft []rune
+}
+
+func newEditor(r io.Reader, w io.Writer, h *history, complete func(string) []string) *editor {
+	return &editor{r: bufio.NewReader(r), w: w, history: h, complete: complete}
+}
+
+// readLine reads the line, showing the prompt.
+// io.EOF is returned on Ctrl-D at the empty line,
+// errInterrupted on Ctrl-C.
+func (e *editor) readLine(prompt string) (string, error) {
+	e.prompt = prompt
+	e.buf = e.buf[:0]
+	e.pos = 0
+	e.histPos = len(e.history.lines)
+	e.refresh()
+
+	for {
+		r, _, err := e.r.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		switch r {
+		case keyCR, keyLF:
+			e.write("\n")
+			line := string(e.buf)
+			e.history.add(line)
+			return line, nil
+		case keyCtrlC:
+			e.write("^C\n")
+			return "", errInterrupted.Here()
+		case keyCtrlD:
+			if len(e.buf) == 0 {
+				e.write("\n")
+				return "", io.EOF
+			}
+			e.delete()
+		case keyBackspace, keyCtrlH:
+			if e.pos > 0 {
+				e.pos--
+				e.delete()
+			}
+		case keyCtrlA:
+			e.pos = 0
+		case keyCtrlE:
+			e.pos = len(e.buf)
+		case keyCtrlB:
+			e.left()
+		case keyCtrlF:
+			e.right()
+		case keyCtrlK:
+			e.buf = e.buf[:e.pos]
+		case keyCtrlU:
+			e.buf = append(e.buf[:0], e.buf[e.pos:]...)
+			e.pos = 0
+		case keyCtrlW:
+			e.deleteWord()
+		case keyCtrlP:
+			e.browse(-1)
+		case keyCtrlN:
+			e.browse(1)
+		case keyCtrlL:
+			e.write("\x1b[H\x1b[2J")
+		case keyTab:
+			e.completeWord()
+		case keyEsc:
+			e.escape()
+		default:
+			if r >= ' ' {
+				e.insert(r)
+			}
+		}
+		e.refresh()
+	}
+}
+
+// escape handles the escape sequences of arrows and other keys.
+func (e *editor) escape() {
+	r, _, err := e.r.ReadRune()
+	if err != nil || (r != '[' && r != 'O') {
+		return
+	}
+	r, _, err = e.r.ReadRune()
+	if err != nil {
+		return
+	}
+	switch r {
+	case 'A':
+		e.browse(-1)
+	case 'B':
+		e.browse(1)
+	case 'C':
+		e.right()
+	case 'D':
+		e.left()
+	case 'H':
+		e.pos = 0
+	case 'F':
+		e.pos = len(e.buf)
+	case '1', '3', '4', '7', '8':
+		// VT sequences: ESC [ n ~
+		if tilde, _, err := e.r.ReadRune(); err != nil || tilde != '~' {
+			return
+		}
+		switch r {
+		case '1', '7':
+			e.pos = 0
+		case '4', '8':
+			e.pos = len(e.buf)
+		case '3':
+			e.delete()
+		}
+	}
+}
+
+func (e *editor) insert(r rune) {
+	e.buf = append(e.buf, 0)
+	copy(e.buf[e.pos+1:], e.buf[e.pos:])
+	e.buf[e.pos] = r
+	e.pos++
+}
+
+// delete removes the rune under the cursor.
+func (e *editor) delete() {
+	if e.pos < len(e.buf) {
+		e.buf = append(e.buf[:e.pos], e.buf[e.pos+1:]...)
+	}
+}
+
+// deleteWord removes the word before the cursor.
+func (e *editor) deleteWord() {
+	start := e.pos
+	for start > 0 && e.buf[start-1] == ' ' {
+		start--
+	}
+	for start > 0 && e.buf[start-1] != ' ' {
+		start--
+	}
+	e.buf = append(e.buf[:start], e.buf[e.pos:]...)
+	e.pos = start
+}
+
+func (e *editor) left() {
+	if e.pos > 0 {
+		e.pos--
+	}
+}
+
+func (e *editor) right() {
+	if e.pos < len(e.buf) {
+		e.pos++
+	}
+}
+
+// browse moves through the history by delta lines.
+func (e *editor) browse(delta int) {
+	next := e.histPos + delta
+	if next < 0 || next > len(e.history.lines) {
+		return
+	}
+	if e.histPos == len(e.history.lines) {
+		e.draft = append(e.draft[:0], e.buf...)
+	}
+	e.histPos = next
+	if next == len(e.history.lines) {
+		e.buf = append(e.buf[:0], e.draft...)
+	} else {
+		e.buf = []rune(e.history.lines[next])
+	}
+	e.pos = len(e.buf)
+}
+
+// completeWord completes the word before the cursor.
+// Single candidate is inserted as a whole, several ones are
+// completed up to their common prefix and listed.
+func (e *editor) completeWord() {
+	if e.complete == nil {
+		return
+	}
+	line := string(e.buf[:e.pos])
+	start := strings.LastIndex(line, " ") + 1
+	word := line[start:]
+	candidates := e.complete(line)
+
+	var completion string
+	switch len(candidates) {
+	case 0:
+		return
+	case 1:
+		completion = candidates[0] + " "
+	default:
+		completion = commonPrefix(candidates)
+		if len(completion) <= len(word) {
+			e.write("\n" + strings.Join(candidates, "  ") + "\n")
+			return
+		}
+	}
+
+	tail := string(e.buf[e.pos:])
+	e.buf = []rune(line[:start] + completion + tail)
+	e.pos = len([]rune(line[:start] + completion))
+}
+
+// refresh redraws the line and places the cursor.
+func (e *editor) refresh() {
+	s := "\r" + e.prompt + string(e.buf) + "\x1b[K"
+	if back := len(e.buf) - e.pos; back > 0 {
+		s += "\x1b[" + strconv.Itoa(back) + "D"
+	}
+	e.write(s)
+}
+
+func (e *editor) write(s string) {
+	_, _ = io.WriteString(e.w, s)
+}
+
+// commonPrefix returns the longest common prefix of the strings.
+func commonPrefix(ss []string) string {
+	ret := ss[0]
+	for _, s := range ss[1:] {
+		for !strings.HasPrefix(s, ret) {
+			ret = ret[:len(ret)-1]
+		}
+	}
+	return ret
+}
@@ -0,0 +1,86 @@
+package repl
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// history keeps the lines entered before, persisting them to the file.
+type history struct {
+	// path is history file's path; history is not persisted if empty.
+	path  string
+	max   int
+	lines []string
+}
+
+// loadHistory loads up to max recent lines from the file.
+// Missing or unreadable file gives an empty history.
+func loadHistory(path string, max int) *history {
+	ret := &history{path: path, max: max}
+	if path == "" {
+		return ret
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return ret
+	}
+	defer f.Close()
+
+	var total int
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if line := sc.Text(); line != "" {
+			ret.append(line)
+			total++
+		}
+	}
+	// Compact the file once it's grown too much
+	if total > 2*max {
+		ret.rewrite()
+	}
+	return ret
+}
+
+// add appends the line to the history and its file.
+// Empty lines and repeats of the last line are skipped.
+func (h *history) add(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || (len(h.lines) > 0 && h.lines[len(h.lines)-1] == line) {
+		return
+	}
+	h.append(line)
+
+	if h.path == "" {
+		return
+	}
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	_, _ = f.WriteString(line + "\n")
+	_ = f.Close()
+}
+
+// append appends the line, keeping up to max lines.
+func (h *history) append(line string) {
+	h.lines = append(h.lines, line)
+	if len(h.lines) > h.max {
+		h.lines = h.lines[len(h.lines)-h.max:]
+	}
+}
+
+// rewrite replaces the history file with the lines in memory.
+func (h *history) rewrite() {
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(f)
+	for _, line := range h.lines {
+		_, _ = w.WriteString(line + "\n")
+	}
+	_ = w.Flush()
+	_ = f.Close()
+}
@@ -0,0 +1,193 @@
+package repl
+
+import (
+	"github.com/ansel1/merry"
+	"github.com/utrack/go-simple-memdb/protocol"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// historySize is the number of lines kept in the history.
+const historySize = 1000
+
+// subcommands are the completions for commands' first arguments
+// that are not keys.
+var subcommands = map[string][]string{
+	"BEGIN":    {"READONLY"},
+	"ROLLBACK": {"TO"},
+}
+
+// commandNames returns the names of the registered commands.
+func commandNames() []string {
+	cmds := protocol.Commands()
+	ret := make([]string, 0, len(cmds))
+	for _, c := range cmds {
+		ret = append(ret, c.Name)
+	}
+	return ret
+}
+
+// isKeyCommand returns true if the command takes the key as the first argument.
+func isKeyCommand(name string) bool {
+	for _, c := range protocol.Commands() {
+		if c.Name == name {
+			return c.Flags&protocol.FlagKey != 0
+		}
+	}
+	return false
+}
+
+// ANSI colours for the output.
+const (
+	colorYellow = "\x1b[33m"
+	colorRed    = "\x1b[31m"
+	colorReset  = "\x1b[0m"
+)
+
+// REPL is an interactive console over the DBSocket.
+type REPL struct {
+	sock    *protocol.DBSocket
+	history *history
+	// keys are the keys seen in the commands, used for completion.
+	keys map[string]struct{}
+}
+
+// New creates new REPL over the socket.
+// History is persisted to historyPath unless it's empty.
+func New(sock *protocol.DBSocket, historyPath string) *REPL {
+	return &REPL{
+		sock:    sock,
+		history: loadHistory(historyPath, historySize),
+		keys:    map[string]struct{}{},
+	}
+}
+
+// DefaultHistoryPath returns the path of the history file
+// in user's home directory, or an empty string if there's no home.
+func DefaultHistoryPath() string {
+	home := os.Getenv("HOME")
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, ".memdb_history")
+}
+
+// Run switches the terminal to raw mode and processes the commands
+// until END or Ctrl-D.
+func (r *REPL) Run(in *os.File, out io.Writer) error {
+	restore, err := makeRaw(in)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	return r.run(in, out)
+}
+
+// run processes the commands read from the raw terminal.
+// Transactions left in progress are rolled back.
+func (r *REPL) run(in io.Reader, out io.Writer) error {
+	defer r.sock.Close()
+	ed := newEditor(in, out, r.history, r.complete)
+	for {
+		line, err := ed.readLine(r.prompt())
+		if merry.Is(err, errInterrupted) {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		r.rememberKeys(line)
+		output, ok := r.sock.Exec(line)
+		if !ok {
+			return nil
+		}
+		if output != "" {
+			_, _ = io.WriteString(out, colorize(output)+"\n")
+		}
+	}
+}
+
+// prompt returns the prompt showing the selected database
+// and the transaction depth.
+func (r *REPL) prompt() string {
+	ret := "memdb"
+	if db := r.sock.DBName(); db != "" && db != "0" {
+		ret += "[" + db + "]"
+	}
+	if depth := r.sock.TxDepth(); depth > 0 {
+		ret += "(tx:" + strconv.Itoa(depth) + ")"
+	}
+	return ret + "> "
+}
+
+// complete returns the candidates for the last word of the line.
+func (r *REPL) complete(line string) []string {
+	words := strings.Split(line, " ")
+	word := words[len(words)-1]
+
+	var candidates []string
+	switch {
+	case len(words) == 1:
+		candidates = commandNames()
+		word = strings.ToUpper(word)
+	case len(words) == 2:
+		cmd := strings.ToUpper(words[0])
+		switch {
+		case cmd == "COMMAND" || cmd == "HELP":
+			candidates = commandNames()
+			word = strings.ToUpper(word)
+		case isKeyCommand(cmd):
+			candidates = r.knownKeys()
+		default:
+			candidates = subcommands[cmd]
+		}
+	}
+
+	var ret []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, word) {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// rememberKeys remembers the key of the command for the completion.
+func (r *REPL) rememberKeys(line string) {
+	words := strings.Fields(line)
+	if len(words) > 1 && isKeyCommand(words[0]) {
+		r.keys[words[1]] = struct{}{}
+	}
+}
+
+func (r *REPL) knownKeys() []string {
+	ret := make([]string, 0, len(r.keys))
+	for k := range r.keys {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// colorize highlights NULLs and errors.
+func colorize(output string) string {
+	switch output {
+	case "NULL":
+		return colorYellow + output + colorReset
+	case "NO TRANSACTION", "NO SAVEPOINT", "READONLY", "UNKNOWN COMMAND", "WRONG NUMBER OF ARGUMENTS",
+		"NOT ALLOWED IN TRANSACTION", "NOAUTH", "NOPERM", "WRONGPASS":
+		return colorRed + output + colorReset
+	}
+	return output
+}
@@ -0,0 +1,105 @@
+package repl
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/utrack/go-simple-memdb/protocol"
+	"github.com/utrack/go-simple-memdb/storage"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestREPL(t *testing.T) {
+	Convey("With REPL and temp history", t, func() {
+		dir, err := ioutil.TempDir("", "memdb-repl")
+		So(err, ShouldBeNil)
+		Reset(func() { _ = os.RemoveAll(dir) })
+		histPath := filepath.Join(dir, "history")
+
+		stor := storage.New()
+		r := New(protocol.NewSocket(stor), histPath)
+		out := &bytes.Buffer{}
+		run := func(input string) {
+			So(r.run(strings.NewReader(input), out), ShouldBeNil)
+		}
+
+		Convey("Should execute the commands", func() {
+			run("SET a 10\rGET a\rGET b\rEND\r")
+			So(out.String(), ShouldContainSubstring, "\n10\n")
+			So(out.String(), ShouldContainSubstring, colorYellow+"NULL"+colorReset)
+			got, err := stor.Get("a")
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, "10")
+		})
+
+		Convey("Prompt should show transaction depth", func() {
+			run("BEGIN\rSAVEPOINT a\rBEGIN\rROLLBACK\rCOMMIT\rCOMMIT\r\x04")
+			So(out.String(), ShouldContainSubstring, "\rmemdb(tx:2)> ROLLBACK")
+			So(out.String(), ShouldContainSubstring, "\rmemdb(tx:1)> COMMIT")
+			So(out.String(), ShouldContainSubstring, "\rmemdb> COMMIT")
+			So(out.String(), ShouldContainSubstring, colorRed+"NO TRANSACTION"+colorReset)
+		})
+
+		Convey("Transactions should be rolled back on exit", func() {
+			run("BEGIN\rSET a 10\r\x04")
+			_, err := stor.Get("a")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Line should be editable", func() {
+			// SET a 1, backspace, "20", left x3, delete "a", insert "b"
+			run("SET a 1\x7f20\x1b[D\x1b[D\x1b[D\x7fb\rEND\r")
+			got, err := stor.Get("b")
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, "20")
+		})
+
+		Convey("Ctrl-C should cancel the line", func() {
+			run("SET a 10\x03GET a\rEND\r")
+			So(out.String(), ShouldContainSubstring, "^C")
+			So(out.String(), ShouldContainSubstring, "NULL")
+		})
+
+		Convey("Prompt should show selected database", func() {
+			r := New(protocol.NewRegistrySocket(storage.NewRegistry(), protocol.Config{}), "")
+			So(r.run(strings.NewReader("SELECT 3\rBEGIN\rEND\r"), out), ShouldBeNil)
+			So(out.String(), ShouldContainSubstring, "\rmemdb[3]> BEGIN")
+			So(out.String(), ShouldContainSubstring, "\rmemdb[3](tx:1)> END")
+		})
+
+		Convey("Commands and keys should be completed", func() {
+			run("SET key1 10\rge\t k\t\rEND\r")
+			So(out.String(), ShouldContainSubstring, "\n10\n")
+
+			So(r.complete("r"), ShouldResemble, []string{"RELEASE", "REPLICATION", "ROLLBACK"})
+			So(r.complete("BEGIN R"), ShouldResemble, []string{"READONLY"})
+			So(r.complete("UNSET k"), ShouldResemble, []string{"key1"})
+			So(r.complete("help nu"), ShouldResemble, []string{"NUMEQUALTO", "NUMEQUALTOB"})
+			So(r.complete("ge"), ShouldResemble, []string{"GET", "GETB"})
+		})
+
+		Convey("History should be browsed and persisted", func() {
+			run("SET a 10\rSET a 20\r\x1b[A\x1b[A\x1b[B\x7f\x7f30\rEND\r")
+			got, err := stor.Get("a")
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, "30")
+
+			h := loadHistory(histPath, historySize)
+			So(h.lines, ShouldResemble, []string{"SET a 10", "SET a 20", "SET a 30", "END"})
+		})
+	})
+}
+
+func TestHistoryLimit(t *testing.T) {
+	Convey("History should keep up to max lines", t, func() {
+		h := loadHistory("", 2)
+		h.add("a")
+		h.add("b")
+		h.add("b")
+		h.add("c")
+		So(h.lines, ShouldResemble, []string{"b", "c"})
+	})
+}
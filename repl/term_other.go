@@ -0,0 +1,19 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package repl
+
+import (
+	"github.com/ansel1/merry"
+	"os"
+)
+
+// IsTerminal returns true if the file is a terminal.
+// Terminals are not supported on this platform.
+func IsTerminal(_ *os.File) bool {
+	return false
+}
+
+func makeRaw(_ *os.File) (func(), error) {
+	return nil, merry.New("Raw terminal mode is not supported on this platform.")
+}
@@ -0,0 +1,32 @@
+/*
+Package replication provides leader/follower replication of the root storage.
+
+Leader streams every change set committed to its root storage
+to the followers connected over the network.
+Follower applies the change sets to its own root in order and tracks
+its replication offset - the sequence number of the last applied change set.
+
+Leader keeps a limited backlog of the recent change sets. Follower that falls
+behind the backlog (or connects for the first time to the leader having
+older changes) is resynced from the leader's full snapshot.
+
+Leader drops the followers that don't read its frames in time.
+Leader's and Follower's stats are reported by their Stats, and by
+the protocol's REPLICATION command via their Info.
+
+Followers should be served read-only, see protocol.NewReadOnlyServer.
+
+Basic usage
+
+  // Leader
+  leaderDB := storage.New()
+  leader := replication.NewLeader(leaderDB, 1024)
+  go leader.Serve(replListener)
+
+  // Follower
+  followerDB := storage.New()
+  follower := replication.NewFollower(followerDB)
+  go follower.Follow(leaderReplAddr)
+  go protocol.NewReadOnlyServer(followerDB).Serve(clientListener)
+*/
+package replication
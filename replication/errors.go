@@ -0,0 +1,8 @@
+package replication
+
+import (
+	"github.com/ansel1/merry"
+)
+
+// ErrClosed is returned when the leader or follower was closed.
+var ErrClosed = merry.New("Replication was closed.")
@@ -0,0 +1,169 @@
+package replication
+
+import (
+	"encoding/gob"
+	"fmt"
+	"github.com/utrack/go-simple-memdb/storage"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stats describes follower's replication state.
+type Stats struct {
+	// Connected is true if the follower is connected to the leader.
+	Connected bool
+	// Offset is the sequence number of the last applied change set.
+	Offset uint64
+	// LeaderOffset is the sequence number of leader's last change set
+	// known to the follower.
+	LeaderOffset uint64
+	// Lag is the number of leader's change sets not applied yet.
+	Lag uint64
+	// LastContact is the time of the last frame received from the leader.
+	LastContact time.Time
+	// Resyncs is the number of full resyncs from leader's snapshot.
+	Resyncs uint64
+}
+
+// Follower applies leader's change sets to the root storage.
+// Root should be served read-only while it is replicated.
+type Follower struct {
+	root storage.Root
+
+	mu       sync.Mutex
+	stats    Stats
+	conn     net.Conn
+	done     chan struct{}
+	isClosed bool
+}
+
+// NewFollower creates a Follower for the root storage.
+func NewFollower(root storage.Root) *Follower {
+	return &Follower{
+		root: root,
+		done: make(chan struct{}),
+	}
+}
+
+// Follow connects to the leader at addr and applies its
+// change sets until the follower is closed.
+// Follower reconnects if the connection is lost.
+func (f *Follower) Follow(addr string) error {
+	for {
+		conn, err := net.DialTimeout("tcp", addr, readTimeout)
+		if err == nil {
+			_ = f.replicate(conn)
+		}
+
+		select {
+		case <-f.done:
+			return ErrClosed.Here()
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+// Close stops the replication.
+func (f *Follower) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.isClosed {
+		return nil
+	}
+	f.isClosed = true
+	close(f.done)
+	if f.conn != nil {
+		_ = f.conn.Close()
+	}
+	return nil
+}
+
+// Stats returns current replication's stats.
+func (f *Follower) Stats() Stats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ret := f.stats
+	ret.Offset = f.root.Seq()
+	if ret.LeaderOffset > ret.Offset {
+		ret.Lag = ret.LeaderOffset - ret.Offset
+	}
+	return ret
+}
+
+// Info returns the stats as the lines of the names and values,
+// the last contact in Unix seconds (0 if there was none);
+// it implements protocol.ReplicationInfo.
+func (f *Follower) Info() []string {
+	st := f.Stats()
+	connected, lastContact := 0, int64(0)
+	if st.Connected {
+		connected = 1
+	}
+	if !st.LastContact.IsZero() {
+		lastContact = st.LastContact.Unix()
+	}
+	return []string{
+		"role follower",
+		fmt.Sprintf("connected %v", connected),
+		fmt.Sprintf("offset %v", st.Offset),
+		fmt.Sprintf("leader_offset %v", st.LeaderOffset),
+		fmt.Sprintf("lag %v", st.Lag),
+		fmt.Sprintf("last_contact %v", lastContact),
+		fmt.Sprintf("resyncs %v", st.Resyncs),
+	}
+}
+
+// replicate applies the change sets received over the connection
+// until it fails or the follower is closed.
+func (f *Follower) replicate(conn net.Conn) error {
+	defer func() { _ = conn.Close() }()
+	if !f.setConn(conn) {
+		return ErrClosed.Here()
+	}
+	defer f.setConn(nil)
+
+	_ = conn.SetWriteDeadline(time.Now().Add(readTimeout))
+	if err := gob.NewEncoder(conn).Encode(request{Offset: f.root.Seq()}); err != nil {
+		return err
+	}
+
+	dec := gob.NewDecoder(conn)
+	for {
+		var fr frame
+		_ = conn.SetReadDeadline(time.Now().Add(readTimeout))
+		if err := dec.Decode(&fr); err != nil {
+			return err
+		}
+
+		if fr.Snapshot != nil {
+			f.root.Restore(*fr.Snapshot)
+		}
+		if fr.ChangeSet != nil {
+			if err := f.root.Apply(*fr.ChangeSet); err != nil {
+				return err
+			}
+		}
+
+		f.mu.Lock()
+		f.stats.LeaderOffset = fr.LeaderOffset
+		f.stats.LastContact = time.Now()
+		if fr.Snapshot != nil {
+			f.stats.Resyncs++
+		}
+		f.mu.Unlock()
+	}
+}
+
+// setConn sets current leader's connection.
+// Returns false if the follower is closed.
+func (f *Follower) setConn(conn net.Conn) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.isClosed {
+		return false
+	}
+	f.conn = conn
+	f.stats.Connected = conn != nil
+	return true
+}
@@ -0,0 +1,293 @@
+package replication
+
+import (
+	"encoding/gob"
+	"fmt"
+	"github.com/utrack/go-simple-memdb/storage"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Leader streams root's change sets to the followers.
+type Leader struct {
+	root        storage.Root
+	backlogSize int
+
+	mu sync.Mutex
+	// backlog keeps recent change sets in order.
+	backlog []storage.ChangeSet
+	// notify is closed and replaced when new change set arrives.
+	notify chan struct{}
+
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	// offsets are the sequence numbers of the last change sets
+	// sent to the connected followers.
+	offsets  map[net.Conn]uint64
+	done     chan struct{}
+	isClosed bool
+}
+
+// LeaderStats describes leader's replication state.
+type LeaderStats struct {
+	// Offset is the sequence number of root's last change set.
+	Offset uint64
+	// Replicas are the connected followers ordered by their addresses.
+	Replicas []Replica
+}
+
+// Replica describes the follower connected to the leader.
+type Replica struct {
+	// Addr is the follower's address.
+	Addr string
+	// Offset is the sequence number of the last change set sent to it.
+	Offset uint64
+	// Lag is the number of root's change sets not sent to it yet.
+	Lag uint64
+}
+
+// NewLeader creates a Leader for the root storage.
+// It keeps up to backlogSize recent change sets for the followers
+// that are catching up; followers that fall behind the backlog
+// are resynced from the full snapshot.
+func NewLeader(root storage.Root, backlogSize int) *Leader {
+	if backlogSize < 1 {
+		backlogSize = 1
+	}
+	ret := &Leader{
+		root:        root,
+		backlogSize: backlogSize,
+		notify:      make(chan struct{}),
+		listeners:   map[net.Listener]struct{}{},
+		conns:       map[net.Conn]struct{}{},
+		offsets:     map[net.Conn]uint64{},
+		done:        make(chan struct{}),
+	}
+	root.OnCommit(ret.onCommit)
+	return ret
+}
+
+// onCommit adds the root's change set to the backlog.
+// It is called with root locked, so it mustn't call the root.
+func (l *Leader) onCommit(cs storage.ChangeSet) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.backlog = append(l.backlog, cs)
+	if len(l.backlog) > l.backlogSize {
+		l.backlog = l.backlog[len(l.backlog)-l.backlogSize:]
+	}
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+// Serve accepts followers' connections on the listener and streams
+// the change sets to them until the listener or the leader is closed.
+func (l *Leader) Serve(lis net.Listener) error {
+	if !l.track(lis) {
+		_ = lis.Close()
+		return ErrClosed.Here()
+	}
+	defer l.untrack(lis)
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if l.closed() {
+				return ErrClosed.Here()
+			}
+			return err
+		}
+		go l.serveFollower(conn)
+	}
+}
+
+// Close closes leader's listeners and followers' connections.
+func (l *Leader) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.isClosed {
+		return nil
+	}
+	l.isClosed = true
+	close(l.done)
+	for lis := range l.listeners {
+		_ = lis.Close()
+	}
+	for conn := range l.conns {
+		_ = conn.Close()
+	}
+	return nil
+}
+
+// serveFollower streams the change sets to the follower
+// until the connection is closed.
+func (l *Leader) serveFollower(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	if !l.track(conn) {
+		return
+	}
+	defer l.untrack(conn)
+
+	var req request
+	_ = conn.SetReadDeadline(time.Now().Add(readTimeout))
+	if err := gob.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+
+	enc := gob.NewEncoder(conn)
+	// send writes the frame, giving up if the follower doesn't read it
+	send := func(fr frame) error {
+		_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		return enc.Encode(fr)
+	}
+	offset := req.Offset
+	for {
+		l.setOffset(conn, offset)
+		batch, resync, ok := l.next(offset)
+		if !ok {
+			return
+		}
+
+		var err error
+		switch {
+		case resync:
+			snap := l.root.Snapshot()
+			offset = snap.Seq
+			err = send(frame{LeaderOffset: l.root.Seq(), Snapshot: &snap})
+		case len(batch) == 0:
+			err = send(frame{LeaderOffset: l.root.Seq()})
+		}
+		for i := 0; err == nil && i < len(batch); i++ {
+			offset = batch[i].Seq
+			err = send(frame{LeaderOffset: batch[len(batch)-1].Seq, ChangeSet: &batch[i]})
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Stats returns current replication's stats.
+func (l *Leader) Stats() LeaderStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ret := LeaderStats{Offset: l.root.Seq()}
+	for conn, offset := range l.offsets {
+		r := Replica{Addr: conn.RemoteAddr().String(), Offset: offset}
+		if ret.Offset > offset {
+			r.Lag = ret.Offset - offset
+		}
+		ret.Replicas = append(ret.Replicas, r)
+	}
+	sort.Slice(ret.Replicas, func(i, j int) bool { return ret.Replicas[i].Addr < ret.Replicas[j].Addr })
+	return ret
+}
+
+// Info returns the stats as the lines of the names and values,
+// a line of address, offset and lag per follower;
+// it implements protocol.ReplicationInfo.
+func (l *Leader) Info() []string {
+	st := l.Stats()
+	ret := []string{
+		"role leader",
+		fmt.Sprintf("offset %v", st.Offset),
+		fmt.Sprintf("followers %v", len(st.Replicas)),
+	}
+	for _, r := range st.Replicas {
+		ret = append(ret, fmt.Sprintf("follower %v %v %v", r.Addr, r.Offset, r.Lag))
+	}
+	return ret
+}
+
+// setOffset remembers the offset of the follower's connection.
+func (l *Leader) setOffset(conn net.Conn, offset uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.conns[conn]; ok {
+		l.offsets[conn] = offset
+	}
+}
+
+// next returns the change sets following the offset.
+// It waits for the new change sets for up to heartbeatInterval
+// and returns an empty batch if there were none.
+// resync is true if the follower at the offset can't be caught up
+// from the backlog.
+// ok is false if the leader was closed.
+func (l *Leader) next(offset uint64) (batch []storage.ChangeSet, resync bool, ok bool) {
+	for waited := false; ; waited = true {
+		l.mu.Lock()
+		batch, resync = l.after(offset)
+		notify := l.notify
+		l.mu.Unlock()
+
+		if resync || len(batch) > 0 || waited {
+			return batch, resync, true
+		}
+
+		select {
+		case <-notify:
+		case <-time.After(heartbeatInterval):
+		case <-l.done:
+			return nil, false, false
+		}
+	}
+}
+
+// after returns backlog's change sets following the offset.
+func (l *Leader) after(offset uint64) ([]storage.ChangeSet, bool) {
+	if len(l.backlog) == 0 {
+		return nil, offset != l.root.Seq()
+	}
+
+	first := l.backlog[0].Seq
+	last := l.backlog[len(l.backlog)-1].Seq
+	switch {
+	case offset+1 < first || offset > last:
+		// Fell behind the backlog or diverged
+		return nil, true
+	case offset == last:
+		return nil, false
+	}
+	return l.backlog[offset+1-first:], false
+}
+
+// track remembers the listener or connection to close them on Close().
+// Returns false if the leader is closed already.
+func (l *Leader) track(c interface{}) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.isClosed {
+		return false
+	}
+	switch c := c.(type) {
+	case net.Listener:
+		l.listeners[c] = struct{}{}
+	case net.Conn:
+		l.conns[c] = struct{}{}
+	}
+	return true
+}
+
+// untrack forgets the listener or connection.
+func (l *Leader) untrack(c interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch c := c.(type) {
+	case net.Listener:
+		delete(l.listeners, c)
+	case net.Conn:
+		delete(l.conns, c)
+		delete(l.offsets, c)
+	}
+}
+
+// closed returns true if the leader was closed.
+func (l *Leader) closed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.isClosed
+}
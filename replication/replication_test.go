@@ -0,0 +1,230 @@
+package replication
+
+import (
+	"bufio"
+	"encoding/gob"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/utrack/go-simple-memdb/protocol"
+	"github.com/utrack/go-simple-memdb/storage"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testClient talks the line protocol to the server.
+type testClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialTestClient(addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	So(err, ShouldBeNil)
+	return &testClient{conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *testClient) cmd(line string) string {
+	_, err := c.conn.Write([]byte(line + "\n"))
+	So(err, ShouldBeNil)
+	ret, err := c.r.ReadString('\n')
+	So(err, ShouldBeNil)
+	return strings.TrimSuffix(ret, "\n")
+}
+
+func listen() net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	So(err, ShouldBeNil)
+	return l
+}
+
+// waitFor polls the condition until it's true or times out.
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestReplication(t *testing.T) {
+	Convey("With leader and follower servers over loopback", t, func() {
+		leaderDB := storage.New()
+		leaderSrv := protocol.NewServer(leaderDB)
+		leaderLis := listen()
+		go func() { _ = leaderSrv.Serve(leaderLis) }()
+
+		leader := NewLeader(leaderDB, 4)
+		replLis := listen()
+		go func() { _ = leader.Serve(replLis) }()
+
+		followerDB := storage.New()
+		followerSrv := protocol.NewReadOnlyServer(followerDB)
+		followerLis := listen()
+		go func() { _ = followerSrv.Serve(followerLis) }()
+
+		follower := NewFollower(followerDB)
+		go func() { _ = follower.Follow(replLis.Addr().String()) }()
+
+		lc := dialTestClient(leaderLis.Addr().String())
+		fc := dialTestClient(followerLis.Addr().String())
+
+		Reset(func() {
+			_ = follower.Close()
+			_ = leader.Close()
+			_ = followerSrv.Close()
+			_ = leaderSrv.Close()
+		})
+
+		caughtUp := func() bool {
+			st := follower.Stats()
+			return st.Connected && st.Offset == leaderDB.Seq()
+		}
+
+		Convey("Committed changes should be replicated", func() {
+			lc.cmd("SET a 10")
+			lc.cmd("BEGIN")
+			lc.cmd("SET b 10")
+			lc.cmd("UNSET a")
+			So(lc.cmd("COMMIT"), ShouldEqual, "")
+			So(waitFor(caughtUp), ShouldBeTrue)
+
+			So(fc.cmd("GET a"), ShouldEqual, "NULL")
+			So(fc.cmd("GET b"), ShouldEqual, "10")
+			So(fc.cmd("NUMEQUALTO 10"), ShouldEqual, "1")
+
+			st := follower.Stats()
+			So(st.Offset, ShouldEqual, uint64(2))
+			So(st.Lag, ShouldEqual, uint64(0))
+			So(st.Resyncs, ShouldEqual, uint64(0))
+
+			Convey("Follower should be read-only", func() {
+				So(fc.cmd("SET a 20"), ShouldEqual, "READONLY")
+			})
+		})
+
+		Convey("REPLICATION should describe the leader and the follower", func() {
+			lc.cmd("SET a 10")
+			So(waitFor(caughtUp), ShouldBeTrue)
+			So(waitFor(func() bool {
+				st := leader.Stats()
+				return len(st.Replicas) == 1 && st.Replicas[0].Offset == 1
+			}), ShouldBeTrue)
+
+			sock := protocol.NewSocketConfig(followerDB, protocol.Config{
+				ReadOnly:    true,
+				Replication: []protocol.ReplicationInfo{follower, leader},
+			})
+			out, _ := sock.Exec("REPLICATION")
+			lines := strings.Split(out, "\n")
+			So(lines[0], ShouldEqual, "11")
+			So(lines[1:6], ShouldResemble, []string{"role follower", "connected 1", "offset 1", "leader_offset 1", "lag 0"})
+			So(lines[7:11], ShouldResemble, []string{"resyncs 0", "role leader", "offset 1", "followers 1"})
+			So(strings.Fields(lines[11])[2:], ShouldResemble, []string{"1", "0"})
+		})
+
+		Convey("Uncommitted changes should not be replicated", func() {
+			lc.cmd("BEGIN")
+			lc.cmd("SET a 10")
+			lc.cmd("SET b 20")
+			So(waitFor(caughtUp), ShouldBeTrue)
+			So(fc.cmd("GET a"), ShouldEqual, "NULL")
+		})
+
+		Convey("Binary values should be replicated as is", func() {
+			value := []byte{0, 0xff, '\n', 0}
+			storage.SetBytes(leaderDB, "a", value)
+			So(waitFor(caughtUp), ShouldBeTrue)
+			got, err := storage.GetBytes(followerDB, "a")
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, value)
+			So(storage.NumEqualToBytes(followerDB, value), ShouldEqual, uint64(1))
+		})
+
+		Convey("Follower that fell behind should resync from snapshot", func() {
+			lc.cmd("SET a 10")
+			So(waitFor(caughtUp), ShouldBeTrue)
+			_ = follower.Close()
+
+			for _, v := range []string{"20", "30", "40", "50", "60", "70"} {
+				lc.cmd("SET a " + v)
+			}
+			follower = NewFollower(followerDB)
+			go func() { _ = follower.Follow(replLis.Addr().String()) }()
+
+			So(waitFor(caughtUp), ShouldBeTrue)
+			So(fc.cmd("GET a"), ShouldEqual, "70")
+			So(follower.Stats().Resyncs, ShouldEqual, uint64(1))
+		})
+
+		Convey("Follower within the backlog should catch up without resync", func() {
+			lc.cmd("SET a 10")
+			So(waitFor(caughtUp), ShouldBeTrue)
+			_ = follower.Close()
+
+			lc.cmd("SET a 20")
+			lc.cmd("SET b 30")
+			So(follower.Stats().Lag, ShouldEqual, uint64(0))
+
+			follower = NewFollower(followerDB)
+			go func() { _ = follower.Follow(replLis.Addr().String()) }()
+
+			So(waitFor(caughtUp), ShouldBeTrue)
+			So(fc.cmd("GET a"), ShouldEqual, "20")
+			So(fc.cmd("GET b"), ShouldEqual, "30")
+			So(follower.Stats().Resyncs, ShouldEqual, uint64(0))
+		})
+
+		Convey("Follower with older data should resync on first connect", func() {
+			lc.cmd("SET a 10")
+			otherDB := storage.New()
+			other := NewFollower(otherDB)
+			go func() { _ = other.Follow(replLis.Addr().String()) }()
+			defer other.Close()
+
+			So(waitFor(func() bool { return otherDB.Seq() == leaderDB.Seq() }), ShouldBeTrue)
+			got, err := otherDB.Get("a")
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, "10")
+		})
+	})
+}
+
+func TestFollowerLag(t *testing.T) {
+	Convey("Lag should be leader's offset minus follower's one", t, func() {
+		f := NewFollower(storage.New())
+		f.stats.LeaderOffset = 5
+		So(f.Stats().Lag, ShouldEqual, uint64(5))
+		So(f.Stats().Offset, ShouldEqual, uint64(0))
+	})
+}
+
+func TestLeaderWriteTimeout(t *testing.T) {
+	Convey("Follower that doesn't read the frames should be dropped", t, func() {
+		prev := writeTimeout
+		writeTimeout = 100 * time.Millisecond
+		defer func() { writeTimeout = prev }()
+
+		db := storage.New()
+		leader := NewLeader(db, 1024)
+		defer leader.Close()
+		lis := listen()
+		go func() { _ = leader.Serve(lis) }()
+
+		conn, err := net.Dial("tcp", lis.Addr().String())
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		So(gob.NewEncoder(conn).Encode(request{}), ShouldBeNil)
+		So(waitFor(func() bool { return len(leader.Stats().Replicas) == 1 }), ShouldBeTrue)
+
+		// Fill the connection's buffers
+		value := strings.Repeat("x", 1<<16)
+		for i := 0; i < 1024; i++ {
+			db.Set("a", value+strconv.Itoa(i))
+		}
+		So(waitFor(func() bool { return len(leader.Stats().Replicas) == 0 }), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,40 @@
+package replication
+
+import (
+	"github.com/utrack/go-simple-memdb/storage"
+	"time"
+)
+
+const (
+	// heartbeatInterval is the interval between leader's frames
+	// when there are no changes to send.
+	heartbeatInterval = time.Second
+	// readTimeout is the time after which the silent connection is dropped.
+	readTimeout = 5 * heartbeatInterval
+	// reconnectDelay is the delay between follower's reconnection attempts.
+	reconnectDelay = 100 * time.Millisecond
+)
+
+// writeTimeout is the time after which the follower that doesn't read
+// leader's frames is dropped, so it doesn't hold leader's goroutine and
+// connection forever.
+var writeTimeout = readTimeout
+
+// request is sent by the follower when it connects to the leader.
+type request struct {
+	// Offset is the sequence number of the last
+	// change set applied by the follower.
+	Offset uint64
+}
+
+// frame is sent by the leader to the follower.
+// Frame without Snapshot and ChangeSet is a heartbeat.
+type frame struct {
+	// LeaderOffset is the sequence number of leader's last
+	// change set known at the moment.
+	LeaderOffset uint64
+	// Snapshot replaces follower's contents.
+	Snapshot *storage.Snapshot
+	// ChangeSet is the next change set to be applied.
+	ChangeSet *storage.ChangeSet
+}
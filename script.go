@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/utrack/go-simple-memdb/script"
+	"github.com/utrack/go-simple-memdb/storage"
+	"io/ioutil"
+	"os"
+)
+
+// runScript executes the run and verify subcommands
+// and returns the exit code.
+//
+//	run [-load init.txt] script.txt
+//	verify [-load init.txt] script.txt expected.txt
+func runScript(name string, args []string) int {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	load := fs.String("load", "", "script to load the db with before running, its output is discarded")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	wantArgs := 1
+	if name == "verify" {
+		wantArgs = 2
+	}
+	if fs.NArg() != wantArgs {
+		fmt.Fprintf(os.Stderr, "%v: expected %v file arguments, got %v\n", name, wantArgs, fs.NArg())
+		return 2
+	}
+
+	db := storage.New()
+	if *load != "" {
+		if err := runFile(*load, func(f *os.File) error { return script.Run(db, f, ioutil.Discard) }); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	err := runFile(fs.Arg(0), func(f *os.File) error {
+		if name == "run" {
+			return script.Run(db, f, os.Stdout)
+		}
+		return runFile(fs.Arg(1), func(expected *os.File) error {
+			return script.Verify(db, f, expected)
+		})
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", fs.Arg(0), err)
+		return 1
+	}
+	return 0
+}
+
+// runFile opens the file and calls fn with it.
+func runFile(path string, fn func(*os.File) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fn(f)
+}
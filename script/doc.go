@@ -0,0 +1,18 @@
+/*
+Package script executes the files of protocol commands
+and verifies their output against the expected transcripts.
+
+Commands are read just like the protocol reads them: the payloads of
+SETB and NUMEQUALTOB follow their commands' lines. Most commands print
+a line (empty for the commands having no output), but some print more,
+e.g. GETB or COMMAND, so the transcript is compared line by line and
+a mismatch names the script's line of the command that printed it.
+END stops the script and prints nothing.
+
+Scripts and transcripts in testdata directory are verified by the
+package's tests - new scenarios can be added as a pair of files:
+
+  name.txt       - commands
+  name.expected  - expected output
+*/
+package script
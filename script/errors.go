@@ -0,0 +1,8 @@
+package script
+
+import (
+	"github.com/ansel1/merry"
+)
+
+// ErrMismatch is returned when the script's output differs from the expected one.
+var ErrMismatch = merry.New("Output mismatch.")
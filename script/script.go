@@ -0,0 +1,129 @@
+package script
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/ansel1/merry"
+	"github.com/utrack/go-simple-memdb/protocol"
+	"github.com/utrack/go-simple-memdb/storage"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Run executes the script's commands against the db
+// and writes their output to w.
+// Transactions left in progress are rolled back.
+func Run(db storage.DB, script io.Reader, w io.Writer) error {
+	buf, err := readScript(script)
+	if err != nil {
+		return err
+	}
+	protocol.NewSocket(db).Process(bytes.NewReader(buf), w)
+	return nil
+}
+
+// readScript reads the whole script, terminating its last command
+// by the newline if it lacks one.
+func readScript(script io.Reader) ([]byte, error) {
+	buf, err := ioutil.ReadAll(script)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > 0 && buf[len(buf)-1] != '\n' {
+		buf = append(buf, '\n')
+	}
+	return buf, nil
+}
+
+// outputLine is a line of the script's output.
+type outputLine struct {
+	text string
+	// cmdLine is the script's line number of the command that printed it
+	cmdLine int
+	cmd     string
+}
+
+// Verify executes the script against the db and compares its output
+// to the expected transcript line by line. Commands are read just like Run
+// reads them, so the payloads of SETB and NUMEQUALTOB span the script's lines,
+// and the multi-line outputs span the transcript's ones.
+// ErrMismatch describing the first differing line is returned
+// if the output differs.
+func Verify(db storage.DB, script io.Reader, expected io.Reader) error {
+	actual, err := execLines(db, script)
+	if err != nil {
+		return err
+	}
+	want, err := readLines(expected)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(actual) || i < len(want); i++ {
+		switch {
+		case i >= len(want):
+			return ErrMismatch.Here().Appendf("line %v: expected the end of output, got %q (script line %v: %v)",
+				i+1, actual[i].text, actual[i].cmdLine, actual[i].cmd)
+		case i >= len(actual):
+			return ErrMismatch.Here().Appendf("line %v: expected %q, got the end of output", i+1, want[i])
+		case actual[i].text != want[i]:
+			return ErrMismatch.Here().Appendf("line %v: expected %q, got %q (script line %v: %v)",
+				i+1, want[i], actual[i].text, actual[i].cmdLine, actual[i].cmd)
+		}
+	}
+	return nil
+}
+
+// execLines executes the script's commands one by one
+// and returns their output lines.
+func execLines(db storage.DB, script io.Reader) ([]outputLine, error) {
+	buf, err := readScript(script)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(bytes.NewReader(buf))
+	sock := protocol.NewSocket(db)
+	defer sock.Close()
+
+	var ret []outputLine
+	appendOutput := func(output string, cmdLine int, cmd string) {
+		for _, text := range strings.Split(output, "\n") {
+			ret = append(ret, outputLine{text: text, cmdLine: cmdLine, cmd: cmd})
+		}
+	}
+	// line and offset are the script's line number and offset of the command
+	for line, offset := 1, 0; ; {
+		cmd, _, _ := strings.Cut(string(buf[offset:]), "\n")
+		cmdRaw, err := protocol.ReadCommand(r)
+		if merry.Is(err, protocol.ErrInvalidPayload) {
+			// Process prints the error and stops the same way
+			appendOutput("INVALID PAYLOAD", line, cmd)
+			break
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		output, ok := sock.Exec(cmdRaw)
+		if !ok {
+			break
+		}
+		appendOutput(output, line, cmd)
+		line += strings.Count(cmdRaw, "\n")
+		offset += len(cmdRaw)
+	}
+	return ret, nil
+}
+
+// readLines returns the reader's lines without newlines.
+func readLines(r io.Reader) ([]string, error) {
+	var ret []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		ret = append(ret, s.Text())
+	}
+	return ret, s.Err()
+}
@@ -0,0 +1,84 @@
+package script
+
+import (
+	"bytes"
+	"github.com/ansel1/merry"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/utrack/go-simple-memdb/storage"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGolden(t *testing.T) {
+	scripts, err := filepath.Glob(filepath.Join("testdata", "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range scripts {
+		script, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := os.Open(strings.TrimSuffix(path, ".txt") + ".expected")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = Verify(storage.New(), script, expected); err != nil {
+			t.Errorf("%v: %v", path, err)
+		}
+		_ = script.Close()
+		_ = expected.Close()
+	}
+}
+
+func TestScript(t *testing.T) {
+	Convey("With storage", t, func() {
+		stor := storage.New()
+
+		Convey("Run should print the output", func() {
+			out := &bytes.Buffer{}
+			err := Run(stor, strings.NewReader("SET a 10\nGET a"), out)
+			So(err, ShouldBeNil)
+			So(out.String(), ShouldEqual, "\n10\n")
+		})
+		Convey("Run should use the db given", func() {
+			stor.Set("a", "10")
+			out := &bytes.Buffer{}
+			So(Run(stor, strings.NewReader("GET a\n"), out), ShouldBeNil)
+			So(out.String(), ShouldEqual, "10\n")
+		})
+		Convey("Matching output should be verified", func() {
+			err := Verify(stor, strings.NewReader("SET a 10\nGET a\nEND\nGET a\n"), strings.NewReader("\n10\n"))
+			So(err, ShouldBeNil)
+		})
+		Convey("First mismatch should be reported", func() {
+			err := Verify(stor, strings.NewReader("SET a 10\nGET a\nGET b\n"), strings.NewReader("\n20\nNULL\n"))
+			So(merry.Is(err, ErrMismatch), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, `line 2: expected "20", got "10" (script line 2: GET a)`)
+		})
+		Convey("Extra output should be reported", func() {
+			err := Verify(stor, strings.NewReader("SET a 10\nGET a\n"), strings.NewReader("\n"))
+			So(merry.Is(err, ErrMismatch), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, `line 2: expected the end of output, got "10"`)
+		})
+		Convey("Payloads and multi-line output should be verified", func() {
+			script := "SETB a 3\nx\ny\nGETB a\nGET b\n"
+			So(Verify(stor, strings.NewReader(script), strings.NewReader("\n3\nx\ny\nNULL\n")), ShouldBeNil)
+
+			err := Verify(storage.New(), strings.NewReader(script), strings.NewReader("\n3\nx\nz\nNULL\n"))
+			So(merry.Is(err, ErrMismatch), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, `line 4: expected "z", got "y" (script line 4: GETB a)`)
+		})
+		Convey("Malformed payload should stop the script", func() {
+			err := Verify(stor, strings.NewReader("SET a 10\nSETB a x\nGET a\n"), strings.NewReader("\nINVALID PAYLOAD\n"))
+			So(err, ShouldBeNil)
+		})
+		Convey("Missing output should be reported", func() {
+			err := Verify(stor, strings.NewReader("GET a\nEND\n"), strings.NewReader("NULL\nNULL\n"))
+			So(merry.Is(err, ErrMismatch), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, `line 2: expected "NULL", got the end of output`)
+		})
+	})
+}
@@ -0,0 +1,355 @@
+package storage
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Every root's shard keeps the aggregates over its values in order:
+// the counts of the distinct values (and of the numeric ones by their numbers),
+// and its numeric values in the order of their keys for the sums.
+// They are guarded by the shard's lock, so the writes to different shards
+// don't contend; readers hold the locks of all the shards and merge
+// the shards' aggregates, just like sumEqualTo does.
+//
+// Transactions don't keep the aggregates: queries take the root's ones
+// and adjust them by the changes the transactions made over the root.
+
+// ValueCount is the value with the number of variables set to it.
+type ValueCount struct {
+	Value string
+	Count uint64
+}
+
+// valueStats are the aggregates over the shard's values.
+// Its shard's mu guards it.
+type valueStats struct {
+	// values are the counts of the distinct values.
+	values *treap[string]
+	// numbers are the counts of the numeric values.
+	numbers *treap[float64]
+}
+
+func newValueStats() *valueStats {
+	return &valueStats{
+		values:  newKeyTreap(),
+		numbers: newTreap(func(a, b float64) bool { return a < b }),
+	}
+}
+
+// replace moves a variable from the previous value's count to the value's one;
+// ok are false if the variable was not set.
+func (s *valueStats) replace(prev string, prevOk bool, value string, ok bool) {
+	if prevOk {
+		s.add(prev, -1)
+	}
+	if ok {
+		s.add(value, 1)
+	}
+}
+
+// add adds the delta to the value's count.
+func (s *valueStats) add(value string, delta int64) {
+	s.values.add(value, delta, 0)
+	if number, ok := parseNumber(value); ok {
+		s.numbers.add(number, delta, 0)
+	}
+}
+
+// moreCommon orders the values by their counts, most common first.
+func moreCommon(a, b ValueCount) bool {
+	if a.Count != b.Count {
+		return a.Count > b.Count
+	}
+	return a.Value < b.Value
+}
+
+// newKeyTreap creates the tree of the keys.
+func newKeyTreap() *treap[string] {
+	return newTreap(func(a, b string) bool { return a < b })
+}
+
+// parseNumber returns the value's number if it's numeric.
+func parseNumber(value string) (float64, bool) {
+	ret, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(ret) || math.IsInf(ret, 0) {
+		return 0, false
+	}
+	return ret, true
+}
+
+// aggregate moves the variable from its previous value to the value
+// in the aggregates.
+func (s *shard) aggregate(key string, prev, value *valueState) {
+	prevOk := prev != nil && !prev.Deleted
+	if prevOk && !value.Deleted && prev.Data == value.Data {
+		return
+	}
+	var prevData string
+	if prevOk {
+		prevData = prev.Data
+	}
+	s.stats.replace(prevData, prevOk, value.Data, !value.Deleted)
+
+	// The key is removed and added again, so its sum stays exact
+	if number, ok := parseNumber(prevData); prevOk && ok {
+		s.numbers.add(key, -1, -number)
+	}
+	if number, ok := parseNumber(value.Data); !value.Deleted && ok {
+		s.numbers.add(key, 1, number)
+	}
+}
+
+// viewFunc calls the func with the root and the changes
+// the transactions made over it, holding the locks of both.
+type viewFunc func(ctx context.Context, f func(root *layer, changes map[string]*valueState)) error
+
+// view calls the func with the root under the layer and the changes
+// the transactions made over it, holding the locks of both.
+func (t *layer) view(ctx context.Context, f func(root *layer, changes map[string]*valueState)) error {
+	changes := map[string]*valueState{}
+	if t.parentLayer != nil {
+		if err := t.mu.LockContext(ctx); err != nil {
+			return err
+		}
+		defer t.mu.Unlock()
+		if err := t.syncFlat(ctx); err != nil {
+			return err
+		}
+		t.flat.each(func(key string, value *valueState) {
+			changes[key] = value
+		})
+	}
+
+	root := t.root()
+	unlock, err := root.lockAllContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	f(root, changes)
+	return nil
+}
+
+// overlay calls the func for every changed variable with its root's value
+// and the changed one; ok is false if the variable is not set.
+func (t *layer) overlay(changes map[string]*valueState, f func(key, was string, wasOk bool, is string, isOk bool)) {
+	for key, value := range changes {
+		was, ok := t.shardFor(key).data[key]
+		wasOk := ok && !was.Deleted
+		var wasData string
+		if wasOk {
+			wasData = was.Data
+		}
+		f(key, wasData, wasOk, value.Data, !value.Deleted)
+	}
+}
+
+// CountRange implements Aggregator interface.
+func (t *layer) CountRange(min, max string) uint64 {
+	return countRange(t.view, min, max)
+}
+
+// countRange implements Aggregator for the view.
+func countRange(view viewFunc, min, max string) uint64 {
+	var ret int64
+	_ = view(context.Background(), func(root *layer, changes map[string]*valueState) {
+		inRange := func(value string) bool {
+			return value >= min && value <= max
+		}
+		if min <= max {
+			for _, s := range root.shards {
+				below, _ := s.stats.values.below(func(v string) bool { return v <= max })
+				notAbove, _ := s.stats.values.below(func(v string) bool { return v < min })
+				ret += below - notAbove
+			}
+		}
+		root.overlay(changes, func(_, was string, wasOk bool, is string, isOk bool) {
+			ret += countDelta(wasOk && inRange(was), isOk && inRange(is))
+		})
+	})
+	return uint64(ret)
+}
+
+// CountNumericRange implements Aggregator interface.
+func (t *layer) CountNumericRange(min, max float64) uint64 {
+	return countNumericRange(t.view, min, max)
+}
+
+// countNumericRange implements Aggregator for the view.
+func countNumericRange(view viewFunc, min, max float64) uint64 {
+	var ret int64
+	_ = view(context.Background(), func(root *layer, changes map[string]*valueState) {
+		inRange := func(value string) bool {
+			number, ok := parseNumber(value)
+			return ok && number >= min && number <= max
+		}
+		if min <= max {
+			for _, s := range root.shards {
+				below, _ := s.stats.numbers.below(func(n float64) bool { return n <= max })
+				notAbove, _ := s.stats.numbers.below(func(n float64) bool { return n < min })
+				ret += below - notAbove
+			}
+		}
+		root.overlay(changes, func(_, was string, wasOk bool, is string, isOk bool) {
+			ret += countDelta(wasOk && inRange(was), isOk && inRange(is))
+		})
+	})
+	return uint64(ret)
+}
+
+// DistinctValues implements Aggregator interface.
+func (t *layer) DistinctValues() uint64 {
+	return distinctValues(t.view)
+}
+
+// distinctValues implements Aggregator for the view.
+func distinctValues(view viewFunc) uint64 {
+	var ret int64
+	_ = view(context.Background(), func(root *layer, changes map[string]*valueState) {
+		for _, count := range root.valueCounts(changes) {
+			if count > 0 {
+				ret++
+			}
+		}
+	})
+	return uint64(ret)
+}
+
+// TopValues implements Aggregator interface.
+func (t *layer) TopValues(n int) []ValueCount {
+	return topValues(t.view, n)
+}
+
+// topValues implements Aggregator for the view.
+func topValues(view viewFunc, n int) []ValueCount {
+	var ret []ValueCount
+	if n <= 0 {
+		return ret
+	}
+	_ = view(context.Background(), func(root *layer, changes map[string]*valueState) {
+		counts := root.valueCounts(changes)
+		candidates := make([]ValueCount, 0, len(counts))
+		for value, count := range counts {
+			if count > 0 {
+				candidates = append(candidates, ValueCount{Value: value, Count: uint64(count)})
+			}
+		}
+		sort.Slice(candidates, func(i, j int) bool { return moreCommon(candidates[i], candidates[j]) })
+		if len(candidates) > n {
+			candidates = candidates[:n]
+		}
+		ret = candidates
+	})
+	return ret
+}
+
+// SumPrefix implements Aggregator interface.
+func (t *layer) SumPrefix(prefix string) (sum float64, count uint64) {
+	return sumPrefix(t.view, prefix)
+}
+
+// sumPrefix implements Aggregator for the view.
+func sumPrefix(view viewFunc, prefix string) (sum float64, count uint64) {
+	var total int64
+	_ = view(context.Background(), func(root *layer, changes map[string]*valueState) {
+		for _, s := range root.shards {
+			w, sum1 := s.numbers.below(func(key string) bool { return hasPrefixOrBelow(key, prefix) })
+			w0, sum0 := s.numbers.below(func(key string) bool { return key < prefix })
+			total += w - w0
+			sum += sum1 - sum0
+		}
+		root.overlay(changes, func(key, was string, wasOk bool, is string, isOk bool) {
+			if !strings.HasPrefix(key, prefix) {
+				return
+			}
+			if number, ok := parseNumber(was); wasOk && ok {
+				total--
+				sum -= number
+			}
+			if number, ok := parseNumber(is); isOk && ok {
+				total++
+				sum += number
+			}
+		})
+	})
+	return sum, uint64(total)
+}
+
+// valueCounts merges the shards' counts of the distinct values
+// and adjusts them by the changes. Caller should hold the locks of all the shards.
+func (t *layer) valueCounts(changes map[string]*valueState) map[string]int64 {
+	ret := map[string]int64{}
+	for _, s := range t.shards {
+		s.stats.values.ascend(func(value string, count int64) bool {
+			ret[value] += count
+			return true
+		})
+	}
+	for value, delta := range t.countDeltas(changes) {
+		ret[value] += delta
+	}
+	return ret
+}
+
+// countDeltas returns how the changes change the counts of the values.
+func (t *layer) countDeltas(changes map[string]*valueState) map[string]int64 {
+	ret := map[string]int64{}
+	t.overlay(changes, func(_, was string, wasOk bool, is string, isOk bool) {
+		if wasOk && isOk && was == is {
+			return
+		}
+		if wasOk {
+			ret[was]--
+		}
+		if isOk {
+			ret[is]++
+		}
+	})
+	return ret
+}
+
+// countDelta returns the change of the count when the condition
+// changes from was to is.
+func countDelta(was, is bool) int64 {
+	switch {
+	case was && !is:
+		return -1
+	case !was && is:
+		return 1
+	}
+	return 0
+}
+
+// hasPrefixOrBelow is true for the keys up to the last one with the prefix in order.
+func hasPrefixOrBelow(key, prefix string) bool {
+	return key < prefix || strings.HasPrefix(key, prefix)
+}
+
+// CountRange implements Aggregator interface.
+func (t *readLayer) CountRange(min, max string) uint64 {
+	return countRange(t.view, min, max)
+}
+
+// CountNumericRange implements Aggregator interface.
+func (t *readLayer) CountNumericRange(min, max float64) uint64 {
+	return countNumericRange(t.view, min, max)
+}
+
+// DistinctValues implements Aggregator interface.
+func (t *readLayer) DistinctValues() uint64 {
+	return distinctValues(t.view)
+}
+
+// TopValues implements Aggregator interface.
+func (t *readLayer) TopValues(n int) []ValueCount {
+	return topValues(t.view, n)
+}
+
+// SumPrefix implements Aggregator interface.
+func (t *readLayer) SumPrefix(prefix string) (sum float64, count uint64) {
+	return sumPrefix(t.view, prefix)
+}
@@ -0,0 +1,205 @@
+package storage_test
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/utrack/go-simple-memdb/storage"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAggregates(t *testing.T) {
+	Convey("With root", t, func() {
+		root := storage.New()
+		root.Set("n:a", "10")
+		root.Set("n:b", "2.5")
+		root.Set("n:c", "10")
+		root.Set("s:a", "apple")
+		root.Set("s:b", "banana")
+		root.Set("s:c", "10")
+
+		Convey("Values should be counted by range", func() {
+			So(root.CountRange("a", "b"), ShouldEqual, uint64(1))
+			So(root.CountRange("a", "banana"), ShouldEqual, uint64(2))
+			So(root.CountRange("1", "2.5"), ShouldEqual, uint64(4))
+			So(root.CountRange("b", "a"), ShouldEqual, uint64(0))
+			So(root.CountNumericRange(2, 9.5), ShouldEqual, uint64(1))
+			So(root.CountNumericRange(2.5, 10), ShouldEqual, uint64(4))
+			So(root.CountNumericRange(11, 100), ShouldEqual, uint64(0))
+		})
+
+		Convey("Distinct and top values should be counted", func() {
+			So(root.DistinctValues(), ShouldEqual, uint64(4))
+			So(root.TopValues(2), ShouldResemble, []storage.ValueCount{{Value: "10", Count: 3}, {Value: "2.5", Count: 1}})
+			So(root.TopValues(0), ShouldBeEmpty)
+
+			root.Set("n:c", "apple")
+			root.Unset("s:c")
+			So(root.DistinctValues(), ShouldEqual, uint64(4))
+			So(root.TopValues(10), ShouldResemble, []storage.ValueCount{
+				{Value: "apple", Count: 2}, {Value: "10", Count: 1}, {Value: "2.5", Count: 1}, {Value: "banana", Count: 1},
+			})
+		})
+
+		Convey("Numeric values should be summed by the keys' prefix", func() {
+			sum, count := root.SumPrefix("n:")
+			So(sum, ShouldEqual, 22.5)
+			So(count, ShouldEqual, uint64(3))
+			sum, count = root.SumPrefix("")
+			So(sum, ShouldEqual, 32.5)
+			So(count, ShouldEqual, uint64(4))
+			_, count = root.SumPrefix("x")
+			So(count, ShouldEqual, uint64(0))
+		})
+
+		Convey("Transactions should see their own changes only", func() {
+			tx := root.Tx()
+			tx.Set("n:d", "7.5")
+			tx.Unset("n:a")
+			nested := tx.Tx()
+			nested.Set("s:a", "10")
+			nested.Set("n:b", "banana")
+
+			agg := nested.(storage.Aggregator)
+			So(agg.DistinctValues(), ShouldEqual, uint64(3))
+			So(agg.TopValues(1), ShouldResemble, []storage.ValueCount{{Value: "10", Count: 3}})
+			So(agg.CountNumericRange(0, 100), ShouldEqual, uint64(4))
+			sum, count := agg.SumPrefix("n:")
+			So(sum, ShouldEqual, 17.5)
+			So(count, ShouldEqual, uint64(2))
+			So(nested.ReadTx().(storage.Aggregator).CountRange("banana", "banana"), ShouldEqual, uint64(2))
+
+			sum, _ = tx.(storage.Aggregator).SumPrefix("n:")
+			So(sum, ShouldEqual, 20)
+			sum, _ = root.SumPrefix("n:")
+			So(sum, ShouldEqual, 22.5)
+
+			_, err := nested.Commit()
+			So(err, ShouldBeNil)
+			sum, _ = root.SumPrefix("n:")
+			So(sum, ShouldEqual, 17.5)
+			So(root.DistinctValues(), ShouldEqual, uint64(3))
+		})
+
+		Convey("Restored root should aggregate the snapshot", func() {
+			root.Restore(storage.Snapshot{Values: map[string]string{"a": "1", "b": "1"}})
+			So(root.DistinctValues(), ShouldEqual, uint64(1))
+			So(root.TopValues(5), ShouldResemble, []storage.ValueCount{{Value: "1", Count: 2}})
+			sum, _ := root.SumPrefix("")
+			So(sum, ShouldEqual, 2)
+		})
+	})
+
+	Convey("Aggregates of nested transactions should match the scan of their values", t, func() {
+		rnd := rand.New(rand.NewSource(1))
+		keys := []string{"a", "a1", "a2", "b", "b1", "c"}
+		values := []string{"1", "2", "10", "-3.5", "x", "y", "1e1"}
+		db := storage.DB(storage.NewSharded(4))
+		expected := []map[string]string{{}}
+
+		for i := 0; i < 300; i++ {
+			current := expected[len(expected)-1]
+			switch op := rnd.Intn(20); {
+			case op == 0 && len(expected) < 4:
+				db = db.Tx()
+				expected = append(expected, copyValues(current))
+			case op == 1 && len(expected) > 1:
+				db, _ = db.Rollback()
+				expected = expected[:len(expected)-1]
+			case op < 5:
+				key := keys[rnd.Intn(len(keys))]
+				db.Unset(key)
+				delete(current, key)
+			default:
+				key, value := keys[rnd.Intn(len(keys))], values[rnd.Intn(len(values))]
+				db.Set(key, value)
+				current[key] = value
+			}
+
+			current = expected[len(expected)-1]
+			agg := db.(storage.Aggregator)
+			So(agg.CountRange("1", "2"), ShouldEqual, scanCount(current, func(v string) bool { return v >= "1" && v <= "2" }))
+			So(agg.CountNumericRange(1, 10), ShouldEqual, scanCount(current, func(v string) bool {
+				n, err := strconv.ParseFloat(v, 64)
+				return err == nil && n >= 1 && n <= 10
+			}))
+			So(agg.TopValues(3), ShouldResemble, scanTop(current, 3))
+			So(agg.DistinctValues(), ShouldEqual, uint64(len(scanTop(current, len(values)))))
+			sum, count := agg.SumPrefix("a")
+			wantSum, wantCount := scanSum(current, "a")
+			So(sum, ShouldEqual, wantSum)
+			So(count, ShouldEqual, wantCount)
+		}
+	})
+
+	Convey("Concurrent writes to the shards should be aggregated", t, func() {
+		root := storage.NewSharded(8)
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					root.Set(strconv.Itoa(w)+":"+strconv.Itoa(i), strconv.Itoa(i%10))
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		So(root.DistinctValues(), ShouldEqual, uint64(10))
+		So(root.TopValues(2), ShouldResemble, []storage.ValueCount{{Value: "0", Count: 40}, {Value: "1", Count: 40}})
+		So(root.CountNumericRange(0, 4), ShouldEqual, uint64(200))
+		So(root.CountRange("5", "9"), ShouldEqual, uint64(200))
+	})
+}
+
+func copyValues(values map[string]string) map[string]string {
+	ret := make(map[string]string, len(values))
+	for k, v := range values {
+		ret[k] = v
+	}
+	return ret
+}
+
+func scanCount(values map[string]string, f func(string) bool) (ret uint64) {
+	for _, v := range values {
+		if f(v) {
+			ret++
+		}
+	}
+	return ret
+}
+
+func scanTop(values map[string]string, n int) []storage.ValueCount {
+	counts := map[string]uint64{}
+	for _, v := range values {
+		counts[v]++
+	}
+	ret := []storage.ValueCount{}
+	for v, c := range counts {
+		ret = append(ret, storage.ValueCount{Value: v, Count: c})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count != ret[j].Count {
+			return ret[i].Count > ret[j].Count
+		}
+		return ret[i].Value < ret[j].Value
+	})
+	if len(ret) > n {
+		ret = ret[:n]
+	}
+	return ret
+}
+
+func scanSum(values map[string]string, prefix string) (sum float64, count uint64) {
+	for k, v := range values {
+		if n, err := strconv.ParseFloat(v, 64); err == nil && strings.HasPrefix(k, prefix) {
+			sum += n
+			count++
+		}
+	}
+	return sum, count
+}
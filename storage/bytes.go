@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"unsafe"
+)
+
+// GetBytes returns the variable's value by its key as bytes.
+// ErrNotFound is returned when the variable was not found.
+//
+// Values are immutable, so the bytes share the memory with the stored
+// value instead of copying it: they must not be modified.
+// Use bytes.Clone to get a modifiable copy.
+func GetBytes(r Reader, key string) ([]byte, error) {
+	ret, err := r.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ret) == 0 {
+		return []byte{}, nil
+	}
+	return unsafe.Slice(unsafe.StringData(ret), len(ret)), nil
+}
+
+// SetBytes sets the variable's value by its key to the copy of the bytes,
+// so the slice can be reused after the call.
+func SetBytes(w Writer, key string, value []byte) {
+	w.Set(key, string(value))
+}
+
+// NumEqualToBytes returns the number of variables that are currently set
+// to the value's bytes.
+func NumEqualToBytes(r Reader, value []byte) uint64 {
+	// Transactions cache the counts by the value, so it's copied
+	return r.NumEqualTo(string(value))
+}
@@ -0,0 +1,92 @@
+package storage_test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/ansel1/merry"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/utrack/go-simple-memdb/storage"
+	"testing"
+)
+
+func TestBytes(t *testing.T) {
+	Convey("With binary values", t, func() {
+		db := storage.New()
+		nul := []byte{0, 1, 0}
+		invalid := []byte{0xff, 0xfe, '\n', 0}
+		storage.SetBytes(db, "a", nul)
+		storage.SetBytes(db, "b", invalid)
+		storage.SetBytes(db, "c", []byte{0, 1})
+
+		Convey("Values should be read as is", func() {
+			got, err := storage.GetBytes(db, "a")
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, nul)
+			got, err = storage.GetBytes(db, "b")
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, invalid)
+		})
+
+		Convey("Values should be copied on write and shared on read", func() {
+			nul[0] = 'x'
+			got, _ := storage.GetBytes(db, "a")
+			So(got, ShouldResemble, []byte{0, 1, 0})
+			again, _ := storage.GetBytes(db, "a")
+			So(&again[0], ShouldEqual, &got[0])
+		})
+
+		Convey("Empty and missing values should differ", func() {
+			storage.SetBytes(db, "d", nil)
+			got, err := storage.GetBytes(db, "d")
+			So(err, ShouldBeNil)
+			So(got, ShouldNotBeNil)
+			So(got, ShouldBeEmpty)
+			_, err = storage.GetBytes(db, "e")
+			So(merry.Is(err, storage.ErrNotFound), ShouldBeTrue)
+		})
+
+		Convey("Values with NUL should be counted exactly", func() {
+			storage.SetBytes(db, "d", []byte{0, 1, 0})
+			So(storage.NumEqualToBytes(db, []byte{0, 1, 0}), ShouldEqual, uint64(2))
+			So(storage.NumEqualToBytes(db, []byte{0, 1}), ShouldEqual, uint64(1))
+			So(storage.NumEqualToBytes(db, []byte{0}), ShouldEqual, uint64(0))
+
+			tx := db.Tx()
+			storage.SetBytes(tx, "a", []byte{0})
+			So(storage.NumEqualToBytes(tx, []byte{0, 1, 0}), ShouldEqual, uint64(1))
+			So(storage.NumEqualToBytes(tx, []byte{0}), ShouldEqual, uint64(1))
+			_, err := tx.Commit()
+			So(err, ShouldBeNil)
+			So(storage.NumEqualToBytes(db, []byte{0}), ShouldEqual, uint64(1))
+		})
+
+		Convey("Snapshots and change sets should round-trip over gob", func() {
+			root := storage.New()
+			var sets []storage.ChangeSet
+			root.OnCommit(func(cs storage.ChangeSet) {
+				sets = append(sets, cs)
+			})
+			storage.SetBytes(root, "a", invalid)
+
+			var buf bytes.Buffer
+			So(gob.NewEncoder(&buf).Encode(sets[0]), ShouldBeNil)
+			So(gob.NewEncoder(&buf).Encode(db.Snapshot()), ShouldBeNil)
+			dec := gob.NewDecoder(&buf)
+			var cs storage.ChangeSet
+			So(dec.Decode(&cs), ShouldBeNil)
+			var snap storage.Snapshot
+			So(dec.Decode(&snap), ShouldBeNil)
+
+			restored := storage.New()
+			restored.Restore(snap)
+			got, _ := storage.GetBytes(restored, "a")
+			So(got, ShouldResemble, []byte{0, 1, 0})
+			So(storage.NumEqualToBytes(restored, invalid), ShouldEqual, uint64(1))
+
+			applied := storage.New()
+			So(applied.Apply(cs), ShouldBeNil)
+			got, _ = storage.GetBytes(applied, "a")
+			So(got, ShouldResemble, invalid)
+		})
+	})
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+)
+
+// Codec encodes the values of type V to the strings stored in the DB
+// and decodes them back.
+// Typed's NumEqualTo counts the equal values only if the codec
+// encodes them the same way.
+type Codec[V any] interface {
+	Encode(value V) (string, error)
+	Decode(data string) (V, error)
+}
+
+// JSONCodec encodes the values with encoding/json.
+type JSONCodec[V any] struct{}
+
+// Encode implements Codec interface.
+func (JSONCodec[V]) Encode(value V) (string, error) {
+	ret, err := json.Marshal(value)
+	return string(ret), err
+}
+
+// Decode implements Codec interface.
+func (JSONCodec[V]) Decode(data string) (ret V, err error) {
+	err = json.Unmarshal([]byte(data), &ret)
+	return ret, err
+}
+
+// GobCodec encodes the values with encoding/gob, every value
+// along with its type. Gob encodes the maps in random order,
+// so the values having maps can't be counted by NumEqualTo.
+type GobCodec[V any] struct{}
+
+// Encode implements Codec interface.
+func (GobCodec[V]) Encode(value V) (string, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(value)
+	return buf.String(), err
+}
+
+// Decode implements Codec interface.
+func (GobCodec[V]) Decode(data string) (ret V, err error) {
+	err = gob.NewDecoder(bytes.NewBufferString(data)).Decode(&ret)
+	return ret, err
+}
+
+// BinaryMessage is the pointer to the value that encodes itself to bytes,
+// like the protobuf messages generated with gogo/protobuf do.
+type BinaryMessage[V any] interface {
+	*V
+	Marshal() ([]byte, error)
+	Unmarshal(data []byte) error
+}
+
+// BinaryCodec encodes the values with their own Marshal and Unmarshal methods,
+// e.g. BinaryCodec[pb.User, *pb.User] for the protobuf message pb.User.
+type BinaryCodec[V any, P BinaryMessage[V]] struct{}
+
+// Encode implements Codec interface.
+func (BinaryCodec[V, P]) Encode(value V) (string, error) {
+	ret, err := P(&value).Marshal()
+	return string(ret), err
+}
+
+// Decode implements Codec interface.
+func (BinaryCodec[V, P]) Decode(data string) (ret V, err error) {
+	err = P(&ret).Unmarshal([]byte(data))
+	return ret, err
+}
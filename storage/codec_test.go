@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+// point is encoded as the protobuf message with the varint fields
+// x = 1 and y = 2.
+type point struct {
+	X, Y uint64
+}
+
+func (p *point) Marshal() ([]byte, error) {
+	ret := []byte{1 << 3}
+	ret = binary.AppendUvarint(ret, p.X)
+	ret = append(ret, 2<<3)
+	return binary.AppendUvarint(ret, p.Y), nil
+}
+
+func (p *point) Unmarshal(data []byte) error {
+	for len(data) > 0 {
+		tag := data[0]
+		value, n := binary.Uvarint(data[1:])
+		if n <= 0 {
+			return errors.New("malformed varint")
+		}
+		switch tag {
+		case 1 << 3:
+			p.X = value
+		case 2 << 3:
+			p.Y = value
+		default:
+			return errors.New("unknown field")
+		}
+		data = data[1+n:]
+	}
+	return nil
+}
+
+func TestCodecs(t *testing.T) {
+	Convey("Codecs should decode the encoded values", t, func() {
+		value := point{X: 1, Y: 300}
+		for _, codec := range []Codec[point]{
+			JSONCodec[point]{},
+			GobCodec[point]{},
+			BinaryCodec[point, *point]{},
+		} {
+			data, err := codec.Encode(value)
+			So(err, ShouldBeNil)
+			got, err := codec.Decode(data)
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, value)
+
+			_, err = codec.Decode(data[:len(data)-1])
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Binary codec should use protobuf wire format", t, func() {
+		data, err := BinaryCodec[point, *point]{}.Encode(point{X: 1, Y: 300})
+		So(err, ShouldBeNil)
+		So(data, ShouldEqual, "\x08\x01\x10\xac\x02")
+	})
+
+	Convey("JSON codec should encode the maps the same way", t, func() {
+		codec := JSONCodec[map[string]int]{}
+		first, err := codec.Encode(map[string]int{"a": 1, "b": 2, "c": 3})
+		So(err, ShouldBeNil)
+		second, err := codec.Encode(map[string]int{"c": 3, "b": 2, "a": 1})
+		So(err, ShouldBeNil)
+		So(first, ShouldEqual, second)
+	})
+}
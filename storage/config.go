@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"sync/atomic"
+)
+
+// Config configures the root storages.
+// The zero Config is the default one used by New.
+type Config struct {
+	// Shards is the number of the root's shards, each one with its own lock;
+	// zero means 32.
+	Shards int
+	// Retention bounds the variables' history kept, see Root.SetRetention.
+	Retention Retention
+	// MaxMemory is the number of bytes the root's variables' keys and values
+	// may take before Root.CheckMemory reports ErrOutOfMemory;
+	// zero doesn't limit them.
+	MaxMemory uint64
+	// MaxDatabases is the number of the databases Registry.Open creates;
+	// zero means DefaultMaxDatabases.
+	MaxDatabases int
+}
+
+// DefaultMaxDatabases is the number of the databases Registry.Open
+// creates if Config's MaxDatabases is not set.
+const DefaultMaxDatabases = 16
+
+// NewConfig creates new storage instance configured by the config.
+func NewConfig(cfg Config) Root {
+	return newConfigLayer(cfg)
+}
+
+// newConfigLayer creates the root layer configured by the config.
+func newConfigLayer(cfg Config) *layer {
+	shards := cfg.Shards
+	if shards == 0 {
+		shards = defaultShards
+	}
+	ret := newShardedLayer(shards)
+	ret.maxMemory = cfg.MaxMemory
+	if cfg.Retention.IsEnabled() {
+		ret.SetRetention(cfg.Retention)
+	}
+	return ret
+}
+
+// UsedMemory implements Root interface.
+func (t *layer) UsedMemory() uint64 {
+	t = t.root()
+	var ret int64
+	for _, s := range t.shards {
+		ret += atomic.LoadInt64(&s.used)
+	}
+	return uint64(ret)
+}
+
+// CheckMemory implements Root interface.
+func (t *layer) CheckMemory() error {
+	t = t.root()
+	if t.maxMemory > 0 && t.UsedMemory() > t.maxMemory {
+		return ErrOutOfMemory.Here()
+	}
+	return nil
+}
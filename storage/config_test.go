@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"github.com/ansel1/merry"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestConfig(t *testing.T) {
+	Convey("Zero config should be the default one", t, func() {
+		l := NewConfig(Config{}).(*layer)
+		So(l.shards, ShouldHaveLength, defaultShards)
+		So(l.retention.IsEnabled(), ShouldBeFalse)
+		So(l.CheckMemory(), ShouldBeNil)
+	})
+
+	Convey("MaxMemory should limit the memory taken by the variables", t, func() {
+		l := NewConfig(Config{MaxMemory: 8}).(*layer)
+		l.Set("a", "123")
+		l.Set("b", "456")
+		So(l.UsedMemory(), ShouldEqual, uint64(8))
+		So(l.CheckMemory(), ShouldBeNil)
+
+		l.Set("a", "1234")
+		So(l.UsedMemory(), ShouldEqual, uint64(9))
+		So(merry.Is(l.CheckMemory(), ErrOutOfMemory), ShouldBeTrue)
+
+		Convey("Memory should be freed by the unset variables", func() {
+			l.Unset("a")
+			So(l.UsedMemory(), ShouldEqual, uint64(4))
+			So(l.CheckMemory(), ShouldBeNil)
+		})
+		Convey("Memory should be counted after restore", func() {
+			l.Restore(Snapshot{Values: map[string]string{"c": "1"}})
+			So(l.UsedMemory(), ShouldEqual, uint64(2))
+		})
+		Convey("Uncommitted changes should not be counted", func() {
+			tx := l.tx()
+			tx.Unset("a")
+			So(tx.UsedMemory(), ShouldEqual, uint64(9))
+			So(merry.Is(tx.CheckMemory(), ErrOutOfMemory), ShouldBeTrue)
+			_, err := tx.Commit()
+			So(err, ShouldBeNil)
+			So(l.UsedMemory(), ShouldEqual, uint64(4))
+		})
+	})
+
+	Convey("Config should configure the roots", t, func() {
+		cfg := Config{Shards: 4, Retention: Retention{Versions: 2}}
+		l := NewConfig(cfg).(*layer)
+		So(l.shards, ShouldHaveLength, 4)
+		So(l.retention, ShouldResemble, cfg.Retention)
+
+		Convey("Registry's databases should be configured by it", func() {
+			r := NewRegistryConfig(cfg)
+			db := r.get("0")
+			So(db.shards, ShouldHaveLength, 4)
+			So(db.retention, ShouldResemble, cfg.Retention)
+
+			r.SetRetention(Retention{})
+			So(r.get("1").retention.IsEnabled(), ShouldBeFalse)
+			So(r.get("1").shards, ShouldHaveLength, 4)
+		})
+	})
+}
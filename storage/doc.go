@@ -3,7 +3,7 @@ Package storage provides an in-memory key-value database engine.
 
 Storage supports transactions and transaction trees.
 
-Use New() to instantiate the storage.
+Use New() to instantiate the storage, or NewConfig to configure it.
 
 Basic usage
 
@@ -22,9 +22,104 @@ Storage supports transactions with unlimited nesting.
 
 When the transaction is committed it traverses its parents all the way down to the root storage,
 effectively committing the whole Tx tree.
+Commit of the transaction that changed a variable changed under it meanwhile
+fails with ErrTxConflict and aborts the transaction: it's closed like a rolled back one,
+so nothing keeps the history for it.
 
 Rollback rolls back only one transaction, returning its parent.
 
+Transactions keep their changes along with their parents' ones
+in persistent maps shared with the parents, so reads and opening
+the transaction take the same time however deep it's nested.
+
+Read-only transaction reads the database as it was when it was opened:
+the root's shards keep the values replaced since then until it's closed.
+
+Savepoints can be created within the transaction. RollbackTo forgets the changes
+made since the savepoint, keeping the transaction open; Release keeps them.
+Only the savepoints of the current transaction are found: they never commit
+or close the transactions nested in it.
+
+Root storage is safe for concurrent use. Its variables are split into shards
+by the keys' hash, each one with its own lock and value counts, so the writes
+to different keys don't wait for each other; NumEqualTo sums the shards' counts.
+Committed transactions lock the shards they changed in the same order,
+so their change sets stay atomic. Use NewSharded to choose the number of shards.
+
+Storage's DBs implement ContextDB as well: its methods take the context and
+give up waiting for the locks once it's done, returning the context's error
+and changing nothing. Commits that gave up leave the transaction open,
+so they can be retried.
+
+Root storage keeps deleted variables and previous values only while there are
+open transactions that can observe them; they are collected when the last
+transaction is closed.
+
+Values are binary-safe: GetBytes, SetBytes and NumEqualToBytes pass them
+as bytes, and GetBytes shares the memory with the stored value
+instead of copying it.
+
+Typed values
+
+Typed stores the values of any type over the DB, encoding them to strings
+with the Codec: JSONCodec, GobCodec or BinaryCodec for the values
+marshalling themselves, like protobuf messages. Its transactions are Typed too,
+and NumEqualTo counts the values encoded equally. ErrCodec is returned
+for the values that can't be encoded or decoded.
+
+Change sets
+
+New() returns the Root - database's root storage. Every write outside of transactions
+and every committed transaction tree is applied to the root as a single change set.
+Root streams the change sets to the funcs registered via OnCommit, and can apply
+the change sets or snapshots of another root (see package replication).
+
+Indexes
+
+DBs implement Finder: KeysWithValue returns the keys of the variables set to
+the value, Find - the ones indexed as the value by the root's index.
+Root's indexes are created with CreateIndex and the IndexFunc extracting
+the indexed value, e.g. JSONField. Root keeps them up to date on every change set;
+transactions apply their own changes over the root's indexes, so they're
+invisible to the others until commit.
+
+Aggregates
+
+DBs implement Aggregator: CountRange and CountNumericRange count the values
+in the range, DistinctValues and TopValues count the distinct and the most
+common values, SumPrefix sums the numeric values by the keys' prefix.
+Root keeps its values ordered by every change set, so the queries take
+logarithmic time; transactions adjust the root's results by their own changes.
+
+History
+
+Root can keep the variables' versions written by its change sets (see
+SetRetention): the last versions of every variable, the versions replaced
+recently, or both. History returns the versions kept, GetAt and GetAtTime
+read the value as of the change set's sequence number or time.
+History is not kept by default.
+
+Expiration
+
+Expire sets the root's variable to expire after the TTL; SweepExpired
+unsets the expired variables in a single change set, so they stay
+readable until swept. Writing the variable removes its expiration.
+Snapshots keep the expiration times.
+
+Memory
+
+UsedMemory returns the bytes taken by the root's variables' keys and values.
+If Config's MaxMemory is set, CheckMemory returns ErrOutOfMemory while
+they take more, so the writes adding to them can be rejected.
+
+Databases
+
+Registry keeps the named databases, each one with its own Root.
+Open creates up to Config's MaxDatabases of them, returning
+ErrTooManyDatabases for the new names past it.
+Swapping and flushing the databases changes their variables
+in single change sets, keeping the roots and their transactions.
+
 See DB interface for the API and usage examples.
 */
 package storage
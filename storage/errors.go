@@ -17,5 +17,40 @@ var ErrNoTransaction = merry.New("There is no transaction in progress.")
 var ErrTxConflict = merry.New("Transaction conflict! Aborted.")
 
 // ErrTxClosed is returned when trying to commit transaction
-// that was committed before.
+// that was committed before, or to read via closed read-only transaction.
 var ErrTxClosed = merry.New("Transaction was closed.")
+
+// ErrReadOnly is returned when trying to modify the storage
+// via read-only transaction or session.
+var ErrReadOnly = merry.New("Storage is read-only.")
+
+// ErrNoSavepoint is returned when the savepoint was not found
+// in current transaction.
+var ErrNoSavepoint = merry.New("There is no such savepoint.")
+
+// ErrChangeSetOrder is returned when the change set
+// doesn't follow the root's last change set.
+var ErrChangeSetOrder = merry.New("Change set is out of order.")
+
+// ErrNoHistory is returned when reading the variable's version
+// that is out of the history kept by the root.
+var ErrNoHistory = merry.New("Version is out of the kept history.")
+
+// ErrIndexExists is returned when creating the index
+// with the name that is taken.
+var ErrIndexExists = merry.New("Index already exists.")
+
+// ErrNoIndex is returned when there's no index with such name.
+var ErrNoIndex = merry.New("There is no such index.")
+
+// ErrCodec is returned by Typed when the value can't be encoded
+// or the stored value can't be decoded.
+var ErrCodec = merry.New("Value can't be encoded or decoded.")
+
+// ErrOutOfMemory is returned when the root's variables take
+// more memory than allowed by Config's MaxMemory.
+var ErrOutOfMemory = merry.New("Storage is out of memory.")
+
+// ErrTooManyDatabases is returned when Registry can't create
+// the database: it has Config's MaxDatabases already.
+var ErrTooManyDatabases = merry.New("Too many databases.")
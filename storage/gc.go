@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"sync/atomic"
+)
+
+// History (Prev links and tombstones) is needed only while
+// there are open transactions over the root: they use it to
+// detect the conflicts on commit.
+// Root's shards remember the keys that got history while
+// transactions were open, and collect them once the last
+// transaction is gone.
+
+// isCollectable is true if nobody can observe this layer's history.
+func (t *layer) isCollectable() bool {
+	return t.parentLayer == nil && atomic.LoadInt64(&t.openTxs) == 0
+}
+
+// collectKey drops the key's history if nobody can observe it.
+// Returns true if the history was kept.
+func (s *shard) collectKey(key string, collectable bool) bool {
+	if !collectable {
+		s.history[key] = struct{}{}
+		return true
+	}
+	value := s.data[key]
+	if value == nil {
+		return false
+	}
+	if value.Deleted {
+		delete(s.data, key)
+		return false
+	}
+	value.Prev = nil
+	return false
+}
+
+// collectCount drops the zero count for the value.
+// Missing count is treated as zero.
+func (s *shard) collectCount(value string) {
+	if count, ok := s.valueCache[value]; ok && count == 0 {
+		delete(s.valueCache, value)
+	}
+}
+
+// txClosed is called when a child transaction was committed or rolled back.
+// Root's history is collected when the last transaction is closed.
+// Caller shouldn't hold the root's locks.
+func (t *layer) txClosed() {
+	if atomic.AddInt64(&t.openTxs, -1) != 0 || t.parentLayer != nil {
+		return
+	}
+	// Transactions are opened under the first shard's lock, and the history
+	// is kept under the shards' locks, so both are seen here
+	unlock := t.lockAll()
+	defer unlock()
+	if !t.isCollectable() {
+		// Transaction was opened meanwhile,
+		// leave the history to its closing
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&t.hasHistory, 1, 0) {
+		return
+	}
+	for _, s := range t.shards {
+		for key := range s.history {
+			s.collectKey(key, true)
+		}
+		s.history = map[string]struct{}{}
+	}
+}
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestGarbageCollection(t *testing.T) {
+	Convey("With layer and value", t, func() {
+		l := newLayer()
+		key := RandString(16)
+		value := valueState{Data: RandString(64)}
+		l.set(key, value)
+
+		Convey("With open tx", func() {
+			tx := l.tx()
+			l.unset(key)
+
+			Convey("Tombstone should be kept", func() {
+				So(l.shardFor(key).data, ShouldContainKey, key)
+			})
+
+			Convey("Tombstone should be collected on rollback", func() {
+				_, err := tx.rollback()
+				So(err, ShouldBeNil)
+				So(l.shardFor(key).data, ShouldNotContainKey, key)
+				So(l.shardFor(key).history, ShouldBeEmpty)
+			})
+
+			Convey("History should be kept while nested tx is open", func() {
+				tx2 := tx.tx()
+				_, err := tx2.rollback()
+				So(err, ShouldBeNil)
+				So(l.shardFor(key).data, ShouldContainKey, key)
+			})
+		})
+
+		Convey("Tombstone should be collected on aborted commit", func() {
+			tx := l.tx()
+			tx.set(key, valueState{Data: RandString(64)})
+			l.unset(key)
+			_, err := tx.commitRecurse(context.Background(), false)
+			So(err, ShouldNotBeNil)
+			So(l.shardFor(key).data, ShouldNotContainKey, key)
+		})
+
+		Convey("Committed values should not link to history", func() {
+			tx := l.tx()
+			newValue := valueState{Data: RandString(64)}
+			tx.set(key, newValue)
+			_, err := tx.commitRecurse(context.Background(), false)
+			So(err, ShouldBeNil)
+
+			got := l.get(key)
+			So(got.Data, ShouldEqual, newValue.Data)
+			So(got.Prev, ShouldBeNil)
+			So(l.shardFor(key).valueCache, ShouldNotContainKey, value.Data)
+		})
+	})
+}
+
+func TestGarbageCollectionConcurrent(t *testing.T) {
+	Convey("History should be collected after concurrent transactions", t, func() {
+		l := newShardedLayer(4)
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 200; i++ {
+					_, _ = l.tx().rollback()
+				}
+			}()
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 200; i++ {
+					key := strconv.Itoa(w) + ":" + strconv.Itoa(i%10)
+					l.Set(key, "x")
+					l.Unset(key)
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		// The last closed transaction collects the history left
+		_, _ = l.tx().rollback()
+		for _, s := range l.shards {
+			So(s.history, ShouldBeEmpty)
+			So(s.data, ShouldBeEmpty)
+		}
+	})
+}
+
+// TestGarbageCollectionMemory checks that the heap usage
+// stays bounded for the flood of unique keys and values.
+func TestGarbageCollectionMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping memory regression test in short mode")
+	}
+	const iterations = 2000000
+	const maxGrowth = 16 << 20
+
+	l := newLayer()
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	for i := 0; i < iterations; i++ {
+		key := RandString(16)
+		l.set(key, valueState{Data: RandString(16)})
+		l.unset(key)
+	}
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+
+	var keys, counts int
+	for _, s := range l.shards {
+		keys += len(s.data)
+		counts += len(s.valueCache)
+	}
+	if keys != 0 || counts != 0 {
+		t.Fatalf("garbage was not collected: %v keys, %v counts left", keys, counts)
+	}
+	if after.HeapAlloc > before.HeapAlloc && after.HeapAlloc-before.HeapAlloc > maxGrowth {
+		t.Fatalf("heap grew by %v bytes after %v set/unset pairs", after.HeapAlloc-before.HeapAlloc, iterations)
+	}
+	runtime.KeepAlive(l)
+
+	// Tombstones are kept while the transaction can observe them
+	const withTx = 10000
+	tx := l.tx()
+	for i := 0; i < withTx; i++ {
+		key := RandString(16)
+		l.set(key, valueState{Data: RandString(16)})
+		l.unset(key)
+	}
+	keys, counts = 0, 0
+	for _, s := range l.shards {
+		keys += len(s.data)
+		counts += len(s.valueCache)
+	}
+	if keys != withTx || counts != 0 {
+		t.Fatalf("with open tx: %v keys, %v counts kept, want %v keys and no zero counts", keys, counts, withTx)
+	}
+
+	if _, err := tx.rollback(); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range l.shards {
+		if len(s.data) != 0 || len(s.history) != 0 {
+			t.Fatalf("garbage was not collected after tx was closed: %v keys, %v history left", len(s.data), len(s.history))
+		}
+	}
+}
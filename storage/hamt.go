@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"math/bits"
+)
+
+// hamt is the persistent hash array mapped trie of the strings.
+// Maps returned by set share the unchanged nodes with the original one,
+// so the map is copied in O(1) and changed in O(log n).
+// The zero value is the empty map.
+// Maps are never changed, so they're safe for concurrent reads.
+type hamt[V any] struct {
+	root *hamtNode[V]
+	len  int
+}
+
+type hamtNode[V any] struct {
+	// bitmap has the bit set for every child present, the children
+	// are kept in the order of their bits. Nodes at hamtMaxShift
+	// keep the keys whose hashes collide in the entries instead.
+	bitmap  uint32
+	entries []hamtEntry[V]
+}
+
+// hamtEntry is either the child node or the key with its hash and value.
+type hamtEntry[V any] struct {
+	node  *hamtNode[V]
+	hash  uint64
+	key   string
+	value V
+}
+
+const (
+	// hamtBits is the number of the hash's bits consumed by every level.
+	hamtBits = 5
+	hamtMask = 1<<hamtBits - 1
+	// hamtMaxShift is the shift of the levels with the colliding keys.
+	hamtMaxShift = 64
+)
+
+// hamtHash returns the key's hash, FNV-1a.
+func hamtHash(key string) uint64 {
+	hash := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= 1099511628211
+	}
+	return hash
+}
+
+// Len returns the number of keys.
+func (m hamt[V]) Len() int {
+	return m.len
+}
+
+// get returns the key's value; ok is false if there's no such key.
+func (m hamt[V]) get(key string) (value V, ok bool) {
+	return m.root.get(hamtHash(key), key)
+}
+
+// set returns the map with the key set to the value.
+func (m hamt[V]) set(key string, value V) hamt[V] {
+	root, added := m.root.set(hamtHash(key), 0, key, value)
+	ret := hamt[V]{root: root, len: m.len}
+	if added {
+		ret.len++
+	}
+	return ret
+}
+
+// each calls the func for every key in no particular order.
+func (m hamt[V]) each(f func(key string, value V)) {
+	m.root.each(f)
+}
+
+func (n *hamtNode[V]) get(hash uint64, key string) (value V, ok bool) {
+	for shift := uint(0); n != nil; shift += hamtBits {
+		if shift >= hamtMaxShift {
+			for _, e := range n.entries {
+				if e.key == key {
+					return e.value, true
+				}
+			}
+			break
+		}
+		bit := uint32(1) << (hash >> shift & hamtMask)
+		if n.bitmap&bit == 0 {
+			break
+		}
+		e := &n.entries[bits.OnesCount32(n.bitmap&(bit-1))]
+		if e.node == nil {
+			if e.key == key {
+				return e.value, true
+			}
+			break
+		}
+		n = e.node
+	}
+	return value, false
+}
+
+// set returns the copy of the node with the key set to the value;
+// the node may be nil. Returns true if the key was added.
+func (n *hamtNode[V]) set(hash uint64, shift uint, key string, value V) (*hamtNode[V], bool) {
+	if n == nil {
+		n = &hamtNode[V]{}
+	}
+	if shift >= hamtMaxShift {
+		ret := &hamtNode[V]{entries: append(make([]hamtEntry[V], 0, len(n.entries)+1), n.entries...)}
+		for i := range ret.entries {
+			if ret.entries[i].key == key {
+				ret.entries[i].value = value
+				return ret, false
+			}
+		}
+		ret.entries = append(ret.entries, hamtEntry[V]{hash: hash, key: key, value: value})
+		return ret, true
+	}
+
+	bit := uint32(1) << (hash >> shift & hamtMask)
+	i := bits.OnesCount32(n.bitmap & (bit - 1))
+	ret := &hamtNode[V]{bitmap: n.bitmap | bit}
+	if n.bitmap&bit == 0 {
+		ret.entries = make([]hamtEntry[V], len(n.entries)+1)
+		copy(ret.entries, n.entries[:i])
+		ret.entries[i] = hamtEntry[V]{hash: hash, key: key, value: value}
+		copy(ret.entries[i+1:], n.entries[i:])
+		return ret, true
+	}
+
+	ret.entries = append([]hamtEntry[V](nil), n.entries...)
+	e := &ret.entries[i]
+	switch {
+	case e.node != nil:
+		var added bool
+		e.node, added = e.node.set(hash, shift+hamtBits, key, value)
+		return ret, added
+	case e.key == key:
+		e.value = value
+		return ret, false
+	}
+	// Move the key down along with the new one
+	child, _ := (*hamtNode[V])(nil).set(e.hash, shift+hamtBits, e.key, e.value)
+	child, _ = child.set(hash, shift+hamtBits, key, value)
+	*e = hamtEntry[V]{node: child}
+	return ret, true
+}
+
+func (n *hamtNode[V]) each(f func(key string, value V)) {
+	if n == nil {
+		return
+	}
+	for _, e := range n.entries {
+		if e.node != nil {
+			e.node.each(f)
+		} else {
+			f(e.key, e.value)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func TestHAMT(t *testing.T) {
+	Convey("With random map", t, func() {
+		var m hamt[int]
+		want := map[string]int{}
+		for i := 0; i < 5000; i++ {
+			key := strconv.Itoa(rand.Intn(3000))
+			m = m.set(key, i)
+			want[key] = i
+		}
+		m = m.set("1", 1)
+		want["1"] = 1
+
+		Convey("Values should be found", func() {
+			So(m.Len(), ShouldEqual, len(want))
+			for key, value := range want {
+				got, ok := m.get(key)
+				So(ok, ShouldBeTrue)
+				So(got, ShouldEqual, value)
+			}
+			_, ok := m.get("nope")
+			So(ok, ShouldBeFalse)
+		})
+		Convey("Every key should be iterated once", func() {
+			got := map[string]int{}
+			m.each(func(key string, value int) {
+				So(got, ShouldNotContainKey, key)
+				got[key] = value
+			})
+			So(got, ShouldResemble, want)
+		})
+		Convey("Changes should leave the original map intact", func() {
+			changed := m.set("1", -1).set("new", -2)
+			got, _ := changed.get("1")
+			So(got, ShouldEqual, -1)
+			So(changed.Len(), ShouldEqual, m.Len()+1)
+
+			got, _ = m.get("1")
+			So(got, ShouldEqual, want["1"])
+			_, ok := m.get("new")
+			So(ok, ShouldBeFalse)
+		})
+	})
+
+	Convey("Keys with colliding hashes should be kept apart", t, func() {
+		var n *hamtNode[int]
+		var added bool
+		for i, key := range []string{"a", "b", "c", "a"} {
+			n, added = n.set(42, 0, key, i)
+			So(added, ShouldEqual, i < 3)
+		}
+		for key, value := range map[string]int{"a": 3, "b": 1, "c": 2} {
+			got, ok := n.get(42, key)
+			So(ok, ShouldBeTrue)
+			So(got, ShouldEqual, value)
+		}
+		_, ok := n.get(42, "d")
+		So(ok, ShouldBeFalse)
+
+		var keys []string
+		n.each(func(key string, _ int) { keys = append(keys, key) })
+		So(keys, ShouldResemble, []string{"a", "b", "c"})
+	})
+}
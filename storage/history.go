@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"sort"
+	"time"
+)
+
+// Root keeps the variables' versions written within the retention
+// in their shards. Ages are checked against the time of the writes:
+// versions that got older than Retention.Age are dropped on the following
+// writes and reads of the shard.
+
+// Retention bounds the variables' history kept by the root.
+// Versions exceeding either bound are dropped; zero bound doesn't limit
+// the history. History is not kept if both are zero.
+type Retention struct {
+	// Versions is the number of the last versions kept per variable.
+	Versions int
+	// Age is how long the versions are kept after they were replaced.
+	Age time.Duration
+}
+
+// IsEnabled returns true if the history is kept.
+func (r Retention) IsEnabled() bool {
+	return r.Versions > 0 || r.Age > 0
+}
+
+// Version is the variable's value written by the root's change set.
+type Version struct {
+	// Seq is the sequence number of the change set.
+	Seq uint64
+	// Time is when the change set was committed.
+	Time  time.Time
+	Value string
+	// Deleted is true if the variable was unset.
+	Deleted bool
+}
+
+// expiry is the version waiting for the retention's age to pass.
+type expiry struct {
+	key  string
+	time time.Time
+}
+
+// record keeps the change sets' versions of the changed variables.
+// Caller should hold the locks of the changed keys' shards.
+func (t *layer) record(seq uint64, changes []Change) {
+	if !t.retention.IsEnabled() || len(changes) == 0 {
+		return
+	}
+	now := t.now()
+	for _, change := range changes {
+		v := Version{Seq: seq, Time: now, Value: change.Value, Deleted: change.Deleted}
+		t.shardFor(change.Key).record(change.Key, v, t.retention)
+	}
+}
+
+// SetRetention implements Root interface.
+func (t *layer) SetRetention(r Retention) {
+	unlock := t.lockAll()
+	defer unlock()
+
+	t.retention = r
+	now := t.now()
+	for _, s := range t.shards {
+		if !r.IsEnabled() {
+			s.versions = map[string][]Version{}
+			s.expiries = nil
+			continue
+		}
+		for key := range s.versions {
+			s.prune(key, r, now)
+		}
+		if r.Age == 0 {
+			s.expiries = nil
+		}
+	}
+}
+
+// History implements Root interface.
+// Transactions return the root's history.
+func (t *layer) History(key string) []Version {
+	root := t.root()
+	s := root.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(root.retention, root.now())
+	return append([]Version(nil), s.versions[key]...)
+}
+
+// GetAt implements Root interface.
+func (t *layer) GetAt(key string, seq uint64) (string, error) {
+	return t.getVersion(key, func(v Version) bool {
+		return v.Seq > seq
+	})
+}
+
+// GetAtTime implements Root interface.
+func (t *layer) GetAtTime(key string, at time.Time) (string, error) {
+	return t.getVersion(key, func(v Version) bool {
+		return v.Time.After(at)
+	})
+}
+
+// getVersion returns the value of the last version kept
+// before the first one that is after the point in time.
+func (t *layer) getVersion(key string, after func(Version) bool) (string, error) {
+	versions := t.History(key)
+	i := sort.Search(len(versions), func(i int) bool {
+		return after(versions[i])
+	})
+	if i == 0 {
+		return ``, ErrNoHistory.Here()
+	}
+	if versions[i-1].Deleted {
+		return ``, ErrNotFound.Here()
+	}
+	return versions[i-1].Value, nil
+}
+
+// record appends the version to the key's history,
+// dropping the versions out of the retention.
+func (s *shard) record(key string, v Version, r Retention) {
+	s.versions[key] = append(s.versions[key], v)
+	if r.Age > 0 {
+		s.expiries = append(s.expiries, expiry{key: key, time: v.Time})
+	}
+	s.prune(key, r, v.Time)
+	s.expire(r, v.Time)
+}
+
+// expire prunes the histories of the keys whose versions
+// got older than the retention's age.
+func (s *shard) expire(r Retention, now time.Time) {
+	if r.Age == 0 {
+		return
+	}
+	cutoff := now.Add(-r.Age)
+	n := 0
+	for ; n < len(s.expiries) && !s.expiries[n].time.After(cutoff); n++ {
+		s.prune(s.expiries[n].key, r, now)
+	}
+	s.expiries = s.expiries[n:]
+}
+
+// prune drops the key's versions out of the retention.
+func (s *shard) prune(key string, r Retention, now time.Time) {
+	versions := s.versions[key]
+	drop := 0
+	if r.Versions > 0 && len(versions) > r.Versions {
+		drop = len(versions) - r.Versions
+	}
+	if r.Age > 0 {
+		cutoff := now.Add(-r.Age)
+		// Keep the last version written before the cutoff:
+		// it was the variable's value at the cutoff
+		for drop+1 < len(versions) && !versions[drop+1].Time.After(cutoff) {
+			drop++
+		}
+		// Unless it's the deletion, so the unset variables are forgotten
+		if drop == len(versions)-1 && versions[drop].Deleted && !versions[drop].Time.After(cutoff) {
+			drop++
+		}
+	}
+	if drop == 0 {
+		return
+	}
+	if drop == len(versions) {
+		delete(s.versions, key)
+		return
+	}
+	// Release the dropped values
+	for i := range versions[:drop] {
+		versions[i] = Version{}
+	}
+	s.versions[key] = versions[drop:]
+}
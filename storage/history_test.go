@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"github.com/ansel1/merry"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	Convey("With root and fake clock", t, func() {
+		l := newLayer()
+		start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		now := start
+		l.now = func() time.Time { return now }
+		tick := func() { now = now.Add(time.Minute) }
+
+		Convey("History should not be kept by default", func() {
+			l.Set("a", "10")
+			So(l.History("a"), ShouldBeEmpty)
+			_, err := l.GetAt("a", 1)
+			So(merry.Is(err, ErrNoHistory), ShouldBeTrue)
+		})
+
+		Convey("With unbounded retention", func() {
+			l.SetRetention(Retention{Versions: 100})
+			l.Set("a", "10")
+			tick()
+			tx := l.Tx()
+			tx.Set("a", "20")
+			tx.Set("b", "20")
+			_, err := tx.Commit()
+			So(err, ShouldBeNil)
+			tick()
+			l.Unset("a")
+			tick()
+			l.Set("a", "30")
+
+			Convey("Versions should be listed oldest first", func() {
+				So(l.History("a"), ShouldResemble, []Version{
+					{Seq: 1, Time: start, Value: "10"},
+					{Seq: 2, Time: start.Add(time.Minute), Value: "20"},
+					{Seq: 3, Time: start.Add(2 * time.Minute), Deleted: true},
+					{Seq: 4, Time: start.Add(3 * time.Minute), Value: "30"},
+				})
+				So(l.History("b"), ShouldHaveLength, 1)
+				So(l.History("c"), ShouldBeEmpty)
+				So(l.tx().History("a"), ShouldHaveLength, 4)
+			})
+
+			Convey("Values should be read as of the version", func() {
+				got, err := l.GetAt("a", 1)
+				So(err, ShouldBeNil)
+				So(got, ShouldEqual, "10")
+				got, _ = l.GetAt("a", 2)
+				So(got, ShouldEqual, "20")
+				_, err = l.GetAt("a", 3)
+				So(merry.Is(err, ErrNotFound), ShouldBeTrue)
+				got, _ = l.GetAt("a", 100)
+				So(got, ShouldEqual, "30")
+				got, _ = l.GetAt("b", 3)
+				So(got, ShouldEqual, "20")
+				_, err = l.GetAt("b", 1)
+				So(merry.Is(err, ErrNoHistory), ShouldBeTrue)
+			})
+
+			Convey("Values should be read as of the time", func() {
+				got, err := l.GetAtTime("a", start.Add(90*time.Second))
+				So(err, ShouldBeNil)
+				So(got, ShouldEqual, "20")
+				_, err = l.GetAtTime("a", start.Add(2*time.Minute))
+				So(merry.Is(err, ErrNotFound), ShouldBeTrue)
+				_, err = l.GetAtTime("a", start.Add(-time.Second))
+				So(merry.Is(err, ErrNoHistory), ShouldBeTrue)
+			})
+
+			Convey("Disabled retention should drop the history", func() {
+				l.SetRetention(Retention{})
+				So(l.History("a"), ShouldBeEmpty)
+				l.Set("a", "40")
+				So(l.History("a"), ShouldBeEmpty)
+			})
+
+			Convey("Restored root should forget the history", func() {
+				l.Restore(l.Snapshot())
+				So(l.History("a"), ShouldBeEmpty)
+			})
+		})
+
+		Convey("Number of versions should be bounded", func() {
+			l.SetRetention(Retention{Versions: 2})
+			for _, v := range []string{"10", "20", "30"} {
+				l.Set("a", v)
+			}
+			history := l.History("a")
+			So(history, ShouldHaveLength, 2)
+			So(history[0].Value, ShouldEqual, "20")
+			_, err := l.GetAt("a", 1)
+			So(merry.Is(err, ErrNoHistory), ShouldBeTrue)
+
+			Convey("Tighter retention should prune the history", func() {
+				l.SetRetention(Retention{Versions: 1})
+				So(l.History("a"), ShouldHaveLength, 1)
+			})
+		})
+
+		Convey("Age of versions should be bounded", func() {
+			l.SetRetention(Retention{Age: 10 * time.Minute})
+			l.Set("a", "10")
+			tick()
+			l.Set("a", "20")
+			l.Set("b", "10")
+			tick()
+			l.Unset("b")
+			So(l.History("a"), ShouldHaveLength, 2)
+
+			now = start.Add(10*time.Minute + 30*time.Second)
+			// The last version written before the cutoff is kept
+			So(l.History("a"), ShouldHaveLength, 2)
+			got, err := l.GetAtTime("a", now.Add(-10*time.Minute))
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, "10")
+
+			now = start.Add(20 * time.Minute)
+			So(l.History("a"), ShouldResemble, []Version{{Seq: 2, Time: start.Add(time.Minute), Value: "20"}})
+			// Unset variables are forgotten
+			So(l.History("b"), ShouldBeEmpty)
+			for _, s := range l.shards {
+				So(s.expiries, ShouldBeEmpty)
+			}
+		})
+
+		Convey("Swapped databases should record the versions", func() {
+			reg := NewRegistry()
+			reg.SetRetention(Retention{Versions: 10})
+			reg.Get("0").Set("a", "10")
+			reg.Swap("0", "1")
+			So(reg.Get("0").History("a"), ShouldHaveLength, 2)
+			So(reg.Get("1").History("a"), ShouldHaveLength, 1)
+		})
+	})
+}
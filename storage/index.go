@@ -0,0 +1,308 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Root's shards index their variables' keys by the values, and by the
+// values extracted by the user-defined indexes. Transactions don't keep
+// the indexes: they look the keys up in the parent and apply their own
+// changes over them, so the uncommitted changes are found only within
+// the transaction itself.
+
+// IndexFunc extracts the indexed value from the variable's value.
+// ok is false if the variable should not be indexed.
+// IndexFunc is called under the root's locks, so it should be fast
+// and must not access the storage.
+type IndexFunc func(value string) (indexed string, ok bool)
+
+// Keys iterates over the keys in order, until yield returns false.
+// With Go 1.23 or later it can be ranged over.
+type Keys func(yield func(key string) bool)
+
+// Slice returns the keys.
+func (k Keys) Slice() []string {
+	var ret []string
+	k(func(key string) bool {
+		ret = append(ret, key)
+		return true
+	})
+	return ret
+}
+
+// keysOf returns the Keys iterating over the set sorted.
+func keysOf(set map[string]struct{}) Keys {
+	sorted := make([]string, 0, len(set))
+	for key := range set {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	return func(yield func(string) bool) {
+		for _, key := range sorted {
+			if !yield(key) {
+				return
+			}
+		}
+	}
+}
+
+// JSONField returns the IndexFunc indexing the JSON values
+// by the field at the dot-separated path, e.g. "user.name" or "tags.0".
+// Strings are indexed as is, other fields - as JSON.
+// Values that are not JSON or have no such field are not indexed.
+func JSONField(path string) IndexFunc {
+	fields := strings.Split(path, ".")
+	return func(value string) (string, bool) {
+		var doc interface{}
+		if err := json.Unmarshal([]byte(value), &doc); err != nil {
+			return "", false
+		}
+		for _, field := range fields {
+			switch node := doc.(type) {
+			case map[string]interface{}:
+				var ok bool
+				if doc, ok = node[field]; !ok {
+					return "", false
+				}
+			case []interface{}:
+				i, err := strconv.Atoi(field)
+				if err != nil || i < 0 || i >= len(node) {
+					return "", false
+				}
+				doc = node[i]
+			default:
+				return "", false
+			}
+		}
+		if s, ok := doc.(string); ok {
+			return s, true
+		}
+		ret, err := json.Marshal(doc)
+		if err != nil {
+			return "", false
+		}
+		return string(ret), true
+	}
+}
+
+// identity indexes the variables by their values.
+func identity(value string) (string, bool) {
+	return value, true
+}
+
+// keyIndex maps the indexed values to the keys of the variables.
+type keyIndex map[string]map[string]struct{}
+
+func (i keyIndex) add(indexed, key string) {
+	keys, ok := i[indexed]
+	if !ok {
+		keys = map[string]struct{}{}
+		i[indexed] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+func (i keyIndex) remove(indexed, key string) {
+	keys := i[indexed]
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(i, indexed)
+	}
+}
+
+// userIndex is the shard's part of the user-defined index.
+type userIndex struct {
+	f    IndexFunc
+	keys keyIndex
+}
+
+// index adds the variable to the shard's indexes.
+func (s *shard) index(key, value string) {
+	s.byValue.add(value, key)
+	for _, idx := range s.indexes {
+		if indexed, ok := idx.f(value); ok {
+			idx.keys.add(indexed, key)
+		}
+	}
+}
+
+// unindex removes the variable from the shard's indexes.
+func (s *shard) unindex(key, value string) {
+	s.byValue.remove(value, key)
+	for _, idx := range s.indexes {
+		if indexed, ok := idx.f(value); ok {
+			idx.keys.remove(indexed, key)
+		}
+	}
+}
+
+// CreateIndex implements Root interface.
+// Transactions create the root's indexes.
+func (t *layer) CreateIndex(name string, f IndexFunc) error {
+	t = t.root()
+	unlock := t.lockAll()
+	defer unlock()
+
+	if _, ok := t.shards[0].indexes[name]; ok || name == "" {
+		return ErrIndexExists.Here().Append(name)
+	}
+	for _, s := range t.shards {
+		idx := &userIndex{f: f, keys: keyIndex{}}
+		for key, value := range s.data {
+			if value.Deleted {
+				continue
+			}
+			if indexed, ok := f(value.Data); ok {
+				idx.keys.add(indexed, key)
+			}
+		}
+		s.indexes[name] = idx
+	}
+	return nil
+}
+
+// DropIndex implements Root interface.
+func (t *layer) DropIndex(name string) error {
+	t = t.root()
+	unlock := t.lockAll()
+	defer unlock()
+
+	if _, ok := t.shards[0].indexes[name]; !ok {
+		return ErrNoIndex.Here().Append(name)
+	}
+	for _, s := range t.shards {
+		delete(s.indexes, name)
+	}
+	return nil
+}
+
+// Indexes implements Root interface.
+func (t *layer) Indexes() []string {
+	s := t.root().shards[0]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]string, 0, len(s.indexes))
+	for name := range s.indexes {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// KeysWithValue implements Finder interface.
+func (t *layer) KeysWithValue(value string) Keys {
+	ret, _ := t.Find("", value)
+	return ret
+}
+
+// Find implements Finder interface.
+func (t *layer) Find(index, value string) (Keys, error) {
+	ret, _, err := t.lockedFind(context.Background(), index, value)
+	if err != nil {
+		return nil, err
+	}
+	return keysOf(ret), nil
+}
+
+// lockedFind locks the layer and returns the keys of the variables
+// indexed as the value by the index ("" for the values themselves)
+// along with the index's func.
+// Root's shards are locked all at once, so the keys are consistent.
+func (t *layer) lockedFind(ctx context.Context, index, value string) (map[string]struct{}, IndexFunc, error) {
+	if t.parentLayer == nil {
+		unlock, err := t.lockAllContext(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer unlock()
+		return t.findShards(index, value)
+	}
+	if err := t.mu.LockContext(ctx); err != nil {
+		return nil, nil, err
+	}
+	defer t.mu.Unlock()
+
+	if err := t.syncFlat(ctx); err != nil {
+		return nil, nil, err
+	}
+	ret, f, err := t.rootLayer.lockedFind(ctx, index, value)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Apply the transactions' changes
+	t.flat.each(func(key string, v *valueState) {
+		applyFound(ret, f, value, key, v)
+	})
+	return ret, f, nil
+}
+
+// applyFound adds the changed variable to the keys indexed as the value
+// or removes it from them.
+func applyFound(keys map[string]struct{}, f IndexFunc, value, key string, v *valueState) {
+	indexed, ok := "", false
+	if !v.Deleted {
+		indexed, ok = f(v.Data)
+	}
+	if ok && indexed == value {
+		keys[key] = struct{}{}
+	} else {
+		delete(keys, key)
+	}
+}
+
+// findShards collects the keys indexed as the value from the root's shards.
+// Caller should hold the locks of all the shards.
+func (t *layer) findShards(index, value string) (map[string]struct{}, IndexFunc, error) {
+	f := IndexFunc(identity)
+	if index != "" {
+		idx, ok := t.shards[0].indexes[index]
+		if !ok {
+			return nil, nil, ErrNoIndex.Here().Append(index)
+		}
+		f = idx.f
+	}
+	ret := map[string]struct{}{}
+	for _, s := range t.shards {
+		keys := s.byValue
+		if index != "" {
+			keys = s.indexes[index].keys
+		}
+		for key := range keys[value] {
+			ret[key] = struct{}{}
+		}
+	}
+	return ret, f, nil
+}
+
+// KeysWithValue implements Finder interface.
+func (t *readLayer) KeysWithValue(value string) Keys {
+	ret, _ := t.Find("", value)
+	return ret
+}
+
+// Find implements Finder interface.
+func (t *readLayer) Find(index, value string) (Keys, error) {
+	var ret map[string]struct{}
+	var err error
+	viewErr := t.view(context.Background(), func(root *layer, changes map[string]*valueState) {
+		var f IndexFunc
+		ret, f, err = root.findShards(index, value)
+		if err != nil {
+			return
+		}
+		for key, v := range changes {
+			applyFound(ret, f, value, key, v)
+		}
+	})
+	if viewErr != nil {
+		return nil, viewErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return keysOf(ret), nil
+}
@@ -0,0 +1,138 @@
+package storage_test
+
+import (
+	"github.com/ansel1/merry"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/utrack/go-simple-memdb/storage"
+	"testing"
+)
+
+func TestIndexes(t *testing.T) {
+	Convey("With root", t, func() {
+		root := storage.New()
+		root.Set("a", "10")
+		root.Set("b", "10")
+		root.Set("c", "20")
+
+		Convey("Keys should be found by the value", func() {
+			So(root.KeysWithValue("10").Slice(), ShouldResemble, []string{"a", "b"})
+			So(root.KeysWithValue("30").Slice(), ShouldBeNil)
+			root.Set("b", "20")
+			root.Unset("c")
+			So(root.KeysWithValue("10").Slice(), ShouldResemble, []string{"a"})
+			So(root.KeysWithValue("20").Slice(), ShouldResemble, []string{"b"})
+		})
+
+		Convey("Iteration should stop when asked", func() {
+			var got []string
+			root.KeysWithValue("10")(func(key string) bool {
+				got = append(got, key)
+				return false
+			})
+			So(got, ShouldResemble, []string{"a"})
+		})
+
+		Convey("Transactions should see their own changes only", func() {
+			tx := root.Tx()
+			tx.Set("c", "10")
+			tx.Unset("a")
+			nested := tx.Tx()
+			nested.Set("d", "10")
+			finder := nested.(storage.Finder)
+			So(finder.KeysWithValue("10").Slice(), ShouldResemble, []string{"b", "c", "d"})
+			So(tx.(storage.Finder).KeysWithValue("10").Slice(), ShouldResemble, []string{"b", "c"})
+			So(root.KeysWithValue("10").Slice(), ShouldResemble, []string{"a", "b"})
+			So(nested.ReadTx().(storage.Finder).KeysWithValue("10").Slice(), ShouldResemble, []string{"b", "c", "d"})
+
+			_, err := nested.Commit()
+			So(err, ShouldBeNil)
+			So(root.KeysWithValue("10").Slice(), ShouldResemble, []string{"b", "c", "d"})
+		})
+
+		Convey("With JSON index", func() {
+			root.Set("u1", `{"name":"alice","age":30,"tags":["a","b"]}`)
+			root.Set("u2", `{"name":"bob","age":30}`)
+			So(root.CreateIndex("age", storage.JSONField("age")), ShouldBeNil)
+			So(root.CreateIndex("tag", storage.JSONField("tags.1")), ShouldBeNil)
+
+			Convey("Existing variables should be indexed", func() {
+				keys, err := root.Find("age", "30")
+				So(err, ShouldBeNil)
+				So(keys.Slice(), ShouldResemble, []string{"u1", "u2"})
+				keys, _ = root.Find("tag", "b")
+				So(keys.Slice(), ShouldResemble, []string{"u1"})
+				So(root.Indexes(), ShouldResemble, []string{"age", "tag"})
+			})
+
+			Convey("Index should be maintained transactionally", func() {
+				tx := root.Tx()
+				tx.Set("u2", `{"name":"bob","age":31}`)
+				tx.Set("u3", `{"age":30}`)
+				keys, err := tx.(storage.Finder).Find("age", "30")
+				So(err, ShouldBeNil)
+				So(keys.Slice(), ShouldResemble, []string{"u1", "u3"})
+				keys, _ = root.Find("age", "30")
+				So(keys.Slice(), ShouldResemble, []string{"u1", "u2"})
+
+				_, err = tx.Commit()
+				So(err, ShouldBeNil)
+				keys, _ = root.Find("age", "30")
+				So(keys.Slice(), ShouldResemble, []string{"u1", "u3"})
+				keys, _ = root.Find("age", "31")
+				So(keys.Slice(), ShouldResemble, []string{"u2"})
+			})
+
+			Convey("Restored root should be indexed", func() {
+				snap := root.Snapshot()
+				root.Flush()
+				keys, _ := root.Find("age", "30")
+				So(keys.Slice(), ShouldBeNil)
+				root.Restore(snap)
+				keys, _ = root.Find("age", "30")
+				So(keys.Slice(), ShouldResemble, []string{"u1", "u2"})
+			})
+
+			Convey("Names should be unique", func() {
+				err := root.CreateIndex("age", storage.JSONField("name"))
+				So(merry.Is(err, storage.ErrIndexExists), ShouldBeTrue)
+				err = root.CreateIndex("", storage.JSONField("name"))
+				So(merry.Is(err, storage.ErrIndexExists), ShouldBeTrue)
+			})
+
+			Convey("Dropped index should not be found", func() {
+				So(root.DropIndex("age"), ShouldBeNil)
+				_, err := root.Find("age", "30")
+				So(merry.Is(err, storage.ErrNoIndex), ShouldBeTrue)
+				So(merry.Is(root.DropIndex("age"), storage.ErrNoIndex), ShouldBeTrue)
+				_, err = root.Tx().(storage.Finder).Find("age", "30")
+				So(merry.Is(err, storage.ErrNoIndex), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestJSONField(t *testing.T) {
+	Convey("JSON fields should be extracted", t, func() {
+		doc := `{"user":{"name":"alice","age":30,"admin":true,"tags":["a",{"b":null}]}}`
+		for _, c := range []struct {
+			path, want string
+			ok         bool
+		}{
+			{"user.name", "alice", true},
+			{"user.age", "30", true},
+			{"user.admin", "true", true},
+			{"user.tags.0", "a", true},
+			{"user.tags.1", `{"b":null}`, true},
+			{"user.tags.1.b", "null", true},
+			{"user.tags.2", "", false},
+			{"user.name.first", "", false},
+			{"user.email", "", false},
+		} {
+			got, ok := storage.JSONField(c.path)(doc)
+			So(ok, ShouldEqual, c.ok)
+			So(got, ShouldEqual, c.want)
+		}
+		_, ok := storage.JSONField("a")("not json")
+		So(ok, ShouldBeFalse)
+	})
+}
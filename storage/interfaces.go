@@ -1,5 +1,10 @@
 package storage
 
+import (
+	"context"
+	"time"
+)
+
 // Reader is able to retrieve values from the storage.
 type Reader interface {
 	// Get returns the variable's value by its key.
@@ -23,14 +28,185 @@ type ReadWriter interface {
 	Writer
 }
 
+// Finder is able to look the variables up by their values.
+// Storage's DBs and read-only transactions implement it.
+type Finder interface {
+	// KeysWithValue returns the keys of the variables that are currently set
+	// to the value.
+	KeysWithValue(value string) Keys
+	// Find returns the keys of the variables whose values are indexed
+	// as the value by the root's index.
+	// ErrNoIndex is returned if there's no such index.
+	Find(index, value string) (Keys, error)
+}
+
+// Aggregator aggregates the variables' values without scanning them.
+// Storage's DBs and read-only transactions implement it.
+type Aggregator interface {
+	// CountRange returns the number of variables whose values are
+	// between min and max inclusive, compared as strings.
+	CountRange(min, max string) uint64
+	// CountNumericRange returns the number of variables whose values are
+	// numbers between min and max inclusive.
+	CountNumericRange(min, max float64) uint64
+	// DistinctValues returns the number of distinct values.
+	DistinctValues() uint64
+	// TopValues returns up to n most common values with their counts,
+	// equal counts ordered by the values.
+	TopValues(n int) []ValueCount
+	// SumPrefix returns the sum and the number of the numeric values
+	// of the variables whose keys start with the prefix.
+	SumPrefix(prefix string) (sum float64, count uint64)
+}
+
+// ReadOnlyTx is the read-only transaction.
+// It reads the database as it was when the transaction was opened,
+// so the changes made after that are not observed.
+type ReadOnlyTx interface {
+	Reader
+	// Close closes the transaction, releasing the values it kept.
+	// ErrTxClosed is returned by its reads after that.
+	Close()
+}
+
 // DB is an instance of a database, or transaction over the DB.
 // It is able to read and write values and create child transactions.
 type DB interface {
 	ReadWriter
 	// Tx creates a transaction over the database or current transaction.
 	Tx() DB
+	// ReadTx creates a read-only transaction over the database or current transaction.
+	ReadTx() ReadOnlyTx
 	// Commit commits the whole transaction tree, returning database's root.
+	// ErrTxConflict is returned if a variable the transaction changed was changed
+	// under it meanwhile; the transaction is aborted then, so committing it again
+	// returns ErrTxClosed, and its parent is returned.
 	Commit() (DB, error)
-	// Rollback cancels the current transaction, returning parent tx (or database's root).
+	// Rollback cancels the current transaction with its savepoints, returning parent tx (or database's root).
 	Rollback() (DB, error)
+
+	// Savepoint creates a named savepoint within the current transaction.
+	Savepoint(name string) (DB, error)
+	// RollbackTo cancels the changes made since the savepoint, keeping the savepoint
+	// and the transaction open.
+	RollbackTo(name string) (DB, error)
+	// Release removes the savepoint, keeping the changes made since it.
+	Release(name string) (DB, error)
+}
+
+// ContextReader is the Reader that gives up waiting for the locks
+// once the context is done, returning the context's error.
+type ContextReader interface {
+	// GetContext returns the variable's value by its key.
+	// ErrNotFound is returned when the variable was not found.
+	GetContext(ctx context.Context, key string) (string, error)
+	// NumEqualToContext returns the number of variables that are currently set
+	// to the passed value.
+	NumEqualToContext(ctx context.Context, value string) (uint64, error)
+}
+
+// ContextWriter is the Writer that gives up waiting for the locks
+// once the context is done, returning the context's error.
+// Nothing is changed then.
+type ContextWriter interface {
+	// SetContext sets the variable's value by its key.
+	SetContext(ctx context.Context, key string, value string) error
+	// UnsetContext removes the variable by its key.
+	UnsetContext(ctx context.Context, key string) error
+}
+
+// ContextReadWriter is able to read and modify values honouring the contexts.
+type ContextReadWriter interface {
+	ContextReader
+	ContextWriter
+}
+
+// ContextDB is the DB with the context-aware variants of its methods;
+// DB's own methods wait for the locks unconditionally.
+// Storage's DBs implement it, and its read-only transactions
+// implement ContextReader.
+type ContextDB interface {
+	DB
+	ContextReadWriter
+	// CommitContext commits the whole transaction tree, returning database's root.
+	// If the context is done while waiting for the locks, the transaction
+	// that is still open is returned with the context's error;
+	// transactions closer to the top of the tree are committed to it by then.
+	CommitContext(ctx context.Context) (DB, error)
+	// ReleaseContext removes the savepoint, keeping the changes made since it.
+	// It gives up waiting for the locks the same way CommitContext does.
+	ReleaseContext(ctx context.Context, name string) (DB, error)
+}
+
+// Root is the database's root storage.
+// Besides being the DB, it streams the change sets committed to it
+// and is able to replicate another root's change sets.
+type Root interface {
+	ContextDB
+	// OnCommit registers the func that is called for every change set committed
+	// to the root, in order. The func is called while the root is locked, so it
+	// should return quickly and must not access the storage.
+	// Funcs should be registered before the root is written to concurrently.
+	OnCommit(func(ChangeSet))
+	// Seq returns the sequence number of the last committed change set.
+	Seq() uint64
+	// Snapshot returns a consistent copy of the root's variables.
+	Snapshot() Snapshot
+	// Restore replaces root's variables with the snapshot's ones,
+	// forgetting their history.
+	Restore(Snapshot)
+	// Apply applies another root's change set.
+	// ErrChangeSetOrder is returned if the change set doesn't follow the last one.
+	Apply(ChangeSet) error
+	// Flush unsets all the variables in a single change set.
+	// Open transactions that touched them will conflict on commit.
+	Flush()
+	// UsedMemory returns the number of bytes taken by the variables' keys and values.
+	UsedMemory() uint64
+	// CheckMemory returns ErrOutOfMemory if the variables take more than
+	// Config's MaxMemory bytes, so the writes adding to them should be rejected.
+	CheckMemory() error
+
+	// Expire sets the variable to expire after the ttl; it's unset by
+	// SweepExpired once expired, and stays readable until then.
+	// Writing the variable removes its expiration.
+	// False is returned if the variable is not set.
+	Expire(key string, ttl time.Duration) bool
+	// TTL returns the time left until the variable expires
+	// and true if it expires, or ErrNotFound if it's not set.
+	TTL(key string) (time.Duration, bool, error)
+	// Persist removes the variable's expiration,
+	// returning false if it didn't expire.
+	Persist(key string) bool
+	// SweepExpired unsets the expired variables in a single change set
+	// and returns their number.
+	SweepExpired() int
+
+	// SetRetention enables keeping the variables' versions written by the
+	// change sets within the retention; zero Retention disables it.
+	// History is not kept by default.
+	SetRetention(Retention)
+	// History returns the variable's versions kept, oldest first.
+	History(key string) []Version
+	// GetAt returns the variable's value as of the change set's sequence number.
+	// ErrNotFound is returned if the variable was not set at that moment,
+	// ErrNoHistory - if that moment is before the variable's oldest version kept.
+	GetAt(key string, seq uint64) (string, error)
+	// GetAtTime works like GetAt, returning the value as of the time.
+	GetAtTime(key string, at time.Time) (string, error)
+
+	// Finder looks the variables up in the root and its transactions.
+	Finder
+	// Aggregator aggregates the values of the root and its transactions.
+	Aggregator
+	// CreateIndex creates the named index of the variables by the values
+	// extracted by the func, e.g. JSONField. The index is maintained by every
+	// change set and is used by Find in the root and its transactions.
+	// ErrIndexExists is returned if the name is taken or empty.
+	CreateIndex(name string, f IndexFunc) error
+	// DropIndex removes the index.
+	// ErrNoIndex is returned if there's no such index.
+	DropIndex(name string) error
+	// Indexes returns the sorted names of the indexes.
+	Indexes() []string
 }
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Change is a modification of a single variable.
+type Change struct {
+	Key   string
+	Value string
+	// Deleted is true if the variable was unset.
+	Deleted bool
+}
+
+// ChangeSet is a set of changes applied to the root storage atomically:
+// either a single write outside of transactions or the whole committed
+// transaction.
+type ChangeSet struct {
+	// Seq is the change set's sequence number.
+	// Root's change sets are numbered consecutively starting from 1.
+	Seq     uint64
+	Changes []Change
+}
+
+// Snapshot is a copy of the root storage's variables.
+type Snapshot struct {
+	// Seq is the sequence number of the last change set
+	// included in the snapshot.
+	Seq    uint64
+	Values map[string]string
+	// Deadlines are the expiration times of the expiring variables,
+	// nil if none expire.
+	Deadlines map[string]time.Time
+}
+
+// publish commits the change set to the root, passes it to the listeners
+// and returns its sequence number.
+// Caller should hold the locks of the changed keys' shards,
+// so the change sets are numbered in the order they're applied.
+func (t *layer) publish(changes []Change) uint64 {
+	if atomic.LoadInt32(&t.isListened) == 0 {
+		// Nobody to pass the change sets to in order,
+		// so the writes to different shards don't have to wait
+		return atomic.AddUint64(&t.seq, 1)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cs := ChangeSet{Seq: atomic.AddUint64(&t.seq, 1), Changes: changes}
+	for _, f := range t.listeners {
+		f(cs)
+	}
+	return cs.Seq
+}
+
+// OnCommit implements Root interface.
+func (t *layer) OnCommit(f func(ChangeSet)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.listeners = append(t.listeners, f)
+	atomic.StoreInt32(&t.isListened, 1)
+}
+
+// Seq implements Root interface.
+func (t *layer) Seq() uint64 {
+	return atomic.LoadUint64(&t.seq)
+}
+
+// Snapshot implements Root interface.
+func (t *layer) Snapshot() Snapshot {
+	unlock := t.lockAll()
+	defer unlock()
+
+	return Snapshot{Seq: atomic.LoadUint64(&t.seq), Values: t.values(), Deadlines: t.deadlines()}
+}
+
+// Restore implements Root interface.
+func (t *layer) Restore(snap Snapshot) {
+	unlock := t.lockAll()
+	defer unlock()
+
+	// Read-only transactions keep both the replaced and the new keys
+	for _, s := range t.shards {
+		for key := range s.data {
+			s.remember(key)
+		}
+	}
+	for key := range snap.Values {
+		t.shardFor(key).remember(key)
+	}
+
+	for _, s := range t.shards {
+		s.data = map[string]*valueState{}
+		atomic.StoreInt64(&s.used, 0)
+		s.valueCache = map[string]uint64{}
+		s.byValue = keyIndex{}
+		s.stats = newValueStats()
+		s.numbers = newKeyTreap()
+		for _, idx := range s.indexes {
+			idx.keys = keyIndex{}
+		}
+		s.history = map[string]struct{}{}
+		s.versions = map[string][]Version{}
+		s.expiries = nil
+		s.deadlines = map[string]time.Time{}
+	}
+	for key, value := range snap.Values {
+		s := t.shardFor(key)
+		s.data[key] = &valueState{Data: value}
+		atomic.AddInt64(&s.used, int64(len(key)+len(value)))
+		s.valueCache[value]++
+		s.index(key, value)
+		s.aggregate(key, nil, s.data[key])
+	}
+	for key, deadline := range snap.Deadlines {
+		if _, ok := snap.Values[key]; ok {
+			t.shardFor(key).deadlines[key] = deadline
+		}
+	}
+	atomic.StoreUint64(&t.seq, snap.Seq)
+}
+
+// Apply implements Root interface.
+func (t *layer) Apply(cs ChangeSet) error {
+	unlock := t.lockAll()
+	defer unlock()
+
+	if cs.Seq != atomic.LoadUint64(&t.seq)+1 {
+		return ErrChangeSetOrder.Here()
+	}
+	// Empty change sets still advance the sequence
+	t.apply(cs.Changes)
+	return nil
+}
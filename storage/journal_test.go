@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"context"
+	"github.com/ansel1/merry"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	Convey("With root and listener", t, func() {
+		l := newLayer()
+		var got []ChangeSet
+		l.OnCommit(func(cs ChangeSet) {
+			got = append(got, cs)
+		})
+
+		Convey("Writes outside of tx should be published one by one", func() {
+			l.Set("a", "10")
+			l.Unset("a")
+			So(got, ShouldResemble, []ChangeSet{
+				{Seq: 1, Changes: []Change{{Key: "a", Value: "10"}}},
+				{Seq: 2, Changes: []Change{{Key: "a", Deleted: true}}},
+			})
+			So(l.Seq(), ShouldEqual, uint64(2))
+		})
+
+		Convey("Committed tx should be published as a single change set", func() {
+			tx := l.tx()
+			tx.Set("a", "10")
+			tx.Set("c", "30")
+			tx2 := tx.tx()
+			tx2.Set("b", "20")
+			tx2.Unset("c")
+			_, err := tx2.commitRecurse(context.Background(), false)
+			So(err, ShouldBeNil)
+			So(len(got), ShouldEqual, 1)
+			So(got[0].Seq, ShouldEqual, uint64(1))
+			changes := map[string]Change{}
+			for _, change := range got[0].Changes {
+				changes[change.Key] = change
+			}
+			So(changes, ShouldResemble, map[string]Change{
+				"a": {Key: "a", Value: "10"},
+				"b": {Key: "b", Value: "20"},
+				"c": {Key: "c", Deleted: true},
+			})
+		})
+
+		Convey("Empty, rolled back and conflicting txs should not be published", func() {
+			l.Set("a", "10")
+			got = nil
+
+			_, err := l.tx().commitRecurse(context.Background(), false)
+			So(err, ShouldBeNil)
+
+			tx := l.tx()
+			tx.Set("a", "20")
+			_, err = tx.rollback()
+			So(err, ShouldBeNil)
+
+			tx = l.tx()
+			tx.Set("a", "30")
+			l.Set("a", "40")
+			got = nil
+			_, err = tx.commitRecurse(context.Background(), false)
+			So(merry.Is(err, ErrTxConflict), ShouldBeTrue)
+
+			So(got, ShouldBeEmpty)
+			So(l.Seq(), ShouldEqual, uint64(2))
+		})
+
+		Convey("Snapshot should be restored", func() {
+			l.Set("a", "10")
+			l.Set("b", "10")
+			l.Set("c", "20")
+			l.Unset("c")
+
+			snap := l.Snapshot()
+			So(snap, ShouldResemble, Snapshot{Seq: 4, Values: map[string]string{"a": "10", "b": "10"}})
+
+			r := newLayer()
+			r.Set("d", "30")
+			r.Restore(snap)
+			So(r.Seq(), ShouldEqual, uint64(4))
+			So(r.NumEqualTo("10"), ShouldEqual, uint64(2))
+			_, err := r.Get("d")
+			So(merry.Is(err, ErrNotFound), ShouldBeTrue)
+		})
+
+		Convey("Change sets should be applied in order", func() {
+			r := newLayer()
+			err := r.Apply(ChangeSet{Seq: 2})
+			So(merry.Is(err, ErrChangeSetOrder), ShouldBeTrue)
+
+			err = r.Apply(ChangeSet{Seq: 1, Changes: []Change{{Key: "a", Value: "10"}, {Key: "b", Value: "10"}}})
+			So(err, ShouldBeNil)
+			err = r.Apply(ChangeSet{Seq: 2, Changes: []Change{{Key: "a", Deleted: true}}})
+			So(err, ShouldBeNil)
+			So(r.Seq(), ShouldEqual, uint64(2))
+			So(r.NumEqualTo("10"), ShouldEqual, uint64(1))
+
+			Convey("Applied change sets should be published", func() {
+				var gotApplied []ChangeSet
+				r.OnCommit(func(cs ChangeSet) {
+					gotApplied = append(gotApplied, cs)
+				})
+				cs := ChangeSet{Seq: 3, Changes: []Change{{Key: "c", Value: "30"}}}
+				So(r.Apply(cs), ShouldBeNil)
+				So(gotApplied, ShouldResemble, []ChangeSet{cs})
+			})
+		})
+	})
+}
@@ -1,129 +1,395 @@
 package storage
 
 import (
-	"sync"
+	"context"
+	"sync/atomic"
+	"time"
 )
 
 // layer is a storage primitive with optional passthrough
 // to underlying layers.
 //
-// Layer stores values that were modified locally and
-// uses recursive get() calls if the key wasn't found locally.
+// Layer stores values that were modified locally. Its flat view
+// also has the values modified by the parent transactions, so the keys
+// not found there are read from the root layer right away,
+// however deep the layer is. Flat views are persistent maps shared
+// with the parents' ones (see hamt), so opening the transaction is O(1).
+// Writes to the layers having open transactions over them make
+// the flat views over them stale; they're rebuilt on the next read.
 //
 // When asked for commit(), the layer dumps its contents to the level
 // under it and calls commit(). Commit wave recurses to the root level.
 //
 // When asked for rollback(), the parent layer is returned - and local changes are
 // forgotten.
+//
+// Layer's mu guards transaction layer's contents. Unexported methods
+// expect the caller to hold the layer's lock; they lock the parent layer
+// themselves when rebuilding the flat view over it, so the locks
+// are always taken from the top layer down to the root.
+//
+// Root layer keeps its variables in the shards, each one with its own lock
+// (see shard); root's unexported methods expect the caller to hold the locks
+// of the shards they touch. Root's mu guards its journal.
 type layer struct {
 	// parentLayer is this layer's parent - either
 	// parent transaction or root layer.
 	parentLayer *layer
-	// data stores the values.
+	// rootLayer is the root layer under the transaction layer.
+	rootLayer *layer
+	// data stores the transaction layer's values.
 	data map[string]*valueState
-	// valueCache keeps count for each unique value in the layer
-	// and caches the counts coming from the underlying layers.
+	// deltas are the changes of the values' counts made by the transaction layer.
+	deltas map[string]int64
+	// valueCache caches the root's counts seen by the transaction layer.
 	valueCache map[string]uint64
+	// flat and counts are the transaction layer's values and deltas
+	// along with the parent transactions' ones, the topmost winning.
+	flat   hamt[*valueState]
+	counts hamt[int64]
+	// flatGen is the root's flatGen the transaction layer's flat view
+	// was built at. Root's flatGen is bumped by the writes to the
+	// transaction layers having open transactions over them;
+	// it is accessed atomically and starts at 1, so the views
+	// never built are stale.
+	flatGen uint64
+	// shards store the root layer's values.
+	shards []*shard
 
 	// isClosed is true if this layer was committed or rolled back.
 	isClosed bool
 
-	mu sync.Mutex
+	// isSavepoint is true if this layer was created by the savepoint.
+	isSavepoint bool
+	// savepointName is the name of the savepoint.
+	savepointName string
+
+	// openTxs is the number of open transactions over this layer.
+	// It is accessed atomically.
+	openTxs int64
+	// hasHistory is 1 if root's shards may have the history to collect.
+	// It is accessed atomically.
+	hasHistory int32
+
+	// seq is the sequence number of the last change set
+	// committed to the root layer. It is accessed atomically.
+	seq uint64
+	// listeners are called for every committed root's change set.
+	listeners []func(ChangeSet)
+	// isListened is 1 if there are listeners. It is accessed atomically.
+	isListened int32
+
+	// retention bounds the root's history.
+	// It's guarded by the locks of all the shards.
+	retention Retention
+	// now returns the time of the root's change sets.
+	now func() time.Time
+	// maxMemory is the root's Config.MaxMemory.
+	maxMemory uint64
+
+	mu mutex
 }
 
 func newLayer() *layer {
-	return &layer{
-		data:       map[string]*valueState{},
-		valueCache: map[string]uint64{},
+	return newShardedLayer(defaultShards)
+}
+
+// root returns the root layer under the layer.
+func (t *layer) root() *layer {
+	if t.parentLayer == nil {
+		return t
 	}
+	return t.rootLayer
 }
 
 func (t *layer) set(key string, value valueState) {
-	var isLocal bool
-	value.Prev, isLocal = t.getIsLocal(key)
+	_ = t.setContext(context.Background(), key, value)
+}
+
+// setContext sets the value, giving up if the context is done
+// while waiting for the underlying layers.
+// Layer is left intact on error.
+func (t *layer) setContext(ctx context.Context, key string, value valueState) error {
+	if t.parentLayer == nil {
+		t.setShard(key, value)
+		return nil
+	}
+
+	prev, isLocal, err := t.getIsLocal(ctx, key)
+	if err != nil {
+		return err
+	}
+	value.Prev = prev
 
 	// Crop unneeded leaves, save memory
 	// 3 -> 2 -> 1 becomes 3 -> 1
 	// Don't cross the layer's boundaries
-	if isLocal && value.Prev != nil && value.Prev.Prev != nil {
-		value.Prev = value.Prev.Prev
+	if isLocal && prev != nil && prev.Prev != nil {
+		value.Prev = prev.Prev
 	}
-	t.data[key] = &value
-	t.refreshCacheForValue(value)
+	t.put(key, prev, &value)
+	return nil
 }
 
 func (t *layer) unset(key string) {
-	newValue := valueState{Data: "", Prev: t.get(key), Deleted: true}
-	t.data[key] = &newValue
-	t.refreshCacheForValue(newValue)
+	_ = t.unsetContext(context.Background(), key)
+}
+
+// unsetContext unsets the value, giving up if the context is done
+// while waiting for the underlying layers.
+// Layer is left intact on error.
+func (t *layer) unsetContext(ctx context.Context, key string) error {
+	if t.parentLayer == nil {
+		t.setShard(key, valueState{Deleted: true})
+		return nil
+	}
+
+	prev, err := t.getContext(ctx, key)
+	if err != nil {
+		return err
+	}
+	t.put(key, prev, &valueState{Data: "", Prev: prev, Deleted: true})
+	return nil
+}
+
+// values returns the root layer's variables.
+func (t *layer) values() map[string]string {
+	ret := map[string]string{}
+	for _, s := range t.shards {
+		for key, value := range s.data {
+			if !value.Deleted {
+				ret[key] = value.Data
+			}
+		}
+	}
+	return ret
+}
+
+// replace replaces the root's variables with the values
+// in a single change set.
+// Caller should hold the locks of all the shards.
+func (t *layer) replace(values map[string]string) {
+	var changes []Change
+	for _, s := range t.shards {
+		for key, value := range s.data {
+			if _, ok := values[key]; !ok && !value.Deleted {
+				changes = append(changes, Change{Key: key, Deleted: true})
+			}
+		}
+	}
+	for key, value := range values {
+		if cur := t.get(key); cur == nil || cur.Deleted || cur.Data != value {
+			changes = append(changes, Change{Key: key, Value: value})
+		}
+	}
+	if len(changes) == 0 {
+		return
+	}
+	t.apply(changes)
 }
 
 // get returns the value by its key.
 func (t *layer) get(key string) *valueState {
-	ret, _ := t.getIsLocal(key)
+	ret, _ := t.getContext(context.Background(), key)
 	return ret
 }
 
+// getContext returns the value by its key, giving up if the context
+// is done while waiting for the underlying layers.
+func (t *layer) getContext(ctx context.Context, key string) (*valueState, error) {
+	ret, _, err := t.getIsLocal(ctx, key)
+	return ret, err
+}
+
 // getIsLocal returns a valueState for the key.
 // Second param is true if the value was found locally.
-func (t *layer) getIsLocal(key string) (*valueState, bool) {
+func (t *layer) getIsLocal(ctx context.Context, key string) (*valueState, bool, error) {
+	if t.parentLayer == nil {
+		ret := t.shardFor(key).data[key]
+		return ret, ret != nil, nil
+	}
+
 	// Try to return this layer's data
 	ret := t.data[key]
 	if ret != nil {
-		return ret, true
+		return ret, true, nil
 	}
 
-	// if no underlying layer - return
+	// Then the parent transactions' one
+	if err := t.syncFlat(ctx); err != nil {
+		return nil, false, err
+	}
+	if ret, ok := t.flat.get(key); ok {
+		return ret, false, nil
+	}
+	ret, err := t.rootLayer.lockedGet(ctx, key)
+	return ret, false, err
+}
+
+// lockedGet locks the layer and returns the value by its key.
+func (t *layer) lockedGet(ctx context.Context, key string) (*valueState, error) {
 	if t.parentLayer == nil {
-		return nil, false
+		s := t.shardFor(key)
+		if err := s.mu.LockContext(ctx); err != nil {
+			return nil, err
+		}
+		defer s.mu.Unlock()
+		return s.data[key], nil
+	}
+	if err := t.mu.LockContext(ctx); err != nil {
+		return nil, err
 	}
+	defer t.mu.Unlock()
+	return t.getContext(ctx, key)
+}
 
-	// recurse to underlying
-	return t.parentLayer.get(key), false
+func (t *layer) numEqualTo(value string) uint64 {
+	ret, _ := t.numEqualToContext(context.Background(), value)
+	return ret
 }
 
-func (t *layer) numEqualTo(value string) (ret uint64) {
-	// Try local storage
-	val, ok := t.valueCache[value]
-	if ok {
-		return val
+// numEqualToContext returns the count for the value, giving up if the context
+// is done while waiting for the underlying layers.
+// Root's count is cached in the transaction layer.
+func (t *layer) numEqualToContext(ctx context.Context, value string) (uint64, error) {
+	if t.parentLayer == nil {
+		return t.sumEqualTo(value), nil
+	}
+	if err := t.syncFlat(ctx); err != nil {
+		return 0, err
 	}
 
-	// Nowhere to recurse - return 0
-	if t.parentLayer == nil {
-		return 0
+	count, ok := t.valueCache[value]
+	if !ok {
+		var err error
+		if count, err = t.rootLayer.scanEqualTo(ctx, value); err != nil {
+			return 0, err
+		}
+		t.valueCache[value] = count
 	}
+	return t.countWithDelta(value, count), nil
+}
 
-	// Try to recurse to parentLayer
-	retCount := t.parentLayer.numEqualTo(value)
-	// And cache it
-	t.valueCache[value] = retCount
-	return retCount
+// lockedNumEqualTo locks the layer and returns the count for the value.
+// Root's shards are locked one by one.
+func (t *layer) lockedNumEqualTo(ctx context.Context, value string) (uint64, error) {
+	if t.parentLayer == nil {
+		return t.scanEqualTo(ctx, value)
+	}
+	if err := t.mu.LockContext(ctx); err != nil {
+		return 0, err
+	}
+	defer t.mu.Unlock()
+	return t.numEqualToContext(ctx, value)
 }
 
-// refreshCacheForValue actualizes the valueCache for changed values.
-func (t *layer) refreshCacheForValue(value valueState) {
-	// Initiate the count for current and previous values
-	// from underlying layers first if exists
-	if t.parentLayer != nil {
-		// Init current value
-		if _, ok := t.valueCache[value.Data]; !ok {
-			t.valueCache[value.Data] = t.parentLayer.numEqualTo(value.Data)
+// countEqualTo returns the count for the value without caching it
+// in the layers.
+func (t *layer) countEqualTo(ctx context.Context, value string) (uint64, error) {
+	if t.parentLayer == nil {
+		return t.sumEqualTo(value), nil
+	}
+	if err := t.syncFlat(ctx); err != nil {
+		return 0, err
+	}
+
+	count, ok := t.valueCache[value]
+	if !ok {
+		var err error
+		if count, err = t.rootLayer.lockedCountEqualTo(ctx, value); err != nil {
+			return 0, err
 		}
-		// Init previous value
-		if value.Prev != nil {
-			if _, ok := t.valueCache[value.Prev.Data]; !ok {
-				t.valueCache[value.Prev.Data] = t.parentLayer.numEqualTo(value.Prev.Data)
-			}
+	}
+	return t.countWithDelta(value, count), nil
+}
+
+// lockedCountEqualTo locks the layer and returns the count for the value
+// without caching it in the layers.
+// Root's shards are locked all at once, so the count is consistent.
+func (t *layer) lockedCountEqualTo(ctx context.Context, value string) (uint64, error) {
+	if t.parentLayer == nil {
+		unlock, err := t.lockAllContext(ctx)
+		if err != nil {
+			return 0, err
 		}
+		defer unlock()
+		return t.sumEqualTo(value), nil
+	}
+	if err := t.mu.LockContext(ctx); err != nil {
+		return 0, err
 	}
+	defer t.mu.Unlock()
+	return t.countEqualTo(ctx, value)
+}
 
-	// Decrement previous value's count
-	if value.Prev != nil && !value.Prev.Deleted {
-		t.valueCache[value.Prev.Data]--
+// countWithDelta adds the transactions' delta for the value
+// to the root's count. Root's count may be outdated,
+// so the result is never negative.
+func (t *layer) countWithDelta(value string, count uint64) uint64 {
+	delta, _ := t.counts.get(value)
+	if delta < 0 && uint64(-delta) > count {
+		return 0
 	}
+	return uint64(int64(count) + delta)
+}
 
+// put writes the value replacing the previous one
+// to the transaction layer, counting them.
+func (t *layer) put(key string, prev *valueState, value *valueState) {
+	if prev != nil && !prev.Deleted {
+		t.addDelta(prev.Data, -1)
+	}
 	if !value.Deleted {
-		t.valueCache[value.Data]++
+		t.addDelta(value.Data, 1)
+	}
+	t.data[key] = value
+	t.flat = t.flat.set(key, value)
+
+	if atomic.LoadInt64(&t.openTxs) > 0 {
+		// Views of the transactions over this one are stale now
+		atomic.AddUint64(&t.rootLayer.flatGen, 1)
+	}
+}
+
+// addDelta changes the value's count in the transaction layer.
+func (t *layer) addDelta(value string, delta int64) {
+	if t.deltas[value] += delta; t.deltas[value] == 0 {
+		delete(t.deltas, value)
+	}
+	count, _ := t.counts.get(value)
+	t.counts = t.counts.set(value, count+delta)
+}
+
+// syncFlat rebuilds the transaction layer's flat view over the parent's one
+// if it's stale, giving up if the context is done while waiting
+// for the underlying layers.
+// Caller should hold the layer's lock.
+func (t *layer) syncFlat(ctx context.Context) error {
+	gen := atomic.LoadUint64(&t.rootLayer.flatGen)
+	if t.flatGen == gen {
+		return nil
+	}
+
+	var flat hamt[*valueState]
+	var counts hamt[int64]
+	if parent := t.parentLayer; parent.parentLayer != nil {
+		if err := parent.mu.LockContext(ctx); err != nil {
+			return err
+		}
+		err := parent.syncFlat(ctx)
+		flat, counts = parent.flat, parent.counts
+		parent.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	for key, value := range t.data {
+		flat = flat.set(key, value)
+	}
+	for value, delta := range t.deltas {
+		count, _ := counts.get(value)
+		counts = counts.set(value, count+delta)
 	}
+	t.flat, t.counts, t.flatGen = flat, counts, gen
+	return nil
 }
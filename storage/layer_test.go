@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	. "github.com/smartystreets/goconvey/convey"
 	"testing"
 )
@@ -22,7 +23,8 @@ func TestBasicStorage(t *testing.T) {
 
 			l.set(valKey, value)
 			Convey("getIsLocal should return true", func() {
-				got, isLocal := l.getIsLocal(valKey)
+				got, isLocal, err := l.getIsLocal(context.Background(), valKey)
+				So(err, ShouldBeNil)
 				So(got, ShouldResemble, &value)
 				So(isLocal, ShouldBeTrue)
 			})
@@ -34,6 +36,17 @@ func TestBasicStorage(t *testing.T) {
 			Convey("Deletion", func() {
 				l.unset(valKey)
 
+				Convey("Should forget the value", func() {
+					So(l.get(valKey), ShouldBeNil)
+					So(l.shardFor(valKey).data, ShouldNotContainKey, valKey)
+				})
+
+			})
+
+			Convey("Deletion with open tx", func() {
+				_ = l.tx()
+				l.unset(valKey)
+
 				Convey("Should return deleted value", func() {
 					got := l.get(valKey)
 					So(got.Deleted, ShouldEqual, true)
@@ -80,7 +93,8 @@ func TestBasicStorage(t *testing.T) {
 				})
 			})
 
-			Convey("On deletion", func() {
+			Convey("On deletion with open tx", func() {
+				_ = l.tx()
 				l.unset(valKey)
 				Convey("Get should return linked value with Deleted = true", func() {
 					got := l.get(valKey)
@@ -95,6 +109,29 @@ func TestBasicStorage(t *testing.T) {
 
 				l.set(valKey, value2)
 
+				Convey("Should not link to the old value", func() {
+					got := l.get(valKey)
+					So(got.Data, ShouldEqual, value2.Data)
+					So(got.Prev, ShouldBeNil)
+				})
+
+				Convey("Should modify numEqualTo for mods", func() {
+					So(l.numEqualTo(value.Data), ShouldEqual, uint64(0))
+					So(l.numEqualTo(value2.Data), ShouldEqual, uint64(1))
+				})
+
+				Convey("Should forget zero counts", func() {
+					So(l.shardFor(valKey).valueCache, ShouldNotContainKey, value.Data)
+				})
+			})
+
+			Convey("On value's modification with open tx", func() {
+				_ = l.tx()
+				value2 := value
+				value2.Data = RandString(256)
+
+				l.set(valKey, value2)
+
 				Convey("Should return new value linked to old one", func() {
 					got := l.get(valKey)
 					So(got.Data, ShouldEqual, value2.Data)
@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"context"
+	"sync"
+)
+
+// mutex is a lock that can be waited for until the context is done.
+// Zero value is an unlocked mutex.
+type mutex struct {
+	sync.Mutex
+}
+
+// LockContext locks the mutex or returns the context's error
+// if the context is done first. The error is returned as is,
+// so it's comparable to context.Canceled and context.DeadlineExceeded.
+func (m *mutex) LockContext(ctx context.Context) error {
+	if m.TryLock() {
+		return nil
+	}
+	if ctx.Done() == nil {
+		// Context can't be done
+		m.Lock()
+		return nil
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		m.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		// Release the lock once the waiter gets it
+		go func() {
+			<-locked
+			m.Unlock()
+		}()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/ansel1/merry"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestMutex(t *testing.T) {
+	Convey("With locked mutex", t, func() {
+		var m mutex
+		m.Lock()
+
+		Convey("LockContext should give up once the context is done", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			err := m.LockContext(ctx)
+			So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+			So(merry.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+
+			Convey("Abandoned wait should not keep the mutex", func() {
+				m.Unlock()
+				So(m.LockContext(context.Background()), ShouldBeNil)
+			})
+		})
+
+		Convey("LockContext should wait for unlock", func() {
+			time.AfterFunc(10*time.Millisecond, m.Unlock)
+			So(m.LockContext(context.Background()), ShouldBeNil)
+		})
+	})
+}
@@ -1,13 +1,29 @@
 package storage
 
+import (
+	"context"
+)
+
 // New creates new storage instance.
-func New() DB {
+func New() Root {
 	return newLayer()
 }
 
+// NewSharded creates new storage instance with root's variables
+// split into the number of shards, each one with its own lock.
+// New uses 32 shards.
+func NewSharded(shards int) Root {
+	return newShardedLayer(shards)
+}
+
 // Commit implements DB interface.
 func (t *layer) Commit() (DB, error) {
-	return t.commitRecurse(false)
+	return t.CommitContext(context.Background())
+}
+
+// CommitContext implements ContextDB interface.
+func (t *layer) CommitContext(ctx context.Context) (DB, error) {
+	return t.commitRecurse(ctx, false)
 }
 
 // Rollback implements DB interface.
@@ -15,9 +31,37 @@ func (t *layer) Rollback() (DB, error) {
 	return t.rollback()
 }
 
+// Savepoint implements DB interface.
+func (t *layer) Savepoint(name string) (DB, error) {
+	return t.savepoint(name)
+}
+
+// RollbackTo implements DB interface.
+func (t *layer) RollbackTo(name string) (DB, error) {
+	return t.rollbackTo(name)
+}
+
+// Release implements DB interface.
+func (t *layer) Release(name string) (DB, error) {
+	return t.ReleaseContext(context.Background(), name)
+}
+
+// ReleaseContext implements ContextDB interface.
+func (t *layer) ReleaseContext(ctx context.Context, name string) (DB, error) {
+	return t.release(ctx, name)
+}
+
 // Get implements Reader interface.
 func (t *layer) Get(key string) (string, error) {
-	ret := t.get(key)
+	return t.GetContext(context.Background(), key)
+}
+
+// GetContext implements ContextReader interface.
+func (t *layer) GetContext(ctx context.Context, key string) (string, error) {
+	ret, err := t.lockedGet(ctx, key)
+	if err != nil {
+		return ``, err
+	}
 	if ret == nil || ret.Deleted {
 		return ``, ErrNotFound.Here()
 	}
@@ -26,20 +70,65 @@ func (t *layer) Get(key string) (string, error) {
 
 // NumEqualTo implements Reader interface.
 func (t *layer) NumEqualTo(value string) uint64 {
-	return t.numEqualTo(value)
+	ret, _ := t.NumEqualToContext(context.Background(), value)
+	return ret
+}
+
+// NumEqualToContext implements ContextReader interface.
+func (t *layer) NumEqualToContext(ctx context.Context, value string) (uint64, error) {
+	if t.parentLayer == nil {
+		return t.lockedCountEqualTo(ctx, value)
+	}
+	return t.lockedNumEqualTo(ctx, value)
 }
 
 // Set implements Writer interface.
 func (t *layer) Set(key, value string) {
-	t.set(key, valueState{Data: value})
+	_ = t.SetContext(context.Background(), key, value)
+}
+
+// SetContext implements ContextWriter interface.
+func (t *layer) SetContext(ctx context.Context, key, value string) error {
+	if t.parentLayer == nil {
+		return t.update(ctx, []Change{{Key: key, Value: value}})
+	}
+	if err := t.mu.LockContext(ctx); err != nil {
+		return err
+	}
+	defer t.mu.Unlock()
+	return t.setContext(ctx, key, valueState{Data: value})
 }
 
 // Unset implements Writer interface.
 func (t *layer) Unset(key string) {
-	t.unset(key)
+	_ = t.UnsetContext(context.Background(), key)
+}
+
+// UnsetContext implements ContextWriter interface.
+func (t *layer) UnsetContext(ctx context.Context, key string) error {
+	if t.parentLayer == nil {
+		return t.update(ctx, []Change{{Key: key, Deleted: true}})
+	}
+	if err := t.mu.LockContext(ctx); err != nil {
+		return err
+	}
+	defer t.mu.Unlock()
+	return t.unsetContext(ctx, key)
 }
 
 // Tx implements DB interface.
 func (t *layer) Tx() DB {
 	return t.tx()
 }
+
+// ReadTx implements DB interface.
+func (t *layer) ReadTx() ReadOnlyTx {
+	return t.readTx()
+}
+
+// Flush implements Root interface.
+func (t *layer) Flush() {
+	unlock := t.lockAll()
+	defer unlock()
+	t.replace(nil)
+}
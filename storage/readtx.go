@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// readLayer is a read-only transaction over the layer.
+//
+// It reads the database as it was when the transaction was opened:
+// the parent transactions' changes are taken from the parent's flat view
+// at that time, which is never changed, and the root's shards keep
+// the values replaced since then for the transaction until it's closed.
+// The replaced values are kept by the transaction itself,
+// so it doesn't need the root's history and isn't counted
+// as an open transaction.
+// It doesn't cache anything in the parent layers.
+type readLayer struct {
+	root *layer
+	// flat are the parent transactions' changes.
+	flat hamt[*valueState]
+
+	// isClosed is 1 once the transaction is closed.
+	// It is accessed atomically.
+	isClosed int32
+}
+
+// readTx opens the read-only transaction over the layer.
+// Root's shards are locked all at once, so the view is consistent.
+func (t *layer) readTx() *readLayer {
+	ret := &readLayer{root: t.root()}
+	if t.parentLayer != nil {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		_ = t.syncFlat(context.Background())
+		ret.flat = t.flat
+	}
+
+	unlock := ret.root.lockAll()
+	defer unlock()
+	for _, s := range ret.root.shards {
+		s.snapshots[ret] = map[string]*valueState{}
+	}
+	return ret
+}
+
+// Close implements ReadOnlyTx interface.
+func (t *readLayer) Close() {
+	if !atomic.CompareAndSwapInt32(&t.isClosed, 0, 1) {
+		return
+	}
+	unlock := t.root.lockAll()
+	defer unlock()
+	for _, s := range t.root.shards {
+		delete(s.snapshots, t)
+	}
+}
+
+// snapshot returns the key's value as it was when the transaction was opened.
+// Caller should hold the lock of the key's shard.
+func (t *readLayer) snapshot(key string) *valueState {
+	if ret, ok := t.flat.get(key); ok {
+		return ret
+	}
+	s := t.root.shardFor(key)
+	if ret, ok := s.snapshots[t][key]; ok {
+		return ret
+	}
+	return s.data[key]
+}
+
+// view calls the func with the root and the changes over it since
+// the transaction was opened: the parent transactions' ones
+// and the root's replaced values, holding the locks of all the root's shards.
+// ErrTxClosed is returned if the transaction is closed.
+func (t *readLayer) view(ctx context.Context, f func(root *layer, changes map[string]*valueState)) error {
+	unlock, err := t.root.lockAllContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if atomic.LoadInt32(&t.isClosed) != 0 {
+		return ErrTxClosed.Here()
+	}
+
+	changes := map[string]*valueState{}
+	for _, s := range t.root.shards {
+		for key, value := range s.snapshots[t] {
+			if value == nil {
+				value = &valueState{Deleted: true}
+			}
+			changes[key] = value
+		}
+	}
+	t.flat.each(func(key string, value *valueState) {
+		changes[key] = value
+	})
+	f(t.root, changes)
+	return nil
+}
+
+// Get implements Reader interface.
+func (t *readLayer) Get(key string) (string, error) {
+	return t.GetContext(context.Background(), key)
+}
+
+// GetContext implements ContextReader interface.
+func (t *readLayer) GetContext(ctx context.Context, key string) (string, error) {
+	s := t.root.shardFor(key)
+	if err := s.mu.LockContext(ctx); err != nil {
+		return ``, err
+	}
+	defer s.mu.Unlock()
+	if atomic.LoadInt32(&t.isClosed) != 0 {
+		return ``, ErrTxClosed.Here()
+	}
+
+	ret := t.snapshot(key)
+	if ret == nil || ret.Deleted {
+		return ``, ErrNotFound.Here()
+	}
+	return ret.Data, nil
+}
+
+// NumEqualTo implements Reader interface.
+func (t *readLayer) NumEqualTo(value string) uint64 {
+	ret, _ := t.NumEqualToContext(context.Background(), value)
+	return ret
+}
+
+// NumEqualToContext implements ContextReader interface.
+func (t *readLayer) NumEqualToContext(ctx context.Context, value string) (uint64, error) {
+	var ret int64
+	err := t.view(ctx, func(root *layer, changes map[string]*valueState) {
+		ret = int64(root.sumEqualTo(value))
+		root.overlay(changes, func(_, was string, wasOk bool, is string, isOk bool) {
+			ret += countDelta(wasOk && was == value, isOk && is == value)
+		})
+	})
+	return uint64(ret), err
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"context"
+	"github.com/ansel1/merry"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestReadTransactions(t *testing.T) {
+	Convey("With layer, tx and value", t, func() {
+		l := newLayer()
+		key := RandString(16)
+		value := RandString(64)
+		l.Set(key, value)
+
+		tx := l.tx()
+		rtx := tx.readTx()
+
+		Convey("Should read parent's values", func() {
+			got, err := rtx.Get(key)
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, value)
+			So(rtx.NumEqualTo(value), ShouldEqual, uint64(1))
+		})
+
+		Convey("Should see parent tx's changes made before it was opened", func() {
+			tx.Unset(key)
+			rtx := tx.readTx()
+			_, err := rtx.Get(key)
+			So(merry.Is(err, ErrNotFound), ShouldBeTrue)
+			So(rtx.NumEqualTo(value), ShouldEqual, uint64(0))
+		})
+
+		Convey("Should not see the changes made after it was opened", func() {
+			tx.Set("new", value)
+			tx.Unset(key)
+			_, err := rtx.Get(key)
+			So(err, ShouldBeNil)
+			_, err = rtx.Get("new")
+			So(merry.Is(err, ErrNotFound), ShouldBeTrue)
+			So(rtx.NumEqualTo(value), ShouldEqual, uint64(1))
+		})
+
+		Convey("Should not see other sessions' commits", func() {
+			other := l.tx()
+			other.Set(key, "changed")
+			other.Set("new", value)
+			_, err := other.Commit()
+			So(err, ShouldBeNil)
+			So(l.NumEqualTo(value), ShouldEqual, uint64(1))
+
+			got, err := rtx.Get(key)
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, value)
+			_, err = rtx.Get("new")
+			So(merry.Is(err, ErrNotFound), ShouldBeTrue)
+			So(rtx.NumEqualTo(value), ShouldEqual, uint64(1))
+			So(rtx.NumEqualTo("changed"), ShouldEqual, uint64(0))
+			So(rtx.CountRange(value, value), ShouldEqual, uint64(1))
+			So(rtx.DistinctValues(), ShouldEqual, uint64(1))
+			So(rtx.KeysWithValue(value).Slice(), ShouldResemble, []string{key})
+		})
+
+		Convey("Should keep the values whose history was collected", func() {
+			rootTx := l.readTx()
+			tx.Rollback()
+			l.Unset(key)
+			So(l.shardFor(key).data, ShouldNotContainKey, key)
+
+			got, err := rootTx.Get(key)
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, value)
+			So(rootTx.NumEqualTo(value), ShouldEqual, uint64(1))
+		})
+
+		Convey("Should not see the restored snapshot", func() {
+			rootTx := l.readTx()
+			l.Restore(Snapshot{Values: map[string]string{"new": value}})
+			_, err := rootTx.Get(key)
+			So(err, ShouldBeNil)
+			_, err = rootTx.Get("new")
+			So(merry.Is(err, ErrNotFound), ShouldBeTrue)
+			So(rootTx.NumEqualTo(value), ShouldEqual, uint64(1))
+		})
+
+		Convey("Close should release the kept values", func() {
+			l.Set(key, "changed")
+			So(l.shardFor(key).snapshots[rtx], ShouldContainKey, key)
+			rtx.Close()
+			rtx.Close()
+			for _, s := range l.shards {
+				So(s.snapshots, ShouldBeEmpty)
+			}
+			_, err := rtx.Get(key)
+			So(merry.Is(err, ErrTxClosed), ShouldBeTrue)
+			_, err = rtx.NumEqualToContext(context.Background(), value)
+			So(merry.Is(err, ErrTxClosed), ShouldBeTrue)
+		})
+
+		Convey("NumEqualTo should not write to parents' caches", func() {
+			So(rtx.NumEqualTo(value), ShouldEqual, uint64(1))
+			So(rtx.NumEqualTo(RandString(64)), ShouldEqual, uint64(0))
+			So(tx.valueCache, ShouldBeEmpty)
+		})
+
+		Convey("Should not be counted as open tx", func() {
+			So(tx.openTxs, ShouldEqual, 0)
+			So(l.openTxs, ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+)
+
+// Registry keeps the named databases, each one with its own root.
+// Databases are created on first use, up to Config's MaxDatabases
+// of them by Open.
+// It is safe for concurrent use.
+type Registry struct {
+	mu  sync.Mutex
+	dbs map[string]*layer
+	// cfg configures the databases.
+	cfg Config
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return NewRegistryConfig(Config{})
+}
+
+// NewRegistryConfig creates an empty Registry
+// of the databases configured by the config.
+func NewRegistryConfig(cfg Config) *Registry {
+	return &Registry{dbs: map[string]*layer{}, cfg: cfg}
+}
+
+// Get returns the database by its name, creating it if needed
+// regardless of Config's MaxDatabases, e.g. for the server's own databases.
+// Open should be used for the names given by the clients.
+func (r *Registry) Get(name string) Root {
+	ret, _ := r.open(name, false)
+	return ret
+}
+
+// Open returns the database by its name, creating it if needed.
+// ErrTooManyDatabases is returned if there are Config's MaxDatabases
+// databases already.
+func (r *Registry) Open(name string) (Root, error) {
+	ret, err := r.open(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (r *Registry) get(name string) *layer {
+	ret, _ := r.open(name, false)
+	return ret
+}
+
+// open returns the database, creating it if needed;
+// if limit is true, up to Config's MaxDatabases of them.
+func (r *Registry) open(name string, limit bool) (*layer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ret, ok := r.dbs[name]; ok {
+		return ret, nil
+	}
+	max := r.cfg.MaxDatabases
+	if max == 0 {
+		max = DefaultMaxDatabases
+	}
+	if limit && len(r.dbs) >= max {
+		return nil, ErrTooManyDatabases.Here().Append(name)
+	}
+	ret := newConfigLayer(r.cfg)
+	r.dbs[name] = ret
+	return ret, nil
+}
+
+// SetRetention sets the history's retention of every database,
+// including the ones created later.
+func (r *Registry) SetRetention(retention Retention) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cfg.Retention = retention
+	for _, db := range r.dbs {
+		db.SetRetention(retention)
+	}
+}
+
+// Names returns the sorted names of the databases.
+func (r *Registry) Names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ret := make([]string, 0, len(r.dbs))
+	for name := range r.dbs {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Swap atomically swaps the variables of the databases.
+// Every database is changed in a single change set; the roots are kept,
+// so the transactions stay tied to the databases they started in
+// and conflict on commit if they touched the swapped variables.
+func (r *Registry) Swap(a, b string) {
+	if a == b {
+		return
+	}
+	// Lock the roots in the same order to avoid deadlocks
+	if b < a {
+		a, b = b, a
+	}
+	first, second := r.get(a), r.get(b)
+	unlockFirst := first.lockAll()
+	defer unlockFirst()
+	unlockSecond := second.lockAll()
+	defer unlockSecond()
+
+	firstValues := first.values()
+	first.replace(second.values())
+	second.replace(firstValues)
+}
+
+// FlushAll flushes every database.
+func (r *Registry) FlushAll() {
+	for _, name := range r.Names() {
+		r.get(name).Flush()
+	}
+}
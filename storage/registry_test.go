@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"github.com/ansel1/merry"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	Convey("With registry", t, func() {
+		r := NewRegistry()
+		db0, db1 := r.Get("0"), r.Get("1")
+		db0.Set("a", "10")
+		db0.Set("b", "10")
+		db1.Set("a", "20")
+
+		Convey("Databases should be created once and isolated", func() {
+			So(r.Get("0"), ShouldEqual, db0)
+			So(r.Names(), ShouldResemble, []string{"0", "1"})
+			got, err := db1.Get("a")
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, "20")
+			_, err = db1.Get("b")
+			So(merry.Is(err, ErrNotFound), ShouldBeTrue)
+		})
+
+		Convey("Open should create up to MaxDatabases", func() {
+			r := NewRegistryConfig(Config{MaxDatabases: 2})
+			db0 := r.Get("0")
+			got, err := r.Open("0")
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, db0)
+			_, err = r.Open("1")
+			So(err, ShouldBeNil)
+			_, err = r.Open("2")
+			So(merry.Is(err, ErrTooManyDatabases), ShouldBeTrue)
+			So(r.Names(), ShouldResemble, []string{"0", "1"})
+
+			Convey("Default limit should apply", func() {
+				r := NewRegistry()
+				for i := 0; i < DefaultMaxDatabases; i++ {
+					_, err := r.Open(string(rune('a' + i)))
+					So(err, ShouldBeNil)
+				}
+				_, err := r.Open("new")
+				So(merry.Is(err, ErrTooManyDatabases), ShouldBeTrue)
+			})
+		})
+
+		Convey("Swap should swap the variables", func() {
+			r.Swap("1", "0")
+			So(db0.Snapshot().Values, ShouldResemble, map[string]string{"a": "20"})
+			So(db1.Snapshot().Values, ShouldResemble, map[string]string{"a": "10", "b": "10"})
+			So(db0.NumEqualTo("10"), ShouldEqual, 0)
+			So(db1.NumEqualTo("10"), ShouldEqual, 2)
+
+			Convey("Swap with itself should change nothing", func() {
+				r.Swap("1", "1")
+				So(db1.Snapshot().Values, ShouldResemble, map[string]string{"a": "10", "b": "10"})
+			})
+		})
+
+		Convey("Transactions should stay tied to their databases", func() {
+			touched := db0.Tx()
+			touched.Set("a", "30")
+			untouched := db0.Tx()
+			untouched.Set("c", "30")
+			r.Swap("0", "1")
+
+			_, err := touched.Commit()
+			So(merry.Is(err, ErrTxConflict), ShouldBeTrue)
+			_, err = untouched.Commit()
+			So(err, ShouldBeNil)
+			So(db0.Snapshot().Values, ShouldResemble, map[string]string{"a": "20", "c": "30"})
+		})
+
+		Convey("Swap should publish a change set per database", func() {
+			var got []ChangeSet
+			db0.OnCommit(func(cs ChangeSet) { got = append(got, cs) })
+			r.Swap("0", "1")
+			So(got, ShouldHaveLength, 1)
+			So(got[0].Changes, ShouldHaveLength, 2)
+		})
+
+		Convey("Flush should unset all the variables", func() {
+			var got []ChangeSet
+			db0.OnCommit(func(cs ChangeSet) { got = append(got, cs) })
+			tx := db0.Tx()
+			tx.Set("b", "30")
+
+			db0.Flush()
+			So(db0.Snapshot().Values, ShouldBeEmpty)
+			So(db0.NumEqualTo("10"), ShouldEqual, 0)
+			So(got, ShouldHaveLength, 1)
+			So(got[0].Changes, ShouldHaveLength, 2)
+			_, err := tx.Commit()
+			So(merry.Is(err, ErrTxConflict), ShouldBeTrue)
+
+			So(db1.Snapshot().Values, ShouldResemble, map[string]string{"a": "20"})
+		})
+
+		Convey("FlushAll should flush every database", func() {
+			r.FlushAll()
+			So(db0.Snapshot().Values, ShouldBeEmpty)
+			So(db1.Snapshot().Values, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"context"
+)
+
+// Savepoints are transaction layers marked with the name.
+// They are nested the same way transactions are,
+// so savepoint's changes are layered over the changes
+// made before it. Savepoints belong to the transaction they were
+// created in: transactions nested in it don't see them.
+
+// savepoint creates a named savepoint over the transaction.
+func (t *layer) savepoint(name string) (*layer, error) {
+	if t.parentLayer == nil {
+		return t, ErrNoTransaction.Here()
+	}
+	if t.isClosed {
+		return t, ErrTxClosed.Here()
+	}
+	ret := t.tx()
+	ret.isSavepoint = true
+	ret.savepointName = name
+	return ret, nil
+}
+
+// findSavepoint returns the most recent savepoint of the current
+// transaction by its name or nil if not found.
+// The savepoints of the outer transactions are not found,
+// so nested transactions are never committed or closed by them.
+func (t *layer) findSavepoint(name string) *layer {
+	for l := t; l.isSavepoint; l = l.parentLayer {
+		if l.isSavepoint && l.savepointName == name {
+			return l
+		}
+	}
+	return nil
+}
+
+// rollbackTo forgets the changes made since the savepoint,
+// returning the savepoint created anew.
+func (t *layer) rollbackTo(name string) (*layer, error) {
+	sp, err := t.lookupSavepoint(name)
+	if err != nil {
+		return t, err
+	}
+
+	for l := t; l != sp.parentLayer; l = l.parentLayer {
+		l.close()
+	}
+	return sp.parentLayer.savepoint(name)
+}
+
+// release forgets the savepoint, keeping the changes made since it.
+// If the context is done while waiting for the locks, the layer
+// that is still open is returned with the context's error.
+func (t *layer) release(ctx context.Context, name string) (*layer, error) {
+	sp, err := t.lookupSavepoint(name)
+	if err != nil {
+		return t, err
+	}
+
+	for l := t; l != sp.parentLayer; l = l.parentLayer {
+		if err = l.commitToParent(ctx); err != nil {
+			if !l.isClosed {
+				return l, err
+			}
+			return l.parentLayer, err
+		}
+	}
+	return sp.parentLayer, nil
+}
+
+// lookupSavepoint returns the savepoint by its name or
+// an error if there's no such savepoint.
+func (t *layer) lookupSavepoint(name string) (*layer, error) {
+	if t.parentLayer == nil {
+		return nil, ErrNoTransaction.Here()
+	}
+	if t.isClosed {
+		return nil, ErrTxClosed.Here()
+	}
+	sp := t.findSavepoint(name)
+	if sp == nil {
+		return nil, ErrNoSavepoint.Here()
+	}
+	return sp, nil
+}
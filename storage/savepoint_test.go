@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"context"
+	"github.com/ansel1/merry"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestSavepoints(t *testing.T) {
+	Convey("With layer and value", t, func() {
+		l := newLayer()
+		key := RandString(16)
+		value := RandString(64)
+		l.Set(key, value)
+
+		Convey("Savepoint should fail outside of tx", func() {
+			got, err := l.savepoint("sp")
+			So(merry.Is(err, ErrNoTransaction), ShouldBeTrue)
+			So(got, ShouldEqual, l)
+		})
+
+		Convey("With tx and savepoint", func() {
+			tx := l.tx()
+			tx.Set(key, "tx")
+			sp, err := tx.savepoint("sp")
+			So(err, ShouldBeNil)
+			sp.Set(key, "sp")
+
+			Convey("Unknown savepoint should fail", func() {
+				got, err := sp.rollbackTo("unknown")
+				So(merry.Is(err, ErrNoSavepoint), ShouldBeTrue)
+				So(got, ShouldEqual, sp)
+				_, err = sp.release(context.Background(), "unknown")
+				So(merry.Is(err, ErrNoSavepoint), ShouldBeTrue)
+			})
+
+			Convey("RollbackTo should forget the changes since savepoint", func() {
+				got, err := sp.rollbackTo("sp")
+				So(err, ShouldBeNil)
+				So(got.isSavepoint, ShouldBeTrue)
+				So(got.parentLayer, ShouldEqual, tx)
+				So(got.get(key).Data, ShouldEqual, "tx")
+				So(got.numEqualTo("sp"), ShouldEqual, uint64(0))
+
+				Convey("Savepoint should be kept", func() {
+					got.Set(key, "sp2")
+					got, err = got.rollbackTo("sp")
+					So(err, ShouldBeNil)
+					So(got.get(key).Data, ShouldEqual, "tx")
+				})
+			})
+
+			Convey("Nested transactions should not see the savepoint", func() {
+				tx2 := sp.tx()
+				tx2.Set(key, "tx2")
+				sp2, err := tx2.savepoint("sp2")
+				So(err, ShouldBeNil)
+
+				got, err := sp2.rollbackTo("sp")
+				So(merry.Is(err, ErrNoSavepoint), ShouldBeTrue)
+				So(got, ShouldEqual, sp2)
+				got, err = sp2.release(context.Background(), "sp")
+				So(merry.Is(err, ErrNoSavepoint), ShouldBeTrue)
+				So(got, ShouldEqual, sp2)
+				So(tx2.isClosed, ShouldBeFalse)
+				So(sp.get(key).Data, ShouldEqual, "sp")
+
+				Convey("Savepoint should be found once they're closed", func() {
+					got, err := sp2.rollback()
+					So(err, ShouldBeNil)
+					got, err = got.rollbackTo("sp")
+					So(err, ShouldBeNil)
+					So(got.get(key).Data, ShouldEqual, "tx")
+				})
+			})
+
+			Convey("Release should keep the changes", func() {
+				got, err := sp.release(context.Background(), "sp")
+				So(err, ShouldBeNil)
+				So(got, ShouldEqual, tx)
+				So(tx.get(key).Data, ShouldEqual, "sp")
+				So(tx.numEqualTo("sp"), ShouldEqual, uint64(1))
+				So(l.get(key).Data, ShouldEqual, value)
+			})
+
+			Convey("Rollback should close the whole transaction block", func() {
+				sp2, err := sp.savepoint("sp2")
+				So(err, ShouldBeNil)
+				got, err := sp2.rollback()
+				So(err, ShouldBeNil)
+				So(got, ShouldEqual, l)
+				So(l.openTxs, ShouldEqual, 0)
+			})
+
+			Convey("Commit should commit the savepoints", func() {
+				got, err := sp.commitRecurse(context.Background(), false)
+				So(err, ShouldBeNil)
+				So(got, ShouldEqual, l)
+				So(l.get(key).Data, ShouldEqual, "sp")
+			})
+		})
+	})
+}
@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Root layer's variables are split into shards by the keys' hash,
+// so the writes to different keys don't contend for a single lock.
+// Every shard has its own lock, values and partial value counts.
+//
+// Operations touching several shards lock them in the order of
+// their indexes, then the root's mu guarding the journal, so the locks
+// are always taken in the same order and the change sets are atomic.
+
+// defaultShards is the number of the root's shards created by New.
+const defaultShards = 32
+
+// shard is a part of the root layer's variables.
+// Its mu guards the contents.
+type shard struct {
+	// data stores the values.
+	data map[string]*valueState
+	// valueCache keeps count for each unique value in the shard.
+	valueCache map[string]uint64
+	// byValue indexes the keys by their values.
+	byValue keyIndex
+	// indexes are the user-defined indexes by their names.
+	indexes map[string]*userIndex
+	// history keeps the keys whose history should be collected
+	// once there are no open transactions.
+	history map[string]struct{}
+	// versions keep the variables' history within the root's retention.
+	versions map[string][]Version
+	// expiries queue the versions in the order they were written,
+	// if the retention limits their age.
+	expiries []expiry
+	// stats are the aggregates over the shard's values.
+	stats *valueStats
+	// numbers keep the shard's numeric values in the order of their keys.
+	numbers *treap[string]
+	// deadlines are the expiration times of the variables set by Expire.
+	deadlines map[string]time.Time
+	// used is the number of bytes taken by the keys and values
+	// of the variables set. It is written under the mu and read atomically.
+	used int64
+	// snapshots keep the values replaced since the read-only transactions
+	// were opened, nil for the absent ones.
+	snapshots map[*readLayer]map[string]*valueState
+
+	mu mutex
+}
+
+func newShard() *shard {
+	return &shard{
+		data:       map[string]*valueState{},
+		valueCache: map[string]uint64{},
+		byValue:    keyIndex{},
+		indexes:    map[string]*userIndex{},
+		history:    map[string]struct{}{},
+		versions:   map[string][]Version{},
+		stats:      newValueStats(),
+		numbers:    newKeyTreap(),
+		deadlines:  map[string]time.Time{},
+		snapshots:  map[*readLayer]map[string]*valueState{},
+	}
+}
+
+// newShardedLayer creates the root layer with the number of shards.
+func newShardedLayer(shards int) *layer {
+	if shards < 1 {
+		shards = 1
+	}
+	ret := &layer{shards: make([]*shard, shards), now: time.Now, flatGen: 1}
+	for i := range ret.shards {
+		ret.shards[i] = newShard()
+	}
+	return ret
+}
+
+// set sets the value, dropping its history if nobody can observe it.
+// Returns true if the history was kept.
+func (s *shard) set(key string, value valueState, collectable bool) bool {
+	prev := s.data[key]
+	s.remember(key)
+	value.Prev = prev
+	// Crop unneeded leaves, save memory
+	if prev != nil && prev.Prev != nil {
+		value.Prev = prev.Prev
+	}
+	s.data[key] = &value
+	delete(s.deadlines, key)
+
+	s.aggregate(key, prev, &value)
+	if prev != nil && !prev.Deleted {
+		atomic.AddInt64(&s.used, -int64(len(key)+len(prev.Data)))
+		s.valueCache[prev.Data]--
+		s.collectCount(prev.Data)
+		s.unindex(key, prev.Data)
+	}
+	if !value.Deleted {
+		atomic.AddInt64(&s.used, int64(len(key)+len(value.Data)))
+		s.valueCache[value.Data]++
+		s.index(key, value.Data)
+	}
+	return s.collectKey(key, collectable)
+}
+
+// remember keeps the key's current value for the read-only transactions
+// that don't keep one yet.
+func (s *shard) remember(key string) {
+	for _, replaced := range s.snapshots {
+		if _, ok := replaced[key]; !ok {
+			replaced[key] = s.data[key]
+		}
+	}
+}
+
+// setShard sets the root layer's value in the key's shard.
+func (t *layer) setShard(key string, value valueState) {
+	if t.shardFor(key).set(key, value, t.isCollectable()) {
+		atomic.StoreInt32(&t.hasHistory, 1)
+	}
+}
+
+// shardIndex returns the index of the key's shard.
+func (t *layer) shardIndex(key string) int {
+	// FNV-1a
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return int(hash % uint32(len(t.shards)))
+}
+
+// shardFor returns the key's shard.
+func (t *layer) shardFor(key string) *shard {
+	return t.shards[t.shardIndex(key)]
+}
+
+// lockShards locks the shards of the changed keys in the order
+// of their indexes and returns the func unlocking them.
+// Nothing is left locked if the context is done first.
+func (t *layer) lockShards(ctx context.Context, changes []Change) (func(), error) {
+	if len(changes) == 1 {
+		s := t.shardFor(changes[0].Key)
+		if err := s.mu.LockContext(ctx); err != nil {
+			return nil, err
+		}
+		return s.mu.Unlock, nil
+	}
+	locked := make([]bool, len(t.shards))
+	for _, change := range changes {
+		locked[t.shardIndex(change.Key)] = true
+	}
+	return t.lockIndexes(ctx, locked)
+}
+
+// lockAll locks every shard and returns the func unlocking them.
+func (t *layer) lockAll() func() {
+	ret, _ := t.lockAllContext(context.Background())
+	return ret
+}
+
+// lockAllContext locks every shard and returns the func unlocking them.
+// Nothing is left locked if the context is done first.
+func (t *layer) lockAllContext(ctx context.Context) (func(), error) {
+	locked := make([]bool, len(t.shards))
+	for i := range locked {
+		locked[i] = true
+	}
+	return t.lockIndexes(ctx, locked)
+}
+
+func (t *layer) lockIndexes(ctx context.Context, locked []bool) (func(), error) {
+	unlock := func(n int) {
+		for i, ok := range locked[:n] {
+			if ok {
+				t.shards[i].mu.Unlock()
+			}
+		}
+	}
+	for i, ok := range locked {
+		if !ok {
+			continue
+		}
+		if err := t.shards[i].mu.LockContext(ctx); err != nil {
+			unlock(i)
+			return nil, err
+		}
+	}
+	return func() { unlock(len(locked)) }, nil
+}
+
+// sumEqualTo sums the counts for the value across the shards.
+// Caller should hold the locks of all the shards.
+func (t *layer) sumEqualTo(value string) (ret uint64) {
+	for _, s := range t.shards {
+		ret += s.valueCache[value]
+	}
+	return ret
+}
+
+// scanEqualTo sums the counts for the value across the shards,
+// locking them one by one. Unlike sumEqualTo, it doesn't stop the writes
+// to the whole root, but may observe a change set applied partially.
+// Transactions cache the counts this way: they don't observe the root
+// at a single point in time anyway.
+func (t *layer) scanEqualTo(ctx context.Context, value string) (ret uint64, err error) {
+	for _, s := range t.shards {
+		if err = s.mu.LockContext(ctx); err != nil {
+			return 0, err
+		}
+		ret += s.valueCache[value]
+		s.mu.Unlock()
+	}
+	return ret, nil
+}
+
+// update applies the changes to the root layer as a single change set.
+func (t *layer) update(ctx context.Context, changes []Change) error {
+	unlock, err := t.lockShards(ctx, changes)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	t.apply(changes)
+	return nil
+}
+
+// apply writes the changes to the root layer, publishes them
+// and keeps their history.
+// Caller should hold the locks of the changed keys' shards.
+func (t *layer) apply(changes []Change) {
+	t.write(changes)
+	t.record(t.publish(changes), changes)
+}
+
+// write applies the changes to the root layer.
+// Caller should hold the locks of the changed keys' shards.
+func (t *layer) write(changes []Change) {
+	for _, change := range changes {
+		if change.Deleted {
+			t.unset(change.Key)
+		} else {
+			t.set(change.Key, valueState{Data: change.Value})
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/ansel1/merry"
+	. "github.com/smartystreets/goconvey/convey"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShards(t *testing.T) {
+	Convey("With sharded root", t, func() {
+		l := newLayer()
+
+		Convey("Keys should be spread across the shards", func() {
+			for i := 0; i < 1000; i++ {
+				l.Set(RandString(16), "v")
+			}
+			for _, s := range l.shards {
+				So(s.data, ShouldNotBeEmpty)
+			}
+
+			Convey("NumEqualTo should sum the shards' counts", func() {
+				So(l.NumEqualTo("v"), ShouldEqual, uint64(1000))
+				tx := l.tx()
+				So(tx.numEqualTo("v"), ShouldEqual, uint64(1000))
+				So(tx.ReadTx().NumEqualTo("v"), ShouldEqual, uint64(1000))
+			})
+		})
+
+		Convey("Single shard should work the same", func() {
+			l := newShardedLayer(0)
+			So(len(l.shards), ShouldEqual, 1)
+			l.Set("a", "10")
+			l.Set("b", "10")
+			So(l.NumEqualTo("10"), ShouldEqual, uint64(2))
+		})
+
+		Convey("Root should give up waiting for the shard's lock", func() {
+			l.Set("a", "10")
+			s := l.shardFor("a")
+			s.mu.Lock()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			_, getErr := l.GetContext(ctx, "a")
+			setErr := l.SetContext(ctx, "a", "20")
+			_, countErr := l.NumEqualToContext(ctx, "10")
+			s.mu.Unlock()
+			for _, err := range []error{getErr, setErr, countErr} {
+				So(merry.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+			}
+			So(l.Seq(), ShouldEqual, uint64(1))
+			So(l.NumEqualTo("10"), ShouldEqual, uint64(1))
+			for _, s := range l.shards {
+				So(s.mu.TryLock(), ShouldBeTrue)
+				s.mu.Unlock()
+			}
+		})
+
+		Convey("Commits touching several shards should be atomic", func() {
+			a, b := "a", "b"
+			for l.shardIndex(a) == l.shardIndex(b) {
+				b += "b"
+			}
+			l.Set(a, "0")
+			l.Set(b, "0")
+
+			const writers, commits = 4, 500
+			var wg sync.WaitGroup
+			for w := 0; w < writers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < commits; i++ {
+						value := strconv.Itoa(w*commits + i)
+						tx := l.Tx()
+						tx.Set(a, value)
+						tx.Set(b, value)
+						if _, err := tx.Commit(); err != nil && !merry.Is(err, ErrTxConflict) {
+							panic(err)
+						}
+					}
+				}(w)
+			}
+
+			done := make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(done)
+			}()
+			for {
+				select {
+				case <-done:
+					snap := l.Snapshot()
+					So(snap.Values[a], ShouldEqual, snap.Values[b])
+					So(l.NumEqualTo(snap.Values[a]), ShouldEqual, uint64(2))
+					return
+				default:
+				}
+				snap := l.Snapshot()
+				So(snap.Values[a], ShouldEqual, snap.Values[b])
+				So(l.NumEqualTo(snap.Values[a]), ShouldBeIn, []uint64{0, 2})
+			}
+		})
+	})
+}
+
+// benchKeys are the keys used by the parallel benchmarks.
+var benchKeys = func() []string {
+	ret := make([]string, 4096)
+	for i := range ret {
+		ret[i] = RandString(16)
+	}
+	return ret
+}()
+
+// benchShards runs the parallel benchmark against the roots with
+// a single shard and the default number of shards.
+// Run with -cpu 1,2,4,8 to see the scaling with GOMAXPROCS.
+func benchShards(b *testing.B, f func(l *layer, pb *testing.PB)) {
+	for _, shards := range []int{1, defaultShards} {
+		b.Run(fmt.Sprintf("shards=%v", shards), func(b *testing.B) {
+			l := newShardedLayer(shards)
+			for _, key := range benchKeys {
+				l.Set(key, "0")
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				f(l, pb)
+			})
+		})
+	}
+}
+
+func BenchmarkParallelSet(b *testing.B) {
+	benchShards(b, func(l *layer, pb *testing.PB) {
+		i := rand.Int()
+		for pb.Next() {
+			l.Set(benchKeys[i%len(benchKeys)], "1")
+			i++
+		}
+	})
+}
+
+func BenchmarkParallelGet(b *testing.B) {
+	benchShards(b, func(l *layer, pb *testing.PB) {
+		i := rand.Int()
+		for pb.Next() {
+			_, _ = l.Get(benchKeys[i%len(benchKeys)])
+			i++
+		}
+	})
+}
+
+func BenchmarkParallelCommit(b *testing.B) {
+	benchShards(b, func(l *layer, pb *testing.PB) {
+		i := rand.Int()
+		for pb.Next() {
+			tx := l.Tx()
+			for n := 0; n < 4; n++ {
+				tx.Set(benchKeys[(i+n*997)%len(benchKeys)], "1")
+			}
+			_, _ = tx.Commit()
+			i++
+		}
+	})
+}
@@ -0,0 +1,169 @@
+package storage
+
+// treap is the ordered tree of the keys with their weights and sums.
+// It answers the ordered and range queries in logarithmic time.
+// Keys with zero weight are removed.
+// It is not safe for concurrent use.
+type treap[K any] struct {
+	root *treapNode[K]
+	less func(a, b K) bool
+	// seed generates the nodes' priorities.
+	seed uint32
+}
+
+type treapNode[K any] struct {
+	key         K
+	priority    uint32
+	left, right *treapNode[K]
+
+	// weight and sum are the node's own values,
+	// totalWeight, totalSum and size - the subtree's ones.
+	weight, totalWeight int64
+	sum, totalSum       float64
+	size                int
+}
+
+func newTreap[K any](less func(a, b K) bool) *treap[K] {
+	return &treap[K]{less: less, seed: 2463534242}
+}
+
+// Len returns the number of keys.
+func (t *treap[K]) Len() int {
+	return t.root.len()
+}
+
+// weightOf returns the key's weight, or zero if there's no such key.
+func (t *treap[K]) weightOf(key K) int64 {
+	for n := t.root; n != nil; {
+		switch {
+		case t.less(key, n.key):
+			n = n.left
+		case t.less(n.key, key):
+			n = n.right
+		default:
+			return n.weight
+		}
+	}
+	return 0
+}
+
+// add adds the weight and sum to the key's ones.
+func (t *treap[K]) add(key K, weight int64, sum float64) {
+	t.root = t.insert(t.root, key, weight, sum)
+}
+
+func (t *treap[K]) insert(n *treapNode[K], key K, weight int64, sum float64) *treapNode[K] {
+	switch {
+	case n == nil:
+		if weight == 0 {
+			return nil
+		}
+		n = &treapNode[K]{key: key, priority: t.priority(), weight: weight, sum: sum}
+	case t.less(key, n.key):
+		n.left = t.insert(n.left, key, weight, sum)
+		if n.left != nil && n.left.priority > n.priority {
+			// Rotate right
+			l := n.left
+			n.left, l.right = l.right, n
+			n.update()
+			n = l
+		}
+	case t.less(n.key, key):
+		n.right = t.insert(n.right, key, weight, sum)
+		if n.right != nil && n.right.priority > n.priority {
+			// Rotate left
+			r := n.right
+			n.right, r.left = r.left, n
+			n.update()
+			n = r
+		}
+	default:
+		n.weight += weight
+		n.sum += sum
+		if n.weight == 0 {
+			return t.merge(n.left, n.right)
+		}
+	}
+	n.update()
+	return n
+}
+
+// below returns the total weight and sum of the keys the func is true for.
+// The func should be true for the keys up to some key in order, e.g. k < max.
+func (t *treap[K]) below(f func(K) bool) (weight int64, sum float64) {
+	for n := t.root; n != nil; {
+		if f(n.key) {
+			weight += n.left.weightTotal() + n.weight
+			sum += n.left.sumTotal() + n.sum
+			n = n.right
+		} else {
+			n = n.left
+		}
+	}
+	return weight, sum
+}
+
+// ascend calls the func for the keys in order, until it returns false.
+func (t *treap[K]) ascend(f func(key K, weight int64) bool) {
+	t.root.ascend(f)
+}
+
+func (n *treapNode[K]) ascend(f func(key K, weight int64) bool) bool {
+	if n == nil {
+		return true
+	}
+	return n.left.ascend(f) && f(n.key, n.weight) && n.right.ascend(f)
+}
+
+// merge merges the trees, all keys of a being less than b's ones.
+func (t *treap[K]) merge(a, b *treapNode[K]) *treapNode[K] {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if a.priority > b.priority {
+		a.right = t.merge(a.right, b)
+		a.update()
+		return a
+	}
+	b.left = t.merge(a, b.left)
+	b.update()
+	return b
+}
+
+// priority returns the next pseudo-random priority (xorshift32).
+func (t *treap[K]) priority() uint32 {
+	t.seed ^= t.seed << 13
+	t.seed ^= t.seed >> 17
+	t.seed ^= t.seed << 5
+	return t.seed
+}
+
+func (n *treapNode[K]) update() {
+	n.totalWeight = n.left.weightTotal() + n.weight + n.right.weightTotal()
+	n.totalSum = n.left.sumTotal() + n.sum + n.right.sumTotal()
+	n.size = n.left.len() + 1 + n.right.len()
+}
+
+func (n *treapNode[K]) weightTotal() int64 {
+	if n == nil {
+		return 0
+	}
+	return n.totalWeight
+}
+
+func (n *treapNode[K]) sumTotal() float64 {
+	if n == nil {
+		return 0
+	}
+	return n.totalSum
+}
+
+func (n *treapNode[K]) len() int {
+	if n == nil {
+		return 0
+	}
+	return n.size
+}
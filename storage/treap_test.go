@@ -0,0 +1,48 @@
+package storage
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestTreap(t *testing.T) {
+	Convey("With treap", t, func() {
+		tr := newTreap(func(a, b int) bool { return a < b })
+		for i := 0; i < 100; i++ {
+			tr.add(i, 1, float64(i))
+		}
+
+		Convey("Keys should be kept in order", func() {
+			So(tr.Len(), ShouldEqual, 100)
+			var got []int
+			tr.ascend(func(key int, _ int64) bool {
+				got = append(got, key)
+				return len(got) < 3
+			})
+			So(got, ShouldResemble, []int{0, 1, 2})
+		})
+
+		Convey("Weights and sums below the key should be totalled", func() {
+			weight, sum := tr.below(func(k int) bool { return k < 10 })
+			So(weight, ShouldEqual, 10)
+			So(sum, ShouldEqual, 45)
+
+			tr.add(5, 2, 0)
+			So(tr.weightOf(5), ShouldEqual, 3)
+			weight, _ = tr.below(func(k int) bool { return k < 10 })
+			So(weight, ShouldEqual, 12)
+		})
+
+		Convey("Keys with zero weight should be removed", func() {
+			for i := 0; i < 100; i += 2 {
+				tr.add(i, -1, -float64(i))
+			}
+			So(tr.Len(), ShouldEqual, 50)
+			So(tr.weightOf(4), ShouldEqual, 0)
+			So(tr.weightOf(5), ShouldEqual, 1)
+			weight, sum := tr.below(func(int) bool { return true })
+			So(weight, ShouldEqual, 50)
+			So(sum, ShouldEqual, 2500)
+		})
+	})
+}
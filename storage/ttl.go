@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"time"
+)
+
+// Root's variables may expire: Expire sets the time they're unset at
+// by SweepExpired. Writing the variable removes its expiration.
+
+// Expire implements Root interface.
+func (t *layer) Expire(key string, ttl time.Duration) bool {
+	t = t.root()
+	s := t.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if value := s.data[key]; value == nil || value.Deleted {
+		return false
+	}
+	s.deadlines[key] = t.now().Add(ttl)
+	return true
+}
+
+// TTL implements Root interface.
+func (t *layer) TTL(key string) (time.Duration, bool, error) {
+	t = t.root()
+	s := t.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if value := s.data[key]; value == nil || value.Deleted {
+		return 0, false, ErrNotFound.Here()
+	}
+	deadline, ok := s.deadlines[key]
+	if !ok {
+		return 0, false, nil
+	}
+	if ret := deadline.Sub(t.now()); ret > 0 {
+		return ret, true, nil
+	}
+	return 0, true, nil
+}
+
+// Persist implements Root interface.
+func (t *layer) Persist(key string) bool {
+	t = t.root()
+	s := t.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.deadlines[key]
+	delete(s.deadlines, key)
+	return ok
+}
+
+// SweepExpired implements Root interface.
+func (t *layer) SweepExpired() int {
+	t = t.root()
+	unlock := t.lockAll()
+	defer unlock()
+
+	now := t.now()
+	var changes []Change
+	for _, s := range t.shards {
+		for key, deadline := range s.deadlines {
+			if !deadline.After(now) {
+				changes = append(changes, Change{Key: key, Deleted: true})
+			}
+		}
+	}
+	if len(changes) == 0 {
+		return 0
+	}
+	t.apply(changes)
+	return len(changes)
+}
+
+// deadlines returns the root's variables' expiration times, or nil
+// if none expire.
+// Caller should hold the locks of all the shards.
+func (t *layer) deadlines() map[string]time.Time {
+	var ret map[string]time.Time
+	for _, s := range t.shards {
+		for key, deadline := range s.deadlines {
+			if ret == nil {
+				ret = map[string]time.Time{}
+			}
+			ret[key] = deadline
+		}
+	}
+	return ret
+}
+
+// SweepExpired unsets the expired variables of every database,
+// returning their number.
+func (r *Registry) SweepExpired() int {
+	ret := 0
+	for _, name := range r.Names() {
+		ret += r.get(name).SweepExpired()
+	}
+	return ret
+}
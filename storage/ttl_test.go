@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"github.com/ansel1/merry"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestExpiration(t *testing.T) {
+	Convey("With layer, clock and values", t, func() {
+		l := newLayer()
+		now := time.Unix(1000, 0)
+		l.now = func() time.Time { return now }
+		l.Set("a", "10")
+		l.Set("b", "20")
+
+		Convey("Absent variables should not expire", func() {
+			So(l.Expire("c", time.Second), ShouldBeFalse)
+			_, _, err := l.TTL("c")
+			So(merry.Is(err, ErrNotFound), ShouldBeTrue)
+			So(l.Persist("c"), ShouldBeFalse)
+		})
+
+		Convey("With expiring variable", func() {
+			So(l.Expire("a", 10*time.Second), ShouldBeTrue)
+			ttl, ok, err := l.TTL("a")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(ttl, ShouldEqual, 10*time.Second)
+			_, ok, err = l.TTL("b")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+
+			Convey("It should be readable until swept", func() {
+				now = now.Add(10 * time.Second)
+				ttl, ok, _ := l.TTL("a")
+				So(ok, ShouldBeTrue)
+				So(ttl, ShouldEqual, time.Duration(0))
+				got, err := l.Get("a")
+				So(err, ShouldBeNil)
+				So(got, ShouldEqual, "10")
+
+				seq := l.Seq()
+				So(l.SweepExpired(), ShouldEqual, 1)
+				So(l.Seq(), ShouldEqual, seq+1)
+				_, err = l.Get("a")
+				So(merry.Is(err, ErrNotFound), ShouldBeTrue)
+				So(l.NumEqualTo("10"), ShouldEqual, uint64(0))
+				So(l.SweepExpired(), ShouldEqual, 0)
+			})
+			Convey("It should not be swept before it expires", func() {
+				now = now.Add(9 * time.Second)
+				So(l.SweepExpired(), ShouldEqual, 0)
+				So(l.Seq(), ShouldEqual, uint64(2))
+			})
+			Convey("Writing it should remove the expiration", func() {
+				tx := l.tx()
+				tx.Set("a", "11")
+				_, err := tx.Commit()
+				So(err, ShouldBeNil)
+				_, ok, _ := l.TTL("a")
+				So(ok, ShouldBeFalse)
+				now = now.Add(time.Minute)
+				So(l.SweepExpired(), ShouldEqual, 0)
+			})
+			Convey("Persist should remove the expiration", func() {
+				So(l.Persist("a"), ShouldBeTrue)
+				So(l.Persist("a"), ShouldBeFalse)
+				now = now.Add(time.Minute)
+				So(l.SweepExpired(), ShouldEqual, 0)
+			})
+			Convey("Snapshot should keep the expiration", func() {
+				snap := l.Snapshot()
+				So(snap.Deadlines, ShouldResemble, map[string]time.Time{"a": now.Add(10 * time.Second)})
+
+				other := newLayer()
+				other.Restore(snap)
+				_, ok, _ := other.TTL("a")
+				So(ok, ShouldBeTrue)
+
+				l.Restore(Snapshot{Values: map[string]string{"a": "10"}})
+				_, ok, _ = l.TTL("a")
+				So(ok, ShouldBeFalse)
+			})
+		})
+
+		Convey("Transactions should expire the root's variables", func() {
+			tx := l.tx()
+			tx.Set("c", "30")
+			So(tx.Expire("c", time.Second), ShouldBeFalse)
+			So(tx.Expire("a", 0), ShouldBeTrue)
+			So(tx.SweepExpired(), ShouldEqual, 1)
+			_, err := l.Get("a")
+			So(merry.Is(err, ErrNotFound), ShouldBeTrue)
+		})
+
+		Convey("Registry should sweep every database", func() {
+			r := NewRegistry()
+			for _, name := range []string{"0", "1"} {
+				db := r.get(name)
+				db.now = l.now
+				db.Set("a", "10")
+				So(db.Expire("a", 0), ShouldBeTrue)
+			}
+			So(r.SweepExpired(), ShouldEqual, 2)
+		})
+	})
+}
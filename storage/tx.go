@@ -1,9 +1,26 @@
 package storage
 
+import (
+	"context"
+	"sync/atomic"
+)
+
 func (t *layer) tx() *layer {
+	if t.parentLayer == nil {
+		// txClosed holds the shards' locks while collecting the history,
+		// so no transaction is opened meanwhile
+		s := t.shards[0]
+		s.mu.Lock()
+		atomic.AddInt64(&t.openTxs, 1)
+		s.mu.Unlock()
+	} else {
+		atomic.AddInt64(&t.openTxs, 1)
+	}
 	return &layer{
 		parentLayer: t,
+		rootLayer:   t.root(),
 		data:        map[string]*valueState{},
+		deltas:      map[string]int64{},
 		valueCache:  map[string]uint64{},
 	}
 }
@@ -11,7 +28,9 @@ func (t *layer) tx() *layer {
 // commit dumps current layer's data to the parent and recurses
 // commit() back to the root.
 // boolean is true if commit() was called recursively.
-func (t *layer) commitRecurse(inRecursion bool) (ret *layer, err error) {
+// If the context is done while waiting for the locks, the layer
+// that is still open is returned with the context's error.
+func (t *layer) commitRecurse(ctx context.Context, inRecursion bool) (*layer, error) {
 	// If nowhere to commit to (root layer)
 	if t.parentLayer == nil {
 		if inRecursion {
@@ -24,35 +43,99 @@ func (t *layer) commitRecurse(inRecursion bool) (ret *layer, err error) {
 	if t.isClosed {
 		return t, ErrTxClosed.Here()
 	}
-	// defer recursion to parent layer's commit()
-	defer func() {
-		if err == nil {
-			ret, err = t.parentLayer.commitRecurse(true)
+
+	if err := t.commitToParent(ctx); err != nil {
+		if !t.isClosed {
+			return t, err
 		}
-	}()
+		return t.parentLayer, err
+	}
+	return t.parentLayer.commitRecurse(ctx, true)
+}
+
+// commitToParent dumps current layer's data to the parent
+// and closes the layer.
+// Layer is closed (aborted) on conflict as well,
+// but is left open if the context is done while waiting for the locks.
+func (t *layer) commitToParent(ctx context.Context) error {
+	if t.parentLayer.parentLayer == nil {
+		return t.commitToRoot(ctx)
+	}
 
 	// Lock the underlying layer
-	t.parentLayer.mu.Lock()
+	if err := t.parentLayer.mu.LockContext(ctx); err != nil {
+		return err
+	}
 	defer t.parentLayer.mu.Unlock()
 
 	// Check for conflicts
-	for key, value := range t.data {
-		if gotParent := t.parentLayer.get(key); gotParent != nil && gotParent != value.Prev {
-			return t.parentLayer, ErrTxConflict.Here()
-		}
+	conflict, err := t.hasConflicts(ctx)
+	if err != nil {
+		return err
+	}
+	t.isClosed = true
+	// Closed before the copy, so the parent's writes don't make
+	// the flat views stale if there are no other transactions over it
+	t.parentLayer.txClosed()
+	if conflict {
+		return ErrTxConflict.Here()
 	}
 
-	// Copy this layer's data over and recurse
+	// Copy this layer's data over.
+	// Copy can't be cancelled halfway, so it waits for the root unconditionally
 	for key, value := range t.data {
 		t.parentLayer.set(key, *value)
 	}
+	return nil
+}
+
+// commitToRoot dumps current layer's data to the root layer
+// as a single change set and closes the layer.
+// Only the shards of the changed keys are locked.
+func (t *layer) commitToRoot(ctx context.Context) error {
+	root := t.parentLayer
+	changes := make([]Change, 0, len(t.data))
+	for key, value := range t.data {
+		changes = append(changes, Change{Key: key, Value: value.Data, Deleted: value.Deleted})
+	}
+	unlock, err := root.lockShards(ctx, changes)
+	if err != nil {
+		return err
+	}
 
 	t.isClosed = true
-	// returns are handled in the defer
-	return
+	// Collect the root's history after unlocking the shards
+	defer root.txClosed()
+	defer unlock()
+
+	if conflict, _ := t.hasConflicts(ctx); conflict {
+		return ErrTxConflict.Here()
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	root.apply(changes)
+	return nil
+}
+
+// hasConflicts returns true if any of the layer's keys
+// was changed in the parent since the layer had seen it.
+// Caller should hold the parent's locks.
+func (t *layer) hasConflicts(ctx context.Context) (bool, error) {
+	for key, value := range t.data {
+		gotParent, err := t.parentLayer.getContext(ctx, key)
+		if err != nil {
+			return false, err
+		}
+		if gotParent != nil && gotParent != value.Prev {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
-// rollback returns the parent layer.
+// rollback closes the most recent transaction block
+// (with the savepoints in it) and returns its parent layer.
 func (t *layer) rollback() (*layer, error) {
 	if t.parentLayer == nil {
 		return t, ErrNoTransaction.Here()
@@ -61,6 +144,16 @@ func (t *layer) rollback() (*layer, error) {
 	if t.isClosed {
 		return t, ErrTxClosed.Here()
 	}
-	t.isClosed = true
+	t.close()
+
+	if t.isSavepoint {
+		return t.parentLayer.rollback()
+	}
 	return t.parentLayer, nil
 }
+
+// close closes the layer, forgetting its changes.
+func (t *layer) close() {
+	t.isClosed = true
+	t.parentLayer.txClosed()
+}
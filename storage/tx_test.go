@@ -1,9 +1,13 @@
 package storage
 
 import (
+	"context"
+	"fmt"
 	"github.com/ansel1/merry"
 	. "github.com/smartystreets/goconvey/convey"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestTransactions(t *testing.T) {
@@ -29,14 +33,23 @@ func TestTransactions(t *testing.T) {
 			})
 
 			Convey("Should not commit twice", func() {
-				_, _ = tx.commitRecurse(false)
-				_, err := tx.commitRecurse(false)
+				_, _ = tx.commitRecurse(context.Background(), false)
+				_, err := tx.commitRecurse(context.Background(), false)
 				So(err, ShouldNotBeNil)
 				So(merry.Is(err, ErrTxClosed), ShouldBeTrue)
 			})
 
+			Convey("Values overwritten within tx should not be counted", func() {
+				tx.set(key, valueState{Data: "1"})
+				tx.set(key, valueState{Data: "2"})
+				So(tx.numEqualTo("1"), ShouldEqual, uint64(0))
+				So(tx.numEqualTo("2"), ShouldEqual, uint64(1))
+				So(tx.numEqualTo(value.Data), ShouldEqual, uint64(0))
+			})
+
 			Convey("getIsLocal should return false", func() {
-				got, isLocal := tx.getIsLocal(key)
+				got, isLocal, err := tx.getIsLocal(context.Background(), key)
+				So(err, ShouldBeNil)
 				So(got, ShouldResemble, &value)
 				So(isLocal, ShouldBeFalse)
 			})
@@ -61,7 +74,7 @@ func TestTransactions(t *testing.T) {
 				})
 
 				Convey("Commit", func() {
-					lGot, err := tx.commitRecurse(false)
+					lGot, err := tx.commitRecurse(context.Background(), false)
 					So(err, ShouldBeNil)
 					So(lGot, ShouldResemble, l)
 					Convey("Tx values should be written", func() {
@@ -83,21 +96,47 @@ func TestTransactions(t *testing.T) {
 					})
 				})
 
+				Convey("Commit should give up waiting for the root's lock", func() {
+					s := l.shardFor(key)
+					s.mu.Lock()
+					ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+					defer cancel()
+					lGot, err := tx.commitRecurse(ctx, false)
+					s.mu.Unlock()
+					So(merry.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+					So(lGot, ShouldEqual, tx)
+					So(tx.isClosed, ShouldBeFalse)
+					So(l.get(key).Data, ShouldEqual, value.Data)
+
+					Convey("And commit afterwards", func() {
+						_, err := tx.commitRecurse(context.Background(), false)
+						So(err, ShouldBeNil)
+						So(l.get(key).Data, ShouldEqual, newValue.Data)
+					})
+				})
+
 				Convey("On conflicting change to the base", func() {
 					value.Data = RandString(256)
 					l.set(key, value)
 					Convey("Commit should fail", func() {
-						lGot, err := tx.commitRecurse(false)
+						lGot, err := tx.commitRecurse(context.Background(), false)
 						So(err, ShouldNotBeNil)
 						So(merry.Is(err, ErrTxConflict), ShouldEqual, true)
 						So(lGot, ShouldResemble, l)
 					})
+					Convey("Failed commit should abort the transaction", func() {
+						_, _ = tx.commitRecurse(context.Background(), false)
+						So(tx.isClosed, ShouldBeTrue)
+						So(l.openTxs, ShouldEqual, 0)
+						_, err := tx.commitRecurse(context.Background(), false)
+						So(merry.Is(err, ErrTxClosed), ShouldBeTrue)
+					})
 				})
 
 				Convey("On non-conflicting change to the base", func() {
 					l.set(RandString(32), valueState{Data: RandString(64)})
 					Convey("Commit should succeed", func() {
-						_, err := tx.commitRecurse(false)
+						_, err := tx.commitRecurse(context.Background(), false)
 						So(err, ShouldBeNil)
 					})
 
@@ -112,8 +151,34 @@ func TestTransactions(t *testing.T) {
 					So(err, ShouldBeNil)
 					So(lGot, ShouldResemble, tx)
 				})
+				Convey("Commit should give up waiting for the parent's lock", func() {
+					tx2.set(key, valueState{Data: "tx2"})
+					tx.mu.Lock()
+					ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+					defer cancel()
+					lGot, err := tx2.commitRecurse(ctx, false)
+					tx.mu.Unlock()
+					So(merry.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+					So(lGot, ShouldEqual, tx2)
+					So(tx.get(key).Data, ShouldEqual, value.Data)
+
+					_, err = tx2.commitRecurse(context.Background(), false)
+					So(err, ShouldBeNil)
+					So(l.get(key).Data, ShouldEqual, "tx2")
+				})
+				Convey("Writes should give up waiting for the root's lock", func() {
+					s := l.shardFor(key)
+					s.mu.Lock()
+					ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+					defer cancel()
+					err := tx2.SetContext(ctx, key, "tx2")
+					s.mu.Unlock()
+					So(merry.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+					So(tx2.data, ShouldBeEmpty)
+					So(tx2.valueCache, ShouldBeEmpty)
+				})
 				Convey("Commit should return base layer", func() {
-					lGot, err := tx2.commitRecurse(false)
+					lGot, err := tx2.commitRecurse(context.Background(), false)
 					So(err, ShouldBeNil)
 					So(lGot, ShouldResemble, l)
 				})
@@ -123,3 +188,106 @@ func TestTransactions(t *testing.T) {
 	})
 
 }
+
+func TestDeepTransactions(t *testing.T) {
+	Convey("With deep transactions", t, func() {
+		l := newLayer()
+		l.set("root", valueState{Data: "v"})
+		txs := []*layer{l.tx()}
+		for i := 1; i < 1000; i++ {
+			tx := txs[i-1]
+			if i%100 == 0 {
+				tx.set(strconv.Itoa(i), valueState{Data: "v"})
+			}
+			txs = append(txs, tx.tx())
+		}
+		top := txs[len(txs)-1]
+
+		Convey("Parents' changes should be seen", func() {
+			So(top.get("root").Data, ShouldEqual, "v")
+			So(top.get("500").Data, ShouldEqual, "v")
+			So(top.numEqualTo("v"), ShouldEqual, uint64(10))
+			So(txs[450].numEqualTo("v"), ShouldEqual, uint64(5))
+			_, isLocal, _ := top.getIsLocal(context.Background(), "500")
+			So(isLocal, ShouldBeFalse)
+		})
+		Convey("Parents' later changes should be seen", func() {
+			So(top.numEqualTo("v"), ShouldEqual, uint64(10))
+			txs[10].set("root", valueState{Data: "w"})
+			txs[600].unset("500")
+			So(top.get("root").Data, ShouldEqual, "w")
+			So(top.get("500").Deleted, ShouldBeTrue)
+			So(top.numEqualTo("v"), ShouldEqual, uint64(8))
+			So(top.numEqualTo("w"), ShouldEqual, uint64(1))
+			So(txs[15].get("500"), ShouldBeNil)
+		})
+		Convey("Sibling's changes should not be seen", func() {
+			sibling := txs[500].tx()
+			sibling.set("root", valueState{Data: "s"})
+			So(top.get("root").Data, ShouldEqual, "v")
+			So(sibling.get("900"), ShouldBeNil)
+			So(sibling.numEqualTo("v"), ShouldEqual, uint64(5))
+		})
+		Convey("Commit should write every layer's changes", func() {
+			top.set("top", valueState{Data: "v"})
+			_, err := top.commitRecurse(context.Background(), false)
+			So(err, ShouldBeNil)
+			So(l.numEqualTo("v"), ShouldEqual, uint64(11))
+			So(l.get("900").Data, ShouldEqual, "v")
+		})
+		Convey("Rolled back changes should be forgotten", func() {
+			parent, err := txs[950].rollback()
+			So(err, ShouldBeNil)
+			So(parent, ShouldEqual, txs[949])
+			parent.set("900", valueState{Data: "w"})
+			So(parent.numEqualTo("v"), ShouldEqual, uint64(9))
+			So(txs[900].get("900").Data, ShouldEqual, "v")
+			So(txs[949].get("950"), ShouldBeNil)
+		})
+	})
+}
+
+// benchDepths are the transaction depths of the nested benchmarks.
+var benchDepths = []int{1, 100, 10000}
+
+// benchNested runs the benchmark against the top transaction of the depth,
+// every one of them changing a key.
+func benchNested(b *testing.B, f func(tx *layer, i int)) {
+	for _, depth := range benchDepths {
+		b.Run(fmt.Sprintf("depth=%v", depth), func(b *testing.B) {
+			l := newLayer()
+			for _, key := range benchKeys {
+				l.Set(key, "0")
+			}
+			tx := l
+			for i := 0; i < depth; i++ {
+				tx = tx.tx()
+				tx.Set(benchKeys[i%len(benchKeys)], strconv.Itoa(i%10))
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				f(tx, i)
+			}
+		})
+	}
+}
+
+func BenchmarkNestedGet(b *testing.B) {
+	benchNested(b, func(tx *layer, i int) {
+		_, _ = tx.Get(benchKeys[i%len(benchKeys)])
+	})
+}
+
+func BenchmarkNestedNumEqualTo(b *testing.B) {
+	benchNested(b, func(tx *layer, i int) {
+		tx.NumEqualTo(strconv.Itoa(i % 10))
+	})
+}
+
+func BenchmarkNestedBegin(b *testing.B) {
+	benchNested(b, func(tx *layer, i int) {
+		child := tx.tx()
+		_, _ = child.Get(benchKeys[i%len(benchKeys)])
+		_, _ = child.rollback()
+	})
+}
@@ -0,0 +1,133 @@
+package storage
+
+// TypedReader reads the values of type V encoded by the codec.
+type TypedReader[V any] struct {
+	r     Reader
+	codec Codec[V]
+}
+
+// NewTypedReader creates the TypedReader over the reader.
+func NewTypedReader[V any](r Reader, codec Codec[V]) *TypedReader[V] {
+	return &TypedReader[V]{r: r, codec: codec}
+}
+
+// Get returns the variable's value by its key.
+// ErrNotFound is returned when the variable was not found,
+// ErrCodec - when its value can't be decoded.
+func (t *TypedReader[V]) Get(key string) (V, error) {
+	var ret V
+	data, err := t.r.Get(key)
+	if err != nil {
+		return ret, err
+	}
+	ret, err = t.codec.Decode(data)
+	if err != nil {
+		return ret, ErrCodec.Here().Appendf("%v: %v", key, err)
+	}
+	return ret, nil
+}
+
+// NumEqualTo returns the number of variables that are currently set
+// to the value, comparing the encoded values.
+// ErrCodec is returned if the value can't be encoded.
+func (t *TypedReader[V]) NumEqualTo(value V) (uint64, error) {
+	data, err := t.codec.Encode(value)
+	if err != nil {
+		return 0, ErrCodec.Here().Append(err.Error())
+	}
+	return t.r.NumEqualTo(data), nil
+}
+
+// TypedReadTx is the read-only transaction reading the values of type V.
+type TypedReadTx[V any] struct {
+	TypedReader[V]
+	tx ReadOnlyTx
+}
+
+// Close closes the transaction.
+func (t *TypedReadTx[V]) Close() {
+	t.tx.Close()
+}
+
+// Typed is the DB storing the values of type V encoded by the codec.
+// Its transactions are Typed as well.
+type Typed[V any] struct {
+	TypedReader[V]
+	db DB
+}
+
+// NewTyped creates the Typed over the DB.
+func NewTyped[V any](db DB, codec Codec[V]) *Typed[V] {
+	return &Typed[V]{TypedReader: TypedReader[V]{r: db, codec: codec}, db: db}
+}
+
+// DB returns the underlying DB.
+func (t *Typed[V]) DB() DB {
+	return t.db
+}
+
+// Set sets the variable's value by its key.
+// ErrCodec is returned if the value can't be encoded.
+func (t *Typed[V]) Set(key string, value V) error {
+	data, err := t.codec.Encode(value)
+	if err != nil {
+		return ErrCodec.Here().Appendf("%v: %v", key, err)
+	}
+	t.db.Set(key, data)
+	return nil
+}
+
+// Unset removes the variable by its key.
+func (t *Typed[V]) Unset(key string) {
+	t.db.Unset(key)
+}
+
+// Tx creates a transaction over the database or current transaction.
+func (t *Typed[V]) Tx() *Typed[V] {
+	return t.wrap(t.db.Tx())
+}
+
+// ReadTx creates a read-only transaction over the database or current transaction.
+func (t *Typed[V]) ReadTx() *TypedReadTx[V] {
+	tx := t.db.ReadTx()
+	return &TypedReadTx[V]{TypedReader: TypedReader[V]{r: tx, codec: t.codec}, tx: tx}
+}
+
+// Commit commits the whole transaction tree, returning database's root.
+func (t *Typed[V]) Commit() (*Typed[V], error) {
+	return t.wrapResult(t.db.Commit())
+}
+
+// Rollback cancels the current transaction with its savepoints,
+// returning parent tx (or database's root).
+func (t *Typed[V]) Rollback() (*Typed[V], error) {
+	return t.wrapResult(t.db.Rollback())
+}
+
+// Savepoint creates a named savepoint within the current transaction.
+func (t *Typed[V]) Savepoint(name string) (*Typed[V], error) {
+	return t.wrapResult(t.db.Savepoint(name))
+}
+
+// RollbackTo cancels the changes made since the savepoint, keeping the savepoint
+// and the transaction open.
+func (t *Typed[V]) RollbackTo(name string) (*Typed[V], error) {
+	return t.wrapResult(t.db.RollbackTo(name))
+}
+
+// Release removes the savepoint, keeping the changes made since it.
+func (t *Typed[V]) Release(name string) (*Typed[V], error) {
+	return t.wrapResult(t.db.Release(name))
+}
+
+// wrap returns the Typed over the DB with the same codec.
+func (t *Typed[V]) wrap(db DB) *Typed[V] {
+	if db == t.db {
+		return t
+	}
+	return NewTyped(db, t.codec)
+}
+
+func (t *Typed[V]) wrapResult(db DB, err error) (*Typed[V], error) {
+	return t.wrap(db), err
+}
@@ -0,0 +1,95 @@
+package storage_test
+
+import (
+	"fmt"
+	"github.com/ansel1/merry"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/utrack/go-simple-memdb/storage"
+	"testing"
+)
+
+type user struct {
+	Name string
+	Age  int
+}
+
+func TestTyped(t *testing.T) {
+	Convey("With typed storage", t, func() {
+		db := storage.New()
+		users := storage.NewTyped[user](db, storage.JSONCodec[user]{})
+		alice := user{Name: "alice", Age: 30}
+		So(users.Set("1", alice), ShouldBeNil)
+
+		Convey("Values should be decoded", func() {
+			got, err := users.Get("1")
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, alice)
+			raw, err := db.Get("1")
+			So(err, ShouldBeNil)
+			So(raw, ShouldEqual, `{"Name":"alice","Age":30}`)
+		})
+
+		Convey("Missing values should return ErrNotFound", func() {
+			_, err := users.Get("2")
+			So(merry.Is(err, storage.ErrNotFound), ShouldBeTrue)
+			So(merry.Is(err, storage.ErrCodec), ShouldBeFalse)
+		})
+
+		Convey("Malformed values should return ErrCodec", func() {
+			db.Set("2", "nope")
+			_, err := users.Get("2")
+			So(merry.Is(err, storage.ErrCodec), ShouldBeTrue)
+			So(merry.Is(err, storage.ErrNotFound), ShouldBeFalse)
+
+			_, err = storage.NewTyped[chan int](db, storage.JSONCodec[chan int]{}).NumEqualTo(nil)
+			So(merry.Is(err, storage.ErrCodec), ShouldBeTrue)
+			err = storage.NewTyped[chan int](db, storage.JSONCodec[chan int]{}).Set("3", nil)
+			So(merry.Is(err, storage.ErrCodec), ShouldBeTrue)
+		})
+
+		Convey("Equal values should be counted", func() {
+			So(users.Set("2", alice), ShouldBeNil)
+			So(users.Set("3", user{Name: "bob"}), ShouldBeNil)
+			got, err := users.NumEqualTo(alice)
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, uint64(2))
+		})
+
+		Convey("Transactions should be typed", func() {
+			tx := users.Tx()
+			So(tx.Set("1", user{Name: "alice", Age: 31}), ShouldBeNil)
+			sp, err := tx.Savepoint("sp")
+			So(err, ShouldBeNil)
+			sp.Unset("1")
+			tx, err = sp.RollbackTo("sp")
+			So(err, ShouldBeNil)
+
+			got, err := tx.ReadTx().Get("1")
+			So(err, ShouldBeNil)
+			So(got.Age, ShouldEqual, 31)
+			got, err = users.Get("1")
+			So(err, ShouldBeNil)
+			So(got.Age, ShouldEqual, 30)
+
+			root, err := tx.Commit()
+			So(err, ShouldBeNil)
+			So(root.DB(), ShouldEqual, db)
+			got, err = users.Get("1")
+			So(err, ShouldBeNil)
+			So(got.Age, ShouldEqual, 31)
+		})
+	})
+}
+
+func ExampleTyped() {
+	type point struct{ X, Y int }
+	points := storage.NewTyped[point](storage.New(), storage.JSONCodec[point]{})
+
+	tx := points.Tx()
+	_ = tx.Set("a", point{X: 1, Y: 2})
+	points, _ = tx.Commit()
+
+	ret, _ := points.Get("a")
+	fmt.Println(ret.X, ret.Y)
+	// Output: 1 2
+}